@@ -1,10 +1,17 @@
 package config
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"math"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -16,7 +23,7 @@ func LoadConfig(path string) IConfig {
 		log.Fatalf("load dotenv failed: %v", err)
 	}
 
-	return &config{
+	cfg := &config{
 		app: &app{
 			host: envMap["APP_HOST"],
 			// create callback anonymous func for convert APP_PORT from type string to int
@@ -64,6 +71,10 @@ func LoadConfig(path string) IConfig {
 				return b
 			}(),
 			gcpBucket: envMap["APP_GCP_BUCKET"],
+			// empty is disable creating the first admin through the api
+			bootstrapToken: envMap["APP_BOOTSTRAP_TOKEN"],
+			// links in emails point here, e.g., https://cafe-beans.com
+			webUrl: envMap["APP_WEB_URL"],
 		},
 		db: &db{
 			host: envMap["DB_HOST"],
@@ -105,20 +116,257 @@ func LoadConfig(path string) IConfig {
 				}
 				return t
 			}(),
+			// e.g., JWT_SIGNING_KEYS=2023-08=./keys/2023-08.pem,2023-09=./keys/2023-09.pem
+			signingKeys: func() map[string]crypto.Signer {
+				keys := make(map[string]crypto.Signer)
+				if envMap["JWT_SIGNING_KEYS"] == "" {
+					return keys
+				}
+
+				for _, pair := range strings.Split(envMap["JWT_SIGNING_KEYS"], ",") {
+					kid, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok {
+						log.Fatalf("load jwt signing keys failed: %v is not kid=path", pair)
+					}
+
+					key, err := loadSigningKey(path)
+					if err != nil {
+						log.Fatalf("load jwt signing key %v failed: %v", kid, err)
+					}
+					keys[kid] = key
+				}
+				return keys
+			}(),
+			activeKeyId: envMap["JWT_ACTIVE_KEY_ID"],
+			// e.g., JWT_HS256_ACCEPT_UNTIL=2023-09-08T00:00:00Z, a refresh token lifetime after
+			// switching to JWT_ACTIVE_KEY_ID so nobody is signed out by the switch
+			hs256AcceptUntil: func() time.Time {
+				if envMap["JWT_HS256_ACCEPT_UNTIL"] == "" {
+					return time.Time{}
+				}
+				t, err := time.Parse(time.RFC3339, envMap["JWT_HS256_ACCEPT_UNTIL"])
+				if err != nil {
+					log.Fatalf("load jwt hs256 accept until failed: %v", err)
+				}
+				return t
+			}(),
+			// legacy JWT api keys are refused unless this is set, e.g., JWT_LEGACY_API_KEYS_UNTIL=2023-12-31T00:00:00Z,
+			// and refused again from then on, every client should have moved to a cbk_ key by that date
+			legacyApiKeysUntil: func() time.Time {
+				if envMap["JWT_LEGACY_API_KEYS_UNTIL"] == "" {
+					return time.Time{}
+				}
+				t, err := time.Parse(time.RFC3339, envMap["JWT_LEGACY_API_KEYS_UNTIL"])
+				if err != nil {
+					log.Fatalf("load jwt legacy api keys until failed: %v", err)
+				}
+				return t
+			}(),
+			// what a legacy key is allowed to do, e.g., JWT_LEGACY_API_KEY_SCOPES=users:auth,categories:read
+			legacyApiKeyScopes: func() []string {
+				scopes := make([]string, 0)
+				for _, scope := range strings.Split(envMap["JWT_LEGACY_API_KEY_SCOPES"], ",") {
+					if scope = strings.TrimSpace(scope); scope != "" {
+						scopes = append(scopes, scope)
+					}
+				}
+				return scopes
+			}(),
+			leeway: func() time.Duration {
+				// clock skew allowed when checking exp/nbf/iat, default 30 seconds
+				if envMap["JWT_LEEWAY"] == "" {
+					return 30 * time.Second
+				}
+				t, err := strconv.Atoi(envMap["JWT_LEEWAY"])
+				if err != nil {
+					log.Fatalf("load jwt leeway failed: %v", err)
+				}
+				return time.Duration(t) * time.Second
+			}(),
+		},
+		cache: &cache{
+			ttl: func() time.Duration {
+				// seconds, default 30, 0 is disable caching
+				if envMap["CACHE_TTL"] == "" {
+					return 30 * time.Second
+				}
+				t, err := strconv.Atoi(envMap["CACHE_TTL"])
+				if err != nil {
+					log.Fatalf("load cache ttl failed: %v", err)
+				}
+				return time.Duration(t) * time.Second
+			}(),
+		},
+		session: &session{
+			// seconds since the signin, 0 is until the refresh token expires
+			absoluteLifetime: time.Duration(envIntOrDefault(envMap, "SESSION_ABSOLUTE_LIFETIME", 0)) * time.Second,
+			// seconds without a request, 0 is never. Cached sessions aren't marked
+			// as used so it has to be longer than CACHE_TTL and a minute
+			idleTimeout:     time.Duration(envIntOrDefault(envMap, "SESSION_IDLE_TIMEOUT", 0)) * time.Second,
+			cleanupInterval: time.Duration(envIntOrDefault(envMap, "SESSION_CLEANUP_INTERVAL", 3600)) * time.Second,
+		},
+		audit: &audit{
+			// days, 0 is keeping events forever
+			retention: time.Duration(envIntOrDefault(envMap, "AUDIT_RETENTION_DAYS", 365)) * 24 * time.Hour,
+		},
+		login: &login{
+			maxAttempts:   envIntOrDefault(envMap, "LOGIN_MAX_ATTEMPTS", 5),
+			maxIpAttempts: envIntOrDefault(envMap, "LOGIN_MAX_IP_ATTEMPTS", 20),
+			lockout:       time.Duration(envIntOrDefault(envMap, "LOGIN_LOCKOUT", 900)) * time.Second,
+		},
+		mail: &mail{
+			// empty is writing mails to the log
+			host:     envMap["SMTP_HOST"],
+			port:     envIntOrDefault(envMap, "SMTP_PORT", 587),
+			username: envMap["SMTP_USERNAME"],
+			password: envMap["SMTP_PASSWORD"],
+			from:     envMap["MAIL_FROM"],
+		},
+		password: &password{
+			// argon2id or bcrypt, hashes of the other still verify and get upgraded on signin
+			algorithm: func() string {
+				switch envMap["PASSWORD_ALGORITHM"] {
+				case "":
+					return "argon2id"
+				case "argon2id", "bcrypt":
+					return envMap["PASSWORD_ALGORITHM"]
+				default:
+					log.Fatalf("load password algorithm failed: %v is not argon2id or bcrypt", envMap["PASSWORD_ALGORITHM"])
+					return ""
+				}
+			}(),
+			// defaults are the owasp minimum for argon2id
+			argon2Memory:      uint32(envIntOrDefault(envMap, "PASSWORD_ARGON2_MEMORY", 19456)),
+			argon2Iterations:  uint32(envIntOrDefault(envMap, "PASSWORD_ARGON2_ITERATIONS", 2)),
+			argon2Parallelism: uint8(envIntOrDefault(envMap, "PASSWORD_ARGON2_PARALLELISM", 1)),
+			bcryptCost:        envIntOrDefault(envMap, "PASSWORD_BCRYPT_COST", 10),
 		},
+		policy: &policy{
+			passwordMinLength: envIntOrDefault(envMap, "PASSWORD_MIN_LENGTH", 8),
+			// of lowercase, uppercase, digits and symbols
+			passwordCharacterClasses: envIntOrDefault(envMap, "PASSWORD_CHARACTER_CLASSES", 3),
+			// one password per line, added to the built-in list
+			breachedPasswordsPath: envMap["PASSWORD_BREACHED_LIST"],
+			usernameMinLength:     envIntOrDefault(envMap, "USERNAME_MIN_LENGTH", 3),
+			usernameMaxLength:     envIntOrDefault(envMap, "USERNAME_MAX_LENGTH", 30),
+			reservedUsernames: func() []string {
+				if envMap["USERNAME_RESERVED"] == "" {
+					return []string{"admin", "administrator", "root", "system", "support", "api", "me", "cafe_beans"}
+				}
+				names := make([]string, 0)
+				for _, name := range strings.Split(envMap["USERNAME_RESERVED"], ",") {
+					names = append(names, strings.ToLower(strings.TrimSpace(name)))
+				}
+				return names
+			}(),
+		},
+		storage: &storage{
+			// uploaded files are kept on the local disk, served under publicUrl
+			dir: func() string {
+				if envMap["STORAGE_DIR"] == "" {
+					return "./uploads"
+				}
+				return envMap["STORAGE_DIR"]
+			}(),
+			publicUrl: func() string {
+				if envMap["STORAGE_PUBLIC_URL"] == "" {
+					return "/uploads"
+				}
+				return envMap["STORAGE_PUBLIC_URL"]
+			}(),
+		},
+		oidc: &oidc{
+			// e.g., OIDC_PROVIDERS=google,line then OIDC_GOOGLE_ISSUER, OIDC_GOOGLE_CLIENT_ID, ...
+			providers: func() map[string]*OidcProvider {
+				providers := make(map[string]*OidcProvider)
+				if envMap["OIDC_PROVIDERS"] == "" {
+					return providers
+				}
+
+				for _, name := range strings.Split(envMap["OIDC_PROVIDERS"], ",") {
+					name = strings.TrimSpace(name)
+					prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+					p := &OidcProvider{
+						Issuer:       envMap[prefix+"ISSUER"],
+						ClientId:     envMap[prefix+"CLIENT_ID"],
+						ClientSecret: envMap[prefix+"CLIENT_SECRET"],
+						RedirectUrl:  envMap[prefix+"REDIRECT_URL"],
+						Scopes:       strings.Fields(envMap[prefix+"SCOPES"]),
+					}
+					if p.Issuer == "" || p.ClientId == "" || p.RedirectUrl == "" {
+						log.Fatalf("load oidc provider %v failed: issuer, client id and redirect url are required", name)
+					}
+					providers[name] = p
+				}
+				return providers
+			}(),
+		},
+	}
+
+	if idle := cfg.session.idleTimeout; idle != 0 && idle <= cfg.cache.ttl+time.Minute {
+		log.Fatalf("load session idle timeout failed: must be longer than CACHE_TTL and a minute")
 	}
+	if cfg.session.cleanupInterval <= 0 {
+		log.Fatalf("load session cleanup interval failed: must be more than 0")
+	}
+	if cfg.login.lockout <= 0 {
+		log.Fatalf("load login lockout failed: must be more than 0")
+	}
+
+	if !cfg.jwt.legacyApiKeysUntil.IsZero() && len(cfg.jwt.apiKey) == 0 {
+		log.Fatalf("load jwt legacy api keys failed: JWT_LEGACY_API_KEYS_UNTIL needs JWT_API_KEY")
+	}
+
+	if id := cfg.jwt.activeKeyId; id != "" {
+		if _, ok := cfg.jwt.signingKeys[id]; !ok {
+			log.Fatalf("load jwt active key failed: %v is not in JWT_SIGNING_KEYS", id)
+		}
+	}
+
+	return cfg
+}
+
+// For optional settings, empty is the default
+func envIntOrDefault(envMap map[string]string, key string, defaultValue int) int {
+	if envMap[key] == "" {
+		return defaultValue
+	}
+	v, err := strconv.Atoi(envMap[key])
+	if err != nil {
+		log.Fatalf("load %v failed: %v", strings.ToLower(key), err)
+	}
+	return v
 }
 
 type IConfig interface {
 	App() IAppConfig
 	Db() IDbConfig
 	Jwt() IJwtConfig
+	Cache() ICacheConfig
+	Session() ISessionConfig
+	Audit() IAuditConfig
+	Login() ILoginConfig
+	Mail() IMailConfig
+	Oidc() IOidcConfig
+	Password() IPasswordConfig
+	Policy() IPolicyConfig
+	Storage() IStorageConfig
 }
 
 type config struct {
-	app *app
-	db  *db
-	jwt *jwt
+	app      *app
+	db       *db
+	jwt      *jwt
+	cache    *cache
+	session  *session
+	audit    *audit
+	login    *login
+	mail     *mail
+	oidc     *oidc
+	password *password
+	policy   *policy
+	storage  *storage
 }
 
 // app
@@ -132,18 +380,22 @@ type IAppConfig interface {
 	BodyLimit() int
 	FileLimit() int
 	GCPBucket() string
+	BootstrapToken() string
+	WebUrl() string
 }
 
 type app struct {
-	host         string
-	port         int
-	name         string
-	version      string
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	bodyLimit    int // bytes
-	fileLimit    int // bytes
-	gcpBucket    string
+	host           string
+	port           int
+	name           string
+	version        string
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	bodyLimit      int // bytes
+	fileLimit      int // bytes
+	gcpBucket      string
+	bootstrapToken string
+	webUrl         string
 }
 
 func (c *config) App() IAppConfig { return c.app }
@@ -158,6 +410,8 @@ func (a *app) WriteTimeout() time.Duration { return a.writeTimeout }
 func (a *app) BodyLimit() int              { return a.bodyLimit }
 func (a *app) FileLimit() int              { return a.fileLimit }
 func (a *app) GCPBucket() string           { return a.gcpBucket }
+func (a *app) BootstrapToken() string      { return a.bootstrapToken }
+func (a *app) WebUrl() string              { return a.webUrl }
 
 // db
 type IDbConfig interface {
@@ -200,6 +454,12 @@ type IJwtConfig interface {
 	ApiKey() []byte
 	AccessExpiresAt() int
 	RefreshExpiresAt() int
+	SigningKeys() map[string]crypto.Signer
+	ActiveKeyId() string
+	Hs256AcceptUntil() time.Time
+	LegacyApiKeysUntil() time.Time
+	LegacyApiKeyScopes() []string
+	Leeway() time.Duration
 
 	SetAccessExpires(t int)
 	SetRefreshExpires(t int)
@@ -211,12 +471,46 @@ type jwt struct {
 	apiKey           string
 	accessExpiresAt  int // seconds
 	refreshExpiresAt int // seconds
+	signingKeys      map[string]crypto.Signer
+	activeKeyId      string    // empty is HS256 with secretKey
+	hs256AcceptUntil time.Time // HS256 user tokens are still verified before it, zero is never
+	// legacy api keys signed with apiKey are accepted before it, zero is never
+	legacyApiKeysUntil time.Time
+	legacyApiKeyScopes []string
+	leeway             time.Duration
 }
 
 func (c *config) Jwt() IJwtConfig {
 	return c.jwt
 }
 
+// Load a PKCS#8 (RSA or Ed25519) or PKCS#1 (RSA) private key from a pem file
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("pem block not found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("key type %T is not supported", key)
+	}
+}
+
 func (j *jwt) AdminKey() []byte        { return []byte(j.adminKey) }
 func (j *jwt) SecretKey() []byte       { return []byte(j.secretKey) }
 func (j *jwt) ApiKey() []byte          { return []byte(j.apiKey) }
@@ -224,3 +518,190 @@ func (j *jwt) AccessExpiresAt() int    { return j.accessExpiresAt }
 func (j *jwt) RefreshExpiresAt() int   { return j.refreshExpiresAt }
 func (j *jwt) SetAccessExpires(t int)  { j.accessExpiresAt = t }
 func (j *jwt) SetRefreshExpires(t int) { j.refreshExpiresAt = t }
+func (j *jwt) SigningKeys() map[string]crypto.Signer {
+	return j.signingKeys
+}
+func (j *jwt) ActiveKeyId() string           { return j.activeKeyId }
+func (j *jwt) Hs256AcceptUntil() time.Time   { return j.hs256AcceptUntil }
+func (j *jwt) LegacyApiKeysUntil() time.Time { return j.legacyApiKeysUntil }
+func (j *jwt) LegacyApiKeyScopes() []string  { return j.legacyApiKeyScopes }
+func (j *jwt) Leeway() time.Duration         { return j.leeway }
+
+// cache
+type ICacheConfig interface {
+	Ttl() time.Duration
+}
+
+type cache struct {
+	ttl time.Duration
+}
+
+func (c *config) Cache() ICacheConfig { return c.cache }
+
+func (c *cache) Ttl() time.Duration { return c.ttl }
+
+// session
+type ISessionConfig interface {
+	AbsoluteLifetime() time.Duration
+	IdleTimeout() time.Duration
+	CleanupInterval() time.Duration
+}
+
+type session struct {
+	absoluteLifetime time.Duration // 0 is no limit
+	idleTimeout      time.Duration // 0 is no limit
+	cleanupInterval  time.Duration
+}
+
+func (c *config) Session() ISessionConfig { return c.session }
+
+func (s *session) AbsoluteLifetime() time.Duration { return s.absoluteLifetime }
+func (s *session) IdleTimeout() time.Duration      { return s.idleTimeout }
+func (s *session) CleanupInterval() time.Duration  { return s.cleanupInterval }
+
+// audit
+type IAuditConfig interface {
+	Retention() time.Duration
+}
+
+type audit struct {
+	retention time.Duration
+}
+
+func (c *config) Audit() IAuditConfig { return c.audit }
+
+func (a *audit) Retention() time.Duration { return a.retention }
+
+// login
+type ILoginConfig interface {
+	MaxAttempts() int
+	MaxIpAttempts() int
+	Lockout() time.Duration
+}
+
+type login struct {
+	maxAttempts   int           // failures per account before it's locked
+	maxIpAttempts int           // failures per ip before it's blocked
+	lockout       time.Duration // also the window failures are counted in
+}
+
+func (c *config) Login() ILoginConfig { return c.login }
+
+func (l *login) MaxAttempts() int       { return l.maxAttempts }
+func (l *login) MaxIpAttempts() int     { return l.maxIpAttempts }
+func (l *login) Lockout() time.Duration { return l.lockout }
+
+// mail
+type IMailConfig interface {
+	Host() string
+	Port() int
+	Username() string
+	Password() string
+	From() string
+}
+
+type mail struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func (c *config) Mail() IMailConfig { return c.mail }
+
+func (m *mail) Host() string     { return m.host }
+func (m *mail) Port() int        { return m.port }
+func (m *mail) Username() string { return m.username }
+func (m *mail) Password() string { return m.password }
+func (m *mail) From() string     { return m.from }
+
+// oidc
+type IOidcConfig interface {
+	Providers() map[string]*OidcProvider
+}
+
+type OidcProvider struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string // empty is "openid email profile"
+}
+
+type oidc struct {
+	providers map[string]*OidcProvider
+}
+
+func (c *config) Oidc() IOidcConfig { return c.oidc }
+
+func (o *oidc) Providers() map[string]*OidcProvider { return o.providers }
+
+// password
+type IPasswordConfig interface {
+	Algorithm() string
+	Argon2Memory() uint32
+	Argon2Iterations() uint32
+	Argon2Parallelism() uint8
+	BcryptCost() int
+}
+
+type password struct {
+	algorithm         string
+	argon2Memory      uint32 // KiB
+	argon2Iterations  uint32
+	argon2Parallelism uint8
+	bcryptCost        int
+}
+
+func (c *config) Password() IPasswordConfig { return c.password }
+
+func (p *password) Algorithm() string        { return p.algorithm }
+func (p *password) Argon2Memory() uint32     { return p.argon2Memory }
+func (p *password) Argon2Iterations() uint32 { return p.argon2Iterations }
+func (p *password) Argon2Parallelism() uint8 { return p.argon2Parallelism }
+func (p *password) BcryptCost() int          { return p.bcryptCost }
+
+// policy
+type IPolicyConfig interface {
+	PasswordMinLength() int
+	PasswordCharacterClasses() int
+	BreachedPasswordsPath() string
+	UsernameMinLength() int
+	UsernameMaxLength() int
+	ReservedUsernames() []string
+}
+
+type policy struct {
+	passwordMinLength        int
+	passwordCharacterClasses int
+	breachedPasswordsPath    string
+	usernameMinLength        int
+	usernameMaxLength        int
+	reservedUsernames        []string
+}
+
+func (c *config) Policy() IPolicyConfig { return c.policy }
+
+func (p *policy) PasswordMinLength() int        { return p.passwordMinLength }
+func (p *policy) PasswordCharacterClasses() int { return p.passwordCharacterClasses }
+func (p *policy) BreachedPasswordsPath() string { return p.breachedPasswordsPath }
+func (p *policy) UsernameMinLength() int        { return p.usernameMinLength }
+func (p *policy) UsernameMaxLength() int        { return p.usernameMaxLength }
+func (p *policy) ReservedUsernames() []string   { return p.reservedUsernames }
+
+// storage
+type IStorageConfig interface {
+	Dir() string
+	PublicUrl() string // a path (e.g., /uploads) is served by the app
+}
+
+type storage struct {
+	dir       string
+	publicUrl string
+}
+
+func (c *config) Storage() IStorageConfig { return c.storage }
+
+func (s *storage) Dir() string       { return s.dir }
+func (s *storage) PublicUrl() string { return s.publicUrl }
@@ -0,0 +1,101 @@
+package addresses
+
+import (
+	"strings"
+
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
+)
+
+// How many addresses a user can keep
+const MaxAddresses = 10
+
+type Address struct {
+	Id          string `json:"id"`
+	UserId      string `json:"user_id"`
+	Recipient   string `json:"recipient"`
+	Phone       string `json:"phone"`
+	Line1       string `json:"line1"`
+	Line2       string `json:"line2"`
+	SubDistrict string `json:"sub_district"`
+	District    string `json:"district"`
+	Province    string `json:"province"`
+	PostalCode  string `json:"postal_code"`
+	IsDefault   bool   `json:"is_default"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// The default only moves when another address is made the default
+type AddressReq struct {
+	Recipient   string `json:"recipient" form:"recipient"`
+	Phone       string `json:"phone" form:"phone"`
+	Line1       string `json:"line1" form:"line1"`
+	Line2       string `json:"line2" form:"line2"`
+	SubDistrict string `json:"sub_district" form:"sub_district"`
+	District    string `json:"district" form:"district"`
+	Province    string `json:"province" form:"province"`
+	PostalCode  string `json:"postal_code" form:"postal_code"`
+	IsDefault   bool   `json:"is_default" form:"is_default"`
+}
+
+// Trim the fields and drop the separators of the phone number
+func (obj *AddressReq) Normalize() {
+	obj.Recipient = strings.TrimSpace(obj.Recipient)
+	obj.Phone = strings.NewReplacer(" ", "", "-", "").Replace(obj.Phone)
+	obj.Line1 = strings.TrimSpace(obj.Line1)
+	obj.Line2 = strings.TrimSpace(obj.Line2)
+	obj.SubDistrict = strings.TrimSpace(obj.SubDistrict)
+	obj.District = strings.TrimSpace(obj.District)
+	obj.Province = strings.TrimSpace(obj.Province)
+	obj.PostalCode = strings.TrimSpace(obj.PostalCode)
+}
+
+// Every invalid field at once, nil when the request is valid
+func (obj *AddressReq) Validate(validator cafeBeansValidator.IValidator) []*entities.FieldError {
+	errs := make([]*entities.FieldError, 0)
+	errs = append(errs, validator.Text("recipient", "recipient", obj.Recipient, true)...)
+	errs = append(errs, validator.Phone("phone", obj.Phone)...)
+	errs = append(errs, validator.Text("line1", "line1", obj.Line1, true)...)
+	errs = append(errs, validator.Text("line2", "line2", obj.Line2, false)...)
+	errs = append(errs, validator.Text("sub_district", "sub-district", obj.SubDistrict, true)...)
+	errs = append(errs, validator.Text("district", "district", obj.District, true)...)
+	errs = append(errs, validator.Text("province", "province", obj.Province, true)...)
+	errs = append(errs, validator.PostalCode("postal_code", obj.PostalCode)...)
+
+	// names are only looked up once every field is well formed
+	if len(errs) == 0 {
+		errs = append(errs, validator.ThaiAddress(obj.SubDistrict, obj.District, obj.Province, obj.PostalCode)...)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// What an order keeps of an address, editing or deleting the address
+// later doesn't change orders placed with it
+type AddressSnapshot struct {
+	Contact string `json:"contact"`
+	Address string `json:"address"`
+}
+
+func (obj *Address) Snapshot() *AddressSnapshot {
+	lines := []string{obj.Line1}
+	if obj.Line2 != "" {
+		lines = append(lines, obj.Line2)
+	}
+	lines = append(lines, obj.SubDistrict, obj.District, obj.Province+" "+obj.PostalCode)
+
+	return &AddressSnapshot{
+		Contact: obj.Recipient + " " + obj.Phone,
+		Address: strings.Join(lines, ", "),
+	}
+}
+
+// Query is matched against sub-districts, districts, provinces and postal codes
+type AddressLookupReq struct {
+	Query string `query:"q"`
+	Limit int    `query:"limit"`
+}
@@ -0,0 +1,247 @@
+package addressesHandlers
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/addresses"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesUseCases"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
+)
+
+type addressesHandlerErrCode string
+
+const (
+	findAddressErr    addressesHandlerErrCode = "addresses-001"
+	findOneAddressErr addressesHandlerErrCode = "addresses-002"
+	insertAddressErr  addressesHandlerErrCode = "addresses-003"
+	updateAddressErr  addressesHandlerErrCode = "addresses-004"
+	updateDefaultErr  addressesHandlerErrCode = "addresses-005"
+	removeAddressErr  addressesHandlerErrCode = "addresses-006"
+	lookupAddressErr  addressesHandlerErrCode = "addresses-007"
+)
+
+type IAddressesHandler interface {
+	FindAddress(c *fiber.Ctx) error
+	FindOneAddress(c *fiber.Ctx) error
+	AddAddress(c *fiber.Ctx) error
+	UpdateAddress(c *fiber.Ctx) error
+	SetDefaultAddress(c *fiber.Ctx) error
+	RemoveAddress(c *fiber.Ctx) error
+	LookupAddress(c *fiber.Ctx) error
+}
+
+type addressesHandler struct {
+	cfg              config.IConfig
+	addressesUseCase addressesUseCases.IAddressesUseCase
+	validator        cafeBeansValidator.IValidator
+}
+
+func AddressesHandler(cfg config.IConfig, addressesUseCase addressesUseCases.IAddressesUseCase, validator cafeBeansValidator.IValidator) IAddressesHandler {
+	return &addressesHandler{
+		cfg:              cfg,
+		addressesUseCase: addressesUseCase,
+		validator:        validator,
+	}
+}
+
+// errors caused by the request itself, everything else is a server error
+var requestErrs = map[string]int{
+	"address not found":    fiber.ErrNotFound.Code,
+	"address book is full": fiber.ErrBadRequest.Code,
+}
+
+func errStatus(err error) int {
+	if status, ok := requestErrs[err.Error()]; ok {
+		return status
+	}
+	return fiber.ErrInternalServerError.Code
+}
+
+func addressIdParam(c *fiber.Ctx) (string, bool) {
+	addressId := strings.Trim(c.Params("address_id"), " ")
+	if _, err := uuid.Parse(addressId); err != nil {
+		return "", false
+	}
+	return addressId, true
+}
+
+func (h *addressesHandler) FindAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.addressesUseCase.FindAddress(userId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(findAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *addressesHandler) FindOneAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId, ok := addressIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findOneAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	result, err := h.addressesUseCase.FindOneAddress(userId, addressId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(findOneAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *addressesHandler) AddAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	req := new(addresses.AddressReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	req.Normalize()
+	if errs := req.Validate(h.validator); errs != nil {
+		return entities.NewResponse(c).ValidationError(
+			fiber.ErrBadRequest.Code,
+			string(insertAddressErr),
+			errs,
+		).Res()
+	}
+
+	result, err := h.addressesUseCase.InsertAddress(userId, req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(insertAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
+func (h *addressesHandler) UpdateAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId, ok := addressIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	req := new(addresses.AddressReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	req.Normalize()
+	if errs := req.Validate(h.validator); errs != nil {
+		return entities.NewResponse(c).ValidationError(
+			fiber.ErrBadRequest.Code,
+			string(updateAddressErr),
+			errs,
+		).Res()
+	}
+
+	result, err := h.addressesUseCase.UpdateAddress(userId, addressId, req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(updateAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *addressesHandler) SetDefaultAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId, ok := addressIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateDefaultErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	result, err := h.addressesUseCase.UpdateDefaultAddress(userId, addressId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(updateDefaultErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *addressesHandler) RemoveAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId, ok := addressIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(removeAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	if err := h.addressesUseCase.DeleteAddress(userId, addressId); err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(removeAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			AddressId string `json:"address_id"`
+		}{
+			AddressId: addressId,
+		},
+	).Res()
+}
+
+func (h *addressesHandler) LookupAddress(c *fiber.Ctx) error {
+	req := new(addresses.AddressLookupReq)
+	if err := c.QueryParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(lookupAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, h.addressesUseCase.LookupAddress(req)).Res()
+}
@@ -0,0 +1,333 @@
+package addressesRepositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pandakn/cafe-beans/modules/addresses"
+)
+
+type IAddressesRepository interface {
+	FindAddress(userId string) ([]*addresses.Address, error)
+	FindOneAddress(userId, addressId string) (*addresses.Address, error)
+	CountAddress(userId string) (int, error)
+	InsertAddress(userId string, req *addresses.AddressReq) (string, error)
+	UpdateAddress(userId, addressId string, req *addresses.AddressReq) error
+	UpdateDefaultAddress(userId, addressId string) error
+	DeleteAddress(userId, addressId string) error
+}
+
+type addressesRepository struct {
+	db *sqlx.DB
+}
+
+func AddressesRepository(db *sqlx.DB) IAddressesRepository {
+	return &addressesRepository{
+		db: db,
+	}
+}
+
+const addressQuery = `
+	SELECT
+		"a"."id",
+		"a"."user_id",
+		"a"."recipient",
+		"a"."phone",
+		"a"."line1",
+		"a"."line2",
+		"a"."sub_district",
+		"a"."district",
+		"a"."province",
+		"a"."postal_code",
+		"a"."is_default",
+		"a"."created_at",
+		"a"."updated_at"
+	FROM "user_addresses" "a"`
+
+// The default address comes first
+func (r *addressesRepository) FindAddress(userId string) ([]*addresses.Address, error) {
+	query := `
+	SELECT
+		COALESCE(array_to_json(array_agg("t" ORDER BY "t"."is_default" DESC, "t"."created_at")), '[]'::json)
+	FROM (` + addressQuery + `
+		WHERE "a"."user_id" = $1
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, userId); err != nil {
+		return nil, fmt.Errorf("select addresses failed: %v", err)
+	}
+
+	result := make([]*addresses.Address, 0)
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal addresses failed: %v", err)
+	}
+
+	return result, nil
+}
+
+func (r *addressesRepository) FindOneAddress(userId, addressId string) (*addresses.Address, error) {
+	query := `
+	SELECT
+		to_json("t")
+	FROM (` + addressQuery + `
+		WHERE "a"."user_id" = $1
+		AND "a"."id" = $2
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, userId, addressId); err != nil {
+		return nil, fmt.Errorf("address not found")
+	}
+
+	address := new(addresses.Address)
+	if err := json.Unmarshal(data, address); err != nil {
+		return nil, fmt.Errorf("unmarshal address failed: %v", err)
+	}
+
+	return address, nil
+}
+
+func (r *addressesRepository) CountAddress(userId string) (int, error) {
+	query := `
+	SELECT
+		COUNT(*)
+	FROM "user_addresses"
+	WHERE "user_id" = $1;`
+
+	var count int
+	if err := r.db.Get(&count, query, userId); err != nil {
+		return 0, fmt.Errorf("count addresses failed: %v", err)
+	}
+	return count, nil
+}
+
+// Clear the current default so another address can take it
+func clearDefault(ctx context.Context, tx *sqlx.Tx, userId string) error {
+	query := `
+	UPDATE "user_addresses" SET
+		"is_default" = FALSE
+	WHERE "user_id" = $1
+	AND "is_default" = TRUE;`
+
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return fmt.Errorf("clear default address failed: %v", err)
+	}
+	return nil
+}
+
+// The first address of a user is always the default
+func (r *addressesRepository) InsertAddress(userId string, req *addresses.AddressReq) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if req.IsDefault {
+		if err := clearDefault(ctx, tx, userId); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	query := `
+	INSERT INTO "user_addresses" (
+		"user_id",
+		"recipient",
+		"phone",
+		"line1",
+		"line2",
+		"sub_district",
+		"district",
+		"province",
+		"postal_code",
+		"is_default"
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10 OR NOT EXISTS (
+		SELECT 1 FROM "user_addresses" WHERE "user_id" = $1
+	))
+	RETURNING "id";`
+
+	var addressId string
+	if err := tx.QueryRowxContext(
+		ctx,
+		query,
+		userId,
+		req.Recipient,
+		req.Phone,
+		req.Line1,
+		req.Line2,
+		req.SubDistrict,
+		req.District,
+		req.Province,
+		req.PostalCode,
+		req.IsDefault,
+	).Scan(&addressId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("insert address failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return addressId, nil
+}
+
+func (r *addressesRepository) UpdateAddress(userId, addressId string, req *addresses.AddressReq) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if req.IsDefault {
+		if err := clearDefault(ctx, tx, userId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query := `
+	UPDATE "user_addresses" SET
+		"recipient" = $3,
+		"phone" = $4,
+		"line1" = $5,
+		"line2" = $6,
+		"sub_district" = $7,
+		"district" = $8,
+		"province" = $9,
+		"postal_code" = $10,
+		"is_default" = "is_default" OR $11
+	WHERE "user_id" = $1
+	AND "id" = $2;`
+
+	result, err := tx.ExecContext(
+		ctx,
+		query,
+		userId,
+		addressId,
+		req.Recipient,
+		req.Phone,
+		req.Line1,
+		req.Line2,
+		req.SubDistrict,
+		req.District,
+		req.Province,
+		req.PostalCode,
+		req.IsDefault,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update address failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		tx.Rollback()
+		return fmt.Errorf("address not found")
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (r *addressesRepository) UpdateDefaultAddress(userId, addressId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := clearDefault(ctx, tx, userId); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := `
+	UPDATE "user_addresses" SET
+		"is_default" = TRUE
+	WHERE "user_id" = $1
+	AND "id" = $2;`
+
+	result, err := tx.ExecContext(ctx, query, userId, addressId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update default address failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		tx.Rollback()
+		return fmt.Errorf("address not found")
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// When the default is deleted the latest updated address becomes the default
+func (r *addressesRepository) DeleteAddress(userId, addressId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	DELETE FROM "user_addresses"
+	WHERE "user_id" = $1
+	AND "id" = $2
+	RETURNING "is_default";`
+
+	var wasDefault bool
+	if err := tx.QueryRowxContext(ctx, query, userId, addressId).Scan(&wasDefault); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("address not found")
+	}
+
+	if wasDefault {
+		queryDefault := `
+		UPDATE "user_addresses" SET
+			"is_default" = TRUE
+		WHERE "id" = (
+			SELECT
+				"id"
+			FROM "user_addresses"
+			WHERE "user_id" = $1
+			ORDER BY "updated_at" DESC
+			LIMIT 1
+		);`
+
+		if _, err := tx.ExecContext(ctx, queryDefault, userId); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("update default address failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
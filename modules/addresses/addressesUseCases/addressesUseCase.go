@@ -0,0 +1,104 @@
+package addressesUseCases
+
+import (
+	"fmt"
+
+	"github.com/pandakn/cafe-beans/modules/addresses"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
+)
+
+type IAddressesUseCase interface {
+	FindAddress(userId string) ([]*addresses.Address, error)
+	FindOneAddress(userId, addressId string) (*addresses.Address, error)
+	InsertAddress(userId string, req *addresses.AddressReq) (*addresses.Address, error)
+	UpdateAddress(userId, addressId string, req *addresses.AddressReq) (*addresses.Address, error)
+	UpdateDefaultAddress(userId, addressId string) (*addresses.Address, error)
+	DeleteAddress(userId, addressId string) error
+	SnapshotAddress(userId, addressId string) (*addresses.AddressSnapshot, error)
+	LookupAddress(req *addresses.AddressLookupReq) []*cafeBeansAddress.Entry
+}
+
+type addressesUseCase struct {
+	addressesRepository addressesRepositories.IAddressesRepository
+	addressBook         cafeBeansAddress.IAddressBook
+	validator           cafeBeansValidator.IValidator
+}
+
+func AddressesUseCase(addressesRepository addressesRepositories.IAddressesRepository, addressBook cafeBeansAddress.IAddressBook, validator cafeBeansValidator.IValidator) IAddressesUseCase {
+	return &addressesUseCase{
+		addressesRepository: addressesRepository,
+		addressBook:         addressBook,
+		validator:           validator,
+	}
+}
+
+func (u *addressesUseCase) FindAddress(userId string) ([]*addresses.Address, error) {
+	return u.addressesRepository.FindAddress(userId)
+}
+
+func (u *addressesUseCase) FindOneAddress(userId, addressId string) (*addresses.Address, error) {
+	return u.addressesRepository.FindOneAddress(userId, addressId)
+}
+
+func (u *addressesUseCase) InsertAddress(userId string, req *addresses.AddressReq) (*addresses.Address, error) {
+	count, err := u.addressesRepository.CountAddress(userId)
+	if err != nil {
+		return nil, err
+	}
+	if count >= addresses.MaxAddresses {
+		return nil, fmt.Errorf("address book is full")
+	}
+
+	addressId, err := u.addressesRepository.InsertAddress(userId, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.addressesRepository.FindOneAddress(userId, addressId)
+}
+
+func (u *addressesUseCase) UpdateAddress(userId, addressId string, req *addresses.AddressReq) (*addresses.Address, error) {
+	if err := u.addressesRepository.UpdateAddress(userId, addressId, req); err != nil {
+		return nil, err
+	}
+
+	return u.addressesRepository.FindOneAddress(userId, addressId)
+}
+
+func (u *addressesUseCase) UpdateDefaultAddress(userId, addressId string) (*addresses.Address, error) {
+	if err := u.addressesRepository.UpdateDefaultAddress(userId, addressId); err != nil {
+		return nil, err
+	}
+
+	return u.addressesRepository.FindOneAddress(userId, addressId)
+}
+
+func (u *addressesUseCase) DeleteAddress(userId, addressId string) error {
+	return u.addressesRepository.DeleteAddress(userId, addressId)
+}
+
+// The contact and address an order stores, taken from an address of the user.
+// The address is checked against the dataset again, it may have been saved
+// before the dataset knew better.
+func (u *addressesUseCase) SnapshotAddress(userId, addressId string) (*addresses.AddressSnapshot, error) {
+	address, err := u.addressesRepository.FindOneAddress(userId, addressId)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := u.validator.ThaiAddress(address.SubDistrict, address.District, address.Province, address.PostalCode); errs != nil {
+		return nil, fmt.Errorf("address is no longer valid")
+	}
+
+	return address.Snapshot(), nil
+}
+
+func (u *addressesUseCase) LookupAddress(req *addresses.AddressLookupReq) []*cafeBeansAddress.Entry {
+	if req.Limit < 1 || req.Limit > 50 {
+		req.Limit = 10
+	}
+
+	return u.addressBook.Search(req.Query, req.Limit)
+}
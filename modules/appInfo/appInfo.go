@@ -1,5 +1,7 @@
 package appInfo
 
+import "errors"
+
 type CategoryFilter struct {
 	Title string `query:"title"`
 }
@@ -8,3 +10,39 @@ type Category struct {
 	Id    int    `db:"id" json:"id"`
 	Title string `db:"title" json:"title"`
 }
+
+// Scopes an api key can be granted, each route asks for the scopes it needs
+const (
+	ScopeUsersAuth      = "users:auth"
+	ScopeCategoriesRead = "categories:read"
+)
+
+var Scopes = []string{
+	ScopeUsersAuth,
+	ScopeCategoriesRead,
+}
+
+var (
+	ErrScopeInvalid   = errors.New("scope is invalid")
+	ErrApiKeyNotFound = errors.New("api key not found")
+)
+
+type ApiKeyReq struct {
+	Name      string   `json:"name" form:"name"`
+	Scopes    []string `json:"scopes" form:"scopes"`
+	ExpiresIn int      `json:"expires_in" form:"expires_in"` // days, 0 is never expires
+}
+
+type ApiKey struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	OwnerId    string   `json:"owner_id"`
+	KeyPrefix  string   `json:"key_prefix"`
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+	RevokedAt  *string  `json:"revoked_at"`
+	CreatedAt  string   `json:"created_at"`
+	// the plain key is only returned once when it's created
+	Key string `json:"key,omitempty"`
+}
@@ -1,15 +1,18 @@
 package appInfoHandlers
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/pandakn/cafe-beans/config"
 	"github.com/pandakn/cafe-beans/modules/appInfo"
 	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoUseCases"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
 	"github.com/pandakn/cafe-beans/modules/entities"
-	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
 )
 
 type appInfoHandlerErrCode string
@@ -19,10 +22,14 @@ const (
 	findCategoryKeyErr   appInfoHandlerErrCode = "appInfo-002"
 	insertCategoryKeyErr appInfoHandlerErrCode = "appInfo-003"
 	removeCategoryKeyErr appInfoHandlerErrCode = "appInfo-004"
+	findApiKeyErr        appInfoHandlerErrCode = "appInfo-005"
+	revokeApiKeyErr      appInfoHandlerErrCode = "appInfo-006"
 )
 
 type IAppInfoHandler interface {
 	GenerateApiKey(c *fiber.Ctx) error
+	FindApiKey(c *fiber.Ctx) error
+	RevokeApiKey(c *fiber.Ctx) error
 	FindCategory(c *fiber.Ctx) error
 	AddCategory(c *fiber.Ctx) error
 	RemoveCategory(c *fiber.Ctx) error
@@ -31,18 +38,63 @@ type IAppInfoHandler interface {
 type appInfoHandler struct {
 	cfg            config.IConfig
 	appInfoUseCase appInfoUseCases.IAppInfoUseCase
+	auditUseCase   auditUseCases.IAuditUseCase
 }
 
-func AppInfoHandler(cfg config.IConfig, appInfoUseCase appInfoUseCases.IAppInfoUseCase) IAppInfoHandler {
+func AppInfoHandler(cfg config.IConfig, appInfoUseCase appInfoUseCases.IAppInfoUseCase, auditUseCase auditUseCases.IAuditUseCase) IAppInfoHandler {
 	return &appInfoHandler{
 		cfg:            cfg,
 		appInfoUseCase: appInfoUseCase,
+		auditUseCase:   auditUseCase,
 	}
 }
 
 func (h *appInfoHandler) GenerateApiKey(c *fiber.Ctx) error {
-	apiKey, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.ApiKey, h.cfg.Jwt(), nil)
+	req := new(appInfo.ApiKeyReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(generateApiKeyErr),
+			err.Error(),
+		).Res()
+	}
+
+	if strings.TrimSpace(req.Name) == "" || len(req.Scopes) == 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(generateApiKeyErr),
+			"name and scopes are required",
+		).Res()
+	}
+
+	if req.ExpiresIn < 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(generateApiKeyErr),
+			"expires_in must not be negative",
+		).Res()
+	}
+
+	ownerId, _ := c.Locals("userId").(string)
+	apiKey, err := h.appInfoUseCase.InsertApiKey(req, ownerId)
+
+	event := audit.NewEvent(c, audit.ActionApiKeyIssued).
+		WithError(err).
+		With("name", req.Name).
+		With("scopes", req.Scopes)
+	if err == nil {
+		event.WithTarget(apiKey.Id)
+	}
+	h.auditUseCase.Record(event)
+
 	if err != nil {
+		if errors.Is(err, appInfo.ErrScopeInvalid) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(generateApiKeyErr),
+				err.Error(),
+			).Res()
+		}
 		return entities.NewResponse(c).Error(
 			fiber.ErrInternalServerError.Code,
 			string(generateApiKeyErr),
@@ -50,12 +102,58 @@ func (h *appInfoHandler) GenerateApiKey(c *fiber.Ctx) error {
 		).Res()
 	}
 
+	return entities.NewResponse(c).Success(fiber.StatusCreated, apiKey).Res()
+}
+
+func (h *appInfoHandler) FindApiKey(c *fiber.Ctx) error {
+	apiKeys, err := h.appInfoUseCase.FindApiKey()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findApiKeyErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, apiKeys).Res()
+}
+
+func (h *appInfoHandler) RevokeApiKey(c *fiber.Ctx) error {
+	apiKeyId := strings.Trim(c.Params("api_key_id"), " ")
+	if _, err := uuid.Parse(apiKeyId); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(revokeApiKeyErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	err := h.appInfoUseCase.RevokeApiKey(apiKeyId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionApiKeyRevoked).WithTarget(apiKeyId).WithError(err))
+
+	if err != nil {
+		switch {
+		case errors.Is(err, appInfo.ErrApiKeyNotFound):
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(revokeApiKeyErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(revokeApiKeyErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
 	return entities.NewResponse(c).Success(
 		fiber.StatusOK,
 		&struct {
-			Key string `json:"key"`
+			ApiKeyId string `json:"api_key_id"`
 		}{
-			Key: apiKey.SignToken(),
+			ApiKeyId: apiKeyId,
 		},
 	).Res()
 }
@@ -2,17 +2,24 @@ package appInfoRepositories
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pandakn/cafe-beans/modules/appInfo"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IAppInfoRepository interface {
 	FindCategory(req *appInfo.CategoryFilter) ([]*appInfo.Category, error)
 	InsertCategory(req []*appInfo.Category) error
 	DeleteCategory(categoryId int) error
+	InsertApiKey(req *appInfo.ApiKeyReq, ownerId, key string) (string, error)
+	FindOneApiKey(apiKeyId string) (*appInfo.ApiKey, error)
+	FindApiKey() ([]*appInfo.ApiKey, error)
+	RevokeApiKey(apiKeyId string) error
 }
 
 type appInfoRepository struct {
@@ -138,3 +145,139 @@ func (r *appInfoRepository) DeleteCategory(categoryId int) error {
 
 	return nil
 }
+
+// Only a digest of the key is stored, the prefix is kept to tell keys apart
+func (r *appInfoRepository) InsertApiKey(req *appInfo.ApiKeyReq, ownerId, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	scopes, err := json.Marshal(req.Scopes)
+	if err != nil {
+		return "", fmt.Errorf("marshal scopes failed: %v", err)
+	}
+
+	query := `
+	INSERT INTO "api_keys" (
+		"name",
+		"owner_id",
+		"key_prefix",
+		"key_hash",
+		"scopes",
+		"expires_at"
+	)
+	VALUES (
+		$1,
+		$2,
+		$3,
+		$4,
+		$5::jsonb,
+		CASE WHEN $6::INT > 0 THEN now() + make_interval(days => $6::INT) ELSE NULL END
+	)
+	RETURNING "id";`
+
+	var id string
+	if err := r.db.QueryRowContext(
+		ctx,
+		query,
+		req.Name,
+		ownerId,
+		key[:12],
+		utils.HashToken(key),
+		string(scopes),
+		req.ExpiresIn,
+	).Scan(&id); err != nil {
+		return "", fmt.Errorf("insert api key failed: %v", err)
+	}
+
+	return id, nil
+}
+
+func (r *appInfoRepository) FindOneApiKey(apiKeyId string) (*appInfo.ApiKey, error) {
+	query := `
+	SELECT
+		to_json("t")
+	FROM (
+		SELECT
+			"k"."id",
+			"k"."name",
+			"k"."owner_id",
+			"k"."key_prefix",
+			"k"."scopes",
+			"k"."expires_at",
+			"k"."last_used_at",
+			"k"."revoked_at",
+			"k"."created_at"
+		FROM "api_keys" "k"
+		WHERE "k"."id" = $1
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, apiKeyId); err != nil {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	apiKey := new(appInfo.ApiKey)
+	if err := json.Unmarshal(data, &apiKey); err != nil {
+		return nil, fmt.Errorf("unmarshal api key failed: %v", err)
+	}
+
+	return apiKey, nil
+}
+
+func (r *appInfoRepository) FindApiKey() ([]*appInfo.ApiKey, error) {
+	query := `
+	SELECT
+		COALESCE(array_to_json(array_agg("t")), '[]'::json)
+	FROM (
+		SELECT
+			"k"."id",
+			"k"."name",
+			"k"."owner_id",
+			"k"."key_prefix",
+			"k"."scopes",
+			"k"."expires_at",
+			"k"."last_used_at",
+			"k"."revoked_at",
+			"k"."created_at"
+		FROM "api_keys" "k"
+		ORDER BY "k"."created_at" DESC
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query); err != nil {
+		return nil, fmt.Errorf("select api keys failed: %v", err)
+	}
+
+	apiKeys := make([]*appInfo.ApiKey, 0)
+	if err := json.Unmarshal(data, &apiKeys); err != nil {
+		return nil, fmt.Errorf("unmarshal api keys failed: %v", err)
+	}
+
+	return apiKeys, nil
+}
+
+func (r *appInfoRepository) RevokeApiKey(apiKeyId string) error {
+	ctx := context.Background()
+
+	query := `
+	UPDATE "api_keys" SET
+		"revoked_at" = now()
+	WHERE "id" = $1
+	AND "revoked_at" IS NULL;`
+
+	result, err := r.db.ExecContext(ctx, query, apiKeyId)
+	if err != nil {
+		return fmt.Errorf("revoke api key failed: %v", err)
+	}
+
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve affected rows: %v", err)
+	}
+
+	if rowCount == 0 {
+		return appInfo.ErrApiKeyNotFound
+	}
+
+	return nil
+}
@@ -1,14 +1,20 @@
 package appInfoUseCases
 
 import (
+	"fmt"
+
 	"github.com/pandakn/cafe-beans/modules/appInfo"
 	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoRepositories"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IAppInfoUseCase interface {
 	FindCategory(req *appInfo.CategoryFilter) ([]*appInfo.Category, error)
 	InsertCategory(req []*appInfo.Category) error
 	DeleteCategory(categoryId int) error
+	InsertApiKey(req *appInfo.ApiKeyReq, ownerId string) (*appInfo.ApiKey, error)
+	FindApiKey() ([]*appInfo.ApiKey, error)
+	RevokeApiKey(apiKeyId string) error
 }
 
 type appInfoUseCase struct {
@@ -45,3 +51,47 @@ func (u *appInfoUseCase) DeleteCategory(categoryId int) error {
 
 	return nil
 }
+
+func (u *appInfoUseCase) InsertApiKey(req *appInfo.ApiKeyReq, ownerId string) (*appInfo.ApiKey, error) {
+	for _, scope := range req.Scopes {
+		if !utils.Contains(appInfo.Scopes, scope) {
+			return nil, fmt.Errorf("%w: %s", appInfo.ErrScopeInvalid, scope)
+		}
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	key := "cbk_" + secret
+
+	apiKeyId, err := u.appInfoRepository.InsertApiKey(req, ownerId, key)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := u.appInfoRepository.FindOneApiKey(apiKeyId)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.Key = key
+
+	return apiKey, nil
+}
+
+func (u *appInfoUseCase) FindApiKey() ([]*appInfo.ApiKey, error) {
+	apiKeys, err := u.appInfoRepository.FindApiKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+func (u *appInfoUseCase) RevokeApiKey(apiKeyId string) error {
+	if err := u.appInfoRepository.RevokeApiKey(apiKeyId); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Actions are named after what happened, the outcome tells whether it succeeded
+const (
+	ActionSignIn              = "signin"
+	ActionSignInMfa           = "signin_2fa"
+	ActionSignInMagicLink     = "signin_magic_link"
+	ActionSignInOidc          = "signin_oidc"
+	ActionTokenRefreshed      = "token_refreshed"
+	ActionRefreshTokenReuse   = "refresh_token_reuse"
+	ActionSignOut             = "signout"
+	ActionAdminCreated        = "admin_created"
+	ActionAdminBootstrapped   = "admin_bootstrapped"
+	ActionAdminTokenIssued    = "admin_token_issued"
+	ActionAdminTokenRejected  = "admin_token_rejected"
+	ActionAccountDisabled     = "account_disabled"
+	ActionAccountEnabled      = "account_enabled"
+	ActionSessionsRevoked     = "sessions_revoked"
+	ActionImpersonationIssued = "impersonation_issued"
+	ActionApiKeyIssued        = "api_key_issued"
+	ActionApiKeyRevoked       = "api_key_revoked"
+	ActionRoleCreated         = "role_created"
+	ActionRoleUpdated         = "role_updated"
+	ActionRoleDeleted         = "role_deleted"
+	ActionRolePermissions     = "role_permissions_updated"
+	ActionUserRoleChanged     = "user_role_changed"
+	ActionPermissionDenied    = "permission_denied"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type Event struct {
+	Id string `json:"id"`
+	// the signed in user, empty when there isn't one
+	ActorId string `json:"actor_id"`
+	Action  string `json:"action"`
+	// what the action was done to, e.g., a user or an api key
+	TargetId  string         `json:"target_id"`
+	Ip        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Outcome   string         `json:"outcome"`
+	Metadata  map[string]any `json:"metadata"`
+	CreatedAt string         `json:"created_at"`
+}
+
+// An event of the request, the actor is whoever JwtAuth signed in.
+// It succeeded unless WithError is given an error.
+func NewEvent(c *fiber.Ctx, action string) *Event {
+	e := &Event{
+		Action:    action,
+		Ip:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Outcome:   OutcomeSuccess,
+		Metadata:  make(map[string]any),
+	}
+	if userId, ok := c.Locals("userId").(string); ok {
+		e.ActorId = userId
+	}
+	// an admin acting on behalf of the actor
+	if impersonatorId, _ := c.Locals("impersonatorId").(string); impersonatorId != "" {
+		e.Metadata["impersonator_id"] = impersonatorId
+	}
+	return e
+}
+
+func (e *Event) WithActor(actorId string) *Event {
+	e.ActorId = actorId
+	return e
+}
+
+func (e *Event) WithTarget(targetId string) *Event {
+	e.TargetId = targetId
+	return e
+}
+
+// A nil error leaves the event as succeeded
+func (e *Event) WithError(err error) *Event {
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Metadata["error"] = err.Error()
+	}
+	return e
+}
+
+func (e *Event) With(key string, value any) *Event {
+	if e.Metadata == nil {
+		e.Metadata = make(map[string]any)
+	}
+	e.Metadata[key] = value
+	return e
+}
+
+// From is inclusive and to is exclusive, both RFC 3339
+type EventFilter struct {
+	ActorId  string `query:"actor_id"`
+	TargetId string `query:"target_id"`
+	Action   string `query:"action"`
+	From     string `query:"from"`
+	To       string `query:"to"`
+	Page     int    `query:"page"`
+	Limit    int    `query:"limit"`
+}
+
+type EventPage struct {
+	Data      []*Event `json:"data"`
+	Page      int      `json:"page"`
+	Limit     int      `json:"limit"`
+	TotalItem int      `json:"total_item"`
+	TotalPage int      `json:"total_page"`
+}
@@ -0,0 +1,62 @@
+package auditHandlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/modules/entities"
+)
+
+type auditHandlerErrCode string
+
+const (
+	findEventsErr auditHandlerErrCode = "audit-001"
+)
+
+type IAuditHandler interface {
+	FindEvents(c *fiber.Ctx) error
+}
+
+type auditHandler struct {
+	cfg          config.IConfig
+	auditUseCase auditUseCases.IAuditUseCase
+}
+
+func AuditHandler(cfg config.IConfig, auditUseCase auditUseCases.IAuditUseCase) IAuditHandler {
+	return &auditHandler{
+		cfg:          cfg,
+		auditUseCase: auditUseCase,
+	}
+}
+
+func (h *auditHandler) FindEvents(c *fiber.Ctx) error {
+	req := new(audit.EventFilter)
+	if err := c.QueryParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findEventsErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.auditUseCase.FindEvents(req)
+	if err != nil {
+		switch err.Error() {
+		case "from and to must be formatted as RFC 3339":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(findEventsErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(findEventsErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
@@ -0,0 +1,155 @@
+package auditRepositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pandakn/cafe-beans/modules/audit"
+)
+
+type IAuditRepository interface {
+	InsertEvent(req *audit.Event) error
+	FindEvents(req *audit.EventFilter) ([]*audit.Event, int, error)
+	DeleteEventsBefore(before time.Time) (int, error)
+}
+
+type auditRepository struct {
+	db *sqlx.DB
+}
+
+func AuditRepository(db *sqlx.DB) IAuditRepository {
+	return &auditRepository{
+		db: db,
+	}
+}
+
+func (r *auditRepository) InsertEvent(req *audit.Event) error {
+	metadata := []byte("{}")
+	if len(req.Metadata) != 0 {
+		var err error
+		if metadata, err = json.Marshal(req.Metadata); err != nil {
+			return fmt.Errorf("marshal audit metadata failed: %v", err)
+		}
+	}
+
+	query := `
+	INSERT INTO "audit_events" (
+		"actor_id",
+		"action",
+		"target_id",
+		"ip",
+		"user_agent",
+		"outcome",
+		"metadata"
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7);`
+
+	if _, err := r.db.ExecContext(
+		context.Background(),
+		query,
+		req.ActorId,
+		req.Action,
+		req.TargetId,
+		req.Ip,
+		req.UserAgent,
+		req.Outcome,
+		string(metadata),
+	); err != nil {
+		return fmt.Errorf("insert audit event failed: %v", err)
+	}
+
+	return nil
+}
+
+// A page of events matching the filter, the latest first, and how many match in total
+func (r *auditRepository) FindEvents(req *audit.EventFilter) ([]*audit.Event, int, error) {
+	conditions := make([]string, 0)
+	filterValues := make([]any, 0)
+
+	if req.ActorId != "" {
+		filterValues = append(filterValues, req.ActorId)
+		conditions = append(conditions, fmt.Sprintf(`"e"."actor_id" = $%d`, len(filterValues)))
+	}
+	if req.TargetId != "" {
+		filterValues = append(filterValues, req.TargetId)
+		conditions = append(conditions, fmt.Sprintf(`"e"."target_id" = $%d`, len(filterValues)))
+	}
+	if req.Action != "" {
+		filterValues = append(filterValues, req.Action)
+		conditions = append(conditions, fmt.Sprintf(`"e"."action" = $%d`, len(filterValues)))
+	}
+	if req.From != "" {
+		filterValues = append(filterValues, req.From)
+		conditions = append(conditions, fmt.Sprintf(`"e"."created_at" >= $%d::TIMESTAMPTZ`, len(filterValues)))
+	}
+	if req.To != "" {
+		filterValues = append(filterValues, req.To)
+		conditions = append(conditions, fmt.Sprintf(`"e"."created_at" < $%d::TIMESTAMPTZ`, len(filterValues)))
+	}
+
+	where := ""
+	if len(conditions) != 0 {
+		where = "WHERE " + strings.Join(conditions, "\n\tAND ")
+	}
+
+	queryCount := `
+	SELECT
+		COUNT(*)
+	FROM "audit_events" "e"
+	` + where + ";"
+
+	var count int
+	if err := r.db.Get(&count, queryCount, filterValues...); err != nil {
+		return nil, 0, fmt.Errorf("count audit events failed: %v", err)
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		COALESCE(json_agg("a" ORDER BY "a"."created_at" DESC, "a"."id" DESC), '[]')
+	FROM (
+		SELECT
+			"e"."id",
+			"e"."actor_id",
+			"e"."action",
+			"e"."target_id",
+			"e"."ip",
+			"e"."user_agent",
+			"e"."outcome",
+			"e"."metadata",
+			"e"."created_at"
+		FROM "audit_events" "e"
+		%s
+		ORDER BY "e"."created_at" DESC, "e"."id" DESC
+		LIMIT $%d OFFSET $%d
+	) AS "a";`, where, len(filterValues)+1, len(filterValues)+2)
+
+	filterValues = append(filterValues, req.Limit, (req.Page-1)*req.Limit)
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, filterValues...); err != nil {
+		return nil, 0, fmt.Errorf("select audit events failed: %v", err)
+	}
+
+	events := make([]*audit.Event, 0)
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal audit events failed: %v", err)
+	}
+
+	return events, count, nil
+}
+
+func (r *auditRepository) DeleteEventsBefore(before time.Time) (int, error) {
+	query := `DELETE FROM "audit_events" WHERE "created_at" < $1;`
+
+	result, err := r.db.ExecContext(context.Background(), query, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete audit events failed: %v", err)
+	}
+
+	count, _ := result.RowsAffected()
+	return int(count), nil
+}
@@ -0,0 +1,79 @@
+package auditUseCases
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditRepositories"
+)
+
+type IAuditUseCase interface {
+	Record(event *audit.Event)
+	FindEvents(req *audit.EventFilter) (*audit.EventPage, error)
+	Prune() (int, error)
+}
+
+type auditUseCase struct {
+	cfg             config.IConfig
+	auditRepository auditRepositories.IAuditRepository
+}
+
+func AuditUseCase(cfg config.IConfig, auditRepository auditRepositories.IAuditRepository) IAuditUseCase {
+	return &auditUseCase{
+		cfg:             cfg,
+		auditRepository: auditRepository,
+	}
+}
+
+// The action itself has already happened, a failure to record it is only logged
+func (u *auditUseCase) Record(event *audit.Event) {
+	if err := u.auditRepository.InsertEvent(event); err != nil {
+		log.Printf("record %s: %v", event.Action, err)
+	}
+}
+
+func (u *auditUseCase) FindEvents(req *audit.EventFilter) (*audit.EventPage, error) {
+	for _, t := range []string{req.From, req.To} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, t); err != nil {
+			return nil, fmt.Errorf("from and to must be formatted as RFC 3339")
+		}
+	}
+
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 1 {
+		req.Limit = 50
+	}
+	if req.Limit > 200 {
+		req.Limit = 200
+	}
+
+	events, count, err := u.auditRepository.FindEvents(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &audit.EventPage{
+		Data:      events,
+		Page:      req.Page,
+		Limit:     req.Limit,
+		TotalItem: count,
+		TotalPage: (count + req.Limit - 1) / req.Limit,
+	}, nil
+}
+
+// Delete events older than the retention, nothing when it's 0
+func (u *auditUseCase) Prune() (int, error) {
+	retention := u.cfg.Audit().Retention()
+	if retention <= 0 {
+		return 0, nil
+	}
+	return u.auditRepository.DeleteEventsBefore(time.Now().Add(-retention))
+}
@@ -9,6 +9,7 @@ import (
 type IResponse interface {
 	Success(code int, data any) IResponse
 	Error(code int, traceId, msg string) IResponse
+	ValidationError(code int, traceId string, errs []*FieldError) IResponse
 	Res() error
 }
 
@@ -22,8 +23,16 @@ type Response struct {
 
 type ErrorResponse struct {
 	// trace id is id of error
-	TraceId string `json:"trace_id"`
-	Msg     string `json:"message"`
+	TraceId string        `json:"trace_id"`
+	Msg     string        `json:"message"`
+	Errors  []*FieldError `json:"errors,omitempty"`
+}
+
+// One invalid field of a request, code is stable for clients to match on
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func NewResponse(c *fiber.Ctx) IResponse {
@@ -50,6 +59,19 @@ func (r *Response) Error(code int, traceId, msg string) IResponse {
 	return r
 }
 
+// Every invalid field at once instead of a single message
+func (r *Response) ValidationError(code int, traceId string, errs []*FieldError) IResponse {
+	r.StatusCode = code
+	r.ErrorRes = &ErrorResponse{
+		TraceId: traceId,
+		Msg:     "validation failed",
+		Errors:  errs,
+	}
+	r.IsError = true
+	cafeBeansLogger.InitCafeBeansLogger(r.Context, &r.ErrorRes, code).Print().Save()
+	return r
+}
+
 func (r *Response) Res() error {
 	return r.Context.Status(r.StatusCode).JSON(func() any {
 		if r.IsError {
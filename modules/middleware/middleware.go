@@ -1,6 +1,40 @@
 package middleware
 
-type Role struct {
-	Id    int    `db:"id"`
-	Title string `db:"title"`
+// Permissions are granted to roles through "roles_permissions",
+// routes ask for permissions instead of role ids
+const (
+	PermissionAdminsCreate     = "admins:create"
+	PermissionApiKeysManage    = "api-keys:manage"
+	PermissionCategoriesManage = "categories:manage"
+	PermissionOrdersRead       = "orders:read"
+	PermissionOrdersWrite      = "orders:write"
+	PermissionRolesManage      = "roles:manage"
+	PermissionMetricsRead      = "metrics:read"
+	PermissionUsersManage      = "users:manage"
+	PermissionUsersImpersonate = "users:impersonate"
+	PermissionAuditRead        = "audit:read"
+)
+
+type ApiKey struct {
+	Id     string   `db:"id"`
+	Scopes []string `db:"-"`
+}
+
+// A signed in session, the role is read from "users" on every request
+// so a role change applies without signing in again
+type Session struct {
+	Id     string `db:"id"`
+	UserId string `db:"user_id"`
+	RoleId int    `db:"role_id"`
+	// set when an admin holds the session on behalf of the user
+	ImpersonatorId string `db:"impersonator_id"`
+}
+
+// How long sessions last in seconds, 0 is no limit
+type SessionLimits struct {
+	// since the signin, a refresh token keeps its expiry through rotations
+	RefreshExpires       int
+	ImpersonationExpires int
+	AbsoluteLifetime     int
+	IdleTimeout          int
 }
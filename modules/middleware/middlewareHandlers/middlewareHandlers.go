@@ -1,13 +1,19 @@
 package middlewareHandlers
 
 import (
+	"errors"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
 	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/modules/middleware"
 	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
 	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
 	"github.com/pandakn/cafe-beans/pkg/utils"
@@ -21,27 +27,52 @@ const (
 	paramsCheckErr middlewareHandlersErrCode = "middleware-003"
 	authorizeErr   middlewareHandlersErrCode = "middleware-004"
 	apiKeyErr      middlewareHandlersErrCode = "middleware-005"
+	adminTokenErr  middlewareHandlersErrCode = "middleware-009"
+	impersonateErr middlewareHandlersErrCode = "middleware-010"
+
+	// stable codes for a rejected token, clients may rely on them
+	tokenExpiredErr   middlewareHandlersErrCode = "middleware-006"
+	tokenMalformedErr middlewareHandlersErrCode = "middleware-007"
+	tokenInvalidErr   middlewareHandlersErrCode = "middleware-008"
 )
 
+func tokenErrCode(err error, fallback middlewareHandlersErrCode) middlewareHandlersErrCode {
+	switch {
+	case errors.Is(err, cafeBeansAuth.ErrTokenExpired):
+		return tokenExpiredErr
+	case errors.Is(err, cafeBeansAuth.ErrTokenMalformed):
+		return tokenMalformedErr
+	case errors.Is(err, cafeBeansAuth.ErrTokenSignature),
+		errors.Is(err, cafeBeansAuth.ErrTokenClaims):
+		return tokenInvalidErr
+	default:
+		return fallback
+	}
+}
+
 type IMiddlewareHandler interface {
 	Cors() fiber.Handler
 	RouterCheck() fiber.Handler
 	Logger() fiber.Handler
 	JwtAuth() fiber.Handler
 	ParamsCheck() fiber.Handler
-	Authorize(expectRoleId ...int) fiber.Handler
-	ApiKeyAuth() fiber.Handler
+	RequirePermission(permissions ...string) fiber.Handler
+	ApiKeyAuth(scopes ...string) fiber.Handler
+	AdminTokenAuth() fiber.Handler
+	DenyImpersonation() fiber.Handler
 }
 
 type middlewareHandler struct {
 	cfg               config.IConfig
 	middlewareUseCase middlewareUseCases.IMiddlewareUseCase
+	auditUseCase      auditUseCases.IAuditUseCase
 }
 
-func MiddlewareHandler(cfg config.IConfig, middlewareUseCase middlewareUseCases.IMiddlewareUseCase) IMiddlewareHandler {
+func MiddlewareHandler(cfg config.IConfig, middlewareUseCase middlewareUseCases.IMiddlewareUseCase, auditUseCase auditUseCases.IAuditUseCase) IMiddlewareHandler {
 	return &middlewareHandler{
 		cfg:               cfg,
 		middlewareUseCase: middlewareUseCase,
+		auditUseCase:      auditUseCase,
 	}
 }
 
@@ -79,17 +110,23 @@ func (h *middlewareHandler) Logger() fiber.Handler {
 func (h *middlewareHandler) JwtAuth() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
-		result, err := cafeBeansAuth.ParseToken(h.cfg.Jwt(), token)
+		result, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, h.cfg.Jwt(), token)
 		if err != nil {
-			return entities.NewResponse(c).Error(
-				fiber.ErrUnauthorized.Code,
-				string(jwtAuthErr),
-				err.Error(),
-			).Res()
+			// an admin may be acting on behalf of the user
+			impersonation, impersonationErr := cafeBeansAuth.ParseToken(cafeBeansAuth.Impersonation, h.cfg.Jwt(), token)
+			if impersonationErr != nil || impersonation.Claims.ImpersonatorId == "" {
+				return entities.NewResponse(c).Error(
+					fiber.ErrUnauthorized.Code,
+					string(tokenErrCode(err, jwtAuthErr)),
+					err.Error(),
+				).Res()
+			}
+			result = impersonation
 		}
 
 		claims := result.Claims
-		if !h.middlewareUseCase.FindAccessToken(claims.Id, token) {
+		session, err := h.middlewareUseCase.FindAccessToken(claims.Id, token)
+		if err != nil || session.ImpersonatorId != claims.ImpersonatorId {
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
 				string(jwtAuthErr),
@@ -98,8 +135,10 @@ func (h *middlewareHandler) JwtAuth() fiber.Handler {
 		}
 
 		// set UserId
-		c.Locals("userId", claims.Id)
-		c.Locals("userRoleId", claims.RoleId)
+		// the role comes from the db, the one in claims may be outdated
+		c.Locals("userId", session.UserId)
+		c.Locals("userRoleId", session.RoleId)
+		c.Locals("impersonatorId", session.ImpersonatorId)
 
 		return c.Next()
 	}
@@ -120,7 +159,8 @@ func (h *middlewareHandler) ParamsCheck() fiber.Handler {
 	}
 }
 
-func (h *middlewareHandler) Authorize(expectRoleId ...int) fiber.Handler {
+// The role of the user must be granted every permission
+func (h *middlewareHandler) RequirePermission(permissions ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userRoleId, ok := c.Locals("userRoleId").(int)
 		if !ok {
@@ -131,7 +171,7 @@ func (h *middlewareHandler) Authorize(expectRoleId ...int) fiber.Handler {
 			).Res()
 		}
 
-		roles, err := h.middlewareUseCase.FindRole()
+		granted, err := h.middlewareUseCase.FindPermission(userRoleId)
 		if err != nil {
 			return entities.NewResponse(c).Error(
 				fiber.ErrInternalServerError.Code,
@@ -140,41 +180,105 @@ func (h *middlewareHandler) Authorize(expectRoleId ...int) fiber.Handler {
 			).Res()
 		}
 
-		sum := 0
-		for _, v := range expectRoleId {
-			sum += v
+		for _, permission := range permissions {
+			if !utils.Contains(granted, permission) {
+				h.auditUseCase.Record(audit.NewEvent(c, audit.ActionPermissionDenied).
+					WithError(fmt.Errorf("no permission to access")).
+					With("permission", permission).
+					With("route", c.Method()+" "+c.Path()))
+
+				return entities.NewResponse(c).Error(
+					fiber.ErrUnauthorized.Code,
+					string(authorizeErr),
+					"no permission to access",
+				).Res()
+			}
 		}
 
-		expectedValueBinary := utils.BinaryConverter(sum, len(roles))
-		userValueBinary := utils.BinaryConverter(userRoleId, len(roles))
+		return c.Next()
+	}
+}
 
-		// assume
-		// user     ->  0 1
-		// expected ->  1 1
-		for i := range userValueBinary {
-			if userValueBinary[i]&expectedValueBinary[i] == 1 {
-				return c.Next()
+// The key must carry every scope the route asks for.
+// Legacy JWT keys are only accepted before JWT_LEGACY_API_KEYS_UNTIL,
+// with the scopes of JWT_LEGACY_API_KEY_SCOPES.
+func (h *middlewareHandler) ApiKeyAuth(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("X-Api-Key")
+
+		apiKey := h.legacyApiKey(key)
+		if apiKey == nil {
+			var err error
+			if apiKey, err = h.middlewareUseCase.FindApiKey(key); err != nil {
+				return entities.NewResponse(c).Error(
+					fiber.ErrUnauthorized.Code,
+					string(apiKeyErr),
+					"api key is invalid or required",
+				).Res()
 			}
 		}
 
-		return entities.NewResponse(c).Error(
-			fiber.ErrUnauthorized.Code,
-			string(authorizeErr),
-			"no permission to access",
-		).Res()
+		for _, scope := range scopes {
+			if !utils.Contains(apiKey.Scopes, scope) {
+				return entities.NewResponse(c).Error(
+					fiber.ErrForbidden.Code,
+					string(apiKeyErr),
+					"api key is not allowed to access",
+				).Res()
+			}
+		}
+
+		// tell which client made the call
+		c.Locals("apiKeyId", apiKey.Id)
+
+		return c.Next()
 	}
 }
 
-func (h *middlewareHandler) ApiKeyAuth() fiber.Handler {
+// A legacy JWT key while they're still accepted, nil otherwise
+func (h *middlewareHandler) legacyApiKey(key string) *middleware.ApiKey {
+	if !time.Now().Before(h.cfg.Jwt().LegacyApiKeysUntil()) {
+		return nil
+	}
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.ApiKey, h.cfg.Jwt(), key); err != nil {
+		return nil
+	}
+	return &middleware.ApiKey{
+		Id:     "legacy",
+		Scopes: h.cfg.Jwt().LegacyApiKeyScopes(),
+	}
+}
+
+// Accept a short-lived admin token from GET /users/admin/secret
+func (h *middlewareHandler) AdminTokenAuth() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		key := c.Get("X-Api-Key")
-		if _, err := cafeBeansAuth.ParseApiKey(h.cfg.Jwt(), key); err != nil {
+		token := c.Get("X-Admin-Token")
+		if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Admin, h.cfg.Jwt(), token); err != nil {
+			h.auditUseCase.Record(audit.NewEvent(c, audit.ActionAdminTokenRejected).WithError(err))
+
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
-				string(apiKeyErr),
-				"api key is invalid or required",
+				string(tokenErrCode(err, adminTokenErr)),
+				err.Error(),
 			).Res()
 		}
+
+		return c.Next()
+	}
+}
+
+// Refuse sessions held by an admin on behalf of the user,
+// for routes changing credentials or placing orders. Must run after JwtAuth.
+func (h *middlewareHandler) DenyImpersonation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if impersonatorId, _ := c.Locals("impersonatorId").(string); impersonatorId != "" {
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(impersonateErr),
+				"not allowed while impersonating",
+			).Res()
+		}
+
 		return c.Next()
 	}
 }
@@ -1,15 +1,22 @@
 package middlewareRepositories
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IMiddlewareRepository interface {
-	FindAccessToken(userId, accessToken string) bool
-	FindRole() ([]*middleware.Role, error)
+	FindAccessToken(userId, accessToken string, limits *middleware.SessionLimits) (*middleware.Session, error)
+	UpdateSessionLastUsed(sessionId string) error
+	DeleteExpiredSessions(limits *middleware.SessionLimits) ([]string, error)
+	FindPermission(roleId int) ([]string, error)
+	FindApiKey(key string) (*middleware.ApiKey, error)
+	UpdateApiKeyLastUsed(apiKeyId string) error
 }
 
 type middlewareRepository struct {
@@ -22,36 +29,130 @@ func MiddlewareRepository(db *sqlx.DB) IMiddlewareRepository {
 	}
 }
 
-func (r *middlewareRepository) FindAccessToken(userId, accessToken string) bool {
+// Sessions past their absolute lifetime or idle for too long are not found
+func (r *middlewareRepository) FindAccessToken(userId, accessToken string, limits *middleware.SessionLimits) (*middleware.Session, error) {
 	query := `
 	SELECT
-		(CASE WHEN COUNT(*) = 1 THEN TRUE ELSE FALSE END)
-	FROM "oauth"
-	WHERE "user_id" = $1
-	AND "access_token" = $2;
+		"o"."id",
+		"o"."user_id",
+		"u"."role_id",
+		COALESCE("o"."impersonator_id", '') AS "impersonator_id"
+	FROM "oauth" "o"
+	JOIN "users" "u" ON "u"."id" = "o"."user_id"
+	WHERE "o"."user_id" = $1
+	AND "o"."access_token" = $2
+	AND "u"."disabled_at" IS NULL
+	AND ($3::INT = 0 OR "o"."created_at" > now() - $3::INT * INTERVAL '1 second')
+	AND ($4::INT = 0 OR "o"."last_used_at" > now() - $4::INT * INTERVAL '1 second');
 	`
 
-	var check bool
-	if err := r.db.Get(&check, query, userId, accessToken); err != nil {
-		return false
+	// oauth only keeps digests of the tokens
+	session := new(middleware.Session)
+	if err := r.db.Get(
+		session,
+		query,
+		userId,
+		utils.HashToken(accessToken),
+		limits.AbsoluteLifetime,
+		limits.IdleTimeout,
+	); err != nil {
+		return nil, fmt.Errorf("session not found")
 	}
 
-	return true
+	return session, nil
 }
 
-// Find all role in db
-func (r *middlewareRepository) FindRole() ([]*middleware.Role, error) {
+// last_used_at is only precise to a minute so a busy session isn't written on every request
+func (r *middlewareRepository) UpdateSessionLastUsed(sessionId string) error {
+	query := `
+	UPDATE "oauth" SET
+		"last_used_at" = now()
+	WHERE "id" = $1
+	AND "last_used_at" < now() - INTERVAL '1 minute';`
+
+	if _, err := r.db.ExecContext(context.Background(), query, sessionId); err != nil {
+		return fmt.Errorf("update session failed: %v", err)
+	}
+
+	return nil
+}
+
+// Delete sessions that can't be used anymore and return whose they were
+func (r *middlewareRepository) DeleteExpiredSessions(limits *middleware.SessionLimits) ([]string, error) {
+	query := `
+	DELETE FROM "oauth"
+	WHERE "created_at" < now() - (CASE WHEN "impersonator_id" IS NULL THEN $1::INT ELSE $2::INT END) * INTERVAL '1 second'
+	OR ($3::INT != 0 AND "created_at" < now() - $3::INT * INTERVAL '1 second')
+	OR ($4::INT != 0 AND "last_used_at" < now() - $4::INT * INTERVAL '1 second')
+	RETURNING "user_id";`
+
+	userIds := make([]string, 0)
+	if err := r.db.Select(
+		&userIds,
+		query,
+		limits.RefreshExpires,
+		limits.ImpersonationExpires,
+		limits.AbsoluteLifetime,
+		limits.IdleTimeout,
+	); err != nil {
+		return nil, fmt.Errorf("delete expired sessions failed: %v", err)
+	}
+
+	return userIds, nil
+}
+
+// Find the permissions granted to a role
+func (r *middlewareRepository) FindPermission(roleId int) ([]string, error) {
+	query := `
+	SELECT
+		"p"."title"
+	FROM "roles_permissions" "rp"
+	JOIN "permissions" "p" ON "p"."id" = "rp"."permission_id"
+	WHERE "rp"."role_id" = $1;`
+
+	permissions := make([]string, 0)
+	if err := r.db.Select(&permissions, query, roleId); err != nil {
+		return nil, fmt.Errorf("select permissions failed: %v", err)
+	}
+
+	return permissions, nil
+}
+
+// Find a key that is neither revoked nor expired
+func (r *middlewareRepository) FindApiKey(key string) (*middleware.ApiKey, error) {
 	query := `
 	SELECT
 		"id",
-		"title"
-	FROM "roles"
-	ORDER BY "id" DESC;`
+		"scopes"
+	FROM "api_keys"
+	WHERE "key_hash" = $1
+	AND "revoked_at" IS NULL
+	AND ("expires_at" IS NULL OR "expires_at" > now());`
+
+	var scopes []byte
+	apiKey := new(middleware.ApiKey)
+	if err := r.db.QueryRowx(query, utils.HashToken(key)).Scan(&apiKey.Id, &scopes); err != nil {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	if err := json.Unmarshal(scopes, &apiKey.Scopes); err != nil {
+		return nil, fmt.Errorf("unmarshal scopes failed: %v", err)
+	}
+
+	return apiKey, nil
+}
+
+// last_used_at is only precise to a minute so a busy key isn't written on every request
+func (r *middlewareRepository) UpdateApiKeyLastUsed(apiKeyId string) error {
+	query := `
+	UPDATE "api_keys" SET
+		"last_used_at" = now()
+	WHERE "id" = $1
+	AND ("last_used_at" IS NULL OR "last_used_at" < now() - INTERVAL '1 minute');`
 
-	roles := make([]*middleware.Role, 0)
-	if err := r.db.Select(&roles, query); err != nil {
-		return nil, fmt.Errorf("roles are empty")
+	if _, err := r.db.ExecContext(context.Background(), query, apiKeyId); err != nil {
+		return fmt.Errorf("update api key failed: %v", err)
 	}
 
-	return roles, nil
+	return nil
 }
@@ -1,35 +1,113 @@
 package middlewareUseCases
 
 import (
+	"time"
+
+	"github.com/pandakn/cafe-beans/config"
 	"github.com/pandakn/cafe-beans/modules/middleware"
 	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IMiddlewareUseCase interface {
-	FindAccessToken(userId, accessToken string) bool
-	FindRole() ([]*middleware.Role, error)
+	FindAccessToken(userId, accessToken string) (*middleware.Session, error)
+	FindPermission(roleId int) ([]string, error)
+	FindApiKey(key string) (*middleware.ApiKey, error)
+	DeleteExpiredSessions() (int, error)
 }
 
 type middlewareUseCase struct {
+	cfg            config.IConfig
 	middlewareRepo middlewareRepositories.IMiddlewareRepository
+	cache          cafeBeansCache.ICafeBeansCache
 }
 
-func MiddlewareUseCase(middlewareRepo middlewareRepositories.IMiddlewareRepository) IMiddlewareUseCase {
+func MiddlewareUseCase(cfg config.IConfig, middlewareRepo middlewareRepositories.IMiddlewareRepository, cache cafeBeansCache.ICafeBeansCache) IMiddlewareUseCase {
 	return &middlewareUseCase{
+		cfg:            cfg,
 		middlewareRepo: middlewareRepo,
+		cache:          cache,
+	}
+}
+
+func (u *middlewareUseCase) sessionLimits() *middleware.SessionLimits {
+	return &middleware.SessionLimits{
+		RefreshExpires:       u.cfg.Jwt().RefreshExpiresAt(),
+		ImpersonationExpires: cafeBeansAuth.ImpersonationExpiresIn,
+		AbsoluteLifetime:     int(u.cfg.Session().AbsoluteLifetime() / time.Second),
+		IdleTimeout:          int(u.cfg.Session().IdleTimeout() / time.Second),
 	}
 }
 
-func (u *middlewareUseCase) FindAccessToken(userId, accessToken string) bool {
-	return u.middlewareRepo.FindAccessToken(userId, accessToken)
+// Cached until the ttl ends or the sessions of the user are invalidated
+func (u *middlewareUseCase) FindAccessToken(userId, accessToken string) (*middleware.Session, error) {
+	key := cafeBeansCache.SessionKey(userId, utils.HashToken(accessToken))
+
+	session := new(middleware.Session)
+	if u.cache.Get(key, session) {
+		return session, nil
+	}
+
+	session, err := u.middlewareRepo.FindAccessToken(userId, accessToken, u.sessionLimits())
+	if err != nil {
+		return nil, err
+	}
+	// a cached session isn't marked, the ttl is shorter than the idle timeout
+	if err := u.middlewareRepo.UpdateSessionLastUsed(session.Id); err != nil {
+		return nil, err
+	}
+	u.cache.Set(key, session)
+
+	return session, nil
 }
 
-func (u *middlewareUseCase) FindRole() ([]*middleware.Role, error) {
-	roles, err := u.middlewareRepo.FindRole()
+func (u *middlewareUseCase) FindPermission(roleId int) ([]string, error) {
+	key := cafeBeansCache.PermissionKey(roleId)
+
+	permissions := make([]string, 0)
+	if u.cache.Get(key, &permissions) {
+		return permissions, nil
+	}
 
+	permissions, err := u.middlewareRepo.FindPermission(roleId)
 	if err != nil {
 		return nil, err
 	}
+	u.cache.Set(key, permissions)
+
+	return permissions, nil
+}
+
+func (u *middlewareUseCase) FindApiKey(key string) (*middleware.ApiKey, error) {
+	apiKey, err := u.middlewareRepo.FindApiKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.middlewareRepo.UpdateApiKeyLastUsed(apiKey.Id); err != nil {
+		return nil, err
+	}
+
+	return apiKey, nil
+}
+
+// Sessions whose refresh token has expired, past their absolute lifetime
+// or idle for too long, how many have been deleted
+func (u *middlewareUseCase) DeleteExpiredSessions() (int, error) {
+	userIds, err := u.middlewareRepo.DeleteExpiredSessions(u.sessionLimits())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := make(map[string]bool)
+	for _, userId := range userIds {
+		if !deleted[userId] {
+			u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(userId))
+			deleted[userId] = true
+		}
+	}
 
-	return roles, nil
+	return len(userIds), nil
 }
@@ -5,19 +5,23 @@ import (
 	"github.com/pandakn/cafe-beans/config"
 	"github.com/pandakn/cafe-beans/modules/entities"
 	"github.com/pandakn/cafe-beans/modules/monitor"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
 )
 
 type IMonitorHandlers interface {
 	HealthCheck(c *fiber.Ctx) error
+	CacheStats(c *fiber.Ctx) error
 }
 
 type monitorHandlers struct {
-	cfg config.IConfig
+	cfg   config.IConfig
+	cache cafeBeansCache.ICafeBeansCache
 }
 
-func MonitorHandler(cfg config.IConfig) IMonitorHandlers {
+func MonitorHandler(cfg config.IConfig, cache cafeBeansCache.ICafeBeansCache) IMonitorHandlers {
 	return &monitorHandlers{
-		cfg: cfg,
+		cfg:   cfg,
+		cache: cache,
 	}
 }
 
@@ -29,3 +33,8 @@ func (h *monitorHandlers) HealthCheck(c *fiber.Ctx) error {
 
 	return entities.NewResponse(c).Success(fiber.StatusOK, res).Res()
 }
+
+// hits and misses of each cache namespace since the server started
+func (h *monitorHandlers) CacheStats(c *fiber.Ctx) error {
+	return entities.NewResponse(c).Success(fiber.StatusOK, h.cache.Stats()).Res()
+}
@@ -0,0 +1,93 @@
+package orders
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pandakn/cafe-beans/modules/entities"
+)
+
+// How many different products an order can have and how many of each
+const (
+	MaxOrderProducts = 20
+	MaxProductQty    = 99
+)
+
+// A new order waits for its transfer slip
+const StatusWaiting = "waiting"
+
+// Contact and address are copied from an address of the user when the
+// order is placed, editing or deleting that address doesn't change them
+type Order struct {
+	Id        string          `json:"id"`
+	UserId    string          `json:"user_id"`
+	Contact   string          `json:"contact"`
+	Address   string          `json:"address"`
+	Status    string          `json:"status"`
+	Products  []*ProductOrder `json:"products"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+// Product is the product as it was when the order was placed
+type ProductOrder struct {
+	Id      string          `json:"id"`
+	Qty     int             `json:"qty"`
+	Product json.RawMessage `json:"product"`
+}
+
+type OrderReq struct {
+	AddressId string             `json:"address_id" form:"address_id"`
+	Products  []*ProductOrderReq `json:"products" form:"products"`
+}
+
+type ProductOrderReq struct {
+	ProductId string `json:"product_id"`
+	Qty       int    `json:"qty"`
+}
+
+func fieldError(field, code, msg string) *entities.FieldError {
+	return &entities.FieldError{
+		Field:   field,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+// Every invalid field at once, nil when the request is valid
+func (obj *OrderReq) Validate() []*entities.FieldError {
+	errs := make([]*entities.FieldError, 0)
+
+	obj.AddressId = strings.TrimSpace(obj.AddressId)
+	if obj.AddressId == "" {
+		errs = append(errs, fieldError("address_id", "required", "address id is required"))
+	} else if _, err := uuid.Parse(obj.AddressId); err != nil {
+		errs = append(errs, fieldError("address_id", "invalid_format", "address id is invalid"))
+	}
+
+	switch {
+	case len(obj.Products) == 0:
+		errs = append(errs, fieldError("products", "required", "products are required"))
+	case len(obj.Products) > MaxOrderProducts:
+		errs = append(errs, fieldError("products", "too_long", fmt.Sprintf("products must be at most %d items", MaxOrderProducts)))
+	}
+
+	for i, p := range obj.Products {
+		if p == nil || strings.TrimSpace(p.ProductId) == "" {
+			errs = append(errs, fieldError(fmt.Sprintf("products[%d].product_id", i), "required", "product id is required"))
+			continue
+		}
+		p.ProductId = strings.TrimSpace(p.ProductId)
+
+		if p.Qty < 1 || p.Qty > MaxProductQty {
+			errs = append(errs, fieldError(fmt.Sprintf("products[%d].qty", i), "out_of_range", fmt.Sprintf("qty must be between 1 and %d", MaxProductQty)))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
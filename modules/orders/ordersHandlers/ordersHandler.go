@@ -0,0 +1,98 @@
+package ordersHandlers
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/modules/orders"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersUseCases"
+)
+
+type ordersHandlerErrCode string
+
+const (
+	findOneOrderErr ordersHandlerErrCode = "orders-001"
+	insertOrderErr  ordersHandlerErrCode = "orders-002"
+)
+
+type IOrdersHandler interface {
+	FindOneOrder(c *fiber.Ctx) error
+	AddOrder(c *fiber.Ctx) error
+}
+
+type ordersHandler struct {
+	cfg           config.IConfig
+	ordersUseCase ordersUseCases.IOrdersUseCase
+}
+
+func OrdersHandler(cfg config.IConfig, ordersUseCase ordersUseCases.IOrdersUseCase) IOrdersHandler {
+	return &ordersHandler{
+		cfg:           cfg,
+		ordersUseCase: ordersUseCase,
+	}
+}
+
+// errors caused by the request itself, everything else is a server error
+var requestErrs = map[string]int{
+	"order not found":            fiber.ErrNotFound.Code,
+	"address not found":          fiber.ErrBadRequest.Code,
+	"address is no longer valid": fiber.ErrBadRequest.Code,
+	"product not found":          fiber.ErrBadRequest.Code,
+}
+
+func errStatus(err error) int {
+	if status, ok := requestErrs[err.Error()]; ok {
+		return status
+	}
+	return fiber.ErrInternalServerError.Code
+}
+
+func (h *ordersHandler) FindOneOrder(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	orderId := strings.Trim(c.Params("order_id"), " ")
+
+	result, err := h.ordersUseCase.FindOneOrder(userId, orderId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(findOneOrderErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *ordersHandler) AddOrder(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	req := new(orders.OrderReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertOrderErr),
+			err.Error(),
+		).Res()
+	}
+
+	if errs := req.Validate(); errs != nil {
+		return entities.NewResponse(c).ValidationError(
+			fiber.ErrBadRequest.Code,
+			string(insertOrderErr),
+			errs,
+		).Res()
+	}
+
+	result, err := h.ordersUseCase.InsertOrder(userId, req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(insertOrderErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
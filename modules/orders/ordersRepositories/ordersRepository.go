@@ -0,0 +1,151 @@
+package ordersRepositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pandakn/cafe-beans/modules/addresses"
+	"github.com/pandakn/cafe-beans/modules/orders"
+)
+
+type IOrdersRepository interface {
+	FindOneOrder(userId, orderId string) (*orders.Order, error)
+	InsertOrder(userId string, snapshot *addresses.AddressSnapshot, req *orders.OrderReq) (string, error)
+}
+
+type ordersRepository struct {
+	db *sqlx.DB
+}
+
+func OrdersRepository(db *sqlx.DB) IOrdersRepository {
+	return &ordersRepository{
+		db: db,
+	}
+}
+
+func (r *ordersRepository) FindOneOrder(userId, orderId string) (*orders.Order, error) {
+	query := `
+	SELECT
+		to_json("t")
+	FROM (
+		SELECT
+			"o"."id",
+			"o"."user_id",
+			"o"."contact",
+			"o"."address",
+			"o"."status",
+			(
+				SELECT
+					COALESCE(array_to_json(array_agg("pt")), '[]'::json)
+				FROM (
+					SELECT
+						"po"."id",
+						"po"."qty",
+						"po"."product"
+					FROM "products_orders" "po"
+					WHERE "po"."order_id" = "o"."id"
+				) AS "pt"
+			) AS "products",
+			"o"."created_at",
+			"o"."updated_at"
+		FROM "orders" "o"
+		WHERE "o"."user_id" = $1
+		AND "o"."id" = $2
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, userId, orderId); err != nil {
+		return nil, fmt.Errorf("order not found")
+	}
+
+	order := new(orders.Order)
+	if err := json.Unmarshal(data, order); err != nil {
+		return nil, fmt.Errorf("unmarshal order failed: %v", err)
+	}
+
+	return order, nil
+}
+
+// The products are copied as they are now, later price changes don't
+// reach orders already placed
+func (r *ordersRepository) InsertOrder(userId string, snapshot *addresses.AddressSnapshot, req *orders.OrderReq) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+	INSERT INTO "orders" (
+		"user_id",
+		"contact",
+		"address",
+		"status"
+	)
+	VALUES ($1, $2, $3, $4)
+	RETURNING "id";`
+
+	var orderId string
+	if err := tx.QueryRowxContext(
+		ctx,
+		query,
+		userId,
+		snapshot.Contact,
+		snapshot.Address,
+		orders.StatusWaiting,
+	).Scan(&orderId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("insert order failed: %v", err)
+	}
+
+	query = `
+	INSERT INTO "products_orders" (
+		"order_id",
+		"qty",
+		"product"
+	)
+	SELECT
+		$1,
+		$2,
+		to_jsonb("p")
+	FROM (
+		SELECT
+			"id",
+			"title",
+			"description",
+			"price"
+		FROM "products"
+		WHERE "id" = $3
+	) AS "p";`
+
+	for _, p := range req.Products {
+		result, err := tx.ExecContext(ctx, query, orderId, p.Qty, p.ProductId)
+		if err != nil {
+			tx.Rollback()
+			return "", fmt.Errorf("insert products order failed: %v", err)
+		}
+
+		rowCount, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return "", fmt.Errorf("failed to retrieve affected rows: %v", err)
+		}
+
+		if rowCount == 0 {
+			tx.Rollback()
+			return "", fmt.Errorf("product not found")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return orderId, nil
+}
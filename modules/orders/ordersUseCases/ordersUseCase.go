@@ -0,0 +1,43 @@
+package ordersUseCases
+
+import (
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesUseCases"
+	"github.com/pandakn/cafe-beans/modules/orders"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersRepositories"
+)
+
+type IOrdersUseCase interface {
+	FindOneOrder(userId, orderId string) (*orders.Order, error)
+	InsertOrder(userId string, req *orders.OrderReq) (*orders.Order, error)
+}
+
+type ordersUseCase struct {
+	ordersRepository ordersRepositories.IOrdersRepository
+	addressesUseCase addressesUseCases.IAddressesUseCase
+}
+
+func OrdersUseCase(ordersRepository ordersRepositories.IOrdersRepository, addressesUseCase addressesUseCases.IAddressesUseCase) IOrdersUseCase {
+	return &ordersUseCase{
+		ordersRepository: ordersRepository,
+		addressesUseCase: addressesUseCase,
+	}
+}
+
+func (u *ordersUseCase) FindOneOrder(userId, orderId string) (*orders.Order, error) {
+	return u.ordersRepository.FindOneOrder(userId, orderId)
+}
+
+// The order is delivered to one of the saved addresses of the user
+func (u *ordersUseCase) InsertOrder(userId string, req *orders.OrderReq) (*orders.Order, error) {
+	snapshot, err := u.addressesUseCase.SnapshotAddress(userId, req.AddressId)
+	if err != nil {
+		return nil, err
+	}
+
+	orderId, err := u.ordersRepository.InsertOrder(userId, snapshot, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.ordersRepository.FindOneOrder(userId, orderId)
+}
@@ -0,0 +1,31 @@
+package roles
+
+// Role 1 (customer) and 2 (admin) are used when inserting users,
+// they can be renamed but not deleted
+const (
+	CustomerRoleId = 1
+	AdminRoleId    = 2
+)
+
+type Role struct {
+	Id          int      `json:"id"`
+	Title       string   `json:"title"`
+	Permissions []string `json:"permissions"`
+}
+
+type Permission struct {
+	Id    int    `db:"id" json:"id"`
+	Title string `db:"title" json:"title"`
+}
+
+type RoleReq struct {
+	Title string `json:"title" form:"title"`
+}
+
+type RolePermissionReq struct {
+	Permissions []string `json:"permissions" form:"permissions"`
+}
+
+type UserRoleReq struct {
+	RoleId int `json:"role_id" form:"role_id"`
+}
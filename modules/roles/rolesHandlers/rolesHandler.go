@@ -0,0 +1,297 @@
+package rolesHandlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesUseCases"
+)
+
+type rolesHandlerErrCode string
+
+const (
+	findRoleErr             rolesHandlerErrCode = "roles-001"
+	findPermissionErr       rolesHandlerErrCode = "roles-002"
+	insertRoleErr           rolesHandlerErrCode = "roles-003"
+	updateRoleErr           rolesHandlerErrCode = "roles-004"
+	removeRoleErr           rolesHandlerErrCode = "roles-005"
+	updateRolePermissionErr rolesHandlerErrCode = "roles-006"
+	updateUserRoleErr       rolesHandlerErrCode = "roles-007"
+)
+
+type IRolesHandler interface {
+	FindRole(c *fiber.Ctx) error
+	FindPermission(c *fiber.Ctx) error
+	AddRole(c *fiber.Ctx) error
+	UpdateRole(c *fiber.Ctx) error
+	RemoveRole(c *fiber.Ctx) error
+	UpdateRolePermission(c *fiber.Ctx) error
+	UpdateUserRole(c *fiber.Ctx) error
+}
+
+type rolesHandler struct {
+	cfg          config.IConfig
+	rolesUseCase rolesUseCases.IRolesUseCase
+	auditUseCase auditUseCases.IAuditUseCase
+}
+
+func RolesHandler(cfg config.IConfig, rolesUseCase rolesUseCases.IRolesUseCase, auditUseCase auditUseCases.IAuditUseCase) IRolesHandler {
+	return &rolesHandler{
+		cfg:          cfg,
+		rolesUseCase: rolesUseCase,
+		auditUseCase: auditUseCase,
+	}
+}
+
+// errors caused by the request itself, everything else is a server error
+var badRequestErrs = map[string]bool{
+	"role not found":               true,
+	"user not found":               true,
+	"title has been used":          true,
+	"role is reserved":             true,
+	"role is assigned to users":    true,
+	"cannot remove the last admin": true,
+}
+
+func errStatus(err error) int {
+	if badRequestErrs[err.Error()] || strings.HasPrefix(err.Error(), "permission ") {
+		return fiber.ErrBadRequest.Code
+	}
+	return fiber.ErrInternalServerError.Code
+}
+
+func roleIdParam(c *fiber.Ctx) (int, bool) {
+	roleId, err := strconv.Atoi(strings.Trim(c.Params("role_id"), " "))
+	if err != nil || roleId <= 0 {
+		return 0, false
+	}
+	return roleId, true
+}
+
+func (h *rolesHandler) FindRole(c *fiber.Ctx) error {
+	result, err := h.rolesUseCase.FindRole()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *rolesHandler) FindPermission(c *fiber.Ctx) error {
+	permissions, err := h.rolesUseCase.FindPermission()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findPermissionErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, permissions).Res()
+}
+
+func (h *rolesHandler) AddRole(c *fiber.Ctx) error {
+	req := new(roles.RoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertRoleErr),
+			"title is required",
+		).Res()
+	}
+
+	role, err := h.rolesUseCase.InsertRole(req)
+
+	event := audit.NewEvent(c, audit.ActionRoleCreated).WithError(err).With("title", req.Title)
+	if err == nil {
+		event.WithTarget(strconv.Itoa(role.Id))
+	}
+	h.auditUseCase.Record(event)
+
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(insertRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, role).Res()
+}
+
+func (h *rolesHandler) UpdateRole(c *fiber.Ctx) error {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRoleErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	req := new(roles.RoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRoleErr),
+			"title is required",
+		).Res()
+	}
+
+	role, err := h.rolesUseCase.UpdateRole(roleId, req)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionRoleUpdated).
+		WithTarget(strconv.Itoa(roleId)).
+		WithError(err).
+		With("title", req.Title))
+
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(updateRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, role).Res()
+}
+
+func (h *rolesHandler) RemoveRole(c *fiber.Ctx) error {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(removeRoleErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	err := h.rolesUseCase.DeleteRole(roleId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionRoleDeleted).WithTarget(strconv.Itoa(roleId)).WithError(err))
+
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(removeRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			RoleId int `json:"role_id"`
+		}{
+			RoleId: roleId,
+		},
+	).Res()
+}
+
+func (h *rolesHandler) UpdateRolePermission(c *fiber.Ctx) error {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRolePermissionErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	req := new(roles.RolePermissionReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRolePermissionErr),
+			err.Error(),
+		).Res()
+	}
+
+	role, err := h.rolesUseCase.UpdateRolePermission(roleId, req)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionRolePermissions).
+		WithTarget(strconv.Itoa(roleId)).
+		WithError(err).
+		With("permissions", req.Permissions))
+
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(updateRolePermissionErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, role).Res()
+}
+
+func (h *rolesHandler) UpdateUserRole(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	req := new(roles.UserRoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.RoleId <= 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserRoleErr),
+			"role_id must more than 0",
+		).Res()
+	}
+
+	err := h.rolesUseCase.UpdateUserRole(userId, req)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionUserRoleChanged).
+		WithTarget(userId).
+		WithError(err).
+		With("role_id", req.RoleId))
+
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			errStatus(err),
+			string(updateUserRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			UserId string `json:"user_id"`
+			RoleId int    `json:"role_id"`
+		}{
+			UserId: userId,
+			RoleId: req.RoleId,
+		},
+	).Res()
+}
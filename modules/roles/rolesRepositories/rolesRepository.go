@@ -0,0 +1,317 @@
+package rolesRepositories
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pandakn/cafe-beans/modules/roles"
+)
+
+type IRolesRepository interface {
+	FindRole() ([]*roles.Role, error)
+	FindOneRole(roleId int) (*roles.Role, error)
+	FindPermission() ([]*roles.Permission, error)
+	InsertRole(req *roles.RoleReq) (int, error)
+	UpdateRole(roleId int, req *roles.RoleReq) error
+	DeleteRole(roleId int) error
+	UpdateRolePermission(roleId int, req *roles.RolePermissionReq) error
+	UpdateUserRole(userId string, roleId int) error
+}
+
+type rolesRepository struct {
+	db *sqlx.DB
+}
+
+func RolesRepository(db *sqlx.DB) IRolesRepository {
+	return &rolesRepository{
+		db: db,
+	}
+}
+
+const roleQuery = `
+	SELECT
+		"r"."id",
+		"r"."title",
+		(
+			SELECT
+				COALESCE(array_to_json(array_agg("p"."title" ORDER BY "p"."title")), '[]'::json)
+			FROM "roles_permissions" "rp"
+			JOIN "permissions" "p" ON "p"."id" = "rp"."permission_id"
+			WHERE "rp"."role_id" = "r"."id"
+		) AS "permissions"
+	FROM "roles" "r"`
+
+func (r *rolesRepository) FindRole() ([]*roles.Role, error) {
+	query := `
+	SELECT
+		COALESCE(array_to_json(array_agg("t" ORDER BY "t"."id")), '[]'::json)
+	FROM (` + roleQuery + `
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query); err != nil {
+		return nil, fmt.Errorf("select roles failed: %v", err)
+	}
+
+	result := make([]*roles.Role, 0)
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal roles failed: %v", err)
+	}
+
+	return result, nil
+}
+
+func (r *rolesRepository) FindOneRole(roleId int) (*roles.Role, error) {
+	query := `
+	SELECT
+		to_json("t")
+	FROM (` + roleQuery + `
+		WHERE "r"."id" = $1
+	) AS "t";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, roleId); err != nil {
+		return nil, fmt.Errorf("role not found")
+	}
+
+	role := new(roles.Role)
+	if err := json.Unmarshal(data, &role); err != nil {
+		return nil, fmt.Errorf("unmarshal role failed: %v", err)
+	}
+
+	return role, nil
+}
+
+func (r *rolesRepository) FindPermission() ([]*roles.Permission, error) {
+	query := `
+	SELECT
+		"id",
+		"title"
+	FROM "permissions"
+	ORDER BY "title";`
+
+	permissions := make([]*roles.Permission, 0)
+	if err := r.db.Select(&permissions, query); err != nil {
+		return nil, fmt.Errorf("select permissions failed: %v", err)
+	}
+
+	return permissions, nil
+}
+
+func (r *rolesRepository) InsertRole(req *roles.RoleReq) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	query := `
+	INSERT INTO "roles" (
+		"title"
+	)
+	VALUES ($1)
+	RETURNING "id";`
+
+	var roleId int
+	if err := r.db.QueryRowContext(ctx, query, req.Title).Scan(&roleId); err != nil {
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			return 0, fmt.Errorf("title has been used")
+		}
+		return 0, fmt.Errorf("insert role failed: %v", err)
+	}
+
+	return roleId, nil
+}
+
+func (r *rolesRepository) UpdateRole(roleId int, req *roles.RoleReq) error {
+	query := `
+	UPDATE "roles" SET
+		"title" = $1
+	WHERE "id" = $2;`
+
+	result, err := r.db.ExecContext(context.Background(), query, req.Title, roleId)
+	if err != nil {
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			return fmt.Errorf("title has been used")
+		}
+		return fmt.Errorf("update role failed: %v", err)
+	}
+
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve affected rows: %v", err)
+	}
+
+	if rowCount == 0 {
+		return fmt.Errorf("role not found")
+	}
+
+	return nil
+}
+
+// "users"."role_id" restricts deletes, so a role can't be deleted while
+// anyone has it, including users assigned while the delete runs
+func (r *rolesRepository) DeleteRole(roleId int) error {
+	result, err := r.db.ExecContext(context.Background(), `DELETE FROM "roles" WHERE "id" = $1;`, roleId)
+	if err != nil {
+		if strings.Contains(err.Error(), "SQLSTATE 23503") {
+			return fmt.Errorf("role is assigned to users")
+		}
+		return fmt.Errorf("delete role failed: %v", err)
+	}
+
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve affected rows: %v", err)
+	}
+
+	if rowCount == 0 {
+		return fmt.Errorf("role not found")
+	}
+
+	return nil
+}
+
+// Replace every permission of a role
+func (r *rolesRepository) UpdateRolePermission(roleId int, req *roles.RolePermissionReq) error {
+	ctx := context.Background()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM "roles" WHERE "id" = $1);`, roleId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update role permissions failed: %v", err)
+	}
+
+	if !exists {
+		tx.Rollback()
+		return fmt.Errorf("role not found")
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "roles_permissions" WHERE "role_id" = $1;`, roleId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update role permissions failed: %v", err)
+	}
+
+	query := `
+	INSERT INTO "roles_permissions" (
+		"role_id",
+		"permission_id"
+	)
+	SELECT $1, "id" FROM "permissions" WHERE "title" = $2
+	ON CONFLICT DO NOTHING;`
+
+	for _, permission := range req.Permissions {
+		result, err := tx.ExecContext(ctx, query, roleId, permission)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("update role permissions failed: %v", err)
+		}
+
+		// nothing inserted means the permission doesn't exist
+		if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+			tx.Rollback()
+			return fmt.Errorf("permission %s is invalid", permission)
+		}
+	}
+
+	if err := hasAdmin(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (r *rolesRepository) UpdateUserRole(userId string, roleId int) error {
+	ctx := context.Background()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE "users" SET "role_id" = $1 WHERE "id" = $2;`, roleId, userId)
+	if err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "SQLSTATE 23503") {
+			return fmt.Errorf("role not found")
+		}
+		return fmt.Errorf("update user role failed: %v", err)
+	}
+
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to retrieve affected rows: %v", err)
+	}
+
+	if rowCount == 0 {
+		tx.Rollback()
+		return fmt.Errorf("user not found")
+	}
+
+	if err := hasAdmin(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// A change must always leave an admin
+func hasAdmin(ctx context.Context, tx *sqlx.Tx) error {
+	exists, err := AdminExists(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("cannot remove the last admin")
+	}
+
+	return nil
+}
+
+// An admin is an active user who can still manage roles, the bootstrap and
+// the last admin safeguard both ask here so they can't disagree.
+// Disabled and deleted admins can't sign in, so they don't count.
+// The lock serializes changes so two admins can't demote each other at once.
+func AdminExists(ctx context.Context, tx *sqlx.Tx) (bool, error) {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('roles_admin'));`); err != nil {
+		return false, fmt.Errorf("check admin failed: %v", err)
+	}
+
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM "users" "u"
+		JOIN "roles_permissions" "rp" ON "rp"."role_id" = "u"."role_id"
+		JOIN "permissions" "p" ON "p"."id" = "rp"."permission_id"
+		WHERE "p"."title" = 'roles:manage'
+		AND "u"."disabled_at" IS NULL
+		AND "u"."deleted_at" IS NULL
+	);`
+
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, query); err != nil {
+		return false, fmt.Errorf("check admin failed: %v", err)
+	}
+
+	return exists, nil
+}
@@ -0,0 +1,99 @@
+package rolesUseCases
+
+import (
+	"fmt"
+
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+)
+
+type IRolesUseCase interface {
+	FindRole() ([]*roles.Role, error)
+	FindPermission() ([]*roles.Permission, error)
+	InsertRole(req *roles.RoleReq) (*roles.Role, error)
+	UpdateRole(roleId int, req *roles.RoleReq) (*roles.Role, error)
+	DeleteRole(roleId int) error
+	UpdateRolePermission(roleId int, req *roles.RolePermissionReq) (*roles.Role, error)
+	UpdateUserRole(userId string, req *roles.UserRoleReq) error
+}
+
+type rolesUseCase struct {
+	rolesRepository rolesRepositories.IRolesRepository
+	cache           cafeBeansCache.ICafeBeansCache
+}
+
+func RolesUseCase(rolesRepository rolesRepositories.IRolesRepository, cache cafeBeansCache.ICafeBeansCache) IRolesUseCase {
+	return &rolesUseCase{
+		rolesRepository: rolesRepository,
+		cache:           cache,
+	}
+}
+
+func (u *rolesUseCase) FindRole() ([]*roles.Role, error) {
+	result, err := u.rolesRepository.FindRole()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (u *rolesUseCase) FindPermission() ([]*roles.Permission, error) {
+	permissions, err := u.rolesRepository.FindPermission()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func (u *rolesUseCase) InsertRole(req *roles.RoleReq) (*roles.Role, error) {
+	roleId, err := u.rolesRepository.InsertRole(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.rolesRepository.FindOneRole(roleId)
+}
+
+func (u *rolesUseCase) UpdateRole(roleId int, req *roles.RoleReq) (*roles.Role, error) {
+	if err := u.rolesRepository.UpdateRole(roleId, req); err != nil {
+		return nil, err
+	}
+
+	return u.rolesRepository.FindOneRole(roleId)
+}
+
+func (u *rolesUseCase) DeleteRole(roleId int) error {
+	if roleId == roles.CustomerRoleId || roleId == roles.AdminRoleId {
+		return fmt.Errorf("role is reserved")
+	}
+
+	if err := u.rolesRepository.DeleteRole(roleId); err != nil {
+		return err
+	}
+	u.cache.Delete(cafeBeansCache.PermissionKey(roleId))
+
+	return nil
+}
+
+func (u *rolesUseCase) UpdateRolePermission(roleId int, req *roles.RolePermissionReq) (*roles.Role, error) {
+	if err := u.rolesRepository.UpdateRolePermission(roleId, req); err != nil {
+		return nil, err
+	}
+	u.cache.Delete(cafeBeansCache.PermissionKey(roleId))
+
+	return u.rolesRepository.FindOneRole(roleId)
+}
+
+// The middleware reads the role of a session from the db,
+// so dropping the cached sessions applies the change right away
+func (u *rolesUseCase) UpdateUserRole(userId string, req *roles.UserRoleReq) error {
+	if err := u.rolesRepository.UpdateUserRole(userId, req.RoleId); err != nil {
+		return err
+	}
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(userId))
+
+	return nil
+}
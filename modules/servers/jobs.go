@@ -0,0 +1,39 @@
+package servers
+
+import (
+	"log"
+	"time"
+
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/modules/users/usersUseCases"
+)
+
+// Jobs run on every instance, each run has to be safe alongside the others
+func (s *server) startJobs() {
+	sessions := middlewareUseCases.MiddlewareUseCase(s.cfg, middlewareRepositories.MiddlewareRepository(s.db), s.cache)
+	accounts := usersUseCases.UserUseCase(s.cfg, usersRepositories.UserRepository(s.db), s.cache, s.mailer, s.oidc, s.storage, s.audit)
+
+	go runEvery("delete expired sessions", s.cfg.Session().CleanupInterval(), sessions.DeleteExpiredSessions)
+	go runEvery("prune audit events", 24*time.Hour, s.audit.Prune)
+	go runEvery("prune login attempts", s.cfg.Login().Lockout(), accounts.PruneLoginAttempts)
+}
+
+// Run the job now and then once every interval,
+// it returns how many rows it has removed
+func runEvery(name string, interval time.Duration, job func() (int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := job()
+		switch {
+		case err != nil:
+			log.Printf("%s failed: %v", name, err)
+		case count != 0:
+			log.Printf("%s: %d removed", name, count)
+		}
+		<-ticker.C
+	}
+}
@@ -2,22 +2,40 @@ package servers
 
 import (
 	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesHandlers"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesRepositories"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesUseCases"
+	"github.com/pandakn/cafe-beans/modules/appInfo"
 	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoHandlers"
 	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoRepositories"
 	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoUseCases"
+	"github.com/pandakn/cafe-beans/modules/audit/auditHandlers"
+	"github.com/pandakn/cafe-beans/modules/middleware"
 	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
 	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
 	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
 	"github.com/pandakn/cafe-beans/modules/monitor/monitorHandlers"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersHandlers"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersRepositories"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersUseCases"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesHandlers"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesUseCases"
 	"github.com/pandakn/cafe-beans/modules/users/usersHandlers"
 	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
 	"github.com/pandakn/cafe-beans/modules/users/usersUseCases"
+	"github.com/pandakn/cafe-beans/modules/wellKnown/wellKnownHandlers"
 )
 
 type IModuleFactory interface {
 	MonitorModule()
 	UsersModule()
 	AppInfoModule()
+	RolesModule()
+	WellKnownModule()
+	AddressesModule()
+	OrdersModule()
+	AuditModule()
 }
 
 type moduleFactory struct {
@@ -36,50 +54,169 @@ func InitModule(r fiber.Router, s *server, mid middlewareHandlers.IMiddlewareHan
 
 func InitMiddleware(s *server) middlewareHandlers.IMiddlewareHandler {
 	repository := middlewareRepositories.MiddlewareRepository(s.db)
-	useCase := middlewareUseCases.MiddlewareUseCase(repository)
-	return middlewareHandlers.MiddlewareHandler(s.cfg, useCase)
+	useCase := middlewareUseCases.MiddlewareUseCase(s.cfg, repository, s.cache)
+	return middlewareHandlers.MiddlewareHandler(s.cfg, useCase, s.audit)
 }
 
 func (m *moduleFactory) MonitorModule() {
-	handler := monitorHandlers.MonitorHandler(m.s.cfg)
+	handler := monitorHandlers.MonitorHandler(m.s.cfg, m.s.cache)
 
 	m.r.Get("/", handler.HealthCheck)
+	m.r.Get("/metrics/cache", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionMetricsRead), handler.CacheStats)
 }
 
 func (m *moduleFactory) UsersModule() {
 	repository := usersRepositories.UserRepository(m.s.db)
-	useCase := usersUseCases.UserUseCase(m.s.cfg, repository)
-	handler := usersHandlers.UserHandler(m.s.cfg, useCase)
+	useCase := usersUseCases.UserUseCase(m.s.cfg, repository, m.s.cache, m.s.mailer, m.s.oidc, m.s.storage, m.s.audit)
+	handler := usersHandlers.UserHandler(m.s.cfg, useCase, m.s.validator, m.s.audit)
 
 	router := m.r.Group("/users")
 
-	router.Post("/signup", m.mid.ApiKeyAuth(), handler.SignUpCustomer)
-	router.Post("/signin", m.mid.ApiKeyAuth(), handler.SingIn)
-	router.Post("/signout", m.mid.ApiKeyAuth(), handler.SignOut)
-	router.Post("/refresh", m.mid.ApiKeyAuth(), handler.RefreshPassport)
+	router.Post("/signup", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.SignUpCustomer)
+	router.Post("/signin", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.SingIn)
+	router.Post("/signout", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.SignOut)
+	router.Post("/refresh", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.RefreshPassport)
+
+	// second step of signin, enroll and activate are for admins
+	// who have to set up 2fa before their first signin
+	router.Post("/signin/2fa", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.VerifyMfa)
+	router.Post("/signin/2fa/enroll", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.EnrollTotp)
+	router.Post("/signin/2fa/activate", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.ActivateTotp)
+
+	// accounts locked by failed signins are unlocked with the emailed token
+	router.Post("/unlock/request", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.RequestUnlock)
+	router.Post("/unlock", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.Unlock)
+
+	// passwordless, the emailed token is exchanged for a passport
+	router.Post("/magic-link", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.RequestMagicLink)
+	router.Post("/magic-link/signin", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.MagicLinkSignIn)
+
+	// a new email is switched to once the token sent to it comes back
+	router.Post("/email/confirm", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.ConfirmEmailChange)
+
+	// the token emailed by /:user_id/deletion
+	router.Post("/deletion/confirm", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.ConfirmDeletion)
+
+	// openid connect, the provider redirects back to the client
+	// which posts the code and state to the callback
+	router.Get("/oidc/:provider/authorize", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.OidcAuthorize)
+	router.Post("/oidc/:provider/callback", m.mid.ApiKeyAuth(appInfo.ScopeUsersAuth), handler.OidcCallback)
 
 	// admin
-	router.Post("/signup-admin", m.mid.JwtAuth(), m.mid.Authorize(2), handler.SignUpAdmin)
+	// the admin token comes from /admin/secret
+	router.Post("/signup-admin", m.mid.AdminTokenAuth(), handler.SignUpAdmin)
+	// only works on a database without any admin, needs X-Bootstrap-Token
+	router.Post("/bootstrap-admin", handler.BootstrapAdmin)
+
+	router.Get("/admin/secret", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionAdminsCreate), handler.GenerateAdminToken)
+
+	// user management, disabling or signing out a user revokes its sessions
+	accounts := router.Group("/admin/accounts", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionUsersManage))
 
-	// role_id = 2 is admin
-	// only admin can access this endpoint
-	router.Get("/admin/secret", m.mid.JwtAuth(), m.mid.Authorize(2), handler.GenerateAdminToken)
+	accounts.Get("/", handler.FindUsers)
+	accounts.Get("/:user_id", handler.GetUserAccount)
+	accounts.Post("/:user_id/disable", handler.DisableUser)
+	accounts.Post("/:user_id/enable", handler.EnableUser)
+	accounts.Delete("/:user_id/sessions", handler.ForceSignOut)
+	// a short lived access token on behalf of the user, every one is logged
+	accounts.Post("/:user_id/impersonate", m.mid.RequirePermission(middleware.PermissionUsersImpersonate), handler.Impersonate)
 
 	// user
+	// credentials, the avatar and the data export are off limits
+	// to an admin impersonating the user
 	router.Get("/:user_id", m.mid.JwtAuth(), m.mid.ParamsCheck(), handler.GetUserProfile)
+	router.Patch("/:user_id", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.UpdateUserProfile)
+	router.Put("/:user_id/avatar", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.UploadAvatar)
+	router.Delete("/:user_id/avatar", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.DeleteAvatar)
+	router.Get("/:user_id/export", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.ExportUser)
+	router.Post("/:user_id/deletion", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.RequestDeletion)
+	router.Post("/:user_id/2fa/enroll", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.EnrollTotp)
+	router.Post("/:user_id/2fa/activate", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.ActivateTotp)
+	router.Delete("/:user_id/2fa", m.mid.JwtAuth(), m.mid.DenyImpersonation(), m.mid.ParamsCheck(), handler.DisableTotp)
 }
 
 func (m *moduleFactory) AppInfoModule() {
 	repository := appInfoRepositories.AppInfoRepository(m.s.db)
 	useCase := appInfoUseCases.AppInfoUseCase(repository)
-	handler := appInfoHandlers.AppInfoHandler(m.s.cfg, useCase)
+	handler := appInfoHandlers.AppInfoHandler(m.s.cfg, useCase, m.s.audit)
 
 	router := m.r.Group("/app-info")
 
-	router.Get("/api-key", m.mid.JwtAuth(), m.mid.Authorize(2), handler.GenerateApiKey)
+	// api keys
+	router.Get("/api-keys", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionApiKeysManage), handler.FindApiKey)
+	router.Post("/api-keys", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionApiKeysManage), handler.GenerateApiKey)
+	router.Delete("/:api_key_id/api-keys", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionApiKeysManage), handler.RevokeApiKey)
 
 	// categories
-	router.Get("/categories", m.mid.ApiKeyAuth(), handler.FindCategory)
-	router.Post("/categories", m.mid.JwtAuth(), m.mid.Authorize(2), handler.AddCategory)
-	router.Delete("/:category_id/categories", m.mid.JwtAuth(), m.mid.Authorize(2), handler.RemoveCategory)
+	router.Get("/categories", m.mid.ApiKeyAuth(appInfo.ScopeCategoriesRead), handler.FindCategory)
+	router.Post("/categories", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionCategoriesManage), handler.AddCategory)
+	router.Delete("/:category_id/categories", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionCategoriesManage), handler.RemoveCategory)
+}
+
+func (m *moduleFactory) RolesModule() {
+	repository := rolesRepositories.RolesRepository(m.s.db)
+	useCase := rolesUseCases.RolesUseCase(repository, m.s.cache)
+	handler := rolesHandlers.RolesHandler(m.s.cfg, useCase, m.s.audit)
+
+	router := m.r.Group("/roles", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionRolesManage))
+
+	router.Get("/", handler.FindRole)
+	router.Post("/", handler.AddRole)
+	router.Get("/permissions", handler.FindPermission)
+	router.Patch("/:role_id", handler.UpdateRole)
+	router.Delete("/:role_id", handler.RemoveRole)
+	router.Put("/:role_id/permissions", handler.UpdateRolePermission)
+
+	// change the role of a user
+	router.Patch("/users/:user_id", handler.UpdateUserRole)
+}
+
+func (m *moduleFactory) AddressesModule() {
+	repository := addressesRepositories.AddressesRepository(m.s.db)
+	useCase := addressesUseCases.AddressesUseCase(repository, m.s.addresses, m.s.validator)
+	handler := addressesHandlers.AddressesHandler(m.s.cfg, useCase, m.s.validator)
+
+	// sub-districts for autocomplete, served from the built-in dataset
+	m.r.Get("/addresses/lookup", m.mid.JwtAuth(), handler.LookupAddress)
+
+	// the address book of the signed in user
+	router := m.r.Group("/users/:user_id/addresses", m.mid.JwtAuth(), m.mid.ParamsCheck())
+
+	router.Get("/", handler.FindAddress)
+	router.Post("/", handler.AddAddress)
+	router.Get("/:address_id", handler.FindOneAddress)
+	router.Put("/:address_id", handler.UpdateAddress)
+	router.Post("/:address_id/default", handler.SetDefaultAddress)
+	router.Delete("/:address_id", handler.RemoveAddress)
+}
+
+func (m *moduleFactory) OrdersModule() {
+	addressesUseCase := addressesUseCases.AddressesUseCase(addressesRepositories.AddressesRepository(m.s.db), m.s.addresses, m.s.validator)
+	repository := ordersRepositories.OrdersRepository(m.s.db)
+	useCase := ordersUseCases.OrdersUseCase(repository, addressesUseCase)
+	handler := ordersHandlers.OrdersHandler(m.s.cfg, useCase)
+
+	// orders of the signed in user, delivered to one of its saved addresses,
+	// an admin impersonating the user can look but not order
+	router := m.r.Group("/users/:user_id/orders", m.mid.JwtAuth(), m.mid.ParamsCheck())
+
+	router.Post("/", m.mid.DenyImpersonation(), handler.AddOrder)
+	router.Get("/:order_id", handler.FindOneOrder)
+}
+
+func (m *moduleFactory) AuditModule() {
+	handler := auditHandlers.AuditHandler(m.s.cfg, m.s.audit)
+
+	router := m.r.Group("/audit", m.mid.JwtAuth(), m.mid.RequirePermission(middleware.PermissionAuditRead))
+
+	// filtered by actor_id, target_id, action and a from/to range, the latest first
+	router.Get("/events", handler.FindEvents)
+}
+
+func (m *moduleFactory) WellKnownModule() {
+	handler := wellKnownHandlers.WellKnownHandler(m.s.cfg)
+
+	router := m.r.Group("/.well-known")
+
+	router.Get("/jwks.json", handler.Jwks)
 }
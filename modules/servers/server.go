@@ -5,10 +5,19 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit/auditRepositories"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansMailer"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansOidc"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansStorage"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
 )
 
 type IServer interface {
@@ -16,15 +25,41 @@ type IServer interface {
 }
 
 type server struct {
-	app *fiber.App
-	cfg config.IConfig
-	db  *sqlx.DB
+	app       *fiber.App
+	cfg       config.IConfig
+	db        *sqlx.DB
+	cache     cafeBeansCache.ICafeBeansCache
+	mailer    cafeBeansMailer.IMailer
+	oidc      map[string]cafeBeansOidc.IClient
+	validator cafeBeansValidator.IValidator
+	storage   cafeBeansStorage.IStorage
+	addresses cafeBeansAddress.IAddressBook
+	// shared by every module recording what users and admins do
+	audit auditUseCases.IAuditUseCase
 }
 
 func NewServer(cfg config.IConfig, db *sqlx.DB) IServer {
+	addresses, err := cafeBeansAddress.NewAddressBook()
+	if err != nil {
+		log.Fatalf("load addresses failed: %v", err)
+	}
+
+	validator, err := cafeBeansValidator.NewValidator(cfg.Policy(), addresses)
+	if err != nil {
+		log.Fatalf("create validator failed: %v", err)
+	}
+
 	return &server{
 		cfg: cfg,
 		db:  db,
+		// swap the memory store for a shared one to share the cache between instances
+		cache:     cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl()),
+		mailer:    cafeBeansMailer.NewMailer(cfg.Mail()),
+		oidc:      newOidcClients(cfg.Oidc()),
+		validator: validator,
+		storage:   cafeBeansStorage.NewLocalStorage(cfg.Storage().Dir(), cfg.Storage().PublicUrl()),
+		addresses: addresses,
+		audit:     auditUseCases.AuditUseCase(cfg, auditRepositories.AuditRepository(db)),
 		app: fiber.New(fiber.Config{
 			AppName:      cfg.App().Name(),
 			BodyLimit:    cfg.App().BodyLimit(),
@@ -36,6 +71,21 @@ func NewServer(cfg config.IConfig, db *sqlx.DB) IServer {
 	}
 }
 
+func newOidcClients(cfg config.IOidcConfig) map[string]cafeBeansOidc.IClient {
+	clients := make(map[string]cafeBeansOidc.IClient)
+	for name, p := range cfg.Providers() {
+		clients[name] = cafeBeansOidc.NewClient(&cafeBeansOidc.Provider{
+			Name:         name,
+			Issuer:       p.Issuer,
+			ClientId:     p.ClientId,
+			ClientSecret: p.ClientSecret,
+			RedirectUrl:  p.RedirectUrl,
+			Scopes:       p.Scopes,
+		})
+	}
+	return clients
+}
+
 func (s *server) Start() {
 	// middleware
 	middleware := InitMiddleware(s)
@@ -49,6 +99,20 @@ func (s *server) Start() {
 	modules.MonitorModule()
 	modules.UsersModule()
 	modules.AppInfoModule()
+	modules.RolesModule()
+	modules.AddressesModule()
+	modules.OrdersModule()
+	modules.AuditModule()
+
+	// well-known endpoints live at the root, not under /v1
+	InitModule(s.app, s, middleware).WellKnownModule()
+
+	// uploaded files, unless they are served from elsewhere
+	if strings.HasPrefix(s.cfg.Storage().PublicUrl(), "/") {
+		s.app.Static(s.cfg.Storage().PublicUrl(), s.cfg.Storage().Dir())
+	}
+
+	s.startJobs()
 
 	// RouterCheck
 	s.app.Use(middleware.RouterCheck())
@@ -7,12 +7,15 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
 	"github.com/pandakn/cafe-beans/modules/users"
 )
 
 type IInsertUser interface {
 	Customer() (IInsertUser, error)
 	Admin() (IInsertUser, error)
+	FirstAdmin() (IInsertUser, error)
 	Result() (*users.UserPassport, error)
 }
 
@@ -68,14 +71,14 @@ func (f *userReq) Customer() (IInsertUser, error) {
 		"role_id"
 	)
 	VALUES 
-		($1, $2, $3, 1)
+		($1, $2, $3, $4)
 	RETURNING "id";`
 	// Scan cuz query return "id"
-	if err := f.db.QueryRowContext(ctx, query, f.req.Email, f.req.Password, f.req.Username).Scan(&f.id); err != nil {
+	if err := f.db.QueryRowContext(ctx, query, f.req.Email, f.req.Password, f.req.Username, roles.CustomerRoleId).Scan(&f.id); err != nil {
 		switch err.Error() {
-		case "ERROR: duplicate key value violates unique constraint \"users_username_key\" (SQLSTATE 23505)":
+		case "ERROR: duplicate key value violates unique constraint \"users_username_lower_key\" (SQLSTATE 23505)":
 			return nil, fmt.Errorf("username has been used")
-		case "ERROR: duplicate key value violates unique constraint \"users_email_key\" (SQLSTATE 23505)":
+		case "ERROR: duplicate key value violates unique constraint \"users_email_lower_key\" (SQLSTATE 23505)":
 			return nil, fmt.Errorf("email has been used")
 		default:
 			return nil, fmt.Errorf("insert user failed: %v", err)
@@ -97,14 +100,14 @@ func (f *userReq) Admin() (IInsertUser, error) {
 		"role_id"
 	)
 	VALUES 
-		($1, $2, $3, 2)
+		($1, $2, $3, $4)
 	RETURNING "id";`
 	// Scan cuz query return "id"
-	if err := f.db.QueryRowContext(ctx, query, f.req.Email, f.req.Password, f.req.Username).Scan(&f.id); err != nil {
+	if err := f.db.QueryRowContext(ctx, query, f.req.Email, f.req.Password, f.req.Username, roles.AdminRoleId).Scan(&f.id); err != nil {
 		switch err.Error() {
-		case "ERROR: duplicate key value violates unique constraint \"users_username_key\" (SQLSTATE 23505)":
+		case "ERROR: duplicate key value violates unique constraint \"users_username_lower_key\" (SQLSTATE 23505)":
 			return nil, fmt.Errorf("username has been used")
-		case "ERROR: duplicate key value violates unique constraint \"users_email_key\" (SQLSTATE 23505)":
+		case "ERROR: duplicate key value violates unique constraint \"users_email_lower_key\" (SQLSTATE 23505)":
 			return nil, fmt.Errorf("email has been used")
 		default:
 			return nil, fmt.Errorf("insert user failed: %v", err)
@@ -114,6 +117,58 @@ func (f *userReq) Admin() (IInsertUser, error) {
 	return f, nil
 }
 
+// Insert an admin only when there is no admin yet, the lock taken by
+// AdminExists keeps two concurrent bootstraps from both succeeding
+func (f *userReq) FirstAdmin() (IInsertUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tx, err := f.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hasAdmin, err := rolesRepositories.AdminExists(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if hasAdmin {
+		tx.Rollback()
+		return nil, fmt.Errorf("admin already exists")
+	}
+
+	query := `
+	INSERT INTO "users" (
+		"email",
+		"password",
+		"username",
+		"role_id"
+	)
+	VALUES 
+		($1, $2, $3, $4)
+	RETURNING "id";`
+	if err := tx.QueryRowContext(ctx, query, f.req.Email, f.req.Password, f.req.Username, roles.AdminRoleId).Scan(&f.id); err != nil {
+		tx.Rollback()
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"users_username_lower_key\" (SQLSTATE 23505)":
+			return nil, fmt.Errorf("username has been used")
+		case "ERROR: duplicate key value violates unique constraint \"users_email_lower_key\" (SQLSTATE 23505)":
+			return nil, fmt.Errorf("email has been used")
+		default:
+			return nil, fmt.Errorf("insert user failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func (f *userReq) Result() (*users.UserPassport, error) {
 	query := `
 	SELECT
@@ -126,7 +181,8 @@ func (f *userReq) Result() (*users.UserPassport, error) {
 			"u"."id",
 			"u"."email",
 			"u"."username",
-			"u"."role_id"
+			"u"."role_id",
+			"u"."avatar_url"
 		FROM "users" "u"
 		WHERE "u"."id" = $1
 	) AS "t"`
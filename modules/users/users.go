@@ -1,17 +1,19 @@
 package users
 
 import (
-	"fmt"
-	"regexp"
+	"errors"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansPassword"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
 )
 
 type User struct {
-	Id       string `db:"id" json:"id"`
-	Email    string `db:"email" json:"email"`
-	Username string `db:"username" json:"username"`
-	RoleId   int    `db:"role_id" json:"role_id"`
+	Id        string `db:"id" json:"id"`
+	Email     string `db:"email" json:"email"`
+	Username  string `db:"username" json:"username"`
+	RoleId    int    `db:"role_id" json:"role_id"`
+	AvatarUrl string `db:"avatar_url" json:"avatar_url"`
 }
 
 type UserRegisterReq struct {
@@ -20,41 +22,101 @@ type UserRegisterReq struct {
 	Username string `db:"username" json:"username" form:"username"`
 }
 
+// Identifier is either the email or the username, email is still accepted
 type UserCredential struct {
-	Email    string `db:"email" json:"email" form:"email"`
-	Password string `db:"password" json:"password" form:"password"`
+	Identifier string `json:"identifier" form:"identifier"`
+	Email      string `db:"email" json:"email" form:"email"`
+	Password   string `db:"password" json:"password" form:"password"`
+	Ip         string `json:"-" form:"-"`
+}
+
+func (obj *UserCredential) Login() string {
+	if obj.Identifier != "" {
+		return obj.Identifier
+	}
+	return obj.Email
 }
 
 type UserCredentialCheck struct {
-	Id       string `db:"id"`
-	Email    string `db:"email"`
-	Password string `db:"password"`
-	Username string `db:"username"`
-	RoleId   int    `db:"role_id"`
+	Id          string `db:"id"`
+	Email       string `db:"email"`
+	Password    string `db:"password"`
+	Username    string `db:"username"`
+	RoleId      int    `db:"role_id"`
+	AvatarUrl   string `db:"avatar_url"`
+	TotpEnabled bool   `db:"totp_enabled"`
+	Disabled    bool   `db:"disabled"`
 }
 
-func (obj *UserRegisterReq) BcryptHashing() error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(obj.Password), 10)
+func (obj *UserRegisterReq) HashPassword(hasher cafeBeansPassword.IHasher) error {
+	hashedPassword, err := hasher.Hash(obj.Password)
 	if err != nil {
-		return fmt.Errorf("hashed password failed: %v", err)
+		return err
 	}
 
-	obj.Password = string(hashedPassword)
+	obj.Password = hashedPassword
 	return nil
 }
 
-func (obj *UserRegisterReq) IsEmail() bool {
-	matched, err := regexp.MatchString(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`, obj.Email)
-	if err != nil {
-		return false
-	}
+// Every invalid field at once, nil when the request is valid
+func (obj *UserRegisterReq) Validate(validator cafeBeansValidator.IValidator) []*entities.FieldError {
+	errs := make([]*entities.FieldError, 0)
+	errs = append(errs, validator.Email("email", obj.Email)...)
+	errs = append(errs, validator.Username("username", obj.Username)...)
+	errs = append(errs, validator.Password("password", obj.Password, obj.Username)...)
 
-	return matched
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
 }
 
+// Admins (role 2) must sign in with a second factor
+const MfaRequiredRoleId = 2
+
+// When a second factor is needed the passport only carries Mfa
 type UserPassport struct {
-	User  *User      `json:"user"`
-	Token *UserToken `json:"token"`
+	User  *User             `json:"user"`
+	Token *UserToken        `json:"token"`
+	Mfa   *UserMfaChallenge `json:"mfa,omitempty"`
+}
+
+type UserMfaChallenge struct {
+	ChallengeToken string `json:"challenge_token"`
+	// 2fa is required but not enrolled yet
+	EnrollmentRequired bool `json:"enrollment_required"`
+}
+
+// Either a totp code or one of the recovery codes
+type UserMfaReq struct {
+	ChallengeToken string `json:"challenge_token" form:"challenge_token"`
+	Code           string `json:"code" form:"code"`
+	RecoveryCode   string `json:"recovery_code" form:"recovery_code"`
+	Ip             string `json:"-" form:"-"`
+}
+
+type UserTotpReq struct {
+	Code string `json:"code" form:"code"`
+}
+
+type UserTotp struct {
+	Email    string `db:"email"`
+	RoleId   int    `db:"role_id"`
+	Secret   string `db:"totp_secret"`
+	Enabled  bool   `db:"totp_enabled"`
+	LastStep int64  `db:"totp_last_step"`
+	Disabled bool   `db:"disabled"`
+}
+
+type UserTotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+	QrCode string `json:"qr_code"` // png data uri
+}
+
+// Only shown once, each code can be used once instead of a totp code
+type UserRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 type UserToken struct {
@@ -67,17 +129,206 @@ type UserToken struct {
 type UserClaims struct {
 	Id     string `db:"id" json:"id"`
 	RoleId int    `db:"role" json:"role"`
+	// the admin holding an impersonation token, empty otherwise
+	ImpersonatorId string `db:"-" json:"impersonator_id,omitempty"`
 }
 
 type UserRefreshCredential struct {
 	RefreshToken string `db:"refresh_token" json:"refresh_token" form:"refresh_token"`
+	Ip           string `db:"-" json:"-" form:"-"`
 }
 
+// A rotated refresh token was presented again, the whole family gets revoked
+var ErrRefreshTokenReused = errors.New("refresh token has been used")
+
+// Oauth is a token family, every refresh rotates the tokens of the same row
 type Oauth struct {
 	Id     string `db:"id" json:"id"`
 	UserId string `db:"user_id" json:"user_id"`
+	// seconds since the signin and since the session was last used
+	Age  int `db:"age" json:"-"`
+	Idle int `db:"idle" json:"-"`
 }
 
 type UserRemoveCredential struct {
 	OauthId string `db:"id" json:"oauth_id" form:"oauth_id"`
 }
+
+// Failed sign ins within the lockout window
+type LoginFailures struct {
+	Account int `db:"account_failures"`
+	Ip      int `db:"ip_failures"`
+	// seconds since the latest failure of each
+	SinceAccountFailure int `db:"since_account_failure"`
+	SinceIpFailure      int `db:"since_ip_failure"`
+}
+
+// Sign in is refused until RetryAfter seconds have passed
+type LoginLockedError struct {
+	RetryAfter int
+}
+
+func (e *LoginLockedError) Error() string {
+	return "too many failed attempts, try again later"
+}
+
+type UserMagicLinkReq struct {
+	Email string `json:"email" form:"email"`
+	Token string `json:"token" form:"token"`
+	Ip    string `json:"-" form:"-"`
+}
+
+type UserUnlockReq struct {
+	Email string `json:"email" form:"email"`
+	Token string `json:"token" form:"token"`
+}
+
+// What a one-time token emailed to a user is for
+const (
+	OneTimeTokenUnlock      = "unlock"
+	OneTimeTokenMagicLink   = "magic_link"
+	OneTimeTokenEmailChange = "email_change"
+	OneTimeTokenDeletion    = "account_deletion"
+)
+
+type OneTimeToken struct {
+	UserId    string `db:"user_id"`
+	Purpose   string `db:"purpose"`
+	Token     string `db:"token"`
+	Payload   string `db:"payload"`
+	ExpiresIn int    `db:"expires_in"` // seconds
+}
+
+// A confirmed email change, PreviousEmail is told about it
+type EmailChange struct {
+	UserId        string `db:"user_id"`
+	Email         string `db:"email"`
+	PreviousEmail string `db:"previous_email"`
+}
+
+// Empty fields are left as they are
+type UserUpdateReq struct {
+	Username string `json:"username" form:"username"`
+	Email    string `json:"email" form:"email"`
+}
+
+// A new email only replaces the current one after it's confirmed
+type UserUpdateResult struct {
+	*User
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+type UserEmailConfirmReq struct {
+	Token string `json:"token" form:"token"`
+}
+
+type OidcAuthUrl struct {
+	AuthorizationUrl string `json:"authorization_url"`
+}
+
+// What the provider redirected back with
+type OidcCallbackReq struct {
+	Code  string `json:"code" form:"code"`
+	State string `json:"state" form:"state"`
+}
+
+type OidcState struct {
+	Provider     string `db:"provider"`
+	State        string `db:"state"`
+	Nonce        string `db:"nonce"`
+	CodeVerifier string `db:"code_verifier"`
+}
+
+type UserIdentity struct {
+	UserId   string `db:"user_id"`
+	Provider string `db:"provider"`
+	Subject  string `db:"subject"`
+	Email    string `db:"email"`
+}
+
+// Everything kept about a user, as a download
+type UserExport struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type UserDeletionReq struct {
+	Token string `json:"token" form:"token"`
+}
+
+// Empty fields match every user, dates are 2006-01-02 and both ends are included
+type UserFilter struct {
+	Search      string `query:"search"` // part of the email or username
+	RoleId      int    `query:"role_id"`
+	CreatedFrom string `query:"created_from"`
+	CreatedTo   string `query:"created_to"`
+	Page        int    `query:"page"`
+	Limit       int    `query:"limit"`
+}
+
+// A user as admins see it
+type UserAccount struct {
+	Id          string  `json:"id"`
+	Email       string  `json:"email"`
+	Username    string  `json:"username"`
+	RoleId      int     `json:"role_id"`
+	AvatarUrl   string  `json:"avatar_url"`
+	TotpEnabled bool    `json:"totp_enabled"`
+	DisabledAt  *string `json:"disabled_at"`
+	DeletedAt   *string `json:"deleted_at"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+}
+
+type UserAccountPage struct {
+	Data      []*UserAccount `json:"data"`
+	Page      int            `json:"page"`
+	Limit     int            `json:"limit"`
+	TotalItem int            `json:"total_item"`
+	TotalPage int            `json:"total_page"`
+}
+
+type UserAccountDetail struct {
+	User       *UserAccount    `json:"user"`
+	Sessions   []*UserSession  `json:"sessions"`
+	OrderStats *UserOrderStats `json:"order_stats"`
+}
+
+// An oauth row without its tokens
+type UserSession struct {
+	Id             string  `json:"id"`
+	ImpersonatorId *string `json:"impersonator_id"`
+	LastUsedAt     string  `json:"last_used_at"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+type UserOrderStats struct {
+	Total       int            `json:"total"`
+	ByStatus    map[string]int `json:"by_status"`
+	LastOrderAt *string        `json:"last_order_at"`
+}
+
+type UserImpersonationReq struct {
+	Reason string `json:"reason" form:"reason"`
+	Ip     string `json:"-" form:"-"`
+}
+
+// Only an access token, signing out with the id ends it early
+type UserImpersonation struct {
+	Id             string `json:"id"`
+	User           *User  `json:"user"`
+	ImpersonatorId string `json:"impersonator_id"`
+	AccessToken    string `json:"access_token"`
+	ExpiresIn      int    `json:"expires_in"` // seconds
+}
+
+type ImpersonationLog struct {
+	AdminId   string `db:"admin_id"`
+	UserId    string `db:"user_id"`
+	OauthId   string `db:"oauth_id"`
+	Reason    string `db:"reason"`
+	Ip        string `db:"ip"`
+	ExpiresIn int    `db:"expires_in"` // seconds
+}
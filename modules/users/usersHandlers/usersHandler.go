@@ -1,14 +1,23 @@
 package usersHandlers
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
 	"github.com/pandakn/cafe-beans/modules/entities"
 	"github.com/pandakn/cafe-beans/modules/users"
 	"github.com/pandakn/cafe-beans/modules/users/usersUseCases"
 	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
 )
 
 type usersHandlersErrCode string
@@ -21,30 +30,96 @@ const (
 	signUpAdminErr     usersHandlersErrCode = "users-005"
 	generateAdminErr   usersHandlersErrCode = "users-006"
 	getUserProfileErr  usersHandlersErrCode = "users-007"
+	bootstrapAdminErr  usersHandlersErrCode = "users-008"
+	verifyMfaErr       usersHandlersErrCode = "users-009"
+	enrollTotpErr      usersHandlersErrCode = "users-010"
+	activateTotpErr    usersHandlersErrCode = "users-011"
+	disableTotpErr     usersHandlersErrCode = "users-012"
+	unlockErr          usersHandlersErrCode = "users-013"
+	oidcAuthorizeErr   usersHandlersErrCode = "users-014"
+	oidcCallbackErr    usersHandlersErrCode = "users-015"
+	magicLinkErr       usersHandlersErrCode = "users-016"
+	updateUserErr      usersHandlersErrCode = "users-017"
+	confirmEmailErr    usersHandlersErrCode = "users-018"
+	uploadAvatarErr    usersHandlersErrCode = "users-019"
+	deleteAvatarErr    usersHandlersErrCode = "users-020"
+	exportUserErr      usersHandlersErrCode = "users-021"
+	deleteUserErr      usersHandlersErrCode = "users-022"
+	findUsersErr       usersHandlersErrCode = "users-023"
+	getUserAccountErr  usersHandlersErrCode = "users-024"
+	disableUserErr     usersHandlersErrCode = "users-025"
+	enableUserErr      usersHandlersErrCode = "users-026"
+	forceSignOutErr    usersHandlersErrCode = "users-027"
+	impersonateErr     usersHandlersErrCode = "users-028"
 )
 
 type IUserHandler interface {
 	SignUpCustomer(c *fiber.Ctx) error
 	SignUpAdmin(c *fiber.Ctx) error
+	BootstrapAdmin(c *fiber.Ctx) error
 	SingIn(c *fiber.Ctx) error
 	RefreshPassport(c *fiber.Ctx) error
 	SignOut(c *fiber.Ctx) error
 	GenerateAdminToken(c *fiber.Ctx) error
 	GetUserProfile(c *fiber.Ctx) error
+	VerifyMfa(c *fiber.Ctx) error
+	EnrollTotp(c *fiber.Ctx) error
+	ActivateTotp(c *fiber.Ctx) error
+	DisableTotp(c *fiber.Ctx) error
+	RequestUnlock(c *fiber.Ctx) error
+	Unlock(c *fiber.Ctx) error
+	OidcAuthorize(c *fiber.Ctx) error
+	OidcCallback(c *fiber.Ctx) error
+	RequestMagicLink(c *fiber.Ctx) error
+	MagicLinkSignIn(c *fiber.Ctx) error
+	UpdateUserProfile(c *fiber.Ctx) error
+	ConfirmEmailChange(c *fiber.Ctx) error
+	UploadAvatar(c *fiber.Ctx) error
+	DeleteAvatar(c *fiber.Ctx) error
+	ExportUser(c *fiber.Ctx) error
+	RequestDeletion(c *fiber.Ctx) error
+	ConfirmDeletion(c *fiber.Ctx) error
+	FindUsers(c *fiber.Ctx) error
+	GetUserAccount(c *fiber.Ctx) error
+	DisableUser(c *fiber.Ctx) error
+	EnableUser(c *fiber.Ctx) error
+	ForceSignOut(c *fiber.Ctx) error
+	Impersonate(c *fiber.Ctx) error
 }
 
 type userHandler struct {
-	cfg         config.IConfig
-	userUseCase usersUseCases.IUserUseCase
+	cfg          config.IConfig
+	userUseCase  usersUseCases.IUserUseCase
+	validator    cafeBeansValidator.IValidator
+	auditUseCase auditUseCases.IAuditUseCase
 }
 
-func UserHandler(cfg config.IConfig, userUseCase usersUseCases.IUserUseCase) IUserHandler {
+func UserHandler(cfg config.IConfig, userUseCase usersUseCases.IUserUseCase, validator cafeBeansValidator.IValidator, auditUseCase auditUseCases.IAuditUseCase) IUserHandler {
 	return &userHandler{
-		cfg:         cfg,
-		userUseCase: userUseCase,
+		cfg:          cfg,
+		userUseCase:  userUseCase,
+		validator:    validator,
+		auditUseCase: auditUseCase,
 	}
 }
 
+// Record a signin of any kind, the actor is the user who got the passport.
+// What was typed in is kept for failures, the account may not exist.
+func (h *userHandler) recordSignIn(c *fiber.Ctx, action, identifier string, passport *users.UserPassport, err error) {
+	event := audit.NewEvent(c, action).WithError(err)
+	if identifier != "" {
+		event.With("identifier", strings.ToLower(strings.TrimSpace(identifier)))
+	}
+	if passport != nil && passport.User != nil {
+		event.WithActor(passport.User.Id).WithTarget(passport.User.Id)
+	}
+	// the signin goes on with /signin/2fa
+	if passport != nil && passport.Mfa != nil {
+		event.With("mfa", "required")
+	}
+	h.auditUseCase.Record(event)
+}
+
 func (h *userHandler) SignUpCustomer(c *fiber.Ctx) error {
 	// request body parser
 	req := new(users.UserRegisterReq)
@@ -56,12 +131,12 @@ func (h *userHandler) SignUpCustomer(c *fiber.Ctx) error {
 		).Res()
 	}
 
-	// validate email
-	if !req.IsEmail() {
-		return entities.NewResponse(c).Error(
+	// validate
+	if errs := req.Validate(h.validator); errs != nil {
+		return entities.NewResponse(c).ValidationError(
 			fiber.ErrBadRequest.Code,
 			string(signUpCustomerErr),
-			"email is not a valid email address",
+			errs,
 		).Res()
 	}
 
@@ -105,17 +180,24 @@ func (h *userHandler) SignUpAdmin(c *fiber.Ctx) error {
 		).Res()
 	}
 
-	// validate email
-	if !req.IsEmail() {
-		return entities.NewResponse(c).Error(
+	// validate
+	if errs := req.Validate(h.validator); errs != nil {
+		return entities.NewResponse(c).ValidationError(
 			fiber.ErrBadRequest.Code,
 			string(signUpAdminErr),
-			"email is not a valid email address",
+			errs,
 		).Res()
 	}
 
 	// Insert
 	result, err := h.userUseCase.InsertAdmin(req)
+
+	event := audit.NewEvent(c, audit.ActionAdminCreated).WithError(err).With("username", req.Username)
+	if err == nil {
+		event.WithTarget(result.User.Id)
+	}
+	h.auditUseCase.Record(event)
+
 	if err != nil {
 		switch err.Error() {
 		case "username has been used":
@@ -143,11 +225,89 @@ func (h *userHandler) SignUpAdmin(c *fiber.Ctx) error {
 	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
 }
 
+// Create the first admin of a fresh database, it stops working
+// as soon as any admin exists
+func (h *userHandler) BootstrapAdmin(c *fiber.Ctx) error {
+	bootstrapToken := h.cfg.App().BootstrapToken()
+	if bootstrapToken == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrNotFound.Code,
+			string(bootstrapAdminErr),
+			"bootstrap is disabled",
+		).Res()
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Get("X-Bootstrap-Token")), []byte(bootstrapToken)) != 1 {
+		h.auditUseCase.Record(audit.NewEvent(c, audit.ActionAdminBootstrapped).WithError(fmt.Errorf("bootstrap token is invalid")))
+
+		return entities.NewResponse(c).Error(
+			fiber.ErrUnauthorized.Code,
+			string(bootstrapAdminErr),
+			"bootstrap token is invalid",
+		).Res()
+	}
+
+	// request body parser
+	req := new(users.UserRegisterReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(bootstrapAdminErr),
+			err.Error(),
+		).Res()
+	}
+
+	// validate
+	if errs := req.Validate(h.validator); errs != nil {
+		return entities.NewResponse(c).ValidationError(
+			fiber.ErrBadRequest.Code,
+			string(bootstrapAdminErr),
+			errs,
+		).Res()
+	}
+
+	// Insert
+	result, err := h.userUseCase.InsertFirstAdmin(req)
+
+	event := audit.NewEvent(c, audit.ActionAdminBootstrapped).WithError(err).With("username", req.Username)
+	if err == nil {
+		event.WithTarget(result.User.Id)
+	}
+	h.auditUseCase.Record(event)
+
+	if err != nil {
+		switch err.Error() {
+		case "admin already exists":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(bootstrapAdminErr),
+				err.Error(),
+			).Res()
+		case "username has been used", "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(bootstrapAdminErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(bootstrapAdminErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
 func (h *userHandler) GenerateAdminToken(c *fiber.Ctx) error {
 	adminToken, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Admin,
 		h.cfg.Jwt(),
 		nil,
 	)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionAdminTokenIssued).WithError(err))
+
 	if err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrInternalServerError.Code,
@@ -175,14 +335,29 @@ func (h *userHandler) SingIn(c *fiber.Ctx) error {
 			err.Error(),
 		).Res()
 	}
+	req.Ip = c.IP()
 
 	passport, err := h.userUseCase.GetPassport(req)
+	h.recordSignIn(c, audit.ActionSignIn, req.Login(), passport, err)
+
 	if err != nil {
-		return entities.NewResponse(c).Error(
-			fiber.ErrBadRequest.Code,
-			string(signInErr),
-			err.Error(),
-		).Res()
+		if locked := new(users.LoginLockedError); errors.As(err, &locked) {
+			return h.tooManyAttempts(c, signInErr, locked)
+		}
+		switch err.Error() {
+		case "user has been disabled":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(signInErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(signInErr),
+				err.Error(),
+			).Res()
+		}
 	}
 	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
 }
@@ -196,8 +371,11 @@ func (h *userHandler) RefreshPassport(c *fiber.Ctx) error {
 			err.Error(),
 		).Res()
 	}
+	req.Ip = c.IP()
 
 	passport, err := h.userUseCase.RefreshPassport(req)
+	h.recordSignIn(c, audit.ActionTokenRefreshed, "", passport, err)
+
 	if err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrBadRequest.Code,
@@ -218,7 +396,14 @@ func (h *userHandler) SignOut(c *fiber.Ctx) error {
 		).Res()
 	}
 
-	if err := h.userUseCase.DeleteOauth(req.OauthId); err != nil {
+	userId, err := h.userUseCase.DeleteOauth(req.OauthId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionSignOut).
+		WithActor(userId).
+		WithTarget(userId).
+		WithError(err).
+		With("oauth_id", req.OauthId))
+
+	if err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrBadRequest.Code,
 			string(signOutErr),
@@ -254,3 +439,773 @@ func (h *userHandler) GetUserProfile(c *fiber.Ctx) error {
 
 	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
 }
+
+func (h *userHandler) VerifyMfa(c *fiber.Ctx) error {
+	req := new(users.UserMfaReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(verifyMfaErr),
+			err.Error(),
+		).Res()
+	}
+	req.Ip = c.IP()
+
+	passport, err := h.userUseCase.VerifyMfa(req)
+	h.recordSignIn(c, audit.ActionSignInMfa, "", passport, err)
+
+	if err != nil {
+		if locked := new(users.LoginLockedError); errors.As(err, &locked) {
+			return h.tooManyAttempts(c, verifyMfaErr, locked)
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrUnauthorized.Code,
+			string(verifyMfaErr),
+			err.Error(),
+		).Res()
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
+}
+
+// The user comes from the route when signed in, otherwise from the
+// challenge token of an admin who must enroll before signing in
+func (h *userHandler) totpUserId(c *fiber.Ctx) (string, error) {
+	if userId := strings.Trim(c.Params("user_id"), " "); userId != "" {
+		return userId, nil
+	}
+
+	req := new(users.UserMfaReq)
+	if err := c.BodyParser(req); err != nil {
+		return "", err
+	}
+	return h.userUseCase.ParseChallenge(req.ChallengeToken)
+}
+
+func (h *userHandler) EnrollTotp(c *fiber.Ctx) error {
+	userId, err := h.totpUserId(c)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrUnauthorized.Code,
+			string(enrollTotpErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.userUseCase.EnrollTotp(userId)
+	if err != nil {
+		switch err.Error() {
+		case "user not found", "2fa is already enabled":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(enrollTotpErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(enrollTotpErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) ActivateTotp(c *fiber.Ctx) error {
+	userId, err := h.totpUserId(c)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrUnauthorized.Code,
+			string(activateTotpErr),
+			err.Error(),
+		).Res()
+	}
+
+	req := new(users.UserTotpReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(activateTotpErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.userUseCase.ActivateTotp(userId, req)
+	if err != nil {
+		switch err.Error() {
+		case "user not found", "2fa is already enabled", "2fa is not enrolled", "code is invalid":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(activateTotpErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(activateTotpErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
+func (h *userHandler) DisableTotp(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	req := new(users.UserTotpReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(disableTotpErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.userUseCase.DisableTotp(userId, req); err != nil {
+		switch err.Error() {
+		case "2fa is required for admin":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(disableTotpErr),
+				err.Error(),
+			).Res()
+		case "user not found", "2fa is not enabled", "code is invalid":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(disableTotpErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(disableTotpErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, "2fa disabled").Res()
+}
+
+func (h *userHandler) tooManyAttempts(c *fiber.Ctx, errCode usersHandlersErrCode, err *users.LoginLockedError) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(err.RetryAfter))
+	return entities.NewResponse(c).Error(
+		fiber.ErrTooManyRequests.Code,
+		string(errCode),
+		err.Error(),
+	).Res()
+}
+
+func (h *userHandler) RequestUnlock(c *fiber.Ctx) error {
+	req := new(users.UserUnlockReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(unlockErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.userUseCase.RequestUnlock(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(unlockErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, "If the account is locked, an unlock link has been sent").Res()
+}
+
+func (h *userHandler) Unlock(c *fiber.Ctx) error {
+	req := new(users.UserUnlockReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(unlockErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.userUseCase.Unlock(req); err != nil {
+		switch err.Error() {
+		case "token is invalid or expired":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(unlockErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(unlockErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, "Account unlocked").Res()
+}
+
+func (h *userHandler) OidcAuthorize(c *fiber.Ctx) error {
+	provider := strings.Trim(c.Params("provider"), " ")
+
+	result, err := h.userUseCase.OidcAuthUrl(provider)
+	if err != nil {
+		switch err.Error() {
+		case "provider not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(oidcAuthorizeErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(oidcAuthorizeErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) OidcCallback(c *fiber.Ctx) error {
+	provider := strings.Trim(c.Params("provider"), " ")
+
+	req := new(users.OidcCallbackReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(oidcCallbackErr),
+			err.Error(),
+		).Res()
+	}
+
+	passport, err := h.userUseCase.OidcSignIn(provider, req)
+
+	event := audit.NewEvent(c, audit.ActionSignInOidc).WithError(err).With("provider", provider)
+	if passport != nil && passport.User != nil {
+		event.WithActor(passport.User.Id).WithTarget(passport.User.Id)
+	}
+	h.auditUseCase.Record(event)
+
+	if err != nil {
+		switch {
+		case err.Error() == "provider not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(oidcCallbackErr),
+				err.Error(),
+			).Res()
+		case err.Error() == "state is invalid or expired",
+			err.Error() == "email is required",
+			err.Error() == "email has been used",
+			err.Error() == "identity has been linked",
+			strings.HasPrefix(err.Error(), "id token is invalid"),
+			strings.HasPrefix(err.Error(), "exchange code failed"):
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(oidcCallbackErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(oidcCallbackErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
+}
+
+func (h *userHandler) RequestMagicLink(c *fiber.Ctx) error {
+	req := new(users.UserMagicLinkReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(magicLinkErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.userUseCase.RequestMagicLink(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(magicLinkErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, "If the email is registered, a sign in link has been sent").Res()
+}
+
+func (h *userHandler) MagicLinkSignIn(c *fiber.Ctx) error {
+	req := new(users.UserMagicLinkReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(magicLinkErr),
+			err.Error(),
+		).Res()
+	}
+	req.Ip = c.IP()
+
+	passport, err := h.userUseCase.MagicLinkSignIn(req)
+	h.recordSignIn(c, audit.ActionSignInMagicLink, req.Email, passport, err)
+
+	if err != nil {
+		switch err.Error() {
+		case "token is invalid or expired", "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrUnauthorized.Code,
+				string(magicLinkErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(magicLinkErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
+}
+
+func (h *userHandler) UpdateUserProfile(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	req := new(users.UserUpdateReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Username == "" && req.Email == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserErr),
+			"nothing to update",
+		).Res()
+	}
+
+	// validate
+	errs := make([]*entities.FieldError, 0)
+	if req.Username != "" {
+		errs = append(errs, h.validator.Username("username", req.Username)...)
+	}
+	if req.Email != "" {
+		errs = append(errs, h.validator.Email("email", req.Email)...)
+	}
+	if len(errs) > 0 {
+		return entities.NewResponse(c).ValidationError(
+			fiber.ErrBadRequest.Code,
+			string(updateUserErr),
+			errs,
+		).Res()
+	}
+
+	result, err := h.userUseCase.UpdateUserProfile(userId, req)
+	if err != nil {
+		switch err.Error() {
+		case "username has been used", "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(updateUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(updateUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) ConfirmEmailChange(c *fiber.Ctx) error {
+	req := new(users.UserEmailConfirmReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(confirmEmailErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.userUseCase.ConfirmEmailChange(req)
+	if err != nil {
+		switch err.Error() {
+		case "token is invalid or expired", "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(confirmEmailErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(confirmEmailErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+// multipart/form-data with the image in "avatar"
+func (h *userHandler) UploadAvatar(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadAvatarErr),
+			err.Error(),
+		).Res()
+	}
+
+	if file.Size > int64(h.cfg.App().FileLimit()) {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadAvatarErr),
+			fmt.Sprintf("file size must be less than %d MiB", int(math.Ceil(float64(h.cfg.App().FileLimit())/math.Pow(1024, 2)))),
+		).Res()
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(uploadAvatarErr),
+			err.Error(),
+		).Res()
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(uploadAvatarErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.userUseCase.UploadAvatar(userId, data)
+	if err != nil {
+		switch err.Error() {
+		case "file is not a valid image", "image is too large":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(uploadAvatarErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(uploadAvatarErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) DeleteAvatar(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.userUseCase.DeleteAvatar(userId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(deleteAvatarErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+// ?format=zip for an archive, json otherwise
+func (h *userHandler) ExportUser(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.userUseCase.ExportUser(userId, c.Query("format"))
+	if err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(exportUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(exportUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, result.ContentType)
+	c.Attachment(result.Filename)
+	return c.Status(fiber.StatusOK).Send(result.Data)
+}
+
+func (h *userHandler) RequestDeletion(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	if err := h.userUseCase.RequestDeletion(userId); err != nil {
+		switch err.Error() {
+		case "admin has to be changed to another role first":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusAccepted, "A confirmation link has been sent to your email").Res()
+}
+
+func (h *userHandler) ConfirmDeletion(c *fiber.Ctx) error {
+	req := new(users.UserDeletionReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(deleteUserErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.userUseCase.ConfirmDeletion(req); err != nil {
+		switch err.Error() {
+		case "token is invalid or expired":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		case "admin has to be changed to another role first":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, "Account deleted").Res()
+}
+
+func (h *userHandler) FindUsers(c *fiber.Ctx) error {
+	req := new(users.UserFilter)
+	if err := c.QueryParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findUsersErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.userUseCase.FindUsers(req)
+	if err != nil {
+		switch err.Error() {
+		case "created date must be formatted as yyyy-mm-dd":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(findUsersErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(findUsersErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) GetUserAccount(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.userUseCase.FindUserAccount(userId)
+	if err != nil {
+		return h.userAccountError(c, getUserAccountErr, err)
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) DisableUser(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	result, err := h.userUseCase.DisableUser(adminId, userId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionAccountDisabled).WithTarget(userId).WithError(err))
+
+	if err != nil {
+		return h.userAccountError(c, disableUserErr, err)
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) EnableUser(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.userUseCase.EnableUser(userId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionAccountEnabled).WithTarget(userId).WithError(err))
+
+	if err != nil {
+		return h.userAccountError(c, enableUserErr, err)
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) ForceSignOut(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	count, result, err := h.userUseCase.ForceSignOut(userId)
+	h.auditUseCase.Record(audit.NewEvent(c, audit.ActionSessionsRevoked).
+		WithTarget(userId).
+		WithError(err).
+		With("sessions", count))
+
+	if err != nil {
+		return h.userAccountError(c, forceSignOutErr, err)
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *userHandler) userAccountError(c *fiber.Ctx, code usersHandlersErrCode, err error) error {
+	switch err.Error() {
+	case "user not found":
+		return entities.NewResponse(c).Error(
+			fiber.ErrNotFound.Code,
+			string(code),
+			err.Error(),
+		).Res()
+	case "you can't disable yourself":
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(code),
+			err.Error(),
+		).Res()
+	default:
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(code),
+			err.Error(),
+		).Res()
+	}
+}
+
+func (h *userHandler) Impersonate(c *fiber.Ctx) error {
+	// Set params
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	req := new(users.UserImpersonationReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(impersonateErr),
+			err.Error(),
+		).Res()
+	}
+	req.Ip = c.IP()
+
+	// every impersonation has to say why
+	if strings.TrimSpace(req.Reason) == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(impersonateErr),
+			"reason is required",
+		).Res()
+	}
+
+	result, err := h.userUseCase.Impersonate(adminId, userId, req)
+
+	event := audit.NewEvent(c, audit.ActionImpersonationIssued).
+		WithTarget(userId).
+		WithError(err).
+		With("reason", req.Reason)
+	if err == nil {
+		event.With("oauth_id", result.Id)
+	}
+	h.auditUseCase.Record(event)
+
+	if err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		case "you can't impersonate yourself",
+			"user has been disabled",
+			"admins can't be impersonated":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
@@ -2,22 +2,57 @@ package usersRepositories
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pandakn/cafe-beans/modules/users"
 	"github.com/pandakn/cafe-beans/modules/users/userPatterns"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IUserRepository interface {
 	InsertUser(req *users.UserRegisterReq, isAdmin bool) (*users.UserPassport, error)
+	InsertFirstAdmin(req *users.UserRegisterReq) (*users.UserPassport, error)
 	FindOneUserByEmail(email string) (*users.UserCredentialCheck, error)
+	FindOneUserByUsername(username string) (*users.UserCredentialCheck, error)
+	FindOneUserById(userId string) (*users.UserCredentialCheck, error)
+	UpdatePassword(userId, password string) error
+	UpdateUsername(userId, username string) error
+	ChangeEmail(token string) (*users.EmailChange, error)
+	UpdateAvatar(userId, avatarUrl string) error
+	ExportUser(userId string) ([]byte, error)
+	AnonymizeUser(userId string) error
 	InsertOauth(req *users.UserPassport) error
 	FindOneOauth(refreshToken string) (*users.Oauth, error)
-	UpdateOauth(req *users.UserToken) error
+	FindRetiredOauth(refreshToken string) (*users.Oauth, error)
+	UpdateOauth(oldRefreshToken string, req *users.UserToken) error
 	GetProfile(userId string) (*users.User, error)
-	DeleteOauth(oauthId string) error
+	DeleteOauth(oauthId string) (string, error)
+	FindTotp(userId string) (*users.UserTotp, error)
+	UpdateTotpSecret(userId, secret string) error
+	EnableTotp(userId string, step int64, recoveryCodes []string) error
+	UpdateTotpStep(userId string, step int64) error
+	UseRecoveryCode(userId, recoveryCode string) error
+	DisableTotp(userId string) error
+	InsertLoginAttempt(identifier, ip string, succeeded bool) error
+	FindLoginFailures(identifier, ip string, window time.Duration) (*users.LoginFailures, error)
+	DeleteLoginFailures(identifier string) error
+	DeleteLoginAttemptsBefore(before time.Time) (int, error)
+	InsertOneTimeToken(req *users.OneTimeToken) error
+	UseOneTimeToken(purpose, token string) (*users.OneTimeToken, error)
+	CountOneTimeTokens(userId, purpose string, window time.Duration) (int, error)
+	InsertOidcState(req *users.OidcState) error
+	UseOidcState(provider, state string) (*users.OidcState, error)
+	FindOneUserByIdentity(provider, subject string) (*users.UserCredentialCheck, error)
+	InsertIdentity(req *users.UserIdentity) error
+	FindUsers(req *users.UserFilter) ([]*users.UserAccount, int, error)
+	FindOneUserAccount(userId string) (*users.UserAccountDetail, error)
+	UpdateDisabled(userId string, disabled bool) error
+	DeleteUserOauth(userId string) (int, error)
+	InsertImpersonation(req *users.ImpersonationLog, accessToken string) (string, error)
 }
 
 type userRepository struct {
@@ -53,6 +88,20 @@ func (r *userRepository) InsertUser(req *users.UserRegisterReq, isAdmin bool) (*
 	return user, nil
 }
 
+func (r *userRepository) InsertFirstAdmin(req *users.UserRegisterReq) (*users.UserPassport, error) {
+	result, err := userPatterns.InsertUser(r.db, req, true).FirstAdmin()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := result.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
 func (r *userRepository) FindOneUserByEmail(email string) (*users.UserCredentialCheck, error) {
 	query := `
 	SELECT
@@ -60,9 +109,12 @@ func (r *userRepository) FindOneUserByEmail(email string) (*users.UserCredential
 		"email",
 		"password",
 		"username",
-		"role_id"
+		"role_id",
+		"avatar_url",
+		"totp_enabled",
+		("disabled_at" IS NOT NULL) AS "disabled"
 	FROM "users"
-	WHERE "email" = $1;`
+	WHERE LOWER("email") = LOWER($1);`
 
 	user := new(users.UserCredentialCheck)
 	if err := r.db.Get(user, query, email); err != nil {
@@ -71,6 +123,151 @@ func (r *userRepository) FindOneUserByEmail(email string) (*users.UserCredential
 	return user, nil
 }
 
+func (r *userRepository) FindOneUserByUsername(username string) (*users.UserCredentialCheck, error) {
+	query := `
+	SELECT
+		"id",
+		"email",
+		"password",
+		"username",
+		"role_id",
+		"avatar_url",
+		"totp_enabled",
+		("disabled_at" IS NOT NULL) AS "disabled"
+	FROM "users"
+	WHERE LOWER("username") = LOWER($1);`
+
+	user := new(users.UserCredentialCheck)
+	if err := r.db.Get(user, query, username); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return user, nil
+}
+
+func (r *userRepository) FindOneUserById(userId string) (*users.UserCredentialCheck, error) {
+	query := `
+	SELECT
+		"id",
+		"email",
+		"password",
+		"username",
+		"role_id",
+		"avatar_url",
+		"totp_enabled",
+		("disabled_at" IS NOT NULL) AS "disabled"
+	FROM "users"
+	WHERE "id" = $1;`
+
+	user := new(users.UserCredentialCheck)
+	if err := r.db.Get(user, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return user, nil
+}
+
+// The password is already hashed
+func (r *userRepository) UpdatePassword(userId, password string) error {
+	query := `
+	UPDATE "users" SET
+		"password" = $1
+	WHERE "id" = $2;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, password, userId); err != nil {
+		return fmt.Errorf("update password failed: %v", err)
+	}
+	return nil
+}
+
+func (r *userRepository) UpdateUsername(userId, username string) error {
+	query := `
+	UPDATE "users" SET
+		"username" = $1
+	WHERE "id" = $2;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, username, userId); err != nil {
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"users_username_lower_key\" (SQLSTATE 23505)":
+			return fmt.Errorf("username has been used")
+		default:
+			return fmt.Errorf("update username failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Use an email change token and set the email it carries, in one
+// transaction so the token is kept when the email has been taken since
+func (r *userRepository) ChangeEmail(token string) (*users.EmailChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	queryToken := `
+	UPDATE "one_time_tokens" SET
+		"used_at" = now()
+	WHERE "token_hash" = $1
+	AND "purpose" = $2
+	AND "used_at" IS NULL
+	AND "expires_at" > now()
+	RETURNING
+		"user_id",
+		"payload" AS "email";`
+
+	result := new(users.EmailChange)
+	if err := tx.GetContext(ctx, result, queryToken, utils.HashToken(token), users.OneTimeTokenEmailChange); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("token is invalid or expired")
+	}
+
+	queryPrevious := `
+	SELECT
+		"email"
+	FROM "users"
+	WHERE "id" = $1
+	FOR UPDATE;`
+
+	if err := tx.GetContext(ctx, &result.PreviousEmail, queryPrevious, result.UserId); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("user not found")
+	}
+
+	query := `
+	UPDATE "users" SET
+		"email" = $1
+	WHERE "id" = $2;`
+
+	if _, err := tx.ExecContext(ctx, query, result.Email, result.UserId); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			return nil, fmt.Errorf("email has been used")
+		}
+		return nil, fmt.Errorf("update email failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (r *userRepository) UpdateAvatar(userId, avatarUrl string) error {
+	query := `
+	UPDATE "users" SET
+		"avatar_url" = $1
+	WHERE "id" = $2;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, avatarUrl, userId); err != nil {
+		return fmt.Errorf("update avatar failed: %v", err)
+	}
+	return nil
+}
+
 func (r *userRepository) InsertOauth(req *users.UserPassport) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
@@ -86,8 +283,15 @@ func (r *userRepository) InsertOauth(req *users.UserPassport) error {
 	RETURNING "id";
 	`
 
+	// only digests of the tokens are stored
 	// Scan() send only reference
-	if err := r.db.QueryRowContext(ctx, query, req.User.Id, req.Token.AccessToken, req.Token.RefreshToken).Scan(&req.Token.Id); err != nil {
+	if err := r.db.QueryRowContext(
+		ctx,
+		query,
+		req.User.Id,
+		utils.HashToken(req.Token.AccessToken),
+		utils.HashToken(req.Token.RefreshToken),
+	).Scan(&req.Token.Id); err != nil {
 		return fmt.Errorf("insert oauth failed: %v", err)
 	}
 
@@ -98,30 +302,100 @@ func (r *userRepository) FindOneOauth(refreshToken string) (*users.Oauth, error)
 	query := `
 	SELECT
 		"id",
-		"user_id"
+		"user_id",
+		EXTRACT(EPOCH FROM now() - "created_at")::INT AS "age",
+		EXTRACT(EPOCH FROM now() - "last_used_at")::INT AS "idle"
 	FROM "oauth"
 	WHERE "refresh_token" = $1;`
 
 	oauth := new(users.Oauth)
-	if err := r.db.Get(oauth, query, refreshToken); err != nil {
+	if err := r.db.Get(oauth, query, utils.HashToken(refreshToken)); err != nil {
 		return nil, fmt.Errorf("oauth not found")
 	}
 	return oauth, nil
 }
 
-func (r *userRepository) UpdateOauth(req *users.UserToken) error {
-	// Return 'id' cuz easy for sign out
+// Find the token family that a rotated (no longer valid) refresh token belonged to
+func (r *userRepository) FindRetiredOauth(refreshToken string) (*users.Oauth, error) {
+	query := `
+	SELECT
+		"o"."id",
+		"o"."user_id"
+	FROM "oauth_retired_tokens" "r"
+	JOIN "oauth" "o" ON "o"."id" = "r"."oauth_id"
+	WHERE "r"."refresh_token" = $1
+	LIMIT 1;`
+
+	oauth := new(users.Oauth)
+	if err := r.db.Get(oauth, query, utils.HashToken(refreshToken)); err != nil {
+		return nil, fmt.Errorf("oauth not found")
+	}
+	return oauth, nil
+}
+
+// Rotate the tokens of a family and retire the old refresh token.
+// The update only matches the current refresh token so two concurrent
+// refreshes with the same token can't both succeed.
+func (r *userRepository) UpdateOauth(oldRefreshToken string, req *users.UserToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	UPDATE "oauth" SET
-		"access_token" = :access_token,
-		"refresh_token" = :refresh_token
-	WHERE "id" = :id;
+		"access_token" = $1,
+		"refresh_token" = $2,
+		"last_used_at" = now()
+	WHERE "id" = $3
+	AND "refresh_token" = $4;
 	`
 
-	if _, err := r.db.NamedExecContext(context.Background(), query, req); err != nil {
+	result, err := tx.ExecContext(
+		ctx,
+		query,
+		utils.HashToken(req.AccessToken),
+		utils.HashToken(req.RefreshToken),
+		req.Id,
+		utils.HashToken(oldRefreshToken),
+	)
+	if err != nil {
+		tx.Rollback()
 		return fmt.Errorf("update oauth failed: %v", err)
 	}
 
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to retrieve affected rows: %v", err)
+	}
+
+	if rowCount == 0 {
+		tx.Rollback()
+		return users.ErrRefreshTokenReused
+	}
+
+	queryRetire := `
+	INSERT INTO "oauth_retired_tokens" (
+		"oauth_id",
+		"refresh_token"
+	)
+	VALUES ($1, $2);
+	`
+
+	if _, err := tx.ExecContext(ctx, queryRetire, req.Id, utils.HashToken(oldRefreshToken)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("retire refresh token failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	return nil
 }
 
@@ -131,7 +405,8 @@ func (r *userRepository) GetProfile(userId string) (*users.User, error) {
 		"id",
 		"email",
 		"username",
-		"role_id"
+		"role_id",
+		"avatar_url"
 	FROM "users"
 	WHERE "id" = $1;`
 
@@ -142,12 +417,843 @@ func (r *userRepository) GetProfile(userId string) (*users.User, error) {
 	return profile, nil
 }
 
-func (r *userRepository) DeleteOauth(oauthId string) error {
-	query := `DELETE FROM "oauth" WHERE "id" = $1;`
+// Return the owner of the session so its cache can be dropped
+func (r *userRepository) DeleteOauth(oauthId string) (string, error) {
+	query := `DELETE FROM "oauth" WHERE "id" = $1 RETURNING "user_id";`
+
+	var userId string
+	if err := r.db.QueryRowContext(context.Background(), query, oauthId).Scan(&userId); err != nil {
+		return "", fmt.Errorf("oauth not found")
+	}
+
+	return userId, nil
+}
+
+func (r *userRepository) FindTotp(userId string) (*users.UserTotp, error) {
+	query := `
+	SELECT
+		"email",
+		"role_id",
+		"totp_secret",
+		"totp_enabled",
+		"totp_last_step",
+		("disabled_at" IS NOT NULL) AS "disabled"
+	FROM "users"
+	WHERE "id" = $1;`
+
+	totp := new(users.UserTotp)
+	if err := r.db.Get(totp, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return totp, nil
+}
+
+// A pending secret can be replaced until 2fa is enabled
+func (r *userRepository) UpdateTotpSecret(userId, secret string) error {
+	query := `
+	UPDATE "users" SET
+		"totp_secret" = $1
+	WHERE "id" = $2
+	AND "totp_enabled" = FALSE;`
+
+	result, err := r.db.ExecContext(context.Background(), query, secret, userId)
+	if err != nil {
+		return fmt.Errorf("update totp secret failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		return fmt.Errorf("2fa is already enabled")
+	}
+
+	return nil
+}
+
+// Enable 2fa and replace the recovery codes, only digests of the codes are stored
+func (r *userRepository) EnableTotp(userId string, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE "users" SET
+		"totp_enabled" = TRUE,
+		"totp_last_step" = $1
+	WHERE "id" = $2
+	AND "totp_enabled" = FALSE
+	AND "totp_secret" <> '';`
+
+	result, err := tx.ExecContext(ctx, query, step, userId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("enable totp failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		tx.Rollback()
+		return fmt.Errorf("2fa is already enabled")
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "recovery_codes" WHERE "user_id" = $1;`, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete recovery codes failed: %v", err)
+	}
+
+	for _, code := range recoveryCodes {
+		queryCode := `
+		INSERT INTO "recovery_codes" (
+			"user_id",
+			"code_hash"
+		)
+		VALUES ($1, $2);`
+
+		if _, err := tx.ExecContext(ctx, queryCode, userId, utils.HashToken(code)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insert recovery code failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// Only a later step is accepted so a code can't be replayed
+func (r *userRepository) UpdateTotpStep(userId string, step int64) error {
+	query := `
+	UPDATE "users" SET
+		"totp_last_step" = $1
+	WHERE "id" = $2
+	AND "totp_last_step" < $1;`
+
+	result, err := r.db.ExecContext(context.Background(), query, step, userId)
+	if err != nil {
+		return fmt.Errorf("update totp step failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		return fmt.Errorf("code is invalid")
+	}
+
+	return nil
+}
+
+func (r *userRepository) UseRecoveryCode(userId, recoveryCode string) error {
+	query := `
+	UPDATE "recovery_codes" SET
+		"used_at" = now()
+	WHERE "user_id" = $1
+	AND "code_hash" = $2
+	AND "used_at" IS NULL;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, utils.HashToken(recoveryCode))
+	if err != nil {
+		return fmt.Errorf("use recovery code failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		return fmt.Errorf("code is invalid")
+	}
+
+	return nil
+}
+
+func (r *userRepository) DisableTotp(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE "users" SET
+		"totp_secret" = '',
+		"totp_enabled" = FALSE,
+		"totp_last_step" = 0
+	WHERE "id" = $1;`
+
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("disable totp failed: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "recovery_codes" WHERE "user_id" = $1;`, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete recovery codes failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (r *userRepository) InsertLoginAttempt(identifier, ip string, succeeded bool) error {
+	query := `
+	INSERT INTO "login_attempts" (
+		"identifier",
+		"ip",
+		"succeeded"
+	)
+	VALUES ($1, $2, $3);`
+
+	if _, err := r.db.ExecContext(context.Background(), query, identifier, ip, succeeded); err != nil {
+		return fmt.Errorf("insert login attempt failed: %v", err)
+	}
+	return nil
+}
+
+// Failures of an account only count after its latest successful sign in
+func (r *userRepository) FindLoginFailures(identifier, ip string, window time.Duration) (*users.LoginFailures, error) {
+	query := `
+	WITH "account" AS (
+		SELECT
+			"a"."created_at"
+		FROM "login_attempts" "a"
+		WHERE "a"."identifier" = $1
+		AND "a"."succeeded" = FALSE
+		AND "a"."created_at" > now() - make_interval(secs => $3)
+		AND "a"."created_at" > COALESCE((
+			SELECT
+				MAX("s"."created_at")
+			FROM "login_attempts" "s"
+			WHERE "s"."identifier" = $1
+			AND "s"."succeeded" = TRUE
+		), '-infinity')
+	), "ip" AS (
+		SELECT
+			"i"."created_at"
+		FROM "login_attempts" "i"
+		WHERE "i"."ip" = $2
+		AND "i"."succeeded" = FALSE
+		AND "i"."created_at" > now() - make_interval(secs => $3)
+	)
+	SELECT
+		(SELECT COUNT(*) FROM "account") AS "account_failures",
+		(SELECT COUNT(*) FROM "ip") AS "ip_failures",
+		COALESCE((SELECT EXTRACT(EPOCH FROM now() - MAX("created_at"))::INT FROM "account"), 0) AS "since_account_failure",
+		COALESCE((SELECT EXTRACT(EPOCH FROM now() - MAX("created_at"))::INT FROM "ip"), 0) AS "since_ip_failure";`
+
+	failures := new(users.LoginFailures)
+	if err := r.db.Get(failures, query, identifier, ip, window.Seconds()); err != nil {
+		return nil, fmt.Errorf("get login failures failed: %v", err)
+	}
+	return failures, nil
+}
+
+func (r *userRepository) DeleteLoginFailures(identifier string) error {
+	query := `
+	DELETE FROM "login_attempts"
+	WHERE "identifier" = $1
+	AND "succeeded" = FALSE;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, identifier); err != nil {
+		return fmt.Errorf("delete login failures failed: %v", err)
+	}
+	return nil
+}
+
+// Attempts older than the lockout window don't count towards anything
+func (r *userRepository) DeleteLoginAttemptsBefore(before time.Time) (int, error) {
+	query := `DELETE FROM "login_attempts" WHERE "created_at" < $1;`
+
+	result, err := r.db.ExecContext(context.Background(), query, before)
+	if err != nil {
+		return 0, fmt.Errorf("delete login attempts failed: %v", err)
+	}
+
+	count, _ := result.RowsAffected()
+	return int(count), nil
+}
+
+// Only a digest of the token is stored
+func (r *userRepository) InsertOneTimeToken(req *users.OneTimeToken) error {
+	query := `
+	INSERT INTO "one_time_tokens" (
+		"user_id",
+		"purpose",
+		"token_hash",
+		"payload",
+		"expires_at"
+	)
+	VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5));`
+
+	if _, err := r.db.ExecContext(
+		context.Background(),
+		query,
+		req.UserId,
+		req.Purpose,
+		utils.HashToken(req.Token),
+		req.Payload,
+		req.ExpiresIn,
+	); err != nil {
+		return fmt.Errorf("insert one-time token failed: %v", err)
+	}
+	return nil
+}
+
+// Mark a token used and return its user and payload, a token works only once
+func (r *userRepository) UseOneTimeToken(purpose, token string) (*users.OneTimeToken, error) {
+	query := `
+	UPDATE "one_time_tokens" SET
+		"used_at" = now()
+	WHERE "token_hash" = $1
+	AND "purpose" = $2
+	AND "used_at" IS NULL
+	AND "expires_at" > now()
+	RETURNING
+		"user_id",
+		"purpose",
+		"payload";`
 
-	if _, err := r.db.ExecContext(context.Background(), query, oauthId); err != nil {
-		return fmt.Errorf("oauth not found")
+	result := new(users.OneTimeToken)
+	if err := r.db.Get(result, query, utils.HashToken(token), purpose); err != nil {
+		return nil, fmt.Errorf("token is invalid or expired")
 	}
+	return result, nil
+}
+
+// A state is valid for 10 minutes, only its digest is stored
+func (r *userRepository) InsertOidcState(req *users.OidcState) error {
+	query := `
+	INSERT INTO "oidc_states" (
+		"state_hash",
+		"provider",
+		"nonce",
+		"code_verifier",
+		"expires_at"
+	)
+	VALUES ($1, $2, $3, $4, now() + INTERVAL '10 minutes');`
 
+	if _, err := r.db.ExecContext(
+		context.Background(),
+		query,
+		utils.HashToken(req.State),
+		req.Provider,
+		req.Nonce,
+		req.CodeVerifier,
+	); err != nil {
+		return fmt.Errorf("insert oidc state failed: %v", err)
+	}
 	return nil
 }
+
+// Delete the state so a callback can't be replayed
+func (r *userRepository) UseOidcState(provider, state string) (*users.OidcState, error) {
+	query := `
+	DELETE FROM "oidc_states"
+	WHERE "state_hash" = $1
+	AND "provider" = $2
+	AND "expires_at" > now()
+	RETURNING
+		"provider",
+		"nonce",
+		"code_verifier";`
+
+	result := new(users.OidcState)
+	if err := r.db.Get(result, query, utils.HashToken(state), provider); err != nil {
+		return nil, fmt.Errorf("state is invalid or expired")
+	}
+	return result, nil
+}
+
+func (r *userRepository) FindOneUserByIdentity(provider, subject string) (*users.UserCredentialCheck, error) {
+	query := `
+	SELECT
+		"u"."id",
+		"u"."email",
+		"u"."password",
+		"u"."username",
+		"u"."role_id",
+		"u"."avatar_url",
+		"u"."totp_enabled",
+		("u"."disabled_at" IS NOT NULL) AS "disabled"
+	FROM "user_identities" "i"
+	JOIN "users" "u" ON "u"."id" = "i"."user_id"
+	WHERE "i"."provider" = $1
+	AND "i"."subject" = $2;`
+
+	user := new(users.UserCredentialCheck)
+	if err := r.db.Get(user, query, provider, subject); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return user, nil
+}
+
+func (r *userRepository) InsertIdentity(req *users.UserIdentity) error {
+	query := `
+	INSERT INTO "user_identities" (
+		"user_id",
+		"provider",
+		"subject",
+		"email"
+	)
+	VALUES ($1, $2, $3, $4);`
+
+	if _, err := r.db.ExecContext(
+		context.Background(),
+		query,
+		req.UserId,
+		req.Provider,
+		req.Subject,
+		req.Email,
+	); err != nil {
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"user_identities_provider_subject_key\" (SQLSTATE 23505)":
+			return fmt.Errorf("identity has been linked")
+		default:
+			return fmt.Errorf("insert identity failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Tokens of a purpose issued to a user within the window
+func (r *userRepository) CountOneTimeTokens(userId, purpose string, window time.Duration) (int, error) {
+	query := `
+	SELECT
+		COUNT(*)
+	FROM "one_time_tokens"
+	WHERE "user_id" = $1
+	AND "purpose" = $2
+	AND "created_at" > now() - make_interval(secs => $3);`
+
+	var count int
+	if err := r.db.Get(&count, query, userId, purpose, window.Seconds()); err != nil {
+		return 0, fmt.Errorf("count one-time tokens failed: %v", err)
+	}
+	return count, nil
+}
+
+// Everything about a user as one json document, never secrets or token digests
+func (r *userRepository) ExportUser(userId string) ([]byte, error) {
+	query := `
+	SELECT
+		json_build_object(
+			'exported_at', now(),
+			'profile', "p",
+			'sessions', COALESCE((
+				SELECT
+					json_agg("s" ORDER BY "s"."created_at")
+				FROM (
+					SELECT
+						"o"."id",
+						"o"."created_at",
+						"o"."updated_at"
+					FROM "oauth" "o"
+					WHERE "o"."user_id" = "p"."id"
+				) AS "s"
+			), '[]'),
+			'identities', COALESCE((
+				SELECT
+					json_agg("i" ORDER BY "i"."created_at")
+				FROM (
+					SELECT
+						"ui"."provider",
+						"ui"."email",
+						"ui"."created_at"
+					FROM "user_identities" "ui"
+					WHERE "ui"."user_id" = "p"."id"
+				) AS "i"
+			), '[]'),
+			'orders', COALESCE((
+				SELECT
+					json_agg("od" ORDER BY "od"."created_at")
+				FROM (
+					SELECT
+						"o"."id",
+						"o"."contact",
+						"o"."address",
+						"o"."status",
+						"o"."created_at",
+						"o"."updated_at",
+						COALESCE((
+							SELECT
+								json_agg(json_build_object(
+									'qty', "po"."qty",
+									'product', "po"."product"
+								))
+							FROM "products_orders" "po"
+							WHERE "po"."order_id" = "o"."id"
+						), '[]') AS "products"
+					FROM "orders" "o"
+					WHERE "o"."user_id" = "p"."id"
+				) AS "od"
+			), '[]'),
+			'addresses', COALESCE((
+				SELECT
+					json_agg("ad" ORDER BY "ad"."created_at")
+				FROM (
+					SELECT
+						"a"."recipient",
+						"a"."phone",
+						"a"."line1",
+						"a"."line2",
+						"a"."sub_district",
+						"a"."district",
+						"a"."province",
+						"a"."postal_code",
+						"a"."is_default",
+						"a"."created_at"
+					FROM "user_addresses" "a"
+					WHERE "a"."user_id" = "p"."id"
+				) AS "ad"
+			), '[]'),
+			'audit_events', COALESCE((
+				SELECT
+					json_agg("e" ORDER BY "e"."created_at")
+				FROM (
+					SELECT
+						"ae"."action",
+						"ae"."outcome",
+						"ae"."ip",
+						"ae"."user_agent",
+						"ae"."created_at"
+					FROM "audit_events" "ae"
+					WHERE "ae"."actor_id" = "p"."id"
+					OR "ae"."target_id" = "p"."id"
+				) AS "e"
+			), '[]')
+		)
+	FROM (
+		SELECT
+			"u"."id",
+			"u"."email",
+			"u"."username",
+			"u"."role_id",
+			"u"."avatar_url",
+			"u"."totp_enabled",
+			"u"."created_at",
+			"u"."updated_at"
+		FROM "users" "u"
+		WHERE "u"."id" = $1
+		AND "u"."deleted_at" IS NULL
+	) AS "p";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return data, nil
+}
+
+// Strip everything personal but keep the row, orders still point at it.
+// Sessions, identities, codes and tokens go, api keys are revoked.
+func (r *userRepository) AnonymizeUser(userId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var email, username string
+	query := `
+	UPDATE "users" "u" SET
+		"username" = 'deleted_' || "u"."id",
+		"email" = 'deleted+' || "u"."id" || '@invalid',
+		"password" = '',
+		"avatar_url" = '',
+		"totp_secret" = '',
+		"totp_enabled" = FALSE,
+		"totp_last_step" = 0,
+		"deleted_at" = now()
+	FROM (
+		SELECT
+			"id",
+			"email",
+			"username"
+		FROM "users"
+		WHERE "id" = $1
+		AND "deleted_at" IS NULL
+		FOR UPDATE
+	) AS "old"
+	WHERE "u"."id" = "old"."id"
+	RETURNING "old"."email", "old"."username";`
+
+	if err := tx.QueryRowxContext(ctx, query, userId).Scan(&email, &username); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("user not found")
+	}
+
+	cleanups := []string{
+		`DELETE FROM "oauth" WHERE "user_id" = $1;`,
+		`DELETE FROM "user_identities" WHERE "user_id" = $1;`,
+		`DELETE FROM "user_addresses" WHERE "user_id" = $1;`,
+		`DELETE FROM "recovery_codes" WHERE "user_id" = $1;`,
+		`DELETE FROM "one_time_tokens" WHERE "user_id" = $1;`,
+		// audit events stay, without what identifies the person
+		`UPDATE "audit_events" SET "ip" = '', "user_agent" = '', "metadata" = '{}' WHERE "actor_id" = $1 OR "target_id" = $1;`,
+		`UPDATE "api_keys" SET "revoked_at" = now() WHERE "owner_id" = $1 AND "revoked_at" IS NULL;`,
+	}
+	for _, cleanup := range cleanups {
+		if _, err := tx.ExecContext(ctx, cleanup, userId); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("anonymize user failed: %v", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "login_attempts" WHERE "identifier" = $1;`, strings.ToLower(email)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("anonymize user failed: %v", err)
+	}
+
+	// failed signins only know what was typed in
+	queryAudit := `
+	UPDATE "audit_events" SET
+		"ip" = '',
+		"user_agent" = '',
+		"metadata" = '{}'
+	WHERE "metadata"->>'identifier' IN ($1, $2);`
+
+	if _, err := tx.ExecContext(ctx, queryAudit, strings.ToLower(email), strings.ToLower(username)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("anonymize user failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
+// A page of users matching the filter and how many match in total
+func (r *userRepository) FindUsers(req *users.UserFilter) ([]*users.UserAccount, int, error) {
+	conditions := make([]string, 0)
+	filterValues := make([]any, 0)
+
+	if req.Search != "" {
+		// the search is matched literally
+		search := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(req.Search))
+		filterValues = append(filterValues, "%"+search+"%")
+		conditions = append(conditions, fmt.Sprintf(`(LOWER("u"."email") LIKE $%d OR LOWER("u"."username") LIKE $%d)`, len(filterValues), len(filterValues)))
+	}
+	if req.RoleId != 0 {
+		filterValues = append(filterValues, req.RoleId)
+		conditions = append(conditions, fmt.Sprintf(`"u"."role_id" = $%d`, len(filterValues)))
+	}
+	if req.CreatedFrom != "" {
+		filterValues = append(filterValues, req.CreatedFrom)
+		conditions = append(conditions, fmt.Sprintf(`"u"."created_at" >= $%d::DATE`, len(filterValues)))
+	}
+	if req.CreatedTo != "" {
+		filterValues = append(filterValues, req.CreatedTo)
+		conditions = append(conditions, fmt.Sprintf(`"u"."created_at" < $%d::DATE + 1`, len(filterValues)))
+	}
+
+	where := ""
+	if len(conditions) != 0 {
+		where = "WHERE " + strings.Join(conditions, "\n\tAND ")
+	}
+
+	queryCount := `
+	SELECT
+		COUNT(*)
+	FROM "users" "u"
+	` + where + ";"
+
+	var count int
+	if err := r.db.Get(&count, queryCount, filterValues...); err != nil {
+		return nil, 0, fmt.Errorf("count users failed: %v", err)
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		COALESCE(json_agg("a" ORDER BY "a"."created_at" DESC, "a"."id" DESC), '[]')
+	FROM (
+		SELECT
+			"u"."id",
+			"u"."email",
+			"u"."username",
+			"u"."role_id",
+			"u"."avatar_url",
+			"u"."totp_enabled",
+			"u"."disabled_at",
+			"u"."deleted_at",
+			"u"."created_at",
+			"u"."updated_at"
+		FROM "users" "u"
+		%s
+		ORDER BY "u"."created_at" DESC, "u"."id" DESC
+		LIMIT $%d OFFSET $%d
+	) AS "a";`, where, len(filterValues)+1, len(filterValues)+2)
+
+	filterValues = append(filterValues, req.Limit, (req.Page-1)*req.Limit)
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, filterValues...); err != nil {
+		return nil, 0, fmt.Errorf("select users failed: %v", err)
+	}
+
+	accounts := make([]*users.UserAccount, 0)
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, 0, fmt.Errorf("unmarshal users failed: %v", err)
+	}
+
+	return accounts, count, nil
+}
+
+// A user with its sessions and a summary of its orders
+func (r *userRepository) FindOneUserAccount(userId string) (*users.UserAccountDetail, error) {
+	query := `
+	SELECT
+		json_build_object(
+			'user', "p",
+			'sessions', COALESCE((
+				SELECT
+					json_agg("s" ORDER BY "s"."updated_at" DESC)
+				FROM (
+					SELECT
+						"o"."id",
+						"o"."impersonator_id",
+						"o"."last_used_at",
+						"o"."created_at",
+						"o"."updated_at"
+					FROM "oauth" "o"
+					WHERE "o"."user_id" = "p"."id"
+				) AS "s"
+			), '[]'),
+			'order_stats', (
+				SELECT
+					json_build_object(
+						'total', COUNT(*),
+						'by_status', COALESCE((
+							SELECT
+								json_object_agg("st"."status", "st"."count")
+							FROM (
+								SELECT
+									"os"."status",
+									COUNT(*) AS "count"
+								FROM "orders" "os"
+								WHERE "os"."user_id" = "p"."id"
+								GROUP BY "os"."status"
+							) AS "st"
+						), '{}'),
+						'last_order_at', MAX("o"."created_at")
+					)
+				FROM "orders" "o"
+				WHERE "o"."user_id" = "p"."id"
+			)
+		)
+	FROM (
+		SELECT
+			"u"."id",
+			"u"."email",
+			"u"."username",
+			"u"."role_id",
+			"u"."avatar_url",
+			"u"."totp_enabled",
+			"u"."disabled_at",
+			"u"."deleted_at",
+			"u"."created_at",
+			"u"."updated_at"
+		FROM "users" "u"
+		WHERE "u"."id" = $1
+	) AS "p";`
+
+	data := make([]byte, 0)
+	if err := r.db.Get(&data, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	account := new(users.UserAccountDetail)
+	if err := json.Unmarshal(data, account); err != nil {
+		return nil, fmt.Errorf("unmarshal user failed: %v", err)
+	}
+	return account, nil
+}
+
+// Deleted users can't be disabled or enabled
+func (r *userRepository) UpdateDisabled(userId string, disabled bool) error {
+	query := `
+	UPDATE "users" SET
+		"disabled_at" = CASE WHEN $2 THEN COALESCE("disabled_at", now()) END
+	WHERE "id" = $1
+	AND "deleted_at" IS NULL;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, disabled)
+	if err != nil {
+		return fmt.Errorf("update user failed: %v", err)
+	}
+
+	if rowCount, _ := result.RowsAffected(); rowCount == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// Remove every session of a user, return how many there were
+func (r *userRepository) DeleteUserOauth(userId string) (int, error) {
+	query := `DELETE FROM "oauth" WHERE "user_id" = $1;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId)
+	if err != nil {
+		return 0, fmt.Errorf("delete oauth failed: %v", err)
+	}
+
+	rowCount, _ := result.RowsAffected()
+	return int(rowCount), nil
+}
+
+// Open a session for the admin on behalf of the user and log it, return the oauth id
+func (r *userRepository) InsertImpersonation(req *users.ImpersonationLog, accessToken string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// an empty refresh token never matches a digest, the session can't be refreshed
+	queryOauth := `
+	INSERT INTO "oauth" (
+		"user_id",
+		"access_token",
+		"refresh_token",
+		"impersonator_id"
+	)
+	VALUES ($1, $2, '', $3)
+	RETURNING "id";`
+
+	if err := tx.QueryRowxContext(ctx, queryOauth, req.UserId, utils.HashToken(accessToken), req.AdminId).Scan(&req.OauthId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("insert oauth failed: %v", err)
+	}
+
+	queryLog := `
+	INSERT INTO "impersonation_logs" (
+		"admin_id",
+		"user_id",
+		"oauth_id",
+		"reason",
+		"ip",
+		"expires_at"
+	)
+	VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6));`
+
+	if _, err := tx.ExecContext(ctx, queryLog, req.AdminId, req.UserId, req.OauthId, req.Reason, req.Ip, req.ExpiresIn); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("insert impersonation log failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return req.OauthId, nil
+}
@@ -1,38 +1,104 @@
 package usersUseCases
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/modules/roles"
 	"github.com/pandakn/cafe-beans/modules/users"
 	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
 	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansImage"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansMailer"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansOidc"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansPassword"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansStorage"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansTotp"
+	"github.com/pandakn/cafe-beans/pkg/utils"
 )
 
 type IUserUseCase interface {
 	InsertCustomer(req *users.UserRegisterReq) (*users.UserPassport, error)
 	InsertAdmin(req *users.UserRegisterReq) (*users.UserPassport, error)
+	InsertFirstAdmin(req *users.UserRegisterReq) (*users.UserPassport, error)
 	GetPassport(req *users.UserCredential) (*users.UserPassport, error)
 	RefreshPassport(req *users.UserRefreshCredential) (*users.UserPassport, error)
-	DeleteOauth(oauthId string) error
+	DeleteOauth(oauthId string) (string, error)
 	GetUserProfile(userId string) (*users.User, error)
+	ParseChallenge(challengeToken string) (string, error)
+	VerifyMfa(req *users.UserMfaReq) (*users.UserPassport, error)
+	EnrollTotp(userId string) (*users.UserTotpEnrollment, error)
+	ActivateTotp(userId string, req *users.UserTotpReq) (*users.UserRecoveryCodes, error)
+	DisableTotp(userId string, req *users.UserTotpReq) error
+	RequestUnlock(req *users.UserUnlockReq) error
+	Unlock(req *users.UserUnlockReq) error
+	OidcAuthUrl(provider string) (*users.OidcAuthUrl, error)
+	RequestMagicLink(req *users.UserMagicLinkReq) error
+	MagicLinkSignIn(req *users.UserMagicLinkReq) (*users.UserPassport, error)
+	UpdateUserProfile(userId string, req *users.UserUpdateReq) (*users.UserUpdateResult, error)
+	ConfirmEmailChange(req *users.UserEmailConfirmReq) (*users.User, error)
+	UploadAvatar(userId string, data []byte) (*users.User, error)
+	DeleteAvatar(userId string) (*users.User, error)
+	ExportUser(userId, format string) (*users.UserExport, error)
+	RequestDeletion(userId string) error
+	ConfirmDeletion(req *users.UserDeletionReq) error
+	OidcSignIn(provider string, req *users.OidcCallbackReq) (*users.UserPassport, error)
+	FindUsers(req *users.UserFilter) (*users.UserAccountPage, error)
+	FindUserAccount(userId string) (*users.UserAccountDetail, error)
+	DisableUser(adminId, userId string) (*users.UserAccountDetail, error)
+	EnableUser(userId string) (*users.UserAccountDetail, error)
+	ForceSignOut(userId string) (int, *users.UserAccountDetail, error)
+	Impersonate(adminId, userId string, req *users.UserImpersonationReq) (*users.UserImpersonation, error)
+	PruneLoginAttempts() (int, error)
 }
 
 type userUseCase struct {
 	cfg            config.IConfig
 	userRepository usersRepositories.IUserRepository
+	cache          cafeBeansCache.ICafeBeansCache
+	mailer         cafeBeansMailer.IMailer
+	oidcClients    map[string]cafeBeansOidc.IClient
+	storage        cafeBeansStorage.IStorage
+	auditUseCase   auditUseCases.IAuditUseCase
+	hasher         cafeBeansPassword.IHasher
+	// verified against when the email is unknown so both cases take as long
+	dummyPassword string
 }
 
-func UserUseCase(cfg config.IConfig, userRepository usersRepositories.IUserRepository) IUserUseCase {
+func UserUseCase(cfg config.IConfig, userRepository usersRepositories.IUserRepository, cache cafeBeansCache.ICafeBeansCache, mailer cafeBeansMailer.IMailer, oidcClients map[string]cafeBeansOidc.IClient, storage cafeBeansStorage.IStorage, auditUseCase auditUseCases.IAuditUseCase) IUserUseCase {
+	hasher := cafeBeansPassword.NewHasher(cfg.Password())
+	dummyPassword, err := hasher.Hash("cafe-beans")
+	if err != nil {
+		log.Fatalf("hash dummy password failed: %v", err)
+	}
+
 	return &userUseCase{
 		cfg:            cfg,
 		userRepository: userRepository,
+		cache:          cache,
+		mailer:         mailer,
+		oidcClients:    oidcClients,
+		storage:        storage,
+		auditUseCase:   auditUseCase,
+		hasher:         hasher,
+		dummyPassword:  dummyPassword,
 	}
 }
 func (u *userUseCase) InsertCustomer(req *users.UserRegisterReq) (*users.UserPassport, error) {
 	// hashing a password
-	if err := req.BcryptHashing(); err != nil {
+	if err := req.HashPassword(u.hasher); err != nil {
 		return nil, err
 	}
 
@@ -47,7 +113,7 @@ func (u *userUseCase) InsertCustomer(req *users.UserRegisterReq) (*users.UserPas
 
 func (u *userUseCase) InsertAdmin(req *users.UserRegisterReq) (*users.UserPassport, error) {
 	// hashing a password
-	if err := req.BcryptHashing(); err != nil {
+	if err := req.HashPassword(u.hasher); err != nil {
 		return nil, err
 	}
 
@@ -60,17 +126,108 @@ func (u *userUseCase) InsertAdmin(req *users.UserRegisterReq) (*users.UserPasspo
 	return result, nil
 }
 
+func (u *userUseCase) InsertFirstAdmin(req *users.UserRegisterReq) (*users.UserPassport, error) {
+	// hashing a password
+	if err := req.HashPassword(u.hasher); err != nil {
+		return nil, err
+	}
+
+	// insert a user, only works while there is no admin
+	result, err := u.userRepository.InsertFirstAdmin(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (u *userUseCase) GetPassport(req *users.UserCredential) (*users.UserPassport, error) {
-	// Find a user
-	user, err := u.userRepository.FindOneUserByEmail(req.Email)
+	// Find a user, an unknown identifier is treated like a wrong password.
+	// Failures are counted against the email whichever one was used
+	identifier := strings.ToLower(strings.TrimSpace(req.Login()))
+	user, err := u.findUserByIdentifier(identifier)
+	if err == nil {
+		identifier = strings.ToLower(user.Email)
+	}
+
+	if err := u.checkLoginAttempts(identifier, req.Ip); err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		u.hasher.Verify(req.Password, u.dummyPassword)
+		u.failLogin(identifier, req.Ip, nil)
+		return nil, fmt.Errorf("email or password is incorrect")
+	}
+
+	if !u.hasher.Verify(req.Password, user.Password) {
+		u.failLogin(identifier, req.Ip, user)
+		return nil, fmt.Errorf("email or password is incorrect")
+	}
+
+	// upgrade the hash while the plain password is at hand
+	if u.hasher.NeedsRehash(user.Password) {
+		if hashed, err := u.hasher.Hash(req.Password); err == nil {
+			if err := u.userRepository.UpdatePassword(user.Id, hashed); err != nil {
+				log.Printf("rehash password: %v", err)
+			}
+		}
+	}
+
+	passport, err := u.signIn(user)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return nil, fmt.Errorf("password is incorrect")
+	// with 2fa the sign in only succeeds after the second step
+	if passport.Mfa == nil {
+		u.userRepository.InsertLoginAttempt(identifier, req.Ip, true)
 	}
+	return passport, nil
+}
+
+// Usernames can't contain "@", so an identifier with one is an email
+func (u *userUseCase) findUserByIdentifier(identifier string) (*users.UserCredentialCheck, error) {
+	if strings.Contains(identifier, "@") {
+		return u.userRepository.FindOneUserByEmail(identifier)
+	}
+	return u.userRepository.FindOneUserByUsername(identifier)
+}
 
+// Issue a passport, or only a challenge when a second factor is needed
+func (u *userUseCase) signIn(user *users.UserCredentialCheck) (*users.UserPassport, error) {
+	if user.Disabled {
+		return nil, fmt.Errorf("user has been disabled")
+	}
+
+	if !user.TotpEnabled && user.RoleId != users.MfaRequiredRoleId {
+		return u.issuePassport(&users.User{
+			Id:        user.Id,
+			Email:     user.Email,
+			Username:  user.Username,
+			RoleId:    user.RoleId,
+			AvatarUrl: user.AvatarUrl,
+		})
+	}
+
+	challenge, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Challenge, u.cfg.Jwt(), &users.UserClaims{
+		Id:     user.Id,
+		RoleId: user.RoleId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.UserPassport{
+		Mfa: &users.UserMfaChallenge{
+			ChallengeToken:     challenge.SignToken(),
+			EnrollmentRequired: !user.TotpEnabled,
+		},
+	}, nil
+}
+
+// Sign tokens for a user and record the session
+func (u *userUseCase) issuePassport(user *users.User) (*users.UserPassport, error) {
 	// Sign Token
 	accessToken, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, u.cfg.Jwt(), &users.UserClaims{
 		Id:     user.Id,
@@ -83,12 +240,7 @@ func (u *userUseCase) GetPassport(req *users.UserCredential) (*users.UserPasspor
 
 	// set passport
 	passport := &users.UserPassport{
-		User: &users.User{
-			Id:       user.Id,
-			Email:    user.Email,
-			Username: user.Username,
-			RoleId:   user.RoleId,
-		},
+		User: user,
 		Token: &users.UserToken{
 			AccessToken:  accessToken.SignToken(),
 			RefreshToken: refreshToken.SignToken(),
@@ -104,7 +256,7 @@ func (u *userUseCase) GetPassport(req *users.UserCredential) (*users.UserPasspor
 
 func (u *userUseCase) RefreshPassport(req *users.UserRefreshCredential) (*users.UserPassport, error) {
 	// Parse token
-	claims, err := cafeBeansAuth.ParseToken(u.cfg.Jwt(), req.RefreshToken)
+	claims, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Refresh, u.cfg.Jwt(), req.RefreshToken)
 	if err != nil {
 		return nil, err
 	}
@@ -112,9 +264,21 @@ func (u *userUseCase) RefreshPassport(req *users.UserRefreshCredential) (*users.
 	// check oauth
 	oauth, err := u.userRepository.FindOneOauth(req.RefreshToken)
 	if err != nil {
+		// a retired refresh token is being replayed
+		if retired, retiredErr := u.userRepository.FindRetiredOauth(req.RefreshToken); retiredErr == nil {
+			return nil, u.revokeOauthFamily(retired, req.Ip)
+		}
 		return nil, err
 	}
 
+	// refreshing doesn't extend a session past its limits
+	if u.sessionExpired(oauth) {
+		if _, err := u.DeleteOauth(oauth.Id); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("session has expired")
+	}
+
 	profile, err := u.userRepository.GetProfile(oauth.UserId)
 	if err != nil {
 		return nil, err
@@ -145,18 +309,54 @@ func (u *userUseCase) RefreshPassport(req *users.UserRefreshCredential) (*users.
 		},
 	}
 
-	if err := u.userRepository.UpdateOauth(passport.Token); err != nil {
+	if err := u.userRepository.UpdateOauth(req.RefreshToken, passport.Token); err != nil {
+		if errors.Is(err, users.ErrRefreshTokenReused) {
+			return nil, u.revokeOauthFamily(oauth, req.Ip)
+		}
 		return nil, err
 	}
+	// the old access token is cached as a valid session
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(oauth.UserId))
 
 	return passport, nil
 }
 
-func (u *userUseCase) DeleteOauth(oauthId string) error {
-	if err := u.userRepository.DeleteOauth(oauthId); err != nil {
+func (u *userUseCase) sessionExpired(oauth *users.Oauth) bool {
+	lifetime := u.cfg.Session().AbsoluteLifetime()
+	idle := u.cfg.Session().IdleTimeout()
+
+	return (lifetime != 0 && time.Duration(oauth.Age)*time.Second >= lifetime) ||
+		(idle != 0 && time.Duration(oauth.Idle)*time.Second >= idle)
+}
+
+// Revoke every token of the family and keep a record of it,
+// the caller always gets an error back.
+func (u *userUseCase) revokeOauthFamily(oauth *users.Oauth, ip string) error {
+	if _, err := u.userRepository.DeleteOauth(oauth.Id); err != nil {
 		return err
 	}
-	return nil
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(oauth.UserId))
+
+	u.auditUseCase.Record(&audit.Event{
+		Action:   audit.ActionRefreshTokenReuse,
+		TargetId: oauth.UserId,
+		Ip:       ip,
+		Outcome:  audit.OutcomeFailure,
+		Metadata: map[string]any{"oauth_id": oauth.Id},
+	})
+
+	return fmt.Errorf("refresh token reuse detected")
+}
+
+// The user who has been signed out
+func (u *userUseCase) DeleteOauth(oauthId string) (string, error) {
+	userId, err := u.userRepository.DeleteOauth(oauthId)
+	if err != nil {
+		return "", err
+	}
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(userId))
+
+	return userId, nil
 }
 
 func (u *userUseCase) GetUserProfile(userId string) (*users.User, error) {
@@ -167,3 +367,894 @@ func (u *userUseCase) GetUserProfile(userId string) (*users.User, error) {
 
 	return profile, nil
 }
+
+func (u *userUseCase) ParseChallenge(challengeToken string) (string, error) {
+	claims, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Challenge, u.cfg.Jwt(), challengeToken)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Claims.Id, nil
+}
+
+// Second step of signing in
+func (u *userUseCase) VerifyMfa(req *users.UserMfaReq) (*users.UserPassport, error) {
+	userId, err := u.ParseChallenge(req.ChallengeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	totp, err := u.userRepository.FindTotp(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !totp.Enabled {
+		return nil, fmt.Errorf("2fa is not enabled")
+	}
+
+	// the challenge may have been issued before the user was disabled
+	if totp.Disabled {
+		return nil, fmt.Errorf("user has been disabled")
+	}
+
+	// wrong codes count towards the same lockout as wrong passwords
+	identifier := strings.ToLower(totp.Email)
+	if err := u.checkLoginAttempts(identifier, req.Ip); err != nil {
+		return nil, err
+	}
+
+	if err := u.verifySecondFactor(userId, totp, req); err != nil {
+		u.failLogin(identifier, req.Ip, &users.UserCredentialCheck{
+			Id:    userId,
+			Email: totp.Email,
+		})
+		return nil, err
+	}
+	u.userRepository.InsertLoginAttempt(identifier, req.Ip, true)
+
+	profile, err := u.userRepository.GetProfile(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.issuePassport(profile)
+}
+
+func (u *userUseCase) verifySecondFactor(userId string, totp *users.UserTotp, req *users.UserMfaReq) error {
+	if req.RecoveryCode != "" {
+		return u.userRepository.UseRecoveryCode(userId, normalizeRecoveryCode(req.RecoveryCode))
+	}
+
+	step, ok := cafeBeansTotp.Validate(totp.Secret, req.Code, time.Now())
+	if !ok {
+		return fmt.Errorf("code is invalid")
+	}
+	return u.userRepository.UpdateTotpStep(userId, step)
+}
+
+// Start enrolling, the secret stays pending until it's activated with a code
+func (u *userUseCase) EnrollTotp(userId string) (*users.UserTotpEnrollment, error) {
+	totp, err := u.userRepository.FindTotp(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp.Enabled {
+		return nil, fmt.Errorf("2fa is already enabled")
+	}
+
+	secret, err := cafeBeansTotp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.userRepository.UpdateTotpSecret(userId, secret); err != nil {
+		return nil, err
+	}
+
+	uri := cafeBeansTotp.Uri(u.cfg.App().Name(), totp.Email, secret)
+	qrCode, err := cafeBeansTotp.QrCode(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.UserTotpEnrollment{
+		Secret: secret,
+		Uri:    uri,
+		QrCode: qrCode,
+	}, nil
+}
+
+func (u *userUseCase) ActivateTotp(userId string, req *users.UserTotpReq) (*users.UserRecoveryCodes, error) {
+	totp, err := u.userRepository.FindTotp(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp.Enabled {
+		return nil, fmt.Errorf("2fa is already enabled")
+	}
+
+	if totp.Secret == "" {
+		return nil, fmt.Errorf("2fa is not enrolled")
+	}
+
+	step, ok := cafeBeansTotp.Validate(totp.Secret, req.Code, time.Now())
+	if !ok {
+		return nil, fmt.Errorf("code is invalid")
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.userRepository.EnableTotp(userId, step, codes); err != nil {
+		return nil, err
+	}
+
+	return &users.UserRecoveryCodes{
+		RecoveryCodes: codes,
+	}, nil
+}
+
+func (u *userUseCase) DisableTotp(userId string, req *users.UserTotpReq) error {
+	totp, err := u.userRepository.FindTotp(userId)
+	if err != nil {
+		return err
+	}
+
+	if totp.RoleId == users.MfaRequiredRoleId {
+		return fmt.Errorf("2fa is required for admin")
+	}
+
+	if !totp.Enabled {
+		return fmt.Errorf("2fa is not enabled")
+	}
+
+	step, ok := cafeBeansTotp.Validate(totp.Secret, req.Code, time.Now())
+	if !ok {
+		return fmt.Errorf("code is invalid")
+	}
+
+	if err := u.userRepository.UpdateTotpStep(userId, step); err != nil {
+		return err
+	}
+
+	if err := u.userRepository.DisableTotp(userId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 10 codes of "xxxxx-xxxxx"
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 10)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate recovery codes failed: %v", err)
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+// Refuse while the account or the ip is locked, and slow down
+// repeated failures of an account before it gets locked
+func (u *userUseCase) checkLoginAttempts(identifier, ip string) error {
+	lockout := int(u.cfg.Login().Lockout().Seconds())
+
+	failures, err := u.userRepository.FindLoginFailures(identifier, ip, u.cfg.Login().Lockout())
+	if err != nil {
+		return err
+	}
+
+	if failures.Ip >= u.cfg.Login().MaxIpAttempts() {
+		return &users.LoginLockedError{RetryAfter: lockout - failures.SinceIpFailure}
+	}
+
+	if failures.Account >= u.cfg.Login().MaxAttempts() {
+		return &users.LoginLockedError{RetryAfter: lockout - failures.SinceAccountFailure}
+	}
+
+	// 2, 4, 8, ... seconds from the third failure on
+	if failures.Account >= 3 {
+		delay := lockout
+		if shift := failures.Account - 2; shift < 16 && 1<<shift < lockout {
+			delay = 1 << shift
+		}
+		if failures.SinceAccountFailure < delay {
+			return &users.LoginLockedError{RetryAfter: delay - failures.SinceAccountFailure}
+		}
+	}
+
+	return nil
+}
+
+// Record a failure and email an unlock link the moment the account gets locked
+func (u *userUseCase) failLogin(identifier, ip string, user *users.UserCredentialCheck) {
+	if err := u.userRepository.InsertLoginAttempt(identifier, ip, false); err != nil {
+		log.Printf("record failed sign in: %v", err)
+		return
+	}
+
+	if user == nil {
+		return
+	}
+
+	failures, err := u.userRepository.FindLoginFailures(identifier, ip, u.cfg.Login().Lockout())
+	if err != nil || failures.Account != u.cfg.Login().MaxAttempts() {
+		return
+	}
+
+	if err := u.sendUnlockEmail(user.Id, user.Email); err != nil {
+		log.Printf("send unlock email: %v", err)
+	}
+}
+
+func (u *userUseCase) sendUnlockEmail(userId, email string) error {
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.userRepository.InsertOneTimeToken(&users.OneTimeToken{
+		UserId:    userId,
+		Purpose:   users.OneTimeTokenUnlock,
+		Token:     token,
+		ExpiresIn: 3600,
+	}); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"There were too many failed attempts to sign in to your account, so it's locked for now.\n\n"+
+			"If it was you, unlock it here (valid for 1 hour):\n%s/unlock?token=%s\n\n"+
+			"If it wasn't you, consider changing your password.",
+		u.cfg.App().WebUrl(),
+		token,
+	)
+
+	// don't keep the request waiting for the mail server
+	go func() {
+		if err := u.mailer.Send(email, "Your account has been locked", body); err != nil {
+			log.Printf("send unlock email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Send a new unlock link, the email is never revealed to exist or not
+func (u *userUseCase) RequestUnlock(req *users.UserUnlockReq) error {
+	user, err := u.userRepository.FindOneUserByEmail(req.Email)
+	if err != nil {
+		return nil
+	}
+
+	failures, err := u.userRepository.FindLoginFailures(strings.ToLower(user.Email), "", u.cfg.Login().Lockout())
+	if err != nil {
+		return err
+	}
+
+	if failures.Account < u.cfg.Login().MaxAttempts() {
+		return nil
+	}
+
+	return u.sendUnlockEmail(user.Id, user.Email)
+}
+
+// Delete the attempts that have fallen out of the lockout window
+func (u *userUseCase) PruneLoginAttempts() (int, error) {
+	return u.userRepository.DeleteLoginAttemptsBefore(time.Now().Add(-u.cfg.Login().Lockout()))
+}
+
+func (u *userUseCase) Unlock(req *users.UserUnlockReq) error {
+	token, err := u.userRepository.UseOneTimeToken(users.OneTimeTokenUnlock, req.Token)
+	if err != nil {
+		return err
+	}
+
+	profile, err := u.userRepository.GetProfile(token.UserId)
+	if err != nil {
+		return err
+	}
+
+	return u.userRepository.DeleteLoginFailures(strings.ToLower(profile.Email))
+}
+
+// Start signing in with a provider, the client sends the user to the url
+func (u *userUseCase) OidcAuthUrl(provider string) (*users.OidcAuthUrl, error) {
+	client, ok := u.oidcClients[provider]
+	if !ok {
+		return nil, fmt.Errorf("provider not found")
+	}
+
+	state, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	codeVerifier, err := cafeBeansOidc.NewCodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	authUrl, err := client.AuthCodeUrl(state, nonce, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.userRepository.InsertOidcState(&users.OidcState{
+		Provider:     provider,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &users.OidcAuthUrl{
+		AuthorizationUrl: authUrl,
+	}, nil
+}
+
+// Finish signing in with a provider. A new identity is linked to the user
+// with the same email when the provider verified it, otherwise a customer is created.
+func (u *userUseCase) OidcSignIn(provider string, req *users.OidcCallbackReq) (*users.UserPassport, error) {
+	client, ok := u.oidcClients[provider]
+	if !ok {
+		return nil, fmt.Errorf("provider not found")
+	}
+
+	state, err := u.userRepository.UseOidcState(provider, req.State)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := client.Exchange(req.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := u.userRepository.FindOneUserByIdentity(provider, identity.Subject)
+	if err == nil {
+		return u.signIn(user)
+	}
+
+	if identity.Email == "" {
+		return nil, fmt.Errorf("email is required")
+	}
+
+	user, err = u.userRepository.FindOneUserByEmail(identity.Email)
+	if err == nil && !identity.EmailVerified {
+		// anyone can claim an unverified email at some providers
+		return nil, fmt.Errorf("email has been used")
+	}
+	if err != nil {
+		if user, err = u.insertOidcCustomer(identity); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := u.userRepository.InsertIdentity(&users.UserIdentity{
+		UserId:   user.Id,
+		Provider: provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}); err != nil {
+		return nil, err
+	}
+
+	return u.signIn(user)
+}
+
+// A customer without a usable password, the username comes from the email
+func (u *userUseCase) insertOidcCustomer(identity *cafeBeansOidc.Identity) (*users.UserCredentialCheck, error) {
+	password, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(strings.Split(identity.Email, "@")[0]))
+
+	for i := 0; i < 3; i++ {
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, fmt.Errorf("generate username failed: %v", err)
+		}
+
+		req := &users.UserRegisterReq{
+			Email:    identity.Email,
+			Password: password,
+			Username: name + "_" + hex.EncodeToString(suffix),
+		}
+		if err := req.HashPassword(u.hasher); err != nil {
+			return nil, err
+		}
+
+		result, err := u.userRepository.InsertUser(req, false)
+		if err != nil {
+			if err.Error() == "username has been used" {
+				continue
+			}
+			return nil, err
+		}
+
+		return &users.UserCredentialCheck{
+			Id:       result.User.Id,
+			Email:    result.User.Email,
+			Username: result.User.Username,
+			RoleId:   result.User.RoleId,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("username has been used")
+}
+
+// Email a single-use sign in link valid for 15 minutes, at most 3 per
+// 15 minutes. The email is never revealed to exist or not.
+func (u *userUseCase) RequestMagicLink(req *users.UserMagicLinkReq) error {
+	user, err := u.userRepository.FindOneUserByEmail(req.Email)
+	if err != nil {
+		return nil
+	}
+
+	count, err := u.userRepository.CountOneTimeTokens(user.Id, users.OneTimeTokenMagicLink, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+	if count >= 3 {
+		return nil
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.userRepository.InsertOneTimeToken(&users.OneTimeToken{
+		UserId:    user.Id,
+		Purpose:   users.OneTimeTokenMagicLink,
+		Token:     token,
+		ExpiresIn: 900,
+	}); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Sign in to %s with this link (valid for 15 minutes, works once):\n%s/magic-link?token=%s\n\n"+
+			"If you didn't ask for it, you can ignore this email.",
+		u.cfg.App().Name(),
+		u.cfg.App().WebUrl(),
+		token,
+	)
+
+	go func() {
+		if err := u.mailer.Send(user.Email, "Your sign in link", body); err != nil {
+			log.Printf("send magic link: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (u *userUseCase) MagicLinkSignIn(req *users.UserMagicLinkReq) (*users.UserPassport, error) {
+	token, err := u.userRepository.UseOneTimeToken(users.OneTimeTokenMagicLink, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := u.userRepository.FindOneUserById(token.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	passport, err := u.signIn(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if passport.Mfa == nil {
+		u.userRepository.InsertLoginAttempt(strings.ToLower(user.Email), req.Ip, true)
+	}
+	return passport, nil
+}
+
+// The username changes right away, a new email waits for a confirmation
+// sent to that address
+func (u *userUseCase) UpdateUserProfile(userId string, req *users.UserUpdateReq) (*users.UserUpdateResult, error) {
+	profile, err := u.userRepository.GetProfile(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Username != "" && req.Username != profile.Username {
+		if err := u.userRepository.UpdateUsername(userId, req.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	result := new(users.UserUpdateResult)
+	if req.Email != "" && !strings.EqualFold(req.Email, profile.Email) {
+		if _, err := u.userRepository.FindOneUserByEmail(req.Email); err == nil {
+			return nil, fmt.Errorf("email has been used")
+		}
+
+		token, err := utils.RandomToken(32)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := u.userRepository.InsertOneTimeToken(&users.OneTimeToken{
+			UserId:    userId,
+			Purpose:   users.OneTimeTokenEmailChange,
+			Token:     token,
+			Payload:   req.Email,
+			ExpiresIn: 86400,
+		}); err != nil {
+			return nil, err
+		}
+
+		body := fmt.Sprintf(
+			"Confirm this is your new email for %s (valid for 24 hours):\n%s/confirm-email?token=%s\n\n"+
+				"If you didn't ask for it, you can ignore this email.",
+			u.cfg.App().Name(),
+			u.cfg.App().WebUrl(),
+			token,
+		)
+
+		go func(email string) {
+			if err := u.mailer.Send(email, "Confirm your new email", body); err != nil {
+				log.Printf("send email confirmation: %v", err)
+			}
+		}(req.Email)
+
+		result.PendingEmail = req.Email
+	}
+
+	if result.User, err = u.userRepository.GetProfile(userId); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (u *userUseCase) ConfirmEmailChange(req *users.UserEmailConfirmReq) (*users.User, error) {
+	change, err := u.userRepository.ChangeEmail(req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	// let the old address know in case it wasn't the owner
+	go func(email string) {
+		body := fmt.Sprintf("The email of your %s account has been changed to %s.", u.cfg.App().Name(), change.Email)
+		if err := u.mailer.Send(email, "Your email has been changed", body); err != nil {
+			log.Printf("send email change notice: %v", err)
+		}
+	}(change.PreviousEmail)
+
+	return u.userRepository.GetProfile(change.UserId)
+}
+
+// Avatars are stored as 256x256 png thumbnails, a new file name
+// each time so cached copies of the old one don't linger
+func (u *userUseCase) UploadAvatar(userId string, data []byte) (*users.User, error) {
+	profile, err := u.userRepository.GetProfile(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnail, err := cafeBeansImage.SquareThumbnail(data, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("generate file name failed: %v", err)
+	}
+
+	avatarUrl, err := u.storage.Upload(
+		fmt.Sprintf("avatars/%s-%s.png", userId, hex.EncodeToString(suffix)),
+		"image/png",
+		thumbnail,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.userRepository.UpdateAvatar(userId, avatarUrl); err != nil {
+		u.storage.Delete(avatarUrl)
+		return nil, err
+	}
+
+	u.deleteAvatarFile(profile.AvatarUrl)
+
+	profile.AvatarUrl = avatarUrl
+	return profile, nil
+}
+
+func (u *userUseCase) DeleteAvatar(userId string) (*users.User, error) {
+	profile, err := u.userRepository.GetProfile(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.userRepository.UpdateAvatar(userId, ""); err != nil {
+		return nil, err
+	}
+
+	u.deleteAvatarFile(profile.AvatarUrl)
+
+	profile.AvatarUrl = ""
+	return profile, nil
+}
+
+// A leftover file is only wasted space, so failures are just logged
+func (u *userUseCase) deleteAvatarFile(avatarUrl string) {
+	if avatarUrl == "" {
+		return
+	}
+	if err := u.storage.Delete(avatarUrl); err != nil {
+		log.Printf("delete avatar: %v", err)
+	}
+}
+
+// Personal data as json, or as a zip with the json inside
+func (u *userUseCase) ExportUser(userId, format string) (*users.UserExport, error) {
+	data, err := u.userRepository.ExportUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := fmt.Sprintf("cafe-beans-%s-%s", userId, time.Now().Format("20060102"))
+	if format != "zip" {
+		return &users.UserExport{
+			Filename:    filename + ".json",
+			ContentType: "application/json",
+			Data:        data,
+		}, nil
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create(filename + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("create export archive failed: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("create export archive failed: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("create export archive failed: %v", err)
+	}
+
+	return &users.UserExport{
+		Filename:    filename + ".zip",
+		ContentType: "application/zip",
+		Data:        buf.Bytes(),
+	}, nil
+}
+
+// Deleting is confirmed from the email so a stolen session alone can't do it
+func (u *userUseCase) RequestDeletion(userId string) error {
+	profile, err := u.userRepository.GetProfile(userId)
+	if err != nil {
+		return err
+	}
+
+	if profile.RoleId == roles.AdminRoleId {
+		return fmt.Errorf("admin has to be changed to another role first")
+	}
+
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.userRepository.InsertOneTimeToken(&users.OneTimeToken{
+		UserId:    userId,
+		Purpose:   users.OneTimeTokenDeletion,
+		Token:     token,
+		ExpiresIn: 3600,
+	}); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Confirm deleting your %s account (valid for 1 hour):\n%s/delete-account?token=%s\n\n"+
+			"Your profile, sessions and sign in methods are removed for good. "+
+			"Orders are kept without your name and email for accounting.\n\n"+
+			"If you didn't ask for it, change your password.",
+		u.cfg.App().Name(),
+		u.cfg.App().WebUrl(),
+		token,
+	)
+
+	go func() {
+		if err := u.mailer.Send(profile.Email, "Confirm deleting your account", body); err != nil {
+			log.Printf("send deletion confirmation: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (u *userUseCase) ConfirmDeletion(req *users.UserDeletionReq) error {
+	token, err := u.userRepository.UseOneTimeToken(users.OneTimeTokenDeletion, req.Token)
+	if err != nil {
+		return err
+	}
+
+	profile, err := u.userRepository.GetProfile(token.UserId)
+	if err != nil {
+		return err
+	}
+
+	if profile.RoleId == roles.AdminRoleId {
+		return fmt.Errorf("admin has to be changed to another role first")
+	}
+
+	if err := u.userRepository.AnonymizeUser(token.UserId); err != nil {
+		return err
+	}
+
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(token.UserId))
+	u.deleteAvatarFile(profile.AvatarUrl)
+
+	return nil
+}
+
+func (u *userUseCase) FindUsers(req *users.UserFilter) (*users.UserAccountPage, error) {
+	for _, date := range []string{req.CreatedFrom, req.CreatedTo} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("created date must be formatted as yyyy-mm-dd")
+		}
+	}
+
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 1 {
+		req.Limit = 20
+	}
+	if req.Limit > 100 {
+		req.Limit = 100
+	}
+
+	accounts, count, err := u.userRepository.FindUsers(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.UserAccountPage{
+		Data:      accounts,
+		Page:      req.Page,
+		Limit:     req.Limit,
+		TotalItem: count,
+		TotalPage: (count + req.Limit - 1) / req.Limit,
+	}, nil
+}
+
+func (u *userUseCase) FindUserAccount(userId string) (*users.UserAccountDetail, error) {
+	return u.userRepository.FindOneUserAccount(userId)
+}
+
+// Disabling also signs the user out everywhere
+func (u *userUseCase) DisableUser(adminId, userId string) (*users.UserAccountDetail, error) {
+	if adminId == userId {
+		return nil, fmt.Errorf("you can't disable yourself")
+	}
+
+	if err := u.userRepository.UpdateDisabled(userId, true); err != nil {
+		return nil, err
+	}
+
+	if _, err := u.userRepository.DeleteUserOauth(userId); err != nil {
+		return nil, err
+	}
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(userId))
+
+	return u.userRepository.FindOneUserAccount(userId)
+}
+
+func (u *userUseCase) EnableUser(userId string) (*users.UserAccountDetail, error) {
+	if err := u.userRepository.UpdateDisabled(userId, false); err != nil {
+		return nil, err
+	}
+
+	return u.userRepository.FindOneUserAccount(userId)
+}
+
+// How many sessions were revoked and the account without them
+func (u *userUseCase) ForceSignOut(userId string) (int, *users.UserAccountDetail, error) {
+	if _, err := u.userRepository.FindOneUserById(userId); err != nil {
+		return 0, nil, err
+	}
+
+	count, err := u.userRepository.DeleteUserOauth(userId)
+	if err != nil {
+		return 0, nil, err
+	}
+	u.cache.DeletePrefix(cafeBeansCache.SessionPrefix(userId))
+
+	account, err := u.userRepository.FindOneUserAccount(userId)
+	if err != nil {
+		return 0, nil, err
+	}
+	return count, account, nil
+}
+
+// An admin sees the api as the user does for a short while,
+// the token is refused where the user would change credentials or spend money
+func (u *userUseCase) Impersonate(adminId, userId string, req *users.UserImpersonationReq) (*users.UserImpersonation, error) {
+	if adminId == userId {
+		return nil, fmt.Errorf("you can't impersonate yourself")
+	}
+
+	account, err := u.userRepository.FindOneUserAccount(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case account.User.DeletedAt != nil:
+		return nil, fmt.Errorf("user not found")
+	case account.User.DisabledAt != nil:
+		return nil, fmt.Errorf("user has been disabled")
+	case account.User.RoleId == roles.AdminRoleId:
+		return nil, fmt.Errorf("admins can't be impersonated")
+	}
+
+	accessToken, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Impersonation, u.cfg.Jwt(), &users.UserClaims{
+		Id:             account.User.Id,
+		RoleId:         account.User.RoleId,
+		ImpersonatorId: adminId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	token := accessToken.SignToken()
+
+	oauthId, err := u.userRepository.InsertImpersonation(&users.ImpersonationLog{
+		AdminId:   adminId,
+		UserId:    userId,
+		Reason:    req.Reason,
+		Ip:        req.Ip,
+		ExpiresIn: cafeBeansAuth.ImpersonationExpiresIn,
+	}, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.UserImpersonation{
+		Id: oauthId,
+		User: &users.User{
+			Id:        account.User.Id,
+			Email:     account.User.Email,
+			Username:  account.User.Username,
+			RoleId:    account.User.RoleId,
+			AvatarUrl: account.User.AvatarUrl,
+		},
+		ImpersonatorId: adminId,
+		AccessToken:    token,
+		ExpiresIn:      cafeBeansAuth.ImpersonationExpiresIn,
+	}, nil
+}
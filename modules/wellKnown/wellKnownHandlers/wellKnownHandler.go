@@ -0,0 +1,32 @@
+package wellKnownHandlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+type IWellKnownHandler interface {
+	Jwks(c *fiber.Ctx) error
+}
+
+type wellKnownHandler struct {
+	cfg config.IConfig
+}
+
+func WellKnownHandler(cfg config.IConfig) IWellKnownHandler {
+	return &wellKnownHandler{
+		cfg: cfg,
+	}
+}
+
+func (h *wellKnownHandler) Jwks(c *fiber.Ctx) error {
+	// keys only change on rotation, let the verifiers cache them for a while
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		cafeBeansAuth.JwkSet(h.cfg.Jwt()),
+	).Res()
+}
@@ -0,0 +1,235 @@
+package cafeBeansAddress
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Every province with the first two digits of its postal codes,
+// tab separated, the prefixes are comma separated
+//
+//go:embed provinces.tsv
+var provinceList string
+
+// Sub-districts as tab separated province, district, sub-district and postal code,
+// built by internal/gen from the postal code list of Thailand Post.
+// Provinces without any of their sub-districts here are only checked
+// against their postal codes.
+//
+//go:generate go run ./internal/gen -in postal_codes.csv -out sub_districts.tsv
+//go:embed sub_districts.tsv
+var subDistrictList string
+
+type Entry struct {
+	SubDistrict string `json:"sub_district"`
+	District    string `json:"district"`
+	Province    string `json:"province"`
+	PostalCode  string `json:"postal_code"`
+}
+
+type IAddressBook interface {
+	// Sub-districts matching the start of any of their fields first,
+	// then the ones containing the query
+	Search(query string, limit int) []*Entry
+	Province(name string) (string, bool)
+	// Whether sub-districts of the province are known
+	HasDistricts(province string) bool
+	District(province, district string) (string, bool)
+	SubDistricts(province, district, subDistrict string) []*Entry
+	PostalCodeInProvince(province, postalCode string) bool
+}
+
+type addressBook struct {
+	entries []*Entry
+	// normalized name to the name in the dataset
+	provinces      map[string]string
+	postalPrefixes map[string][]string
+	districts      map[string]map[string]string
+	subDistricts   map[string][]*Entry
+}
+
+func NewAddressBook() (IAddressBook, error) {
+	b := &addressBook{
+		entries:        make([]*Entry, 0),
+		provinces:      make(map[string]string),
+		postalPrefixes: make(map[string][]string),
+		districts:      make(map[string]map[string]string),
+		subDistricts:   make(map[string][]*Entry),
+	}
+
+	for _, line := range strings.Split(provinceList, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		b.provinces[normalize(fields[0])] = fields[0]
+		b.postalPrefixes[fields[0]] = strings.Split(fields[1], ",")
+	}
+
+	if err := b.load(strings.NewReader(subDistrictList)); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *addressBook) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+		if len(fields) != 4 {
+			return fmt.Errorf("load address dataset failed: line %d must have 4 fields", line)
+		}
+		entry := &Entry{
+			Province:    strings.TrimSpace(fields[0]),
+			District:    strings.TrimSpace(fields[1]),
+			SubDistrict: strings.TrimSpace(fields[2]),
+			PostalCode:  strings.TrimSpace(fields[3]),
+		}
+
+		province, ok := b.Province(entry.Province)
+		if !ok {
+			return fmt.Errorf("load address dataset failed: line %d has an unknown province", line)
+		}
+		entry.Province = province
+
+		key := normalize(entry.District)
+		if b.districts[province] == nil {
+			b.districts[province] = make(map[string]string)
+		}
+		b.districts[province][key] = entry.District
+
+		key = subDistrictKey(province, entry.District, entry.SubDistrict)
+		if duplicated(b.subDistricts[key], entry) {
+			continue
+		}
+		b.subDistricts[key] = append(b.subDistricts[key], entry)
+		b.entries = append(b.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("load address dataset failed: %v", err)
+	}
+	return nil
+}
+
+func duplicated(entries []*Entry, entry *Entry) bool {
+	for _, e := range entries {
+		if e.PostalCode == entry.PostalCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Administrative prefixes people often type, longest first
+var prefixes = []string{
+	"จังหวัด", "อำเภอ", "ตำบล", "แขวง", "เขต", "จ.", "อ.", "ต.",
+}
+
+// Aliases of provinces that aren't a prefix away from their names
+var aliases = map[string]string{
+	"กรุงเทพ":  "กรุงเทพมหานคร",
+	"กรุงเทพฯ": "กรุงเทพมหานคร",
+	"กทม":      "กรุงเทพมหานคร",
+	"กทม.":     "กรุงเทพมหานคร",
+	"อยุธยา":   "พระนครศรีอยุธยา",
+}
+
+func normalize(name string) string {
+	name = strings.Join(strings.Fields(name), "")
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			name = strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+	if alias, ok := aliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func subDistrictKey(province, district, subDistrict string) string {
+	return province + "\t" + normalize(district) + "\t" + normalize(subDistrict)
+}
+
+func (b *addressBook) Province(name string) (string, bool) {
+	province, ok := b.provinces[normalize(name)]
+	return province, ok
+}
+
+func (b *addressBook) HasDistricts(province string) bool {
+	return len(b.districts[province]) != 0
+}
+
+func (b *addressBook) District(province, district string) (string, bool) {
+	name, ok := b.districts[province][normalize(district)]
+	return name, ok
+}
+
+// A sub-district may have more than one postal code
+func (b *addressBook) SubDistricts(province, district, subDistrict string) []*Entry {
+	return b.subDistricts[subDistrictKey(province, district, subDistrict)]
+}
+
+func (b *addressBook) PostalCodeInProvince(province, postalCode string) bool {
+	for _, prefix := range b.postalPrefixes[province] {
+		if strings.HasPrefix(postalCode, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *addressBook) Search(query string, limit int) []*Entry {
+	query = normalize(query)
+	if query == "" {
+		return make([]*Entry, 0)
+	}
+
+	type match struct {
+		entry *Entry
+		rank  int
+	}
+	matches := make([]*match, 0)
+	for _, e := range b.entries {
+		rank := -1
+		for _, field := range []string{e.SubDistrict, e.District, e.Province, e.PostalCode} {
+			switch {
+			case strings.HasPrefix(field, query):
+				rank = 0
+			case rank < 0 && strings.Contains(field, query):
+				rank = 1
+			}
+			if rank == 0 {
+				break
+			}
+		}
+		if rank >= 0 {
+			matches = append(matches, &match{entry: e, rank: rank})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].rank < matches[j].rank
+	})
+
+	result := make([]*Entry, 0)
+	for _, m := range matches {
+		if len(result) == limit {
+			break
+		}
+		entry := *m.entry
+		result = append(result, &entry)
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+// Gen builds sub_districts.tsv from the postal code list of Thailand Post,
+// saved as csv with a header naming the province, district, sub_district
+// and postal_code columns, the other columns are ignored.
+//
+//	go generate ./pkg/cafeBeansAddress
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var postalCodePattern = regexp.MustCompile(`^[1-9][0-9]{4}$`)
+
+// Administrative prefixes, the dataset keeps the bare names
+var prefixes = []string{
+	"จังหวัด", "อำเภอ", "ตำบล", "แขวง", "เขต",
+}
+
+func main() {
+	in := flag.String("in", "", "csv of the postal code list")
+	out := flag.String("out", "sub_districts.tsv", "tsv to write")
+	flag.Parse()
+
+	if *in == "" {
+		log.Fatal("gen: -in is required")
+	}
+
+	rows, err := read(*in)
+	if err != nil {
+		log.Fatalf("gen: %v", err)
+	}
+	if err := write(*out, rows); err != nil {
+		log.Fatalf("gen: %v", err)
+	}
+	log.Printf("gen: wrote %d sub-districts to %s", len(rows), *out)
+}
+
+func trimName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(name, prefix))
+		}
+	}
+	return name
+}
+
+// Province, district, sub-district and postal code of every row,
+// in the order of the source without duplicates
+func read(path string) ([][4]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReader(f))
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header failed: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	index := [4]int{}
+	for i, name := range []string{"province", "district", "sub_district", "postal_code"} {
+		column, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("header has no %s column", name)
+		}
+		index[i] = column
+	}
+
+	rows := make([][4]string, 0)
+	seen := make(map[[4]string]bool)
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		var row [4]string
+		for i, column := range index {
+			if column >= len(record) {
+				return nil, fmt.Errorf("line %d has too few columns", line)
+			}
+			row[i] = trimName(record[column])
+			if row[i] == "" || strings.ContainsAny(row[i], "\t\n") {
+				return nil, fmt.Errorf("line %d has an invalid %s", line, header[column])
+			}
+		}
+		if !postalCodePattern.MatchString(row[3]) {
+			return nil, fmt.Errorf("line %d has an invalid postal code", line)
+		}
+
+		if seen[row] {
+			continue
+		}
+		seen[row] = true
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func write(path string, rows [][4]string) error {
+	var b strings.Builder
+	for _, row := range rows {
+		b.WriteString(strings.Join(row[:], "\t"))
+		b.WriteString("\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/pandakn/cafe-beans/config"
 	"github.com/pandakn/cafe-beans/modules/users"
 )
@@ -17,7 +18,11 @@ const (
 	Access  TokenType = "access"
 	Refresh TokenType = "refresh"
 	Admin   TokenType = "admin"
-	ApiKey  TokenType = "apiKey"
+	// proves the password was right, exchanged for a passport with a second factor
+	Challenge TokenType = "challenge"
+	// an access token an admin holds on behalf of a user, can't be refreshed
+	Impersonation TokenType = "impersonation"
+	ApiKey        TokenType = "apiKey" // legacy stateless api keys, only verified
 )
 
 func jwtTimeDurationCal(t int) *jwt.NumericDate {
@@ -38,10 +43,6 @@ type cafeBeansAdmin struct {
 	*cafeBeansAuth
 }
 
-type cafeBeansApiKey struct {
-	*cafeBeansAuth
-}
-
 type cafeBeansMapClaims struct {
 	Claims *users.UserClaims `json:"claims"`
 	jwt.RegisteredClaims
@@ -55,14 +56,8 @@ type ICafeBeansAdmin interface {
 	SignToken() string
 }
 
-type ICafeBeansApiKey interface {
-	SignToken() string
-}
-
 func (a *cafeBeansAuth) SignToken() string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, a.mapClaims)
-	ss, _ := token.SignedString(a.cfg.SecretKey())
-	return ss
+	return signUserToken(a.cfg, a.mapClaims)
 }
 
 func (a *cafeBeansAdmin) SignToken() string {
@@ -71,73 +66,84 @@ func (a *cafeBeansAdmin) SignToken() string {
 	return ss
 }
 
-func (a *cafeBeansApiKey) SignToken() string {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, a.mapClaims)
-	ss, _ := token.SignedString(a.cfg.ApiKey())
-	return ss
-}
+var (
+	ErrTokenMalformed = errors.New("token format is invalid")
+	ErrTokenExpired   = errors.New("token had expired")
+	ErrTokenSignature = errors.New("token signature is invalid")
+	ErrTokenClaims    = errors.New("token claims are invalid")
+)
 
-func ParseToken(cfg config.IJwtConfig, tokenString string) (*cafeBeansMapClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &cafeBeansMapClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("signing method is invalid")
-		}
-		return cfg.SecretKey(), nil
-	})
-	if err != nil {
-		if errors.Is(err, jwt.ErrTokenMalformed) {
-			return nil, fmt.Errorf("token format is invalid")
-		} else if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, fmt.Errorf("token had expired")
-		} else {
-			return nil, fmt.Errorf("parse token failed: %v", err)
-		}
-	}
+const issuer = "cafe-beans-api"
 
-	if claims, ok := token.Claims.(*cafeBeansMapClaims); ok {
-		return claims, nil
-	} else {
-		return nil, fmt.Errorf("claims type is invalid")
-	}
+// What a token of each type must carry to be accepted
+type verifier struct {
+	subject  string
+	audience string
+	keyFunc  func(cfg config.IJwtConfig) jwt.Keyfunc
 }
 
-func ParseAdminToken(cfg config.IJwtConfig, tokenString string) (*cafeBeansMapClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &cafeBeansMapClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("signing method is invalid")
-		}
-		return cfg.AdminKey(), nil
-	})
-	if err != nil {
-		if errors.Is(err, jwt.ErrTokenMalformed) {
-			return nil, fmt.Errorf("token format is invalid")
-		} else if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, fmt.Errorf("token had expired")
-		} else {
-			return nil, fmt.Errorf("parse token failed: %v", err)
-		}
-	}
+var verifiers = map[TokenType]*verifier{
+	Access: {
+		subject:  "access-token",
+		audience: "customers",
+		keyFunc:  userKeyFunc,
+	},
+	Refresh: {
+		subject:  "refresh-token",
+		audience: "customers",
+		keyFunc:  userKeyFunc,
+	},
+	Challenge: {
+		subject:  "challenge-token",
+		audience: "customers",
+		keyFunc:  userKeyFunc,
+	},
+	Impersonation: {
+		subject:  "impersonation-token",
+		audience: "customers",
+		keyFunc:  userKeyFunc,
+	},
+	Admin: {
+		subject:  "admin-token",
+		audience: "admin",
+		keyFunc:  hmacKeyFunc(config.IJwtConfig.AdminKey),
+	},
+	ApiKey: {
+		subject:  "api-key",
+		audience: "admin",
+		keyFunc:  hmacKeyFunc(config.IJwtConfig.ApiKey),
+	},
+}
 
-	if claims, ok := token.Claims.(*cafeBeansMapClaims); ok {
-		return claims, nil
-	} else {
-		return nil, fmt.Errorf("claims type is invalid")
+// Verify the signature, issuer, audience, subject and lifetime of a token
+// of the given type. Errors are one of the ErrToken* values.
+func ParseToken(tokenType TokenType, cfg config.IJwtConfig, tokenString string) (*cafeBeansMapClaims, error) {
+	v, ok := verifiers[tokenType]
+	if !ok {
+		return nil, fmt.Errorf("unknown token type")
 	}
-}
 
-func ParseApiKey(cfg config.IJwtConfig, tokenString string) (*cafeBeansMapClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &cafeBeansMapClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("signing method is invalid")
-		}
-		return cfg.ApiKey(), nil
-	})
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&cafeBeansMapClaims{},
+		v.keyFunc(cfg),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(v.audience),
+		jwt.WithSubject(v.subject),
+		jwt.WithLeeway(cfg.Leeway()),
+	)
 	if err != nil {
-		if errors.Is(err, jwt.ErrTokenMalformed) {
-			return nil, fmt.Errorf("token format is invalid")
-		} else if errors.Is(err, jwt.ErrTokenExpired) {
-			return nil, fmt.Errorf("token had expired")
-		} else {
+		switch {
+		case errors.Is(err, jwt.ErrTokenMalformed):
+			return nil, ErrTokenMalformed
+		case errors.Is(err, jwt.ErrTokenExpired):
+			return nil, ErrTokenExpired
+		case errors.Is(err, jwt.ErrTokenSignatureInvalid),
+			errors.Is(err, jwt.ErrTokenUnverifiable):
+			return nil, ErrTokenSignature
+		case errors.Is(err, jwt.ErrTokenInvalidClaims):
+			return nil, ErrTokenClaims
+		default:
 			return nil, fmt.Errorf("parse token failed: %v", err)
 		}
 	}
@@ -155,10 +161,11 @@ func RepeatToken(cfg config.IJwtConfig, claims *users.UserClaims, exp int64) str
 		mapClaims: &cafeBeansMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
-				Issuer:    "cafe-beans-api",
+				Issuer:    issuer,
 				Subject:   "refresh-token",
 				Audience:  []string{"customers", "admin"},
 				ExpiresAt: jwtTimeRepeatAdapter(exp),
+				ID:        uuid.NewString(), // every rotated token must be unique
 				NotBefore: jwt.NewNumericDate(time.Now()),
 				IssuedAt:  jwt.NewNumericDate(time.Now()),
 			},
@@ -174,10 +181,12 @@ func NewCafeBeansAuth(tokenType TokenType, cfg config.IJwtConfig, claims *users.
 		return newAccessToken(cfg, claims), nil
 	case Refresh:
 		return newRefreshToken(cfg, claims), nil
+	case Challenge:
+		return newChallengeToken(cfg, claims), nil
+	case Impersonation:
+		return newImpersonationToken(cfg, claims), nil
 	case Admin:
 		return newAdminToken(cfg), nil
-	case ApiKey:
-		return newApiKey(cfg), nil
 	default:
 		return nil, fmt.Errorf("unknown token type")
 	}
@@ -189,10 +198,11 @@ func newAccessToken(cfg config.IJwtConfig, claims *users.UserClaims) ICafeBeansA
 		mapClaims: &cafeBeansMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
-				Issuer:    "cafe-beans-api",
+				Issuer:    issuer,
 				Subject:   "access-token",
 				Audience:  []string{"customers", "admin"},
 				ExpiresAt: jwtTimeDurationCal(cfg.AccessExpiresAt()),
+				ID:        uuid.NewString(),
 				NotBefore: jwt.NewNumericDate(time.Now()),
 				IssuedAt:  jwt.NewNumericDate(time.Now()),
 			},
@@ -206,10 +216,11 @@ func newRefreshToken(cfg config.IJwtConfig, claims *users.UserClaims) ICafeBeans
 		mapClaims: &cafeBeansMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
-				Issuer:    "cafe-beans-api",
+				Issuer:    issuer,
 				Subject:   "refresh-token",
 				Audience:  []string{"customers", "admin"},
 				ExpiresAt: jwtTimeDurationCal(cfg.RefreshExpiresAt()),
+				ID:        uuid.NewString(),
 				NotBefore: jwt.NewNumericDate(time.Now()),
 				IssuedAt:  jwt.NewNumericDate(time.Now()),
 			},
@@ -217,36 +228,56 @@ func newRefreshToken(cfg config.IJwtConfig, claims *users.UserClaims) ICafeBeans
 	}
 }
 
-func newAdminToken(cfg config.IJwtConfig) ICafeBeansAuth {
-	return &cafeBeansAdmin{
-		cafeBeansAuth: &cafeBeansAuth{
-			cfg: cfg,
-			mapClaims: &cafeBeansMapClaims{
-				Claims: nil,
-				RegisteredClaims: jwt.RegisteredClaims{
-					Issuer:    "cafe-beans-api",
-					Subject:   "admin-token",
-					Audience:  []string{"admin"},
-					ExpiresAt: jwtTimeDurationCal(300), // 3 minutes
-					NotBefore: jwt.NewNumericDate(time.Now()),
-					IssuedAt:  jwt.NewNumericDate(time.Now()),
-				},
+func newChallengeToken(cfg config.IJwtConfig, claims *users.UserClaims) ICafeBeansAuth {
+	return &cafeBeansAuth{
+		cfg: cfg,
+		mapClaims: &cafeBeansMapClaims{
+			Claims: claims,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    issuer,
+				Subject:   "challenge-token",
+				Audience:  []string{"customers", "admin"},
+				ExpiresAt: jwtTimeDurationCal(300), // 5 minutes
+				ID:        uuid.NewString(),
+				NotBefore: jwt.NewNumericDate(time.Now()),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
 			},
 		},
 	}
 }
 
-func newApiKey(cfg config.IJwtConfig) ICafeBeansAuth {
-	return &cafeBeansApiKey{
+// How long an impersonation token lasts, in seconds
+const ImpersonationExpiresIn = 900
+
+func newImpersonationToken(cfg config.IJwtConfig, claims *users.UserClaims) ICafeBeansAuth {
+	return &cafeBeansAuth{
+		cfg: cfg,
+		mapClaims: &cafeBeansMapClaims{
+			Claims: claims,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    issuer,
+				Subject:   "impersonation-token",
+				Audience:  []string{"customers", "admin"},
+				ExpiresAt: jwtTimeDurationCal(ImpersonationExpiresIn), // 15 minutes
+				ID:        uuid.NewString(),
+				NotBefore: jwt.NewNumericDate(time.Now()),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		},
+	}
+}
+
+func newAdminToken(cfg config.IJwtConfig) ICafeBeansAuth {
+	return &cafeBeansAdmin{
 		cafeBeansAuth: &cafeBeansAuth{
 			cfg: cfg,
 			mapClaims: &cafeBeansMapClaims{
 				Claims: nil,
 				RegisteredClaims: jwt.RegisteredClaims{
-					Issuer:    "cafe-beans-api",
-					Subject:   "api-key",
-					Audience:  []string{"admin", "customer"},
-					ExpiresAt: jwt.NewNumericDate(time.Now().AddDate(2, 0, 0)), // 2 years
+					Issuer:    issuer,
+					Subject:   "admin-token",
+					Audience:  []string{"admin"},
+					ExpiresAt: jwtTimeDurationCal(300), // 3 minutes
 					NotBefore: jwt.NewNumericDate(time.Now()),
 					IssuedAt:  jwt.NewNumericDate(time.Now()),
 				},
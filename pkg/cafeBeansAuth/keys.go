@@ -0,0 +1,135 @@
+package cafeBeansAuth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/config"
+)
+
+// JSON Web Key (RFC 7517), only the public part is ever exposed
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type Jwks struct {
+	Keys []*Jwk `json:"keys"`
+}
+
+func signingMethod(key crypto.Signer) jwt.SigningMethod {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// Sign user tokens with the active key, or with the shared secret
+// when no asymmetric key is configured.
+func signUserToken(cfg config.IJwtConfig, claims jwt.Claims) string {
+	kid := cfg.ActiveKeyId()
+	if kid == "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		ss, _ := token.SignedString(cfg.SecretKey())
+		return ss
+	}
+
+	key := cfg.SigningKeys()[kid]
+	token := jwt.NewWithClaims(signingMethod(key), claims)
+	token.Header["kid"] = kid
+	ss, _ := token.SignedString(key)
+	return ss
+}
+
+// Every configured key stays valid for verifying so rotating the active key
+// doesn't sign anyone out. Once an asymmetric key is active HS256 tokens are
+// only accepted until JWT_HS256_ACCEPT_UNTIL, anyone holding the secret could
+// mint them otherwise.
+func userKeyFunc(cfg config.IJwtConfig) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if len(cfg.SecretKey()) == 0 {
+				return nil, fmt.Errorf("signing method is invalid")
+			}
+			if cfg.ActiveKeyId() != "" && !time.Now().Before(cfg.Hs256AcceptUntil()) {
+				return nil, fmt.Errorf("signing method is invalid")
+			}
+			return cfg.SecretKey(), nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodEd25519:
+			kid, _ := t.Header["kid"].(string)
+			key, ok := cfg.SigningKeys()[kid]
+			if !ok {
+				return nil, fmt.Errorf("signing key is unknown")
+			}
+			if signingMethod(key).Alg() != t.Method.Alg() {
+				return nil, fmt.Errorf("signing method is invalid")
+			}
+			return key.Public(), nil
+		default:
+			return nil, fmt.Errorf("signing method is invalid")
+		}
+	}
+}
+
+// Admin tokens and api keys stay HS256 with their own secrets
+func hmacKeyFunc(secret func(config.IJwtConfig) []byte) func(cfg config.IJwtConfig) jwt.Keyfunc {
+	return func(cfg config.IJwtConfig) jwt.Keyfunc {
+		return func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("signing method is invalid")
+			}
+			return secret(cfg), nil
+		}
+	}
+}
+
+// Public keys for other services to verify access tokens offline
+func JwkSet(cfg config.IJwtConfig) *Jwks {
+	kids := make([]string, 0, len(cfg.SigningKeys()))
+	for kid := range cfg.SigningKeys() {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := &Jwks{
+		Keys: make([]*Jwk, 0, len(kids)),
+	}
+	for _, kid := range kids {
+		key := cfg.SigningKeys()[kid]
+		jwk := &Jwk{
+			Kid: kid,
+			Use: "sig",
+			Alg: signingMethod(key).Alg(),
+		}
+
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
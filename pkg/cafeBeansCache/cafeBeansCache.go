@@ -0,0 +1,122 @@
+package cafeBeansCache
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keys are "<namespace>:<rest>", stats are counted per namespace
+const (
+	PermissionPrefix = "permissions:"
+	sessionNamespace = "session:"
+)
+
+func PermissionKey(roleId int) string {
+	return PermissionPrefix + strconv.Itoa(roleId)
+}
+
+// Every session of a user shares the prefix so they can be dropped at once
+func SessionPrefix(userId string) string {
+	return sessionNamespace + userId + ":"
+}
+
+func SessionKey(userId, tokenHash string) string {
+	return SessionPrefix(userId) + tokenHash
+}
+
+// IStore keeps the cached bytes. The memory store is used by default,
+// implement it over a shared cache (e.g., redis) to share entries between instances.
+type IStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+	DeletePrefix(prefix string)
+}
+
+type ICafeBeansCache interface {
+	Get(key string, dest any) bool
+	Set(key string, value any)
+	Delete(key string)
+	DeletePrefix(prefix string)
+	Stats() map[string]*Stats
+}
+
+type Stats struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+type counter struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cafeBeansCache struct {
+	store    IStore
+	ttl      time.Duration
+	counters sync.Map // namespace -> *counter
+}
+
+// A ttl of 0 disables caching, every Get is a miss
+func NewCafeBeansCache(store IStore, ttl time.Duration) ICafeBeansCache {
+	return &cafeBeansCache{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+func (c *cafeBeansCache) counter(key string) *counter {
+	namespace, _, _ := strings.Cut(key, ":")
+	v, _ := c.counters.LoadOrStore(namespace, new(counter))
+	return v.(*counter)
+}
+
+func (c *cafeBeansCache) Get(key string, dest any) bool {
+	if c.ttl > 0 {
+		if data, ok := c.store.Get(key); ok && json.Unmarshal(data, dest) == nil {
+			c.counter(key).hits.Add(1)
+			return true
+		}
+	}
+
+	c.counter(key).misses.Add(1)
+	return false
+}
+
+func (c *cafeBeansCache) Set(key string, value any) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	c.store.Set(key, data, c.ttl)
+}
+
+func (c *cafeBeansCache) Delete(key string) { c.store.Delete(key) }
+
+func (c *cafeBeansCache) DeletePrefix(prefix string) { c.store.DeletePrefix(prefix) }
+
+func (c *cafeBeansCache) Stats() map[string]*Stats {
+	stats := make(map[string]*Stats)
+	c.counters.Range(func(k, v any) bool {
+		hits, misses := v.(*counter).hits.Load(), v.(*counter).misses.Load()
+		s := &Stats{
+			Hits:   hits,
+			Misses: misses,
+		}
+		if hits+misses > 0 {
+			s.HitRate = float64(hits) / float64(hits+misses)
+		}
+		stats[k.(string)] = s
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,83 @@
+package cafeBeansCache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type item struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// In-process store, expired items are swept every minute
+type memoryStore struct {
+	mu    sync.RWMutex
+	items map[string]*item
+}
+
+func NewMemoryStore() IStore {
+	s := &memoryStore{
+		items: make(map[string]*item),
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.sweep()
+		}
+	}()
+
+	return s
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	it, ok := s.items[key]
+	if !ok || time.Now().After(it.expiresAt) {
+		return nil, false
+	}
+	return it.value, true
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[key] = &item{
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+}
+
+func (s *memoryStore) DeletePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.items, key)
+		}
+	}
+}
+
+func (s *memoryStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, it := range s.items {
+		if now.After(it.expiresAt) {
+			delete(s.items, key)
+		}
+	}
+}
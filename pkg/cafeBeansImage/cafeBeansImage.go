@@ -0,0 +1,51 @@
+package cafeBeansImage
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// Larger images are refused before decoding so a small file can't
+// expand into a huge bitmap
+const maxPixels = 40_000_000
+
+// Center-crop a jpeg, png or gif to a square and scale it to size x size, as png
+func SquareThumbnail(data []byte, size int) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("file is not a valid image")
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("image is too large")
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("file is not a valid image")
+	}
+
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		b.Min.X+(b.Dx()-side)/2,
+		b.Min.Y+(b.Dy()-side)/2,
+	))
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+	out := new(bytes.Buffer)
+	if err := png.Encode(out, dst); err != nil {
+		return nil, fmt.Errorf("encode image failed: %v", err)
+	}
+	return out.Bytes(), nil
+}
@@ -25,6 +25,7 @@ type cafeBeansLogger struct {
 	Method     string `json:"method"`
 	StatusCode int    `json:"status_code"`
 	Path       string `json:"path"`
+	ApiKeyId   any    `json:"api_key_id"`
 	Query      any    `json:"query"`
 	Body       any    `json:"body"`
 	Response   any    `json:"response"`
@@ -37,6 +38,7 @@ func InitCafeBeansLogger(c *fiber.Ctx, res any, code int) ICafeBeansLoggerLogger
 		Method:     c.Method(),
 		StatusCode: code,
 		Path:       c.Path(),
+		ApiKeyId:   c.Locals("apiKeyId"),
 	}
 	log.SetQuery(c)
 	log.SetBody(c)
@@ -0,0 +1,56 @@
+package cafeBeansMailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+
+	"github.com/pandakn/cafe-beans/config"
+)
+
+type IMailer interface {
+	Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	cfg config.IMailConfig
+}
+
+// Without SMTP_HOST mails are written to the log, good enough for development
+type logMailer struct{}
+
+func NewMailer(cfg config.IMailConfig) IMailer {
+	if cfg.Host() == "" {
+		return &logMailer{}
+	}
+	return &smtpMailer{cfg: cfg}
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.cfg.Username() != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username(), m.cfg.Password(), m.cfg.Host())
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.cfg.From(),
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	addr := fmt.Sprintf("%s:%d", m.cfg.Host(), m.cfg.Port())
+	if err := smtp.SendMail(addr, auth, m.cfg.From(), []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("send mail failed: %v", err)
+	}
+	return nil
+}
+
+func (m *logMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %v: %v\n%v", to, subject, body)
+	return nil
+}
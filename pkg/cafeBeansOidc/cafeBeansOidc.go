@@ -0,0 +1,277 @@
+package cafeBeansOidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// An OpenID Connect provider (e.g., Google, LINE) registered for this app
+type Provider struct {
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string
+}
+
+// Who the provider says signed in
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Authorization code flow with PKCE, see OpenID Connect Core 1.0 section 3.1
+type IClient interface {
+	AuthCodeUrl(state, nonce, codeVerifier string) (string, error)
+	Exchange(code, codeVerifier, nonce string) (*Identity, error)
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type client struct {
+	provider   *Provider
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]any
+}
+
+func NewClient(provider *Provider) IClient {
+	return &client{
+		provider:   provider,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PKCE code verifier, 43 characters from 32 random bytes (RFC 7636)
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate code verifier failed: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// S256 code challenge of a verifier
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (c *client) AuthCodeUrl(state, nonce, codeVerifier string) (string, error) {
+	d, err := c.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	scopes := c.provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", c.provider.ClientId)
+	params.Set("redirect_uri", c.provider.RedirectUrl)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", CodeChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+type tokenResponse struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (c *client) Exchange(code, codeVerifier, nonce string) (*Identity, error) {
+	d, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.provider.RedirectUrl)
+	form.Set("client_id", c.provider.ClientId)
+	form.Set("client_secret", c.provider.ClientSecret)
+	form.Set("code_verifier", codeVerifier)
+
+	res, err := c.httpClient.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	token := new(tokenResponse)
+	if err := json.NewDecoder(res.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("exchange code failed: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK || token.IdToken == "" {
+		return nil, fmt.Errorf("exchange code failed: %v %v", token.Error, token.ErrorDescription)
+	}
+
+	return c.verifyIdToken(d, token.IdToken, nonce)
+}
+
+type idTokenClaims struct {
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"` // some providers send "true"
+	Name          string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+func (c *client) verifyIdToken(d *discovery, idToken, nonce string) (*Identity, error) {
+	claims := new(idTokenClaims)
+	_, err := jwt.ParseWithClaims(
+		idToken,
+		claims,
+		c.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "HS256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(c.provider.ClientId),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token is invalid: %v", err)
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("id token is invalid: exp is missing")
+	}
+
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token is invalid: nonce mismatch")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token is invalid: sub is missing")
+	}
+
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+
+	return &Identity{
+		Provider:      c.provider.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// HS256 id tokens (e.g., LINE) are signed with the client secret,
+// the others with a key from the provider's jwks
+func (c *client) keyFunc(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if c.provider.ClientSecret == "" {
+			return nil, fmt.Errorf("client secret is not set")
+		}
+		return []byte(c.provider.ClientSecret), nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	return c.getKey(kid)
+}
+
+func (c *client) getDiscovery() (*discovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	d := new(discovery)
+	wellKnown := strings.TrimSuffix(c.provider.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJson(wellKnown, d); err != nil {
+		return nil, fmt.Errorf("discover %v failed: %v", c.provider.Name, err)
+	}
+
+	if d.Issuer != c.provider.Issuer {
+		return nil, fmt.Errorf("discover %v failed: issuer %v does not match", c.provider.Name, d.Issuer)
+	}
+
+	c.discovery = d
+	return d, nil
+}
+
+// Keys are cached, an unknown kid refetches them in case the provider rotated
+func (c *client) getKey(kid string) (any, error) {
+	d, err := c.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+
+	set := new(jwks)
+	if err := c.getJson(d.JwksUri, set); err != nil {
+		return nil, fmt.Errorf("get jwks failed: %v", err)
+	}
+
+	keys, err := set.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	c.keys = keys
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %v not found", kid)
+}
+
+func (c *client) getJson(url string, dest any) error {
+	res, err := c.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %v", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(dest)
+}
@@ -0,0 +1,141 @@
+package cafeBeansPassword
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pandakn/cafe-beans/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// Hashes carry their algorithm and parameters, argon2id in the PHC string
+// format ($argon2id$v=19$m=...,t=...,p=...$salt$hash) and bcrypt as $2a$/$2b$,
+// so hashes made with older settings still verify.
+type IHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) bool
+	// The hash was made with another algorithm or other parameters than configured
+	NeedsRehash(encoded string) bool
+}
+
+type hasher struct {
+	cfg config.IPasswordConfig
+}
+
+func NewHasher(cfg config.IPasswordConfig) IHasher {
+	return &hasher{cfg: cfg}
+}
+
+type argon2Params struct {
+	memory      uint32 // KiB
+	iterations  uint32
+	parallelism uint8
+}
+
+func (h *hasher) configuredParams() *argon2Params {
+	return &argon2Params{
+		memory:      h.cfg.Argon2Memory(),
+		iterations:  h.cfg.Argon2Iterations(),
+		parallelism: h.cfg.Argon2Parallelism(),
+	}
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	if h.cfg.Algorithm() == Bcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cfg.BcryptCost())
+		if err != nil {
+			return "", fmt.Errorf("hashed password failed: %v", err)
+		}
+		return string(hashed), nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("hashed password failed: %v", err)
+	}
+
+	p := h.configuredParams()
+	key := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, 32)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.memory,
+		p.iterations,
+		p.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *hasher) Verify(password, encoded string) bool {
+	if isBcrypt(encoded) {
+		return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+	}
+
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (h *hasher) NeedsRehash(encoded string) bool {
+	if isBcrypt(encoded) {
+		if h.cfg.Algorithm() != Bcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != h.cfg.BcryptCost()
+	}
+
+	if h.cfg.Algorithm() != Argon2id {
+		return true
+	}
+	p, _, _, err := decodeArgon2id(encoded)
+	return err != nil || *p != *h.configuredParams()
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2id(encoded string) (*argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return nil, nil, nil, fmt.Errorf("hash format is invalid")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("argon2 version is not supported")
+	}
+
+	p := new(argon2Params)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, nil, nil, fmt.Errorf("hash format is invalid")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("hash format is invalid")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("hash format is invalid")
+	}
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,71 @@
+package cafeBeansStorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where uploaded files (e.g., avatars, product images) are kept.
+// Implement it over a bucket to serve files from a cdn instead of the app.
+type IStorage interface {
+	// Save the file at a relative path and return its public url
+	Upload(path, contentType string, data []byte) (string, error)
+	// Remove a file by the url Upload returned
+	Delete(url string) error
+}
+
+// Files on the local disk, served by the app under publicUrl
+type localStorage struct {
+	dir       string
+	publicUrl string
+}
+
+func NewLocalStorage(dir, publicUrl string) IStorage {
+	return &localStorage{
+		dir:       dir,
+		publicUrl: strings.TrimSuffix(publicUrl, "/"),
+	}
+}
+
+// Keep every path inside dir
+func (s *localStorage) fullPath(path string) (string, error) {
+	clean := filepath.Clean("/" + path)
+	if clean == "/" {
+		return "", fmt.Errorf("file path is invalid")
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+func (s *localStorage) Upload(path, contentType string, data []byte) (string, error) {
+	full, err := s.fullPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return "", fmt.Errorf("upload file failed: %v", err)
+	}
+	if err := os.WriteFile(full, data, 0o644); err != nil {
+		return "", fmt.Errorf("upload file failed: %v", err)
+	}
+
+	return s.publicUrl + filepath.ToSlash(filepath.Clean("/"+path)), nil
+}
+
+func (s *localStorage) Delete(url string) error {
+	if !strings.HasPrefix(url, s.publicUrl+"/") {
+		return fmt.Errorf("file is not in this storage")
+	}
+
+	full, err := s.fullPath(strings.TrimPrefix(url, s.publicUrl))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("delete file failed: %v", err)
+	}
+	return nil
+}
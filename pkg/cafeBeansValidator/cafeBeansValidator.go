@@ -0,0 +1,259 @@
+package cafeBeansValidator
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+)
+
+// Commonly breached passwords, lowercase, one per line
+//
+//go:embed breached.txt
+var breachedList string
+
+var (
+	emailPattern      = regexp.MustCompile(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`)
+	usernamePattern   = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+	phonePattern      = regexp.MustCompile(`^(0|\+66)[0-9]{8,9}$`) // thai numbers, without separators
+	postalCodePattern = regexp.MustCompile(`^[1-9][0-9]{4}$`)
+)
+
+// The longest free text field, in characters
+const maxTextLength = 255
+
+// Each check returns every problem of the field, nil when it's valid
+type IValidator interface {
+	Email(field, email string) []*entities.FieldError
+	Username(field, username string) []*entities.FieldError
+	// username is compared against so the password doesn't contain it
+	Password(field, password, username string) []*entities.FieldError
+	// free text, name is how the field is called in messages
+	Text(field, name, value string, required bool) []*entities.FieldError
+	Phone(field, phone string) []*entities.FieldError
+	PostalCode(field, postalCode string) []*entities.FieldError
+	// Checked against the address dataset, the fields are reported as
+	// sub_district, district, province and postal_code
+	ThaiAddress(subDistrict, district, province, postalCode string) []*entities.FieldError
+}
+
+type validator struct {
+	cfg       config.IPolicyConfig
+	addresses cafeBeansAddress.IAddressBook
+	breached  map[string]bool
+	reserved  map[string]bool
+}
+
+func NewValidator(cfg config.IPolicyConfig, addresses cafeBeansAddress.IAddressBook) (IValidator, error) {
+	v := &validator{
+		cfg:       cfg,
+		addresses: addresses,
+		breached:  make(map[string]bool),
+		reserved:  make(map[string]bool),
+	}
+
+	for _, p := range strings.Split(breachedList, "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			v.breached[p] = true
+		}
+	}
+
+	if path := cfg.BreachedPasswordsPath(); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("load breached passwords failed: %v", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if p := strings.TrimSpace(scanner.Text()); p != "" {
+				v.breached[strings.ToLower(p)] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("load breached passwords failed: %v", err)
+		}
+	}
+
+	for _, name := range cfg.ReservedUsernames() {
+		v.reserved[strings.ToLower(name)] = true
+	}
+
+	return v, nil
+}
+
+func fieldError(field, code, msg string) *entities.FieldError {
+	return &entities.FieldError{
+		Field:   field,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+func (v *validator) Email(field, email string) []*entities.FieldError {
+	if email == "" {
+		return []*entities.FieldError{fieldError(field, "required", "email is required")}
+	}
+	if !emailPattern.MatchString(email) {
+		return []*entities.FieldError{fieldError(field, "invalid_format", "email is not a valid email address")}
+	}
+	return nil
+}
+
+func (v *validator) Username(field, username string) []*entities.FieldError {
+	if username == "" {
+		return []*entities.FieldError{fieldError(field, "required", "username is required")}
+	}
+
+	errs := make([]*entities.FieldError, 0)
+	length := utf8.RuneCountInString(username)
+	if length < v.cfg.UsernameMinLength() {
+		errs = append(errs, fieldError(field, "too_short", fmt.Sprintf("username must be at least %d characters", v.cfg.UsernameMinLength())))
+	}
+	if length > v.cfg.UsernameMaxLength() {
+		errs = append(errs, fieldError(field, "too_long", fmt.Sprintf("username must be at most %d characters", v.cfg.UsernameMaxLength())))
+	}
+	if !usernamePattern.MatchString(username) {
+		errs = append(errs, fieldError(field, "invalid_characters", "username may only contain letters, digits, underscores and dots"))
+	}
+	// deleted_<id> is given to deleted accounts
+	if v.reserved[strings.ToLower(username)] || strings.HasPrefix(strings.ToLower(username), "deleted_") {
+		errs = append(errs, fieldError(field, "reserved", "username is reserved"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (v *validator) Password(field, password, username string) []*entities.FieldError {
+	if password == "" {
+		return []*entities.FieldError{fieldError(field, "required", "password is required")}
+	}
+
+	errs := make([]*entities.FieldError, 0)
+	if utf8.RuneCountInString(password) < v.cfg.PasswordMinLength() {
+		errs = append(errs, fieldError(field, "too_short", fmt.Sprintf("password must be at least %d characters", v.cfg.PasswordMinLength())))
+	}
+
+	if characterClasses(password) < v.cfg.PasswordCharacterClasses() {
+		errs = append(errs, fieldError(
+			field,
+			"too_weak",
+			fmt.Sprintf("password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", v.cfg.PasswordCharacterClasses()),
+		))
+	}
+
+	if v.breached[strings.ToLower(password)] {
+		errs = append(errs, fieldError(field, "breached", "password is too common, it appears in known data breaches"))
+	}
+
+	if len(username) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		errs = append(errs, fieldError(field, "too_similar", "password must not contain the username"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (v *validator) Text(field, name, value string, required bool) []*entities.FieldError {
+	if strings.TrimSpace(value) == "" {
+		if required {
+			return []*entities.FieldError{fieldError(field, "required", name+" is required")}
+		}
+		return nil
+	}
+	if utf8.RuneCountInString(value) > maxTextLength {
+		return []*entities.FieldError{fieldError(field, "too_long", fmt.Sprintf("%s must be at most %d characters", name, maxTextLength))}
+	}
+	return nil
+}
+
+func (v *validator) Phone(field, phone string) []*entities.FieldError {
+	if phone == "" {
+		return []*entities.FieldError{fieldError(field, "required", "phone is required")}
+	}
+	if !phonePattern.MatchString(phone) {
+		return []*entities.FieldError{fieldError(field, "invalid_format", "phone must be a thai phone number")}
+	}
+	return nil
+}
+
+func (v *validator) PostalCode(field, postalCode string) []*entities.FieldError {
+	if postalCode == "" {
+		return []*entities.FieldError{fieldError(field, "required", "postal code is required")}
+	}
+	if !postalCodePattern.MatchString(postalCode) {
+		return []*entities.FieldError{fieldError(field, "invalid_format", "postal code must be 5 digits")}
+	}
+	return nil
+}
+
+// Only the first problem is reported, the later checks depend on the earlier ones
+func (v *validator) ThaiAddress(subDistrict, district, province, postalCode string) []*entities.FieldError {
+	provinceName, ok := v.addresses.Province(province)
+	if !ok {
+		return []*entities.FieldError{fieldError("province", "unknown", "province is not a thai province")}
+	}
+
+	if !v.addresses.PostalCodeInProvince(provinceName, postalCode) {
+		return []*entities.FieldError{fieldError("postal_code", "mismatch", "postal code is not in "+provinceName)}
+	}
+
+	// the dataset doesn't know this province any further
+	if !v.addresses.HasDistricts(provinceName) {
+		return nil
+	}
+
+	districtName, ok := v.addresses.District(provinceName, district)
+	if !ok {
+		return []*entities.FieldError{fieldError("district", "unknown", "district is not in "+provinceName)}
+	}
+
+	entries := v.addresses.SubDistricts(provinceName, districtName, subDistrict)
+	if len(entries) == 0 {
+		return []*entities.FieldError{fieldError("sub_district", "unknown", "sub-district is not in "+districtName)}
+	}
+
+	postalCodes := make([]string, 0)
+	for _, e := range entries {
+		if e.PostalCode == postalCode {
+			return nil
+		}
+		postalCodes = append(postalCodes, e.PostalCode)
+	}
+	return []*entities.FieldError{fieldError(
+		"postal_code",
+		"mismatch",
+		fmt.Sprintf("postal code of %s is %s", entries[0].SubDistrict, strings.Join(postalCodes, " or ")),
+	)}
+}
+
+func characterClasses(s string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "oauth_retired_tokens" CASCADE;
+DROP TABLE IF EXISTS "security_events" CASCADE;
+
+COMMIT;
@@ -0,0 +1,26 @@
+-- this file (version 3) for refresh token rotation
+BEGIN;
+
+--every "oauth" row is a token family, the refresh token that was replaced
+--by a rotation is kept here so that a replay can be detected
+CREATE TABLE "oauth_retired_tokens" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "oauth_id" uuid NOT NULL,
+  "refresh_token" VARCHAR NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE "security_events" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "event" VARCHAR NOT NULL,
+  "detail" VARCHAR NOT NULL DEFAULT '',
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "oauth_retired_tokens" ADD FOREIGN KEY ("oauth_id") REFERENCES "oauth" ("id") ON DELETE CASCADE;
+ALTER TABLE "security_events" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE INDEX "oauth_retired_tokens_refresh_token_idx" ON "oauth_retired_tokens" ("refresh_token");
+
+COMMIT;
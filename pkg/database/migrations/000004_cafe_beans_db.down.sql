@@ -0,0 +1,9 @@
+-- digests can't be reversed, every session has to sign in again
+BEGIN;
+
+DROP INDEX IF EXISTS "oauth_access_token_idx";
+DROP INDEX IF EXISTS "oauth_refresh_token_idx";
+
+TRUNCATE TABLE "oauth" CASCADE;
+
+COMMIT;
@@ -0,0 +1,14 @@
+-- this file (version 4) for store only digests of tokens
+BEGIN;
+
+UPDATE "oauth" SET
+  "access_token" = encode(sha256(convert_to("access_token", 'UTF8')), 'hex'),
+  "refresh_token" = encode(sha256(convert_to("refresh_token", 'UTF8')), 'hex');
+
+UPDATE "oauth_retired_tokens" SET
+  "refresh_token" = encode(sha256(convert_to("refresh_token", 'UTF8')), 'hex');
+
+CREATE INDEX "oauth_access_token_idx" ON "oauth" ("access_token");
+CREATE INDEX "oauth_refresh_token_idx" ON "oauth" ("refresh_token");
+
+COMMIT;
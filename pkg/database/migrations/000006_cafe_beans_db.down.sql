@@ -0,0 +1,13 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "roles_permissions" CASCADE;
+DROP TABLE IF EXISTS "permissions" CASCADE;
+
+-- baristas become customers, deleting the role would cascade to their accounts
+UPDATE "users" SET
+    "role_id" = (SELECT "id" FROM "roles" WHERE "title" = 'customer')
+WHERE "role_id" = (SELECT "id" FROM "roles" WHERE "title" = 'barista');
+
+DELETE FROM "roles" WHERE "title" = 'barista';
+
+COMMIT;
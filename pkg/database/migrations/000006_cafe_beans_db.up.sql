@@ -0,0 +1,60 @@
+-- this file (version 6) for permission based authorization
+BEGIN;
+
+CREATE TABLE "permissions" (
+  "id" SERIAL PRIMARY KEY,
+  "title" VARCHAR NOT NULL UNIQUE
+);
+
+CREATE TABLE "roles_permissions" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "role_id" INT NOT NULL,
+  "permission_id" INT NOT NULL,
+  UNIQUE ("role_id", "permission_id")
+);
+
+ALTER TABLE "roles_permissions" ADD FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE CASCADE;
+ALTER TABLE "roles_permissions" ADD FOREIGN KEY ("permission_id") REFERENCES "permissions" ("id") ON DELETE CASCADE;
+
+INSERT INTO "roles" (
+    "title"
+)
+VALUES
+    ('barista')
+ON CONFLICT ("title") DO NOTHING;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('admins:create'),
+    ('api-keys:manage'),
+    ('categories:manage'),
+    ('orders:read'),
+    ('orders:write');
+
+--admin can do everything
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin';
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'barista'
+AND "p"."title" IN ('orders:read', 'orders:write');
+
+COMMIT;
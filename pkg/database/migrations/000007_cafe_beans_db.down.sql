@@ -0,0 +1,5 @@
+BEGIN;
+
+DELETE FROM "permissions" WHERE "title" = 'roles:manage';
+
+COMMIT;
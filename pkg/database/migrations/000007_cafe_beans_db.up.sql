@@ -0,0 +1,22 @@
+-- this file (version 7) for role management
+BEGIN;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('roles:manage');
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin'
+AND "p"."title" = 'roles:manage';
+
+COMMIT;
@@ -0,0 +1,22 @@
+-- this file (version 8) for cache metrics
+BEGIN;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('metrics:read');
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin'
+AND "p"."title" = 'metrics:read';
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "recovery_codes" CASCADE;
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "totp_secret";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "totp_enabled";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "totp_last_step";
+
+COMMIT;
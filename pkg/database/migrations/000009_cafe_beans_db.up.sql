@@ -0,0 +1,21 @@
+-- this file (version 9) for totp two-factor authentication
+BEGIN;
+
+--totp_secret is pending until totp_enabled, totp_last_step refuses a used code
+ALTER TABLE "users" ADD COLUMN "totp_secret" VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE "users" ADD COLUMN "totp_enabled" BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE "users" ADD COLUMN "totp_last_step" BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE "recovery_codes" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "code_hash" VARCHAR NOT NULL,
+  "used_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "recovery_codes" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE INDEX "recovery_codes_user_id_idx" ON "recovery_codes" ("user_id");
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "one_time_tokens" CASCADE;
+DROP TABLE IF EXISTS "login_attempts" CASCADE;
+
+COMMIT;
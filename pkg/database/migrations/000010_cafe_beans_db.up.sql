@@ -0,0 +1,29 @@
+-- this file (version 10) for sign in lockout and one-time tokens
+BEGIN;
+
+--identifier is the lowercased email, also for emails without an account
+CREATE TABLE "login_attempts" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "identifier" VARCHAR NOT NULL,
+  "ip" VARCHAR NOT NULL DEFAULT '',
+  "succeeded" BOOLEAN NOT NULL DEFAULT FALSE,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX "login_attempts_identifier_idx" ON "login_attempts" ("identifier", "created_at");
+CREATE INDEX "login_attempts_ip_idx" ON "login_attempts" ("ip", "created_at");
+
+--single-use tokens sent by email, purpose tells what a token is for
+CREATE TABLE "one_time_tokens" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "purpose" VARCHAR NOT NULL,
+  "token_hash" VARCHAR NOT NULL UNIQUE,
+  "expires_at" TIMESTAMP NOT NULL,
+  "used_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "one_time_tokens" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "oidc_states" CASCADE;
+DROP TABLE IF EXISTS "user_identities" CASCADE;
+
+COMMIT;
@@ -0,0 +1,33 @@
+-- this file (version 11) for openid connect sign in
+BEGIN;
+
+--an account at a provider (e.g., google) linked to a user
+CREATE TABLE "user_identities" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "provider" VARCHAR NOT NULL,
+  "subject" VARCHAR NOT NULL,
+  "email" VARCHAR NOT NULL DEFAULT '',
+  "created_at" TIMESTAMP NOT NULL DEFAULT now(),
+  "updated_at" TIMESTAMP NOT NULL DEFAULT now(),
+  UNIQUE ("provider", "subject")
+);
+
+ALTER TABLE "user_identities" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE INDEX "user_identities_user_id_idx" ON "user_identities" ("user_id");
+
+CREATE TRIGGER set_updated_at_timestamp_user_identities_table BEFORE UPDATE ON "user_identities" FOR EACH ROW EXECUTE PROCEDURE set_updated_at_column();
+
+--pending authorization requests, a state is deleted when the callback uses it
+CREATE TABLE "oidc_states" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "state_hash" VARCHAR NOT NULL UNIQUE,
+  "provider" VARCHAR NOT NULL,
+  "nonce" VARCHAR NOT NULL,
+  "code_verifier" VARCHAR NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+COMMIT;
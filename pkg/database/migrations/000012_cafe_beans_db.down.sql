@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "one_time_tokens" DROP COLUMN IF EXISTS "payload";
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- this file (version 12) for changing the email of a user
+BEGIN;
+
+--e.g., the new email of an email change waiting to be confirmed
+ALTER TABLE "one_time_tokens" ADD COLUMN "payload" VARCHAR NOT NULL DEFAULT '';
+
+COMMIT;
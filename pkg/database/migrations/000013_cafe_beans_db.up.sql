@@ -0,0 +1,7 @@
+-- this file (version 13) for user avatars
+BEGIN;
+
+--empty is no avatar
+ALTER TABLE "users" ADD COLUMN "avatar_url" VARCHAR NOT NULL DEFAULT '';
+
+COMMIT;
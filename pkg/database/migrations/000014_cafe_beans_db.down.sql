@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "deleted_at";
+
+ALTER TABLE "orders" DROP CONSTRAINT IF EXISTS "orders_user_id_fkey";
+ALTER TABLE "orders" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+COMMIT;
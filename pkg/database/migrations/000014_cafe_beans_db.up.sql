@@ -0,0 +1,11 @@
+-- this file (version 14) for account deletion
+BEGIN;
+
+--a deleted user is anonymized instead of removed so its orders stay for accounting,
+--removing a user with orders is refused instead of destroying the sales history
+ALTER TABLE "orders" DROP CONSTRAINT IF EXISTS "orders_user_id_fkey";
+ALTER TABLE "orders" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE RESTRICT;
+
+ALTER TABLE "users" ADD COLUMN "deleted_at" TIMESTAMP;
+
+COMMIT;
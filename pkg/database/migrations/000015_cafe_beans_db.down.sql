@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS "users_created_at_idx";
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "disabled_at";
+
+DELETE FROM "permissions" WHERE "title" = 'users:manage';
+
+COMMIT;
@@ -0,0 +1,27 @@
+-- this file (version 15) for admin user management
+BEGIN;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('users:manage');
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin'
+AND "p"."title" = 'users:manage';
+
+--a disabled user can't sign in until an admin enables it again
+ALTER TABLE "users" ADD COLUMN "disabled_at" TIMESTAMP;
+
+CREATE INDEX "users_created_at_idx" ON "users" ("created_at");
+
+COMMIT;
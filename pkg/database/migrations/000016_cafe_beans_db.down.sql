@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "impersonation_logs";
+
+DELETE FROM "oauth" WHERE "impersonator_id" IS NOT NULL;
+ALTER TABLE "oauth" DROP COLUMN IF EXISTS "impersonator_id";
+
+DELETE FROM "permissions" WHERE "title" = 'users:impersonate';
+
+COMMIT;
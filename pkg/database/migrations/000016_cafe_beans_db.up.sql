@@ -0,0 +1,44 @@
+-- this file (version 16) for admin impersonation
+BEGIN;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('users:impersonate');
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin'
+AND "p"."title" = 'users:impersonate';
+
+--a session held by an admin on behalf of the user
+ALTER TABLE "oauth" ADD COLUMN "impersonator_id" VARCHAR;
+ALTER TABLE "oauth" ADD FOREIGN KEY ("impersonator_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+--kept after the session is gone
+CREATE TABLE "impersonation_logs" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "admin_id" VARCHAR NOT NULL,
+  "user_id" VARCHAR NOT NULL,
+  "oauth_id" uuid NOT NULL,
+  "reason" VARCHAR NOT NULL,
+  "ip" VARCHAR NOT NULL DEFAULT '',
+  "expires_at" TIMESTAMP NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "impersonation_logs" ADD FOREIGN KEY ("admin_id") REFERENCES "users" ("id");
+ALTER TABLE "impersonation_logs" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id");
+
+CREATE INDEX "impersonation_logs_admin_id_idx" ON "impersonation_logs" ("admin_id", "created_at");
+CREATE INDEX "impersonation_logs_user_id_idx" ON "impersonation_logs" ("user_id", "created_at");
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TRIGGER IF EXISTS set_updated_at_timestamp_user_addresses_table ON "user_addresses";
+DROP TABLE IF EXISTS "user_addresses";
+
+COMMIT;
@@ -0,0 +1,28 @@
+-- this file (version 17) for address books
+BEGIN;
+
+CREATE TABLE "user_addresses" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "recipient" VARCHAR NOT NULL,
+  "phone" VARCHAR NOT NULL,
+  "line1" VARCHAR NOT NULL,
+  "line2" VARCHAR NOT NULL DEFAULT '',
+  "sub_district" VARCHAR NOT NULL,
+  "district" VARCHAR NOT NULL,
+  "province" VARCHAR NOT NULL,
+  "postal_code" VARCHAR(5) NOT NULL,
+  "is_default" BOOLEAN NOT NULL DEFAULT FALSE,
+  "created_at" TIMESTAMP NOT NULL DEFAULT now(),
+  "updated_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "user_addresses" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE INDEX "user_addresses_user_id_idx" ON "user_addresses" ("user_id");
+--at most one default address for each user
+CREATE UNIQUE INDEX "user_addresses_default_idx" ON "user_addresses" ("user_id") WHERE "is_default";
+
+CREATE TRIGGER set_updated_at_timestamp_user_addresses_table BEFORE UPDATE ON "user_addresses" FOR EACH ROW EXECUTE PROCEDURE set_updated_at_column();
+
+COMMIT;
@@ -0,0 +1,12 @@
+-- this file (version 18) for case-insensitive emails and usernames
+BEGIN;
+
+--emails and usernames differing only by case can't both exist,
+--accounts that already do have to be merged before this runs
+ALTER TABLE "users" DROP CONSTRAINT IF EXISTS "users_email_key";
+ALTER TABLE "users" DROP CONSTRAINT IF EXISTS "users_username_key";
+
+CREATE UNIQUE INDEX "users_email_lower_key" ON "users" (LOWER("email"));
+CREATE UNIQUE INDEX "users_username_lower_key" ON "users" (LOWER("username"));
+
+COMMIT;
@@ -0,0 +1,32 @@
+BEGIN;
+
+CREATE TABLE "security_events" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "event" VARCHAR NOT NULL,
+  "detail" VARCHAR NOT NULL DEFAULT '',
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "security_events" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+INSERT INTO "security_events" (
+    "user_id",
+    "event",
+    "detail",
+    "created_at"
+)
+SELECT
+    "ae"."target_id",
+    "ae"."action",
+    COALESCE("ae"."metadata"->>'detail', ''),
+    "ae"."created_at"
+FROM "audit_events" "ae"
+WHERE "ae"."action" IN ('refresh_token_reuse', 'account_disabled', 'account_enabled', 'sessions_revoked')
+AND EXISTS (SELECT 1 FROM "users" "u" WHERE "u"."id" = "ae"."target_id");
+
+DROP TABLE IF EXISTS "audit_events";
+
+DELETE FROM "permissions" WHERE "title" = 'audit:read';
+
+COMMIT;
@@ -0,0 +1,61 @@
+-- this file (version 19) for the audit log
+BEGIN;
+
+INSERT INTO "permissions" (
+    "title"
+)
+VALUES
+    ('audit:read');
+
+INSERT INTO "roles_permissions" (
+    "role_id",
+    "permission_id"
+)
+SELECT
+    "r"."id",
+    "p"."id"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin'
+AND "p"."title" = 'audit:read';
+
+--no foreign keys, events outlive the users and keys they are about,
+--the actor is empty when nobody is signed in (e.g., a failed signin)
+CREATE TABLE "audit_events" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "actor_id" VARCHAR NOT NULL DEFAULT '',
+  "action" VARCHAR NOT NULL,
+  "target_id" VARCHAR NOT NULL DEFAULT '',
+  "ip" VARCHAR NOT NULL DEFAULT '',
+  "user_agent" VARCHAR NOT NULL DEFAULT '',
+  "outcome" VARCHAR NOT NULL,
+  "metadata" JSONB NOT NULL DEFAULT '{}',
+  "created_at" TIMESTAMP NOT NULL DEFAULT now()
+);
+
+ALTER TABLE "audit_events" ADD CONSTRAINT "audit_events_outcome_check" CHECK ("outcome" IN ('success', 'failure'));
+
+CREATE INDEX "audit_events_created_at_idx" ON "audit_events" ("created_at");
+CREATE INDEX "audit_events_actor_id_idx" ON "audit_events" ("actor_id", "created_at");
+CREATE INDEX "audit_events_target_id_idx" ON "audit_events" ("target_id", "created_at");
+CREATE INDEX "audit_events_action_idx" ON "audit_events" ("action", "created_at");
+
+--security events are audit events about the user
+INSERT INTO "audit_events" (
+    "action",
+    "target_id",
+    "outcome",
+    "metadata",
+    "created_at"
+)
+SELECT
+    "se"."event",
+    "se"."user_id",
+    CASE WHEN "se"."event" = 'refresh_token_reuse' THEN 'failure' ELSE 'success' END,
+    json_build_object('detail', "se"."detail"),
+    "se"."created_at"
+FROM "security_events" "se";
+
+DROP TABLE "security_events";
+
+COMMIT;
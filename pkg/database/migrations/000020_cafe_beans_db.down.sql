@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP INDEX IF EXISTS "oauth_last_used_at_idx";
+DROP INDEX IF EXISTS "oauth_created_at_idx";
+
+ALTER TABLE "oauth" DROP COLUMN IF EXISTS "last_used_at";
+
+COMMIT;
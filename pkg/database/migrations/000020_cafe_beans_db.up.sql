@@ -0,0 +1,11 @@
+-- this file (version 20) for session idle timeout and cleanup
+BEGIN;
+
+--marked on use at most once a minute, refreshing counts as a use,
+--existing sessions start their idle time now
+ALTER TABLE "oauth" ADD COLUMN "last_used_at" TIMESTAMP NOT NULL DEFAULT now();
+
+CREATE INDEX "oauth_created_at_idx" ON "oauth" ("created_at");
+CREATE INDEX "oauth_last_used_at_idx" ON "oauth" ("last_used_at");
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE "users" DROP CONSTRAINT IF EXISTS "users_role_id_fkey";
+ALTER TABLE "users" ADD CONSTRAINT "users_role_id_fkey" FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE CASCADE;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- this file (version 21) for refusing to delete roles that are in use
+BEGIN;
+
+--a role that still has users can't be deleted, even if they were assigned
+--after the role was checked
+ALTER TABLE "users" DROP CONSTRAINT "users_role_id_fkey";
+ALTER TABLE "users" ADD CONSTRAINT "users_role_id_fkey" FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE RESTRICT;
+
+COMMIT;
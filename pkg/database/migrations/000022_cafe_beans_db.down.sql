@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS "login_attempts_created_at_idx";
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- this file (version 22) for pruning login attempts
+BEGIN;
+
+--attempts older than the lockout window are deleted in the background
+CREATE INDEX "login_attempts_created_at_idx" ON "login_attempts" ("created_at");
+
+COMMIT;
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// Random url-safe string from n bytes of crypto/rand
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate random token failed: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,10 @@
+package utils
+
+func Contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/addresses"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesRepositories"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+)
+
+func validAddressReq() *addresses.AddressReq {
+	return &addresses.AddressReq{
+		Recipient:   " Somchai Jaidee ",
+		Phone:       "081-234 5678",
+		Line1:       "1 Na Phra Lan Rd.",
+		SubDistrict: "แขวงพระบรมมหาราชวัง",
+		District:    "เขตพระนคร",
+		Province:    "กทม",
+		PostalCode:  "10200",
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+	v := newTestValidator(t, newTestConfig(t, ""))
+
+	req := validAddressReq()
+	req.Normalize()
+	if req.Recipient != "Somchai Jaidee" || req.Phone != "0812345678" {
+		t.Fatalf("expected the fields to be normalized, got %+v", req)
+	}
+	if errs := req.Validate(v); errs != nil {
+		t.Fatalf("expected a valid address, got %v", errorCodes(errs))
+	}
+
+	tests := map[string]struct {
+		change func(req *addresses.AddressReq)
+		field  string
+		code   string
+	}{
+		"no recipient":           {func(req *addresses.AddressReq) { req.Recipient = "" }, "recipient", "required"},
+		"foreign phone":          {func(req *addresses.AddressReq) { req.Phone = "+14155550100" }, "phone", "invalid_format"},
+		"short postal code":      {func(req *addresses.AddressReq) { req.PostalCode = "1020" }, "postal_code", "invalid_format"},
+		"unknown province":       {func(req *addresses.AddressReq) { req.Province = "Atlantis" }, "province", "unknown"},
+		"postal code elsewhere":  {func(req *addresses.AddressReq) { req.PostalCode = "50000" }, "postal_code", "mismatch"},
+		"unknown district":       {func(req *addresses.AddressReq) { req.District = "เมืองเชียงใหม่" }, "district", "unknown"},
+		"unknown sub-district":   {func(req *addresses.AddressReq) { req.SubDistrict = "หนองหอย" }, "sub_district", "unknown"},
+		"postal code of another": {func(req *addresses.AddressReq) { req.PostalCode = "10100" }, "postal_code", "mismatch"},
+	}
+	for name, tt := range tests {
+		req := validAddressReq()
+		tt.change(req)
+		req.Normalize()
+
+		errs := req.Validate(v)
+		if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != tt.code {
+			t.Fatalf("%s: expected %v %v, got %+v", name, tt.field, tt.code, errs)
+		}
+	}
+}
+
+// A province without any of its sub-districts in the dataset
+// is only checked against its postal codes
+func TestAddressValidationOfProvinceWithoutDistricts(t *testing.T) {
+	v := newTestValidator(t, newTestConfig(t, ""))
+
+	if errs := v.ThaiAddress("ในเมือง", "เมืองขอนแก่น", "จ.ขอนแก่น", "40000"); errs != nil {
+		t.Fatalf("expected a valid address, got %v", errorCodes(errs))
+	}
+	expectCodes(t, "postal code elsewhere", v.ThaiAddress("ในเมือง", "เมืองขอนแก่น", "ขอนแก่น", "50000"), "mismatch")
+}
+
+// Holds count addresses for every user
+type fakeAddressesRepository struct {
+	addressesRepositories.IAddressesRepository
+
+	count    int
+	inserted int
+}
+
+func (r *fakeAddressesRepository) CountAddress(userId string) (int, error) {
+	return r.count, nil
+}
+
+func (r *fakeAddressesRepository) InsertAddress(userId string, req *addresses.AddressReq) (string, error) {
+	r.inserted++
+	return "1", nil
+}
+
+func (r *fakeAddressesRepository) FindOneAddress(userId, addressId string) (*addresses.Address, error) {
+	return &addresses.Address{Id: addressId, UserId: userId}, nil
+}
+
+func TestAddressBookIsLimited(t *testing.T) {
+	addressBook, err := cafeBeansAddress.NewAddressBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakeAddressesRepository{count: addresses.MaxAddresses - 1}
+	useCase := addressesUseCases.AddressesUseCase(repo, addressBook, newTestValidator(t, newTestConfig(t, "")))
+
+	if _, err := useCase.InsertAddress("U000001", validAddressReq()); err != nil {
+		t.Fatal(err)
+	}
+
+	repo.count = addresses.MaxAddresses
+	if _, err := useCase.InsertAddress("U000001", validAddressReq()); err == nil || err.Error() != "address book is full" {
+		t.Fatalf("expected address book is full, got %v", err)
+	}
+	if repo.inserted != 1 {
+		t.Fatalf("expected 1 address to be inserted, got %v", repo.inserted)
+	}
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+)
+
+func newTestAddressBook(t *testing.T) cafeBeansAddress.IAddressBook {
+	addressBook, err := cafeBeansAddress.NewAddressBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addressBook
+}
+
+// Every postal code starts with one of 1 to 9, so together the
+// searches return the whole dataset
+func allAddresses(addressBook cafeBeansAddress.IAddressBook) []*cafeBeansAddress.Entry {
+	entries := make([]*cafeBeansAddress.Entry, 0)
+	seen := make(map[cafeBeansAddress.Entry]bool)
+	for _, digit := range strings.Split("123456789", "") {
+		for _, e := range addressBook.Search(digit, 1<<20) {
+			if !seen[*e] {
+				seen[*e] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+func TestEmbeddedAddressesAreConsistent(t *testing.T) {
+	addressBook := newTestAddressBook(t)
+
+	entries := allAddresses(addressBook)
+	if len(entries) == 0 {
+		t.Fatal("expected sub-districts to be embedded")
+	}
+	for _, e := range entries {
+		if province, ok := addressBook.Province(e.Province); !ok || province != e.Province {
+			t.Fatalf("%+v: expected a known province", e)
+		}
+		if !addressBook.PostalCodeInProvince(e.Province, e.PostalCode) {
+			t.Fatalf("%+v: expected the postal code to be in the province", e)
+		}
+		if district, ok := addressBook.District(e.Province, e.District); !ok || district != e.District {
+			t.Fatalf("%+v: expected a known district", e)
+		}
+		if len(addressBook.SubDistricts(e.Province, e.District, e.SubDistrict)) == 0 {
+			t.Fatalf("%+v: expected a known sub-district", e)
+		}
+	}
+}
+
+func TestAddressNamesAreNormalized(t *testing.T) {
+	addressBook := newTestAddressBook(t)
+
+	tests := map[string]string{
+		"เชียงใหม่":         "เชียงใหม่",
+		"จ.เชียงใหม่":       "เชียงใหม่",
+		"จังหวัด เชียงใหม่": "เชียงใหม่",
+		"กทม":      "กรุงเทพมหานคร",
+		"กรุงเทพฯ": "กรุงเทพมหานคร",
+		"อยุธยา":   "พระนครศรีอยุธยา",
+	}
+	for name, expected := range tests {
+		if province, ok := addressBook.Province(name); !ok || province != expected {
+			t.Fatalf("%v: expected %v, got %v", name, expected, province)
+		}
+	}
+	if _, ok := addressBook.Province("Atlantis"); ok {
+		t.Fatal("expected an unknown province")
+	}
+
+	if district, ok := addressBook.District("กรุงเทพมหานคร", "เขต พระนคร"); !ok || district != "พระนคร" {
+		t.Fatalf("expected พระนคร, got %v", district)
+	}
+	if entries := addressBook.SubDistricts("กรุงเทพมหานคร", "พระนคร", "แขวงพระบรมมหาราชวัง"); len(entries) != 1 || entries[0].PostalCode != "10200" {
+		t.Fatalf("expected พระบรมมหาราชวัง 10200, got %v", entries)
+	}
+}
+
+func TestAddressSearch(t *testing.T) {
+	addressBook := newTestAddressBook(t)
+
+	if entries := addressBook.Search("  ", 10); len(entries) != 0 {
+		t.Fatalf("expected nothing for an empty query, got %v", len(entries))
+	}
+
+	entries := addressBook.Search("10200", 3)
+	if len(entries) != 3 {
+		t.Fatalf("expected the limit to be kept, got %v", len(entries))
+	}
+	for _, e := range entries {
+		if e.PostalCode != "10200" {
+			t.Fatalf("expected postal code 10200, got %+v", e)
+		}
+	}
+
+	// a field starting with the query comes before one only containing it
+	entries = addressBook.Search("หนองหอย", 10)
+	if len(entries) == 0 || entries[0].SubDistrict != "หนองหอย" {
+		t.Fatalf("expected หนองหอย first, got %v", entries)
+	}
+
+	// the entries are copies, changing one doesn't change the dataset
+	entries[0].PostalCode = "00000"
+	if again := addressBook.Search("หนองหอย", 1); again[0].PostalCode == "00000" {
+		t.Fatal("expected the dataset to be kept as it is")
+	}
+}
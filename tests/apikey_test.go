@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/appInfo"
+	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoHandlers"
+	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoRepositories"
+	"github.com/pandakn/cafe-beans/modules/appInfo/appInfoUseCases"
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
+	"github.com/pandakn/cafe-beans/pkg/utils"
+)
+
+// Api keys by their plain key, a revoked key is simply not there
+type fakeApiKeyUseCase struct {
+	middlewareUseCases.IMiddlewareUseCase
+
+	keys map[string]*middleware.ApiKey
+}
+
+func (u *fakeApiKeyUseCase) FindApiKey(key string) (*middleware.ApiKey, error) {
+	apiKey, ok := u.keys[key]
+	if !ok {
+		return nil, errors.New("api key not found")
+	}
+	return apiKey, nil
+}
+
+// An app with one route that needs the users:auth scope
+func newApiKeyApp(cfg config.IConfig) *fiber.App {
+	mid := middlewareHandlers.MiddlewareHandler(cfg, &fakeApiKeyUseCase{
+		keys: map[string]*middleware.ApiKey{
+			"cbk_auth":       {Id: "key-1", Scopes: []string{appInfo.ScopeUsersAuth}},
+			"cbk_categories": {Id: "key-2", Scopes: []string{appInfo.ScopeCategoriesRead}},
+		},
+	}, &fakeAuditUseCase{})
+
+	app := fiber.New()
+	app.Post("/signin", mid.ApiKeyAuth(appInfo.ScopeUsersAuth), func(c *fiber.Ctx) error {
+		return c.SendString(c.Locals("apiKeyId").(string))
+	})
+	return app
+}
+
+func callWithApiKey(t *testing.T, app *fiber.App, key string) int {
+	req := httptest.NewRequest(fiber.MethodPost, "/signin", nil)
+	req.Header.Set("X-Api-Key", key)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+// A key of the stateless kind that was issued before cbk_ keys
+func legacyApiKey(t *testing.T, secret string) string {
+	return signClaims(t, secret, jwt.MapClaims{
+		"iss": "cafe-beans-api",
+		"sub": "api-key",
+		"aud": []string{"admin"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func TestApiKeyAuthChecksScopes(t *testing.T) {
+	app := newApiKeyApp(newTestConfig(t, ""))
+
+	if status := callWithApiKey(t, app, "cbk_auth"); status != fiber.StatusOK {
+		t.Fatalf("expected 200, got %v", status)
+	}
+	if status := callWithApiKey(t, app, "cbk_categories"); status != fiber.StatusForbidden {
+		t.Fatalf("expected a key without the scope to be forbidden, got %v", status)
+	}
+	if status := callWithApiKey(t, app, "cbk_revoked"); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected an unknown key to be unauthorized, got %v", status)
+	}
+	if status := callWithApiKey(t, app, ""); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected a missing key to be unauthorized, got %v", status)
+	}
+}
+
+func TestLegacyApiKeysAreOffByDefault(t *testing.T) {
+	app := newApiKeyApp(newTestConfig(t, "JWT_API_KEY=api-secret\nJWT_LEGACY_API_KEY_SCOPES=users:auth\n"))
+
+	if status := callWithApiKey(t, app, legacyApiKey(t, "api-secret")); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected legacy keys to be refused without opting in, got %v", status)
+	}
+}
+
+func TestLegacyApiKeysAreScopedAndExpire(t *testing.T) {
+	until := "JWT_LEGACY_API_KEYS_UNTIL=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + "\n"
+	key := legacyApiKey(t, "api-secret")
+
+	allowed := newApiKeyApp(newTestConfig(t, "JWT_API_KEY=api-secret\n"+until+"JWT_LEGACY_API_KEY_SCOPES=users:auth, categories:read\n"))
+	if status := callWithApiKey(t, allowed, key); status != fiber.StatusOK {
+		t.Fatalf("expected 200, got %v", status)
+	}
+	if status := callWithApiKey(t, allowed, legacyApiKey(t, "other-secret")); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected a key of another secret to be unauthorized, got %v", status)
+	}
+
+	unscoped := newApiKeyApp(newTestConfig(t, "JWT_API_KEY=api-secret\n"+until+"JWT_LEGACY_API_KEY_SCOPES=categories:read\n"))
+	if status := callWithApiKey(t, unscoped, key); status != fiber.StatusForbidden {
+		t.Fatalf("expected a legacy key without the scope to be forbidden, got %v", status)
+	}
+
+	removed := newApiKeyApp(newTestConfig(t, "JWT_API_KEY=api-secret\nJWT_LEGACY_API_KEY_SCOPES=users:auth\n"+
+		"JWT_LEGACY_API_KEYS_UNTIL="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)+"\n"))
+	if status := callWithApiKey(t, removed, key); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected legacy keys to be refused after the removal date, got %v", status)
+	}
+}
+
+func TestFindApiKeySkipsRevokedAndExpiredKeys(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := middlewareRepositories.MiddlewareRepository(db)
+
+	if _, err := repo.FindApiKey("cbk_revoked"); err == nil {
+		t.Fatal("expected no key to be found")
+	}
+
+	q := fake.one(t, `FROM "api_keys"`)
+	for _, condition := range []string{`"revoked_at" IS NULL`, `"expires_at" IS NULL OR "expires_at" > now()`} {
+		if !strings.Contains(q.query, condition) {
+			t.Fatalf("expected the lookup to check %v", condition)
+		}
+	}
+	if q.args[0] != utils.HashToken("cbk_revoked") {
+		t.Fatalf("expected the key digest, got %v", q.args[0])
+	}
+}
+
+func newAppInfoApp(t *testing.T, respond func(query string, args []driver.Value) (*fakeResult, error)) (*fiber.App, *fakeDb) {
+	db, fake := newFakeDb(respond)
+	handler := appInfoHandlers.AppInfoHandler(
+		newTestConfig(t, ""),
+		appInfoUseCases.AppInfoUseCase(appInfoRepositories.AppInfoRepository(db)),
+		&fakeAuditUseCase{},
+	)
+
+	app := fiber.New()
+	app.Post("/api-keys", handler.GenerateApiKey)
+	app.Delete("/api-keys/:api_key_id", handler.RevokeApiKey)
+	return app, fake
+}
+
+func TestGenerateApiKeyRefusesUnknownScope(t *testing.T) {
+	app, fake := newAppInfoApp(t, nil)
+
+	req := httptest.NewRequest(fiber.MethodPost, "/api-keys", strings.NewReader(`{"name":"pos","scopes":["users:auth","orders:delete"]}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", res.StatusCode)
+	}
+	if len(fake.find(`INSERT INTO "api_keys"`)) != 0 {
+		t.Fatal("expected no key to be inserted")
+	}
+
+	_, err = appInfoUseCases.AppInfoUseCase(nil).InsertApiKey(&appInfo.ApiKeyReq{Scopes: []string{"orders:delete"}}, "U000001")
+	if !errors.Is(err, appInfo.ErrScopeInvalid) {
+		t.Fatalf("expected ErrScopeInvalid, got %v", err)
+	}
+}
+
+func TestRevokeApiKey(t *testing.T) {
+	revoked := false
+	app, fake := newAppInfoApp(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		// only the first revoke matches a key that isn't revoked yet
+		if strings.Contains(query, `"revoked_at" IS NULL`) && !revoked {
+			revoked = true
+			return &fakeResult{affected: 1}, nil
+		}
+		return nil, nil
+	})
+
+	apiKeyId := "7b0e5f3c-6f2a-4d5e-9a43-2b8f0f6a9c11"
+	for _, want := range []int{fiber.StatusOK, fiber.StatusBadRequest} {
+		res, err := app.Test(httptest.NewRequest(fiber.MethodDelete, "/api-keys/"+apiKeyId, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != want {
+			t.Fatalf("expected %v, got %v", want, res.StatusCode)
+		}
+	}
+	if len(fake.find(`UPDATE "api_keys"`)) != 2 {
+		t.Fatal("expected both revokes to reach the db")
+	}
+
+	db, _ := newFakeDb(nil)
+	if err := appInfoRepositories.AppInfoRepository(db).RevokeApiKey(apiKeyId); !errors.Is(err, appInfo.ErrApiKeyNotFound) {
+		t.Fatalf("expected ErrApiKeyNotFound, got %v", err)
+	}
+}
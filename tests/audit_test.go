@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditRepositories"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+)
+
+// The event NewEvent makes of a request signed in as locals
+func newRequestEvent(t *testing.T, locals map[string]string) *audit.Event {
+	var event *audit.Event
+	app := fiber.New()
+	app.Post("/", func(c *fiber.Ctx) error {
+		for key, value := range locals {
+			c.Locals(key, value)
+		}
+		event = audit.NewEvent(c, audit.ActionSignOut)
+		return nil
+	})
+
+	req := httptest.NewRequest(fiber.MethodPost, "/", nil)
+	req.Header.Set(fiber.HeaderUserAgent, "cafe-beans-pos/1.0")
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestNewEvent(t *testing.T) {
+	event := newRequestEvent(t, map[string]string{"userId": "U000001"})
+	if event.ActorId != "U000001" || event.Action != audit.ActionSignOut || event.UserAgent != "cafe-beans-pos/1.0" || event.Ip == "" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event.Outcome != audit.OutcomeSuccess || len(event.Metadata) != 0 {
+		t.Fatalf("expected a plain success, got %+v", event)
+	}
+
+	event.WithTarget("U000002").WithError(nil)
+	if event.TargetId != "U000002" || event.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("expected a nil error to keep the success, got %+v", event)
+	}
+	event.WithError(errors.New("no permission to access"))
+	if event.Outcome != audit.OutcomeFailure || event.Metadata["error"] != "no permission to access" {
+		t.Fatalf("expected a failure with its error, got %+v", event)
+	}
+
+	// an admin holding the session of the actor
+	event = newRequestEvent(t, map[string]string{"userId": "U000001", "impersonatorId": "A000001"})
+	if event.ActorId != "U000001" || event.Metadata["impersonator_id"] != "A000001" {
+		t.Fatalf("expected the impersonator to be kept, got %+v", event)
+	}
+
+	if event = newRequestEvent(t, nil); event.ActorId != "" {
+		t.Fatalf("expected no actor before signing in, got %v", event.ActorId)
+	}
+}
+
+func TestInsertEventMetadata(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := auditRepositories.AuditRepository(db)
+
+	if err := repo.InsertEvent(&audit.Event{Action: audit.ActionSignIn, Outcome: audit.OutcomeSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.InsertEvent((&audit.Event{Action: audit.ActionSignIn, Outcome: audit.OutcomeFailure}).With("identifier", "latte")); err != nil {
+		t.Fatal(err)
+	}
+
+	inserts := fake.find(`INSERT INTO "audit_events"`)
+	if len(inserts) != 2 || inserts[0].args[6] != "{}" || inserts[1].args[6] != `{"identifier":"latte"}` {
+		t.Fatalf("unexpected metadata %v", inserts)
+	}
+}
+
+func TestFindEvents(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	useCase := auditUseCases.AuditUseCase(newTestConfig(t, ""), auditRepositories.AuditRepository(db))
+
+	// the fake answers with no rows, only the query is checked
+	useCase.FindEvents(&audit.EventFilter{
+		ActorId: "U000001",
+		Action:  audit.ActionSignIn,
+		From:    "2024-01-01T00:00:00Z",
+		To:      "2024-02-01T00:00:00+07:00",
+		Limit:   1000,
+	})
+
+	count := fake.one(t, "COUNT(*)")
+	for _, condition := range []string{`"e"."actor_id" = $1`, `"e"."action" = $2`, `"e"."created_at" >= $3::TIMESTAMPTZ`, `"e"."created_at" < $4::TIMESTAMPTZ`} {
+		if !strings.Contains(count.query, condition) {
+			t.Fatalf("expected the filter to have %v", condition)
+		}
+	}
+	if strings.Contains(count.query, "target_id") {
+		t.Fatal("expected an empty field not to filter")
+	}
+
+	for _, filter := range []*audit.EventFilter{{From: "2024-01-01"}, {To: "yesterday"}} {
+		if _, err := useCase.FindEvents(filter); err == nil || err.Error() != "from and to must be formatted as RFC 3339" {
+			t.Fatalf("expected the time to be refused, got %v", err)
+		}
+	}
+}
+
+// Counts events and pages them like the repository
+type fakeAuditRepository struct {
+	auditRepositories.IAuditRepository
+
+	filter *audit.EventFilter
+	before []time.Time
+}
+
+func (r *fakeAuditRepository) FindEvents(req *audit.EventFilter) ([]*audit.Event, int, error) {
+	r.filter = req
+	return make([]*audit.Event, 0), 450, nil
+}
+
+func (r *fakeAuditRepository) DeleteEventsBefore(before time.Time) (int, error) {
+	r.before = append(r.before, before)
+	return 3, nil
+}
+
+func TestFindEventsClampsPaging(t *testing.T) {
+	repo := &fakeAuditRepository{}
+	useCase := auditUseCases.AuditUseCase(newTestConfig(t, ""), repo)
+
+	tests := []struct {
+		page, limit         int
+		expectedPage, total int
+		expectedLimit       int
+	}{
+		{0, 0, 1, 9, 50},
+		{3, 1000, 3, 3, 200},
+		{-2, 100, 1, 5, 100},
+	}
+	for _, tt := range tests {
+		page, err := useCase.FindEvents(&audit.EventFilter{Page: tt.page, Limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Page != tt.expectedPage || page.Limit != tt.expectedLimit || page.TotalPage != tt.total || page.TotalItem != 450 {
+			t.Fatalf("page %v of %v: unexpected page %+v", tt.page, tt.limit, page)
+		}
+		if repo.filter.Limit != tt.expectedLimit {
+			t.Fatalf("expected the repository to be asked for %v, got %v", tt.expectedLimit, repo.filter.Limit)
+		}
+	}
+}
+
+func TestPruneKeepsRetention(t *testing.T) {
+	repo := &fakeAuditRepository{}
+	useCase := auditUseCases.AuditUseCase(newTestConfig(t, "AUDIT_RETENTION_DAYS=30\n"), repo)
+
+	start := time.Now()
+	if count, err := useCase.Prune(); err != nil || count != 3 {
+		t.Fatalf("expected 3 events to be pruned, got %v %v", count, err)
+	}
+	retention := 30 * 24 * time.Hour
+	if len(repo.before) != 1 || repo.before[0].Before(start.Add(-retention)) || repo.before[0].After(time.Now().Add(-retention)) {
+		t.Fatalf("expected events older than 30 days to be pruned, got %v", repo.before)
+	}
+
+	// 0 keeps events forever
+	repo = &fakeAuditRepository{}
+	useCase = auditUseCases.AuditUseCase(newTestConfig(t, "AUDIT_RETENTION_DAYS=0\n"), repo)
+	if count, err := useCase.Prune(); err != nil || count != 0 || len(repo.before) != 0 {
+		t.Fatalf("expected nothing to be pruned, got %v %v", count, err)
+	}
+}
+
+func TestDeleteEventsBefore(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		return &fakeResult{affected: 7}, nil
+	})
+
+	before := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	count, err := auditRepositories.AuditRepository(db).DeleteEventsBefore(before)
+	if err != nil || count != 7 {
+		t.Fatalf("expected 7 events to be deleted, got %v %v", count, err)
+	}
+	if q := fake.one(t, `DELETE FROM "audit_events"`, `"created_at" < $1`); q.args[0] != before {
+		t.Fatalf("unexpected args %v", q.args)
+	}
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+// An HS256 token with the secret of the test config and the given claims
+func signClaims(t *testing.T, secret string, claims jwt.MapClaims) string {
+	ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    "cafe-beans-api",
+		"sub":    "access-token",
+		"aud":    []string{"customers", "admin"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"nbf":    time.Now().Unix(),
+		"iat":    time.Now().Unix(),
+		"claims": map[string]any{"id": "U000001", "role": 1},
+	}
+}
+
+func TestParseTokenAcceptsValidAccessToken(t *testing.T) {
+	cfg := newTestConfig(t, "")
+
+	claims, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), signClaims(t, "secret", validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Claims.Id != "U000001" {
+		t.Fatalf("unexpected claims: %+v", claims.Claims)
+	}
+}
+
+func TestParseTokenChecksRegisteredClaims(t *testing.T) {
+	cfg := newTestConfig(t, "")
+
+	tests := map[string]struct {
+		key   string
+		value any
+	}{
+		"wrong issuer":   {"iss", "someone-else"},
+		"wrong audience": {"aud", []string{"another-app"}},
+		"wrong subject":  {"sub", "refresh-token"},
+		"no subject":     {"sub", nil},
+		"not yet valid":  {"nbf", time.Now().Add(time.Hour).Unix()},
+	}
+	for name, tt := range tests {
+		claims := validClaims()
+		if tt.value == nil {
+			delete(claims, tt.key)
+		} else {
+			claims[tt.key] = tt.value
+		}
+
+		if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), signClaims(t, "secret", claims)); !errors.Is(err, cafeBeansAuth.ErrTokenClaims) {
+			t.Errorf("%v: expected ErrTokenClaims, got %v", name, err)
+		}
+	}
+}
+
+func TestParseTokenRejectsOtherTokenTypes(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	claims := &users.UserClaims{Id: "U000001", RoleId: 1}
+
+	refresh, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Refresh, cfg.Jwt(), claims)
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), refresh.SignToken()); !errors.Is(err, cafeBeansAuth.ErrTokenClaims) {
+		t.Fatalf("expected a refresh token to be refused as access, got %v", err)
+	}
+
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), claims)
+	for _, tokenType := range []cafeBeansAuth.TokenType{cafeBeansAuth.Refresh, cafeBeansAuth.Challenge, cafeBeansAuth.Impersonation} {
+		if _, err := cafeBeansAuth.ParseToken(tokenType, cfg.Jwt(), access.SignToken()); !errors.Is(err, cafeBeansAuth.ErrTokenClaims) {
+			t.Fatalf("expected an access token to be refused as %v, got %v", tokenType, err)
+		}
+	}
+}
+
+func TestParseTokenRejectsUserTokenAsAdmin(t *testing.T) {
+	cfg := newTestConfig(t, "APP_ADMIN_KEY=admin-secret\n")
+
+	// signed with the user secret and for customers, both are wrong for admin
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 2})
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Admin, cfg.Jwt(), access.SignToken()); err == nil {
+		t.Fatal("expected a user token to be refused as admin")
+	}
+
+	admin, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Admin, cfg.Jwt(), nil)
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Admin, cfg.Jwt(), admin.SignToken()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTokenErrors(t *testing.T) {
+	cfg := newTestConfig(t, "JWT_LEEWAY=30\n")
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), signClaims(t, "secret", expired)); !errors.Is(err, cafeBeansAuth.ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+
+	// within the leeway
+	skewed := validClaims()
+	skewed["exp"] = time.Now().Add(-10 * time.Second).Unix()
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), signClaims(t, "secret", skewed)); err != nil {
+		t.Fatalf("expected the leeway to allow it, got %v", err)
+	}
+
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), signClaims(t, "other-secret", validClaims())); !errors.Is(err, cafeBeansAuth.ErrTokenSignature) {
+		t.Fatalf("expected ErrTokenSignature, got %v", err)
+	}
+
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), "not-a-token"); !errors.Is(err, cafeBeansAuth.ErrTokenMalformed) {
+		t.Fatalf("expected ErrTokenMalformed, got %v", err)
+	}
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+	ss, _ := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), ss); err == nil {
+		t.Fatal("expected an unsigned token to be refused")
+	}
+}
@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersHandlers"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+const bootstrapBody = `{"email":"owner@cafe-beans.com","username":"owner","password":"Roast-Master-42"}`
+
+// POST /bootstrap-admin over the real repository, adminExists is what
+// the admin check of the database answers
+func newBootstrapApp(t *testing.T, env string, adminExists bool) (*fiber.App, *fakeDb, *fakeAuditUseCase) {
+	cfg := newTestConfig(t, fastPasswordEnv+env)
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.Contains(query, "SELECT EXISTS"):
+			return &fakeResult{columns: []string{"exists"}, rows: [][]driver.Value{{adminExists}}}, nil
+		case strings.Contains(query, `INSERT INTO "users"`):
+			return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{"U000003"}}}, nil
+		case strings.Contains(query, "json_build_object"):
+			user := `{"user":{"id":"U000003","email":"owner@cafe-beans.com","username":"owner","role_id":2,"avatar_url":""},"token":null}`
+			return &fakeResult{columns: []string{"json_build_object"}, rows: [][]driver.Value{{[]byte(user)}}}, nil
+		}
+		return nil, nil
+	})
+
+	auditUseCase := &fakeAuditUseCase{}
+	useCase := newTestUserUseCase(t, cfg, usersRepositories.UserRepository(db), auditUseCase)
+	handler := usersHandlers.UserHandler(cfg, useCase, newTestValidator(t, cfg), auditUseCase)
+
+	app := fiber.New()
+	app.Post("/bootstrap-admin", handler.BootstrapAdmin)
+	return app, fake, auditUseCase
+}
+
+func callBootstrap(t *testing.T, app *fiber.App, token string) (int, map[string]any) {
+	req := httptest.NewRequest(fiber.MethodPost, "/bootstrap-admin", strings.NewReader(bootstrapBody))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set("X-Bootstrap-Token", token)
+	}
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := make(map[string]any)
+	json.NewDecoder(res.Body).Decode(&body)
+	return res.StatusCode, body
+}
+
+func TestBootstrapAdminIsDisabledWithoutToken(t *testing.T) {
+	app, fake, _ := newBootstrapApp(t, "", false)
+
+	if status, _ := callBootstrap(t, app, "anything"); status != fiber.StatusNotFound {
+		t.Fatalf("expected 404, got %v", status)
+	}
+	if len(fake.find("")) != 0 {
+		t.Fatal("expected the database not to be touched")
+	}
+}
+
+func TestBootstrapAdminRefusesWrongToken(t *testing.T) {
+	app, fake, auditUseCase := newBootstrapApp(t, "APP_BOOTSTRAP_TOKEN=first-brew\n", false)
+
+	for _, token := range []string{"", "first-brew-", "FIRST-BREW"} {
+		if status, _ := callBootstrap(t, app, token); status != fiber.StatusUnauthorized {
+			t.Fatalf("%q: expected 401, got %v", token, status)
+		}
+	}
+	if len(fake.find("")) != 0 {
+		t.Fatal("expected the database not to be touched")
+	}
+	if len(auditUseCase.events) != 3 || auditUseCase.events[0].Action != audit.ActionAdminBootstrapped || auditUseCase.events[0].Outcome != audit.OutcomeFailure {
+		t.Fatalf("expected every refusal to be recorded, got %v", auditUseCase.events)
+	}
+}
+
+func TestBootstrapAdminRefusesWhenAdminExists(t *testing.T) {
+	app, fake, _ := newBootstrapApp(t, "APP_BOOTSTRAP_TOKEN=first-brew\n", true)
+
+	status, body := callBootstrap(t, app, "first-brew")
+	if status != fiber.StatusForbidden || body["message"] != "admin already exists" {
+		t.Fatalf("expected 403 admin already exists, got %v %v", status, body)
+	}
+	if len(fake.find(`INSERT INTO "users"`)) != 0 || fake.rollbacks != 1 || fake.commits != 0 {
+		t.Fatal("expected nothing to be inserted")
+	}
+}
+
+func TestBootstrapAdminCreatesFirstAdmin(t *testing.T) {
+	app, fake, auditUseCase := newBootstrapApp(t, "APP_BOOTSTRAP_TOKEN=first-brew\n", false)
+
+	status, body := callBootstrap(t, app, "first-brew")
+	if status != fiber.StatusCreated {
+		t.Fatalf("expected 201, got %v %v", status, body)
+	}
+
+	// the same lock and check as the last admin safeguard of roles
+	fake.one(t, `pg_advisory_xact_lock(hashtext('roles_admin'))`)
+	fake.one(t, "SELECT EXISTS", `'roles:manage'`)
+
+	insert := fake.one(t, `INSERT INTO "users"`)
+	if insert.args[0] != "owner@cafe-beans.com" || insert.args[2] != "owner" || insert.args[3] != roles.AdminRoleId {
+		t.Fatalf("unexpected args %v", insert.args)
+	}
+	if password, _ := insert.args[1].(string); !strings.HasPrefix(password, "$argon2id$") {
+		t.Fatal("expected the password to be hashed")
+	}
+	if fake.commits != 1 {
+		t.Fatalf("expected a commit, got %v", fake.commits)
+	}
+	if len(auditUseCase.events) != 1 || auditUseCase.events[0].Outcome != audit.OutcomeSuccess || auditUseCase.events[0].TargetId != "U000003" {
+		t.Fatalf("expected the bootstrap to be recorded, got %+v", auditUseCase.events)
+	}
+}
+
+// An app with one route that needs an admin token
+func newAdminTokenApp(t *testing.T) (*fiber.App, *fakeAuditUseCase) {
+	auditUseCase := &fakeAuditUseCase{}
+	mid := middlewareHandlers.MiddlewareHandler(newTestConfig(t, "APP_ADMIN_KEY=admin-secret\n"), &fakeApiKeyUseCase{}, auditUseCase)
+
+	app := fiber.New()
+	app.Post("/signup-admin", mid.AdminTokenAuth(), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusCreated)
+	})
+	return app, auditUseCase
+}
+
+func callWithAdminToken(t *testing.T, app *fiber.App, token string) int {
+	req := httptest.NewRequest(fiber.MethodPost, "/signup-admin", nil)
+	if token != "" {
+		req.Header.Set("X-Admin-Token", token)
+	}
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestAdminTokenAuth(t *testing.T) {
+	cfg := newTestConfig(t, "APP_ADMIN_KEY=admin-secret\n")
+	app, auditUseCase := newAdminTokenApp(t)
+
+	admin, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Admin, cfg.Jwt(), nil)
+	if status := callWithAdminToken(t, app, admin.SignToken()); status != fiber.StatusCreated {
+		t.Fatalf("expected an admin token to be accepted, got %v", status)
+	}
+
+	expired := signClaims(t, "admin-secret", jwt.MapClaims{
+		"iss": "cafe-beans-api",
+		"sub": "admin-token",
+		"aud": []string{"admin"},
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: roles.AdminRoleId})
+
+	tests := map[string]string{
+		"missing":      "",
+		"expired":      expired,
+		"access token": access.SignToken(),
+	}
+	for name, token := range tests {
+		if status := callWithAdminToken(t, app, token); status != fiber.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %v", name, status)
+		}
+	}
+	if len(auditUseCase.events) != 3 || auditUseCase.events[0].Action != audit.ActionAdminTokenRejected {
+		t.Fatalf("expected every rejection to be recorded, got %v", auditUseCase.events)
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+)
+
+// Accounts that can be asked for their profile and anonymized
+type fakeDeletionRepository struct {
+	*fakeAccountRepository
+
+	anonymized []string
+}
+
+func (r *fakeDeletionRepository) GetProfile(userId string) (*users.User, error) {
+	u, ok := r.users[userId]
+	if !ok {
+		return nil, fmt.Errorf("get user failed: user not found")
+	}
+	return &users.User{Id: u.Id, Email: u.Email, Username: u.Username, RoleId: u.RoleId}, nil
+}
+
+func (r *fakeDeletionRepository) AnonymizeUser(userId string) error {
+	r.anonymized = append(r.anonymized, userId)
+	return nil
+}
+
+func TestDeletionIsConfirmedOnce(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := &fakeDeletionRepository{fakeAccountRepository: newFakeAccountRepository()}
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	if err := useCase.RequestDeletion("U000001"); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.tokens) != 1 || repo.tokens[0].Purpose != users.OneTimeTokenDeletion || repo.tokens[0].ExpiresIn != 3600 {
+		t.Fatalf("expected a deletion token valid for 1 hour, got %+v", repo.tokens)
+	}
+	// asking alone doesn't delete anything
+	if len(repo.anonymized) != 0 {
+		t.Fatal("expected the account to be kept until it's confirmed")
+	}
+
+	req := &users.UserDeletionReq{Token: repo.tokens[0].Token}
+	if err := useCase.ConfirmDeletion(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.anonymized) != 1 || repo.anonymized[0] != "U000001" {
+		t.Fatalf("expected U000001 to be anonymized, got %v", repo.anonymized)
+	}
+	if err := useCase.ConfirmDeletion(req); err == nil || err.Error() != "token is invalid or expired" {
+		t.Fatalf("expected a used token to be refused, got %v", err)
+	}
+}
+
+func TestDeletionRefusesAdmin(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := &fakeDeletionRepository{fakeAccountRepository: newFakeAccountRepository()}
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000002", Email: "owner@cafe-beans.com", Username: "owner", RoleId: roles.AdminRoleId}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	if err := useCase.RequestDeletion("U000002"); err == nil || err.Error() != "admin has to be changed to another role first" {
+		t.Fatalf("expected admin to be refused, got %v", err)
+	}
+
+	// made admin after the token was sent
+	repo.tokens = append(repo.tokens, &users.OneTimeToken{UserId: "U000002", Purpose: users.OneTimeTokenDeletion, Token: "deletion-token"})
+	if err := useCase.ConfirmDeletion(&users.UserDeletionReq{Token: "deletion-token"}); err == nil || err.Error() != "admin has to be changed to another role first" {
+		t.Fatalf("expected admin to be refused, got %v", err)
+	}
+	if len(repo.anonymized) != 0 {
+		t.Fatal("expected admin to be kept")
+	}
+}
+
+func TestAnonymizeUser(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		if strings.Contains(query, `UPDATE "users"`) {
+			return &fakeResult{columns: []string{"email", "username"}, rows: [][]driver.Value{{"Latte@Cafe-Beans.com", "Latte"}}}, nil
+		}
+		return nil, nil
+	})
+
+	if err := usersRepositories.UserRepository(db).AnonymizeUser("U000001"); err != nil {
+		t.Fatal(err)
+	}
+
+	update := fake.one(t, `UPDATE "users"`)
+	for _, part := range []string{`'deleted_' || "u"."id"`, `'deleted+' || "u"."id" || '@invalid'`, `"password" = ''`, `"totp_secret" = ''`, `"deleted_at" = now()`, `"deleted_at" IS NULL`} {
+		if !strings.Contains(update.query, part) {
+			t.Fatalf("expected the user update to have %v", part)
+		}
+	}
+
+	for _, table := range []string{`"oauth"`, `"user_identities"`, `"user_addresses"`, `"recovery_codes"`, `"one_time_tokens"`} {
+		if q := fake.one(t, `DELETE FROM `+table); q.args[0] != "U000001" {
+			t.Fatalf("expected %v of U000001 to be deleted, got %v", table, q.args)
+		}
+	}
+	if q := fake.one(t, `UPDATE "api_keys"`, `"revoked_at" = now()`); q.args[0] != "U000001" {
+		t.Fatalf("expected the api keys of U000001 to be revoked, got %v", q.args)
+	}
+	if q := fake.one(t, `UPDATE "audit_events"`, `"actor_id" = $1`); q.args[0] != "U000001" {
+		t.Fatalf("expected the audit events of U000001 to be stripped, got %v", q.args)
+	}
+
+	// typed in identifiers are matched lowercase
+	if q := fake.one(t, `DELETE FROM "login_attempts"`); q.args[0] != "latte@cafe-beans.com" {
+		t.Fatalf("expected the login attempts of the old email to be deleted, got %v", q.args)
+	}
+	if q := fake.one(t, `"metadata"->>'identifier'`); q.args[0] != "latte@cafe-beans.com" || q.args[1] != "latte" {
+		t.Fatalf("expected failed signins of the old email and username to be stripped, got %v", q.args)
+	}
+	if fake.commits != 1 || fake.rollbacks != 0 {
+		t.Fatalf("expected a commit, got %v commits and %v rollbacks", fake.commits, fake.rollbacks)
+	}
+}
+
+func TestAnonymizeUserRefusesDeletedUser(t *testing.T) {
+	db, fake := newFakeDb(nil)
+
+	if err := usersRepositories.UserRepository(db).AnonymizeUser("U000001"); err == nil || err.Error() != "user not found" {
+		t.Fatalf("expected user not found, got %v", err)
+	}
+	if len(fake.find(`DELETE FROM`)) != 0 || fake.rollbacks != 1 {
+		t.Fatal("expected nothing else to run")
+	}
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/utils"
+)
+
+// Answers an email change token for user 7 moving from old@ to new@
+func respondEmailChange(updateErr error) func(query string, args []driver.Value) (*fakeResult, error) {
+	return func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.Contains(query, `UPDATE "one_time_tokens"`):
+			return &fakeResult{columns: []string{"user_id", "email"}, rows: [][]driver.Value{{"7", "new@cafe-beans.com"}}}, nil
+		case strings.Contains(query, `SELECT`):
+			return &fakeResult{columns: []string{"email"}, rows: [][]driver.Value{{"old@cafe-beans.com"}}}, nil
+		case strings.Contains(query, `UPDATE "users"`):
+			return &fakeResult{affected: 1}, updateErr
+		}
+		return nil, nil
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	db, fake := newFakeDb(respondEmailChange(nil))
+
+	change, err := usersRepositories.UserRepository(db).ChangeEmail("email-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.UserId != "7" || change.Email != "new@cafe-beans.com" || change.PreviousEmail != "old@cafe-beans.com" {
+		t.Fatalf("unexpected change %+v", change)
+	}
+
+	token := fake.one(t, `UPDATE "one_time_tokens"`)
+	if token.args[0] != utils.HashToken("email-token") || token.args[1] != users.OneTimeTokenEmailChange {
+		t.Fatalf("unexpected token args %v", token.args)
+	}
+	if update := fake.one(t, `UPDATE "users"`); update.args[0] != "new@cafe-beans.com" || update.args[1] != "7" {
+		t.Fatalf("unexpected update args %v", update.args)
+	}
+	if fake.commits != 1 || fake.rollbacks != 0 {
+		t.Fatalf("expected a commit, got %v commits and %v rollbacks", fake.commits, fake.rollbacks)
+	}
+}
+
+func TestChangeEmailKeepsTokenWhenEmailIsTaken(t *testing.T) {
+	duplicate := errors.New(`ERROR: duplicate key value violates unique constraint "users_email_lower_key" (SQLSTATE 23505)`)
+	db, fake := newFakeDb(respondEmailChange(duplicate))
+
+	if _, err := usersRepositories.UserRepository(db).ChangeEmail("email-token"); err == nil || err.Error() != "email has been used" {
+		t.Fatalf("expected email has been used, got %v", err)
+	}
+	// rolled back, so the token is still unused and can be tried again
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Fatalf("expected a rollback, got %v commits and %v rollbacks", fake.commits, fake.rollbacks)
+	}
+}
+
+func TestChangeEmailRefusesUnknownToken(t *testing.T) {
+	db, fake := newFakeDb(nil)
+
+	if _, err := usersRepositories.UserRepository(db).ChangeEmail("email-token"); err == nil || err.Error() != "token is invalid or expired" {
+		t.Fatalf("expected token is invalid or expired, got %v", err)
+	}
+	if len(fake.find(`UPDATE "users"`)) != 0 || fake.rollbacks != 1 {
+		t.Fatal("expected nothing to be updated")
+	}
+}
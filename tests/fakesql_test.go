@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A query and its arguments as the repository sent them
+type fakeQuery struct {
+	query string
+	args  []driver.Value
+}
+
+// What a query answers with, rows for a select and affected for an exec
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// A database/sql driver that records every query instead of running it,
+// so the sql a repository builds can be checked without postgres
+type fakeDb struct {
+	mu        sync.Mutex
+	queries   []fakeQuery
+	commits   int
+	rollbacks int
+	// nil answers every query with no rows and nothing affected
+	respond func(query string, args []driver.Value) (*fakeResult, error)
+}
+
+func newFakeDb(respond func(query string, args []driver.Value) (*fakeResult, error)) (*sqlx.DB, *fakeDb) {
+	f := &fakeDb{respond: respond}
+	return sqlx.NewDb(sql.OpenDB(f), "pgx"), f
+}
+
+// The recorded queries that contain every part
+func (f *fakeDb) find(parts ...string) []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	found := make([]fakeQuery, 0)
+	for _, q := range f.queries {
+		matched := true
+		for _, part := range parts {
+			if !strings.Contains(q.query, part) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			found = append(found, q)
+		}
+	}
+	return found
+}
+
+// The only recorded query that contains every part
+func (f *fakeDb) one(t *testing.T, parts ...string) fakeQuery {
+	t.Helper()
+	found := f.find(parts...)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 query with %q, got %v", parts, len(found))
+	}
+	return found[0]
+}
+
+func (f *fakeDb) run(query string, named []driver.NamedValue) (*fakeResult, error) {
+	args := make([]driver.Value, len(named))
+	for i, v := range named {
+		args[i] = v.Value
+	}
+
+	f.mu.Lock()
+	f.queries = append(f.queries, fakeQuery{query: query, args: args})
+	f.mu.Unlock()
+
+	if f.respond == nil {
+		return &fakeResult{}, nil
+	}
+	result, err := f.respond(query, args)
+	if result == nil && err == nil {
+		result = &fakeResult{}
+	}
+	return result, err
+}
+
+func (f *fakeDb) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDb) Driver() driver.Driver                        { return f }
+func (f *fakeDb) Open(string) (driver.Conn, error)             { return &fakeConn{db: f}, nil }
+
+type fakeConn struct {
+	db *fakeDb
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return &fakeTx{db: c.db}, nil }
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return &fakeTx{db: c.db}, nil
+}
+
+// Arrays and other values pgx would encode are passed along as they are
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: result}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type fakeTx struct {
+	db *fakeDb
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	tx.db.commits++
+	tx.db.mu.Unlock()
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	tx.db.rollbacks++
+	tx.db.mu.Unlock()
+	return nil
+}
+
+type fakeRows struct {
+	result *fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+)
+
+// 45 users match whatever the filter is, the page is empty
+func newFindUsersRepository() (usersRepositories.IUserRepository, *fakeDb) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		if strings.Contains(query, "COUNT(*)") {
+			return &fakeResult{columns: []string{"count"}, rows: [][]driver.Value{{int64(45)}}}, nil
+		}
+		return &fakeResult{columns: []string{"coalesce"}, rows: [][]driver.Value{{[]byte("[]")}}}, nil
+	})
+	return usersRepositories.UserRepository(db), fake
+}
+
+func TestFindUsersBuildsFilter(t *testing.T) {
+	repo, fake := newFindUsersRepository()
+	useCase := newTestUserUseCase(t, newTestConfig(t, ""), repo, &fakeAuditUseCase{})
+
+	page, err := useCase.FindUsers(&users.UserFilter{
+		Search:      "50%_Off\\",
+		RoleId:      3,
+		CreatedFrom: "2024-01-01",
+		CreatedTo:   "2024-01-31",
+		Page:        2,
+		Limit:       20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalItem != 45 || page.TotalPage != 3 || page.Page != 2 || page.Limit != 20 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+
+	count := fake.one(t, "COUNT(*)")
+	for _, condition := range []string{
+		`(LOWER("u"."email") LIKE $1 OR LOWER("u"."username") LIKE $1)`,
+		`"u"."role_id" = $2`,
+		`"u"."created_at" >= $3::DATE`,
+		`"u"."created_at" < $4::DATE + 1`,
+	} {
+		if !strings.Contains(count.query, condition) {
+			t.Fatalf("expected the filter to have %v", condition)
+		}
+	}
+	// the search is lowercase and its wildcards are escaped
+	expected := []driver.Value{`%50\%\_off\\%`, 3, "2024-01-01", "2024-01-31"}
+	if len(count.args) != len(expected) {
+		t.Fatalf("expected args %v, got %v", expected, count.args)
+	}
+	for i := range expected {
+		if count.args[i] != expected[i] {
+			t.Fatalf("expected args %v, got %v", expected, count.args)
+		}
+	}
+
+	list := fake.one(t, "json_agg")
+	if !strings.Contains(list.query, "LIMIT $5 OFFSET $6") || list.args[4] != 20 || list.args[5] != 20 {
+		t.Fatalf("expected the second page of 20, got %v", list.args)
+	}
+}
+
+func TestFindUsersWithoutFilter(t *testing.T) {
+	repo, fake := newFindUsersRepository()
+	useCase := newTestUserUseCase(t, newTestConfig(t, ""), repo, &fakeAuditUseCase{})
+
+	if _, err := useCase.FindUsers(&users.UserFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if count := fake.one(t, "COUNT(*)"); strings.Contains(count.query, "WHERE") || len(count.args) != 0 {
+		t.Fatalf("expected every user to be counted, got %v", count.query)
+	}
+	// the first page of 20 by default
+	if list := fake.one(t, "json_agg"); !strings.Contains(list.query, "LIMIT $1 OFFSET $2") || list.args[0] != 20 || list.args[1] != 0 {
+		t.Fatalf("expected the first page of 20, got %v", list.args)
+	}
+}
+
+func TestFindUsersClampsLimitAndChecksDates(t *testing.T) {
+	repo, fake := newFindUsersRepository()
+	useCase := newTestUserUseCase(t, newTestConfig(t, ""), repo, &fakeAuditUseCase{})
+
+	page, err := useCase.FindUsers(&users.UserFilter{Page: -1, Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Page != 1 || page.Limit != 100 || page.TotalPage != 1 {
+		t.Fatalf("expected the first page of at most 100, got %+v", page)
+	}
+	if list := fake.one(t, "json_agg"); list.args[0] != 100 || list.args[1] != 0 {
+		t.Fatalf("expected limit 100 and offset 0, got %v", list.args)
+	}
+
+	for _, filter := range []*users.UserFilter{{CreatedFrom: "01/02/2024"}, {CreatedTo: "2024-13-01"}} {
+		if _, err := useCase.FindUsers(filter); err == nil || err.Error() != "created date must be formatted as yyyy-mm-dd" {
+			t.Fatalf("expected the date to be refused, got %v", err)
+		}
+	}
+}
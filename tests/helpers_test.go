@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/modules/users/usersUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansMailer"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansOidc"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansStorage"
+)
+
+// Error responses are logged to ./assets/logs, run from a directory that has it
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cafe-beans-tests")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "assets", "logs"), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// The least a config needs to load, extra lines are appended as they are
+const baseEnv = "APP_PORT=3000\nAPP_BODY_LIMIT=10490000\nAPP_READ_TIMEOUT=60\nAPP_WRITE_TIMEOUT=60\nAPP_FILE_LIMIT=2097000\n" +
+	"DB_PORT=5432\nDB_MAX_CONNECTIONS=25\n" +
+	"JWT_SECRET_KEY=secret\nJWT_ACCESS_EXPIRES=86400\nJWT_REFRESH_EXPIRES=604800\n"
+
+func newTestConfig(t *testing.T, env string) config.IConfig {
+	envPath := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envPath, []byte(baseEnv+env), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.LoadConfig(envPath)
+}
+
+// A user use case without oidc providers and with an in memory cache
+func newTestUserUseCase(t *testing.T, cfg config.IConfig, repo usersRepositories.IUserRepository, auditUseCase auditUseCases.IAuditUseCase) usersUseCases.IUserUseCase {
+	return usersUseCases.UserUseCase(
+		cfg,
+		repo,
+		cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl()),
+		cafeBeansMailer.NewMailer(cfg.Mail()),
+		map[string]cafeBeansOidc.IClient{},
+		cafeBeansStorage.NewLocalStorage(t.TempDir(), "/uploads"),
+		auditUseCase,
+	)
+}
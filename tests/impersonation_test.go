@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+// Every token is a live session of U000001, held by A000001 when
+// the token is an impersonation token
+type fakeSessionUseCase struct {
+	middlewareUseCases.IMiddlewareUseCase
+
+	cfg config.IConfig
+}
+
+func (u *fakeSessionUseCase) FindAccessToken(userId, accessToken string) (*middleware.Session, error) {
+	session := &middleware.Session{Id: "S000001", UserId: userId, RoleId: 1}
+	if result, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Impersonation, u.cfg.Jwt(), accessToken); err == nil {
+		session.ImpersonatorId = result.Claims.ImpersonatorId
+	}
+	return session, nil
+}
+
+// The routes of the user module that an impersonating admin can't use,
+// guarded the way module.go guards them
+func newImpersonationApp(cfg config.IConfig) *fiber.App {
+	mid := middlewareHandlers.MiddlewareHandler(cfg, &fakeSessionUseCase{cfg: cfg}, &fakeAuditUseCase{})
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+
+	app := fiber.New()
+	app.Get("/:user_id/export", mid.JwtAuth(), mid.DenyImpersonation(), mid.ParamsCheck(), ok)
+	app.Put("/:user_id/avatar", mid.JwtAuth(), mid.DenyImpersonation(), mid.ParamsCheck(), ok)
+	app.Delete("/:user_id/avatar", mid.JwtAuth(), mid.DenyImpersonation(), mid.ParamsCheck(), ok)
+	app.Get("/:user_id", mid.JwtAuth(), mid.ParamsCheck(), ok)
+	return app
+}
+
+func callWithToken(t *testing.T, app *fiber.App, method, path, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestDenyImpersonation(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app := newImpersonationApp(cfg)
+
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	impersonation, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Impersonation, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1, ImpersonatorId: "A000001"})
+
+	denied := []struct{ method, path string }{
+		{fiber.MethodGet, "/U000001/export"},
+		{fiber.MethodPut, "/U000001/avatar"},
+		{fiber.MethodDelete, "/U000001/avatar"},
+	}
+	for _, route := range denied {
+		if status := callWithToken(t, app, route.method, route.path, access.SignToken()); status != fiber.StatusOK {
+			t.Fatalf("%s %s: expected the user to be let through, got %v", route.method, route.path, status)
+		}
+		if status := callWithToken(t, app, route.method, route.path, impersonation.SignToken()); status != fiber.StatusForbidden {
+			t.Fatalf("%s %s: expected an impersonating admin to be refused, got %v", route.method, route.path, status)
+		}
+	}
+
+	// reading the profile is what impersonation is for
+	if status := callWithToken(t, app, fiber.MethodGet, "/U000001", impersonation.SignToken()); status != fiber.StatusOK {
+		t.Fatalf("expected an impersonating admin to see the profile, got %v", status)
+	}
+}
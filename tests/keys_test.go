@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+// Pem files of a fresh RSA and Ed25519 key, by kid
+func writeSigningKeys(t *testing.T) (map[string]string, *rsa.PrivateKey, ed25519.PrivateKey) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string]string)
+	for kid, key := range map[string]any{"rsa-1": rsaKey, "ed-1": edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[kid] = filepath.Join(dir, kid+".pem")
+		if err := os.WriteFile(paths[kid], pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths, rsaKey, edKey
+}
+
+func signingKeysEnv(paths map[string]string, activeKeyId string) string {
+	return fmt.Sprintf("JWT_SIGNING_KEYS=rsa-1=%s,ed-1=%s\nJWT_ACTIVE_KEY_ID=%s\n", paths["rsa-1"], paths["ed-1"], activeKeyId)
+}
+
+func signAccessToken(t *testing.T, cfg config.IConfig) string {
+	token, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.SignToken()
+}
+
+func tokenHeader(t *testing.T, tokenString string) map[string]any {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Header
+}
+
+func TestUserTokensAreSignedWithActiveKey(t *testing.T) {
+	paths, _, _ := writeSigningKeys(t)
+
+	for kid, alg := range map[string]string{"rsa-1": "RS256", "ed-1": "EdDSA"} {
+		cfg := newTestConfig(t, signingKeysEnv(paths, kid))
+		token := signAccessToken(t, cfg)
+
+		header := tokenHeader(t, token)
+		if header["kid"] != kid || header["alg"] != alg {
+			t.Fatalf("expected %v signed with %v, got %v", kid, alg, header)
+		}
+		if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), token); err != nil {
+			t.Fatalf("%v: %v", kid, err)
+		}
+	}
+}
+
+func TestRotatedKeysStillVerify(t *testing.T) {
+	paths, _, _ := writeSigningKeys(t)
+
+	before := newTestConfig(t, signingKeysEnv(paths, "rsa-1"))
+	after := newTestConfig(t, signingKeysEnv(paths, "ed-1"))
+
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, after.Jwt(), signAccessToken(t, before)); err != nil {
+		t.Fatalf("expected a token of the previous key to verify, got %v", err)
+	}
+}
+
+func TestUnknownKidIsRejected(t *testing.T) {
+	paths, _, _ := writeSigningKeys(t)
+
+	cfg := newTestConfig(t, signingKeysEnv(paths, "rsa-1"))
+	token := signAccessToken(t, cfg)
+
+	// the key was removed from the set
+	other := newTestConfig(t, fmt.Sprintf("JWT_SIGNING_KEYS=ed-1=%s\nJWT_ACTIVE_KEY_ID=ed-1\n", paths["ed-1"]))
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, other.Jwt(), token); !errors.Is(err, cafeBeansAuth.ErrTokenSignature) {
+		t.Fatalf("expected ErrTokenSignature, got %v", err)
+	}
+}
+
+func TestHs256TokensAreRejectedOnceKeyIsActive(t *testing.T) {
+	paths, _, _ := writeSigningKeys(t)
+	hs256Token := signAccessToken(t, newTestConfig(t, ""))
+
+	cfg := newTestConfig(t, signingKeysEnv(paths, "rsa-1"))
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), hs256Token); !errors.Is(err, cafeBeansAuth.ErrTokenSignature) {
+		t.Fatalf("expected ErrTokenSignature, got %v", err)
+	}
+
+	expired := newTestConfig(t, signingKeysEnv(paths, "rsa-1")+
+		"JWT_HS256_ACCEPT_UNTIL="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)+"\n")
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, expired.Jwt(), hs256Token); !errors.Is(err, cafeBeansAuth.ErrTokenSignature) {
+		t.Fatalf("expected ErrTokenSignature after the migration window, got %v", err)
+	}
+}
+
+func TestHs256TokensAreAcceptedDuringMigration(t *testing.T) {
+	paths, _, _ := writeSigningKeys(t)
+	hs256Token := signAccessToken(t, newTestConfig(t, ""))
+
+	cfg := newTestConfig(t, signingKeysEnv(paths, "rsa-1")+
+		"JWT_HS256_ACCEPT_UNTIL="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+"\n")
+	if _, err := cafeBeansAuth.ParseToken(cafeBeansAuth.Access, cfg.Jwt(), hs256Token); err != nil {
+		t.Fatalf("expected the token to verify during the migration window, got %v", err)
+	}
+}
+
+func TestJwkSetPublishesPublicKeys(t *testing.T) {
+	paths, rsaKey, edKey := writeSigningKeys(t)
+	cfg := newTestConfig(t, signingKeysEnv(paths, "rsa-1"))
+
+	set := cafeBeansAuth.JwkSet(cfg.Jwt())
+	if len(set.Keys) != 2 {
+		t.Fatalf("expected 2 keys, got %v", len(set.Keys))
+	}
+
+	// sorted by kid
+	ed, rs := set.Keys[0], set.Keys[1]
+	if ed.Kid != "ed-1" || ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" ||
+		ed.X != base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("unexpected ed25519 key: %+v", ed)
+	}
+	if rs.Kid != "rsa-1" || rs.Kty != "RSA" || rs.Alg != "RS256" || rs.E != "AQAB" ||
+		rs.N != base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()) {
+		t.Fatalf("unexpected rsa key: %+v", rs)
+	}
+}
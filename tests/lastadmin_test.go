@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
+)
+
+type fakeAdminUser struct {
+	roleId   int
+	disabled bool
+	deleted  bool
+}
+
+// The users table as far as the last admin safeguard reads it, the admin
+// check only skips disabled or deleted users when its sql filters them
+func newLastAdminRepository(users map[string]*fakeAdminUser) (rolesRepositories.IRolesRepository, *fakeDb) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.Contains(query, `UPDATE "users" SET "role_id"`):
+			user, ok := users[args[1].(string)]
+			if !ok {
+				return &fakeResult{}, nil
+			}
+			user.roleId = args[0].(int)
+			return &fakeResult{affected: 1}, nil
+		case strings.Contains(query, "SELECT EXISTS"):
+			exists := false
+			for _, user := range users {
+				if user.roleId != roles.AdminRoleId {
+					continue
+				}
+				if user.disabled && strings.Contains(query, `"u"."disabled_at" IS NULL`) {
+					continue
+				}
+				if user.deleted && strings.Contains(query, `"u"."deleted_at" IS NULL`) {
+					continue
+				}
+				exists = true
+			}
+			return &fakeResult{columns: []string{"exists"}, rows: [][]driver.Value{{exists}}}, nil
+		}
+		return nil, nil
+	})
+	return rolesRepositories.RolesRepository(db), fake
+}
+
+func TestDemoteLastActiveAdminWithDisabledAdmin(t *testing.T) {
+	repo, fake := newLastAdminRepository(map[string]*fakeAdminUser{
+		"U000001": {roleId: roles.AdminRoleId},
+		"U000002": {roleId: roles.AdminRoleId, disabled: true},
+		"U000003": {roleId: roles.AdminRoleId, deleted: true},
+	})
+
+	err := repo.UpdateUserRole("U000001", roles.CustomerRoleId)
+	if err == nil || err.Error() != "cannot remove the last admin" {
+		t.Fatalf("expected the last active admin to stay, got %v", err)
+	}
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Fatalf("expected the demotion to be rolled back, got %v commits", fake.commits)
+	}
+}
+
+func TestDemoteAdminWithAnotherActiveAdmin(t *testing.T) {
+	repo, fake := newLastAdminRepository(map[string]*fakeAdminUser{
+		"U000001": {roleId: roles.AdminRoleId},
+		"U000002": {roleId: roles.AdminRoleId},
+	})
+
+	if err := repo.UpdateUserRole("U000001", roles.CustomerRoleId); err != nil {
+		t.Fatal(err)
+	}
+	if fake.commits != 1 {
+		t.Fatalf("expected the demotion to be committed, got %v commits", fake.commits)
+	}
+}
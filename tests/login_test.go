@@ -0,0 +1,346 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansPassword"
+)
+
+// Cheap argon2id parameters, the tests hash a lot of passwords
+const fastPasswordEnv = "PASSWORD_ARGON2_MEMORY=1024\nPASSWORD_ARGON2_ITERATIONS=1\n"
+
+type loginAttempt struct {
+	identifier string
+	ip         string
+	succeeded  bool
+	at         time.Time
+}
+
+// Accounts and their sign in attempts, the failures are counted
+// the way the query of the repository counts them
+type fakeAccountRepository struct {
+	usersRepositories.IUserRepository
+
+	users       map[string]*users.UserCredentialCheck // by id
+	attempts    []*loginAttempt
+	tokens      []*users.OneTimeToken
+	usedTokens  map[string]bool
+	rehashed    map[string]string // user id -> new hash
+	oauthIssued int
+}
+
+func newFakeAccountRepository() *fakeAccountRepository {
+	return &fakeAccountRepository{
+		users:      make(map[string]*users.UserCredentialCheck),
+		usedTokens: make(map[string]bool),
+		rehashed:   make(map[string]string),
+	}
+}
+
+func (r *fakeAccountRepository) addUser(t *testing.T, cfg config.IConfig, user *users.UserCredentialCheck, password string) {
+	hashed, err := cafeBeansPassword.NewHasher(cfg.Password()).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Password = hashed
+	r.users[user.Id] = user
+}
+
+// Move every attempt back in time, as if d has passed
+func (r *fakeAccountRepository) age(d time.Duration) {
+	for _, a := range r.attempts {
+		a.at = a.at.Add(-d)
+	}
+}
+
+func (r *fakeAccountRepository) FindOneUserByEmail(email string) (*users.UserCredentialCheck, error) {
+	for _, u := range r.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+func (r *fakeAccountRepository) FindOneUserByUsername(username string) (*users.UserCredentialCheck, error) {
+	for _, u := range r.users {
+		if strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+func (r *fakeAccountRepository) InsertLoginAttempt(identifier, ip string, succeeded bool) error {
+	r.attempts = append(r.attempts, &loginAttempt{identifier: identifier, ip: ip, succeeded: succeeded, at: time.Now()})
+	return nil
+}
+
+func (r *fakeAccountRepository) FindLoginFailures(identifier, ip string, window time.Duration) (*users.LoginFailures, error) {
+	now := time.Now()
+
+	var lastSuccess time.Time
+	for _, a := range r.attempts {
+		if a.identifier == identifier && a.succeeded && a.at.After(lastSuccess) {
+			lastSuccess = a.at
+		}
+	}
+
+	failures := new(users.LoginFailures)
+	var lastAccount, lastIp time.Time
+	for _, a := range r.attempts {
+		if a.succeeded || !a.at.After(now.Add(-window)) {
+			continue
+		}
+		if a.identifier == identifier && a.at.After(lastSuccess) {
+			failures.Account++
+			if a.at.After(lastAccount) {
+				lastAccount = a.at
+			}
+		}
+		if a.ip == ip {
+			failures.Ip++
+			if a.at.After(lastIp) {
+				lastIp = a.at
+			}
+		}
+	}
+	if failures.Account != 0 {
+		failures.SinceAccountFailure = int(now.Sub(lastAccount).Seconds())
+	}
+	if failures.Ip != 0 {
+		failures.SinceIpFailure = int(now.Sub(lastIp).Seconds())
+	}
+	return failures, nil
+}
+
+func (r *fakeAccountRepository) DeleteLoginFailures(identifier string) error {
+	kept := make([]*loginAttempt, 0)
+	for _, a := range r.attempts {
+		if a.identifier != identifier || a.succeeded {
+			kept = append(kept, a)
+		}
+	}
+	r.attempts = kept
+	return nil
+}
+
+func (r *fakeAccountRepository) DeleteLoginAttemptsBefore(before time.Time) (int, error) {
+	kept := make([]*loginAttempt, 0)
+	for _, a := range r.attempts {
+		if !a.at.Before(before) {
+			kept = append(kept, a)
+		}
+	}
+	count := len(r.attempts) - len(kept)
+	r.attempts = kept
+	return count, nil
+}
+
+func (r *fakeAccountRepository) InsertOneTimeToken(req *users.OneTimeToken) error {
+	r.tokens = append(r.tokens, req)
+	return nil
+}
+
+func (r *fakeAccountRepository) UpdatePassword(userId, password string) error {
+	r.rehashed[userId] = password
+	r.users[userId].Password = password
+	return nil
+}
+
+func (r *fakeAccountRepository) InsertOauth(req *users.UserPassport) error {
+	r.oauthIssued++
+	req.Token.Id = fmt.Sprintf("oauth-%d", r.oauthIssued)
+	return nil
+}
+
+func newLoginUseCase(t *testing.T, env string) (*fakeAccountRepository, config.IConfig, func(login, password, ip string) (*users.UserPassport, error)) {
+	cfg := newTestConfig(t, fastPasswordEnv+env)
+	repo := newFakeAccountRepository()
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "Latte@cafe-beans.com", Username: "Latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	return repo, cfg, func(login, password, ip string) (*users.UserPassport, error) {
+		return useCase.GetPassport(&users.UserCredential{Identifier: login, Password: password, Ip: ip})
+	}
+}
+
+func expectLocked(t *testing.T, err error) *users.LoginLockedError {
+	t.Helper()
+	locked := new(users.LoginLockedError)
+	if !errors.As(err, &locked) {
+		t.Fatalf("expected the sign in to be locked, got %v", err)
+	}
+	if locked.RetryAfter <= 0 {
+		t.Fatalf("expected a positive retry after, got %v", locked.RetryAfter)
+	}
+	return locked
+}
+
+func TestSignInLocksAccountAfterMaxAttempts(t *testing.T) {
+	repo, _, signIn := newLoginUseCase(t, "LOGIN_MAX_ATTEMPTS=5\nLOGIN_LOCKOUT=900\n")
+
+	for i := 0; i < 5; i++ {
+		// wait out the delay that slows down repeated failures
+		repo.age(time.Minute)
+		if _, err := signIn("latte@cafe-beans.com", "wrong", "10.0.0.1"); err == nil || err.Error() != "email or password is incorrect" {
+			t.Fatalf("attempt %v: expected email or password is incorrect, got %v", i+1, err)
+		}
+	}
+
+	// even the right password is refused while locked
+	_, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1")
+	if locked := expectLocked(t, err); locked.RetryAfter > 900 {
+		t.Fatalf("expected to retry within the lockout, got %v", locked.RetryAfter)
+	}
+
+	// an unlock email is sent once the account gets locked
+	if len(repo.tokens) != 1 || repo.tokens[0].Purpose != users.OneTimeTokenUnlock {
+		t.Fatalf("expected 1 unlock token, got %v", len(repo.tokens))
+	}
+
+	// the window is over
+	repo.age(900 * time.Second)
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignInDelaysRepeatedFailures(t *testing.T) {
+	repo, _, signIn := newLoginUseCase(t, "LOGIN_MAX_ATTEMPTS=10\n")
+
+	for i := 0; i < 3; i++ {
+		signIn("latte@cafe-beans.com", "wrong", "10.0.0.1")
+	}
+
+	// 2 seconds after the third failure
+	_, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1")
+	if locked := expectLocked(t, err); locked.RetryAfter > 2 {
+		t.Fatalf("expected to retry within 2 seconds, got %v", locked.RetryAfter)
+	}
+
+	repo.age(3 * time.Second)
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignInFailuresResetAfterSuccess(t *testing.T) {
+	repo, _, signIn := newLoginUseCase(t, "LOGIN_MAX_ATTEMPTS=3\n")
+
+	for i := 0; i < 2; i++ {
+		signIn("latte@cafe-beans.com", "wrong", "10.0.0.1")
+	}
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only failures after the success count
+	for i := 0; i < 2; i++ {
+		repo.age(time.Second)
+		signIn("latte@cafe-beans.com", "wrong", "10.0.0.1")
+	}
+	repo.age(time.Second)
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1"); err != nil {
+		t.Fatalf("expected 2 failures not to lock, got %v", err)
+	}
+}
+
+func TestSignInCountsFailuresAgainstEmailWhicheverLoginIsUsed(t *testing.T) {
+	repo, _, signIn := newLoginUseCase(t, "LOGIN_MAX_ATTEMPTS=2\n")
+
+	signIn("LATTE", "wrong", "10.0.0.1")
+	repo.age(time.Second)
+	signIn("latte@CAFE-beans.com", "wrong", "10.0.0.2")
+
+	_, err := signIn("latte", "Espresso-42", "10.0.0.3")
+	expectLocked(t, err)
+	for _, a := range repo.attempts {
+		if a.identifier != "latte@cafe-beans.com" {
+			t.Fatalf("expected every attempt to count against the email, got %v", a.identifier)
+		}
+	}
+}
+
+func TestSignInBlocksIpAfterMaxIpAttempts(t *testing.T) {
+	repo, _, signIn := newLoginUseCase(t, "LOGIN_MAX_IP_ATTEMPTS=3\n")
+
+	// one guess at each of many accounts
+	for _, email := range []string{"a@cafe-beans.com", "b@cafe-beans.com", "c@cafe-beans.com"} {
+		if _, err := signIn(email, "wrong", "10.0.0.1"); err == nil || err.Error() != "email or password is incorrect" {
+			t.Fatalf("expected email or password is incorrect, got %v", err)
+		}
+	}
+
+	_, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1")
+	expectLocked(t, err)
+
+	// other ips aren't affected
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo.age(901 * time.Second)
+	if _, err := signIn("latte@cafe-beans.com", "Espresso-42", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneLoginAttemptsKeepsLockoutWindow(t *testing.T) {
+	cfg := newTestConfig(t, "LOGIN_LOCKOUT=900\n")
+	repo := newFakeAccountRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	repo.InsertLoginAttempt("old@cafe-beans.com", "10.0.0.1", false)
+	repo.age(901 * time.Second)
+	repo.InsertLoginAttempt("new@cafe-beans.com", "10.0.0.1", false)
+
+	count, err := useCase.PruneLoginAttempts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(repo.attempts) != 1 || repo.attempts[0].identifier != "new@cafe-beans.com" {
+		t.Fatalf("expected only the old attempt to be deleted, got %v deleted", count)
+	}
+}
+
+func TestLoginAttemptsRepositoryUsesWindow(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		if strings.Contains(query, `DELETE FROM "login_attempts"`) {
+			return &fakeResult{affected: 7}, nil
+		}
+		return &fakeResult{
+			columns: []string{"account_failures", "ip_failures", "since_account_failure", "since_ip_failure"},
+			rows:    [][]driver.Value{{int64(2), int64(3), int64(10), int64(5)}},
+		}, nil
+	})
+	repo := usersRepositories.UserRepository(db)
+
+	failures, err := repo.FindLoginFailures("latte@cafe-beans.com", "10.0.0.1", 900*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures.Account != 2 || failures.Ip != 3 {
+		t.Fatalf("unexpected failures %+v", failures)
+	}
+	if q := fake.one(t, `"account" AS`); q.args[2] != float64(900) {
+		t.Fatalf("expected a 900 seconds window, got %v", q.args[2])
+	}
+
+	before := time.Now().Add(-900 * time.Second)
+	count, err := repo.DeleteLoginAttemptsBefore(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := fake.one(t, `DELETE FROM "login_attempts" WHERE "created_at" < $1`); count != 7 || q.args[0] != before {
+		t.Fatalf("expected attempts before %v to be deleted, got %v", before, q.args)
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/userPatterns"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+)
+
+// Records which lookup a sign in used
+type fakeLookupRepository struct {
+	*fakeAccountRepository
+
+	lookups []string
+}
+
+func (r *fakeLookupRepository) FindOneUserByEmail(email string) (*users.UserCredentialCheck, error) {
+	r.lookups = append(r.lookups, "email:"+email)
+	return r.fakeAccountRepository.FindOneUserByEmail(email)
+}
+
+func (r *fakeLookupRepository) FindOneUserByUsername(username string) (*users.UserCredentialCheck, error) {
+	r.lookups = append(r.lookups, "username:"+username)
+	return r.fakeAccountRepository.FindOneUserByUsername(username)
+}
+
+func TestSignInWithEmailOrUsernameOfAnyCase(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := &fakeLookupRepository{fakeAccountRepository: newFakeAccountRepository()}
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "Latte@cafe-beans.com", Username: "Latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	tests := []struct {
+		req    *users.UserCredential
+		lookup string
+	}{
+		{&users.UserCredential{Identifier: " LATTE@Cafe-Beans.com "}, "email:latte@cafe-beans.com"},
+		{&users.UserCredential{Identifier: "lAtTe"}, "username:latte"},
+		// clients sending email from before identifier existed
+		{&users.UserCredential{Email: "latte@CAFE-BEANS.COM"}, "email:latte@cafe-beans.com"},
+	}
+	for _, tt := range tests {
+		repo.lookups = nil
+		tt.req.Password = "Espresso-42"
+		tt.req.Ip = "10.0.0.1"
+
+		passport, err := useCase.GetPassport(tt.req)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.lookup, err)
+		}
+		if passport.User.Id != "U000001" {
+			t.Fatalf("%v: expected U000001, got %v", tt.lookup, passport.User.Id)
+		}
+		if len(repo.lookups) != 1 || repo.lookups[0] != tt.lookup {
+			t.Fatalf("expected %v, got %v", tt.lookup, repo.lookups)
+		}
+	}
+
+	// the password stays case-sensitive
+	if _, err := useCase.GetPassport(&users.UserCredential{Identifier: "latte", Password: "espresso-42", Ip: "10.0.0.1"}); err == nil {
+		t.Fatal("expected the password to be compared as it is")
+	}
+}
+
+func TestUserLookupsIgnoreCase(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := usersRepositories.UserRepository(db)
+
+	repo.FindOneUserByEmail("Latte@Cafe-Beans.com")
+	repo.FindOneUserByUsername("Latte")
+
+	if q := fake.one(t, `LOWER("email") = LOWER($1)`); q.args[0] != "Latte@Cafe-Beans.com" {
+		t.Fatalf("unexpected args %v", q.args)
+	}
+	if q := fake.one(t, `LOWER("username") = LOWER($1)`); q.args[0] != "Latte" {
+		t.Fatalf("unexpected args %v", q.args)
+	}
+}
+
+// The unique indexes are on lower(email) and lower(username)
+func TestSignUpRefusesTakenEmailOrUsernameOfAnyCase(t *testing.T) {
+	tests := map[string]string{
+		"users_email_lower_key":    "email has been used",
+		"users_username_lower_key": "username has been used",
+	}
+	for constraint, expected := range tests {
+		db, _ := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+			if strings.Contains(query, `INSERT INTO "users"`) {
+				return nil, errors.New(`ERROR: duplicate key value violates unique constraint "` + constraint + `" (SQLSTATE 23505)`)
+			}
+			return nil, nil
+		})
+
+		_, err := userPatterns.InsertUser(db, &users.UserRegisterReq{Email: "LATTE@cafe-beans.com", Username: "LATTE", Password: "hashed"}, false).Customer()
+		if err == nil || err.Error() != expected {
+			t.Fatalf("%v: expected %v, got %v", constraint, expected, err)
+		}
+	}
+}
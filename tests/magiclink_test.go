@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/utils"
+)
+
+// A token is used once, like the conditional update of the repository
+func (r *fakeAccountRepository) UseOneTimeToken(purpose, token string) (*users.OneTimeToken, error) {
+	for _, t := range r.tokens {
+		if t.Token == token && t.Purpose == purpose && !r.usedTokens[token] {
+			r.usedTokens[token] = true
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("token is invalid or expired")
+}
+
+func (r *fakeAccountRepository) CountOneTimeTokens(userId, purpose string, window time.Duration) (int, error) {
+	count := 0
+	for _, t := range r.tokens {
+		if t.UserId == userId && t.Purpose == purpose {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *fakeAccountRepository) FindOneUserById(userId string) (*users.UserCredentialCheck, error) {
+	u, ok := r.users[userId]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+	return u, nil
+}
+
+func TestMagicLinkSignsInOnce(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := newFakeAccountRepository()
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	if err := useCase.RequestMagicLink(&users.UserMagicLinkReq{Email: "latte@cafe-beans.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.tokens) != 1 || repo.tokens[0].Purpose != users.OneTimeTokenMagicLink || repo.tokens[0].ExpiresIn != 900 {
+		t.Fatalf("expected a magic link token valid for 15 minutes, got %+v", repo.tokens)
+	}
+	token := repo.tokens[0].Token
+
+	passport, err := useCase.MagicLinkSignIn(&users.UserMagicLinkReq{Token: token, Ip: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passport.User.Id != "U000001" || passport.Token == nil {
+		t.Fatalf("unexpected passport %+v", passport)
+	}
+
+	if _, err := useCase.MagicLinkSignIn(&users.UserMagicLinkReq{Token: token}); err == nil || err.Error() != "token is invalid or expired" {
+		t.Fatalf("expected the link to be used up, got %v", err)
+	}
+	if repo.oauthIssued != 1 {
+		t.Fatalf("expected 1 session, got %v", repo.oauthIssued)
+	}
+}
+
+func TestMagicLinkRefusesOtherTokens(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := newFakeAccountRepository()
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	repo.InsertOneTimeToken(&users.OneTimeToken{UserId: "U000001", Purpose: users.OneTimeTokenUnlock, Token: "unlock-token", ExpiresIn: 3600})
+	if _, err := useCase.MagicLinkSignIn(&users.UserMagicLinkReq{Token: "unlock-token"}); err == nil {
+		t.Fatal("expected an unlock token to be refused")
+	}
+}
+
+func TestRequestMagicLinkIsLimited(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := newFakeAccountRepository()
+	repo.addUser(t, cfg, &users.UserCredentialCheck{Id: "U000001", Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1}, "Espresso-42")
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	for i := 0; i < 5; i++ {
+		if err := useCase.RequestMagicLink(&users.UserMagicLinkReq{Email: "latte@cafe-beans.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(repo.tokens) != 3 {
+		t.Fatalf("expected 3 links within 15 minutes, got %v", len(repo.tokens))
+	}
+
+	// nobody learns whether an email has an account
+	if err := useCase.RequestMagicLink(&users.UserMagicLinkReq{Email: "nobody@cafe-beans.com"}); err != nil || len(repo.tokens) != 3 {
+		t.Fatalf("expected an unknown email to be ignored quietly, got %v", err)
+	}
+}
+
+func TestUseOneTimeTokenIsConditional(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := usersRepositories.UserRepository(db)
+
+	if _, err := repo.UseOneTimeToken(users.OneTimeTokenMagicLink, "magic-token"); err == nil || err.Error() != "token is invalid or expired" {
+		t.Fatalf("expected token is invalid or expired, got %v", err)
+	}
+
+	q := fake.one(t, `UPDATE "one_time_tokens"`)
+	for _, condition := range []string{`"used_at" IS NULL`, `"expires_at" > now()`, `"purpose" = $2`} {
+		if !strings.Contains(q.query, condition) {
+			t.Fatalf("expected the token to be used only if %v", condition)
+		}
+	}
+	if q.args[0] != utils.HashToken("magic-token") || q.args[1] != users.OneTimeTokenMagicLink {
+		t.Fatalf("unexpected args %v", q.args)
+	}
+}
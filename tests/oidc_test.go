@@ -0,0 +1,456 @@
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/audit/auditUseCases"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/modules/users/usersUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansMailer"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansOidc"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansStorage"
+)
+
+const (
+	fakeClientId     = "cafe-beans"
+	fakeClientSecret = "fake-secret"
+	fakeRedirectUrl  = "http://localhost:3000/oidc/callback"
+)
+
+// A local OpenID Connect provider that signs every user in as its
+// configured account without asking
+type fakeOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu            sync.Mutex
+	codes         map[string]url.Values
+	subject       string
+	email         string
+	emailVerified bool
+	audience      string // empty is the client id
+}
+
+func newFakeOidcProvider(t *testing.T) *fakeOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakeOidcProvider{
+		key:           key,
+		codes:         make(map[string]url.Values),
+		subject:       "1234567890",
+		email:         "latte@cafe-beans.com",
+		emailVerified: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *fakeOidcProvider) provider() *cafeBeansOidc.Provider {
+	return &cafeBeansOidc.Provider{
+		Name:         "fake",
+		Issuer:       p.server.URL,
+		ClientId:     fakeClientId,
+		ClientSecret: fakeClientSecret,
+		RedirectUrl:  fakeRedirectUrl,
+	}
+}
+
+func (p *fakeOidcProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.server.URL,
+		"authorization_endpoint": p.server.URL + "/authorize",
+		"token_endpoint":         p.server.URL + "/token",
+		"jwks_uri":               p.server.URL + "/jwks",
+	})
+}
+
+// Redirect back with a code, remembering what the code was issued for
+func (p *fakeOidcProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("client_id") != fakeClientId {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	p.mu.Lock()
+	p.codes[code] = q
+	p.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+}
+
+func (p *fakeOidcProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	p.mu.Lock()
+	q, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	if !ok ||
+		r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("client_id") != fakeClientId ||
+		r.PostForm.Get("client_secret") != fakeClientSecret ||
+		r.PostForm.Get("redirect_uri") != q.Get("redirect_uri") ||
+		cafeBeansOidc.CodeChallenge(r.PostForm.Get("code_verifier")) != q.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	audience := p.audience
+	if audience == "" {
+		audience = fakeClientId
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            p.server.URL,
+		"sub":            p.subject,
+		"aud":            audience,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          q.Get("nonce"),
+		"email":          p.email,
+		"email_verified": p.emailVerified,
+	})
+	token.Header["kid"] = "fake-key"
+	idToken, _ := token.SignedString(p.key)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "fake-access-token",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (p *fakeOidcProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "fake-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// Open the authorization url like a browser and return the code and state
+// the provider redirected back with
+func followAuthorization(t *testing.T, authUrl string) (string, string) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: expected redirect, got %v", res.StatusCode)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestOidcAuthorizationCodeFlow(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	client := cafeBeansOidc.NewClient(fake.provider())
+
+	codeVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	authUrl, err := client.AuthCodeUrl("state-1", "nonce-1", codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state := followAuthorization(t, authUrl)
+	if state != "state-1" {
+		t.Fatalf("expected state-1, got %v", state)
+	}
+
+	identity, err := client.Exchange(code, codeVerifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Provider != "fake" || identity.Subject != fake.subject || identity.Email != fake.email || !identity.EmailVerified {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestOidcRejectsWrongCodeVerifier(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	client := cafeBeansOidc.NewClient(fake.provider())
+
+	codeVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	authUrl, _ := client.AuthCodeUrl("state", "nonce", codeVerifier)
+	code, _ := followAuthorization(t, authUrl)
+
+	otherVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	if _, err := client.Exchange(code, otherVerifier, "nonce"); err == nil {
+		t.Fatal("expected the exchange to fail")
+	}
+}
+
+func TestOidcRejectsNonceMismatch(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	client := cafeBeansOidc.NewClient(fake.provider())
+
+	codeVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	authUrl, _ := client.AuthCodeUrl("state", "nonce", codeVerifier)
+	code, _ := followAuthorization(t, authUrl)
+
+	if _, err := client.Exchange(code, codeVerifier, "other-nonce"); err == nil {
+		t.Fatal("expected a nonce mismatch")
+	}
+}
+
+func TestOidcRejectsWrongAudience(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	fake.audience = "another-app"
+	client := cafeBeansOidc.NewClient(fake.provider())
+
+	codeVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	authUrl, _ := client.AuthCodeUrl("state", "nonce", codeVerifier)
+	code, _ := followAuthorization(t, authUrl)
+
+	if _, err := client.Exchange(code, codeVerifier, "nonce"); err == nil {
+		t.Fatal("expected the id token to be rejected")
+	}
+}
+
+func TestOidcRejectsIssuerMismatch(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	provider := fake.provider()
+	provider.Issuer = fake.server.URL + "/"
+	client := cafeBeansOidc.NewClient(provider)
+
+	codeVerifier, _ := cafeBeansOidc.NewCodeVerifier()
+	if _, err := client.AuthCodeUrl("state", "nonce", codeVerifier); err == nil {
+		t.Fatal("expected discovery to fail")
+	}
+}
+
+// In memory users, states and identities for the oidc sign in
+type fakeOidcUserRepository struct {
+	usersRepositories.IUserRepository
+
+	users      map[string]*users.UserCredentialCheck // by email
+	states     map[string]*users.OidcState
+	identities map[string]string // provider:subject -> user id
+}
+
+func newFakeOidcUserRepository() *fakeOidcUserRepository {
+	return &fakeOidcUserRepository{
+		users:      make(map[string]*users.UserCredentialCheck),
+		states:     make(map[string]*users.OidcState),
+		identities: make(map[string]string),
+	}
+}
+
+func (r *fakeOidcUserRepository) InsertOidcState(req *users.OidcState) error {
+	r.states[req.State] = req
+	return nil
+}
+
+func (r *fakeOidcUserRepository) UseOidcState(provider, state string) (*users.OidcState, error) {
+	s, ok := r.states[state]
+	if !ok || s.Provider != provider {
+		return nil, fmt.Errorf("state is invalid or expired")
+	}
+	delete(r.states, state)
+	return s, nil
+}
+
+func (r *fakeOidcUserRepository) FindOneUserByIdentity(provider, subject string) (*users.UserCredentialCheck, error) {
+	userId, ok := r.identities[provider+":"+subject]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+	for _, u := range r.users {
+		if u.Id == userId {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+func (r *fakeOidcUserRepository) InsertIdentity(req *users.UserIdentity) error {
+	r.identities[req.Provider+":"+req.Subject] = req.UserId
+	return nil
+}
+
+func (r *fakeOidcUserRepository) FindOneUserByEmail(email string) (*users.UserCredentialCheck, error) {
+	u, ok := r.users[email]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+	return u, nil
+}
+
+func (r *fakeOidcUserRepository) InsertUser(req *users.UserRegisterReq, isAdmin bool) (*users.UserPassport, error) {
+	u := &users.UserCredentialCheck{
+		Id:       fmt.Sprintf("U%06d", len(r.users)+1),
+		Email:    req.Email,
+		Password: req.Password,
+		Username: req.Username,
+		RoleId:   1,
+	}
+	r.users[req.Email] = u
+
+	return &users.UserPassport{
+		User: &users.User{
+			Id:       u.Id,
+			Email:    u.Email,
+			Username: u.Username,
+			RoleId:   u.RoleId,
+		},
+	}, nil
+}
+
+func (r *fakeOidcUserRepository) InsertOauth(req *users.UserPassport) error {
+	req.Token.Id = "oauth-id"
+	return nil
+}
+
+// Keeps recorded events in memory, nothing else is needed by the use case
+type fakeAuditUseCase struct {
+	auditUseCases.IAuditUseCase
+
+	events []*audit.Event
+}
+
+func (f *fakeAuditUseCase) Record(event *audit.Event) {
+	f.events = append(f.events, event)
+}
+
+func newOidcUserUseCase(t *testing.T, fake *fakeOidcProvider, repo usersRepositories.IUserRepository) usersUseCases.IUserUseCase {
+	cfg := newTestConfig(t, "")
+
+	return usersUseCases.UserUseCase(
+		cfg,
+		repo,
+		cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl()),
+		cafeBeansMailer.NewMailer(cfg.Mail()),
+		map[string]cafeBeansOidc.IClient{"fake": cafeBeansOidc.NewClient(fake.provider())},
+		cafeBeansStorage.NewLocalStorage(t.TempDir(), "/uploads"),
+		&fakeAuditUseCase{},
+	)
+}
+
+func oidcSignIn(t *testing.T, useCase usersUseCases.IUserUseCase) (*users.UserPassport, error) {
+	authUrl, err := useCase.OidcAuthUrl("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state := followAuthorization(t, authUrl.AuthorizationUrl)
+	return useCase.OidcSignIn("fake", &users.OidcCallbackReq{
+		Code:  code,
+		State: state,
+	})
+}
+
+func TestOidcSignInCreatesAndLinksCustomer(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	repo := newFakeOidcUserRepository()
+	useCase := newOidcUserUseCase(t, fake, repo)
+
+	passport, err := oidcSignIn(t, useCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passport.Token == nil || passport.Token.AccessToken == "" || passport.User.Email != fake.email {
+		t.Fatalf("unexpected passport: %+v", passport)
+	}
+
+	// the identity is linked so signing in again finds the same user
+	again, err := oidcSignIn(t, useCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.User.Id != passport.User.Id || len(repo.users) != 1 {
+		t.Fatalf("expected the same user, got %v and %v users", again.User.Id, len(repo.users))
+	}
+}
+
+func TestOidcSignInLinksVerifiedEmail(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	repo := newFakeOidcUserRepository()
+	repo.users[fake.email] = &users.UserCredentialCheck{Id: "U000042", Email: fake.email, Username: "latte", RoleId: 1}
+	useCase := newOidcUserUseCase(t, fake, repo)
+
+	passport, err := oidcSignIn(t, useCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passport.User.Id != "U000042" {
+		t.Fatalf("expected the existing user, got %v", passport.User.Id)
+	}
+}
+
+func TestOidcSignInRefusesUnverifiedEmail(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	fake.emailVerified = false
+	repo := newFakeOidcUserRepository()
+	repo.users[fake.email] = &users.UserCredentialCheck{Id: "U000042", Email: fake.email, Username: "latte", RoleId: 1}
+	useCase := newOidcUserUseCase(t, fake, repo)
+
+	if _, err := oidcSignIn(t, useCase); err == nil || err.Error() != "email has been used" {
+		t.Fatalf("expected email has been used, got %v", err)
+	}
+}
+
+func TestOidcSignInRefusesReplayedState(t *testing.T) {
+	fake := newFakeOidcProvider(t)
+	useCase := newOidcUserUseCase(t, fake, newFakeOidcUserRepository())
+
+	authUrl, err := useCase.OidcAuthUrl("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := followAuthorization(t, authUrl.AuthorizationUrl)
+
+	if _, err := useCase.OidcSignIn("fake", &users.OidcCallbackReq{Code: code, State: state}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useCase.OidcSignIn("fake", &users.OidcCallbackReq{Code: code, State: state}); err == nil || err.Error() != "state is invalid or expired" {
+		t.Fatalf("expected the state to be used up, got %v", err)
+	}
+}
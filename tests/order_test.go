@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/addresses"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesRepositories"
+	"github.com/pandakn/cafe-beans/modules/addresses/addressesUseCases"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
+	"github.com/pandakn/cafe-beans/modules/orders"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersHandlers"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersRepositories"
+	"github.com/pandakn/cafe-beans/modules/orders/ordersUseCases"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+const (
+	orderAddressId = "6f1c2a1e-1f0b-4c52-9a55-3f0d5f7f1a01"
+	// saved with a postal code of another province
+	staleAddressId = "6f1c2a1e-1f0b-4c52-9a55-3f0d5f7f1a02"
+)
+
+func savedAddress() *addresses.Address {
+	return &addresses.Address{
+		Id:          orderAddressId,
+		UserId:      "U000001",
+		Recipient:   "Somchai Jaidee",
+		Phone:       "0812345678",
+		Line1:       "1 Na Phra Lan Rd.",
+		SubDistrict: "แขวงพระบรมมหาราชวัง",
+		District:    "เขตพระนคร",
+		Province:    "กรุงเทพมหานคร",
+		PostalCode:  "10200",
+	}
+}
+
+func TestAddressSnapshot(t *testing.T) {
+	address := savedAddress()
+	snapshot := address.Snapshot()
+	if snapshot.Contact != "Somchai Jaidee 0812345678" {
+		t.Fatalf("unexpected contact %q", snapshot.Contact)
+	}
+	if snapshot.Address != "1 Na Phra Lan Rd., แขวงพระบรมมหาราชวัง, เขตพระนคร, กรุงเทพมหานคร 10200" {
+		t.Fatalf("unexpected address %q", snapshot.Address)
+	}
+
+	address.Line2 = "Grand Palace"
+	if !strings.HasPrefix(address.Snapshot().Address, "1 Na Phra Lan Rd., Grand Palace, ") {
+		t.Fatalf("expected line2 to follow line1, got %q", address.Snapshot().Address)
+	}
+}
+
+func TestOrderValidation(t *testing.T) {
+	valid := func() *orders.OrderReq {
+		return &orders.OrderReq{
+			AddressId: " " + orderAddressId + " ",
+			Products:  []*orders.ProductOrderReq{{ProductId: "P000001", Qty: 2}},
+		}
+	}
+	req := valid()
+	if errs := req.Validate(); errs != nil {
+		t.Fatalf("expected a valid order, got %v", errorCodes(errs))
+	}
+	if req.AddressId != orderAddressId {
+		t.Fatalf("expected the address id to be trimmed, got %q", req.AddressId)
+	}
+
+	tests := map[string]struct {
+		change func(req *orders.OrderReq)
+		field  string
+		code   string
+	}{
+		"no address":     {func(req *orders.OrderReq) { req.AddressId = "" }, "address_id", "required"},
+		"bad address id": {func(req *orders.OrderReq) { req.AddressId = "1" }, "address_id", "invalid_format"},
+		"no products":    {func(req *orders.OrderReq) { req.Products = nil }, "products", "required"},
+		"no product id":  {func(req *orders.OrderReq) { req.Products[0].ProductId = " " }, "products[0].product_id", "required"},
+		"no qty":         {func(req *orders.OrderReq) { req.Products[0].Qty = 0 }, "products[0].qty", "out_of_range"},
+		"too many":       {func(req *orders.OrderReq) { req.Products[0].Qty = orders.MaxProductQty + 1 }, "products[0].qty", "out_of_range"},
+	}
+	for name, tt := range tests {
+		req := valid()
+		tt.change(req)
+
+		errs := req.Validate()
+		if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != tt.code {
+			t.Fatalf("%s: expected %v %v, got %+v", name, tt.field, tt.code, errs)
+		}
+	}
+}
+
+// The orders routes over the real repositories, guarded the way module.go
+// guards them, the address book holds savedAddress and a stale copy of it
+// and every product exists but P999999
+func newOrdersApp(t *testing.T, cfg config.IConfig) (*fiber.App, *fakeDb) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		switch {
+		case strings.Contains(query, `FROM "user_addresses"`):
+			address := savedAddress()
+			switch args[1] {
+			case orderAddressId:
+			case staleAddressId:
+				address.Id, address.PostalCode = staleAddressId, "50000"
+			default:
+				return &fakeResult{columns: []string{"to_json"}}, nil
+			}
+			data, _ := json.Marshal(address)
+			return &fakeResult{columns: []string{"to_json"}, rows: [][]driver.Value{{data}}}, nil
+		case strings.Contains(query, `INSERT INTO "orders"`):
+			return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{"O000001"}}}, nil
+		case strings.Contains(query, `INSERT INTO "products_orders"`):
+			if args[2] == "P999999" {
+				return &fakeResult{}, nil
+			}
+			return &fakeResult{affected: 1}, nil
+		case strings.Contains(query, `FROM "orders" "o"`):
+			order := `{"id":"O000001","user_id":"U000001","contact":"Somchai Jaidee 0812345678","address":"1 Na Phra Lan Rd.","status":"waiting","products":[{"id":"1","qty":2,"product":{"id":"P000001","title":"Espresso","price":60}}]}`
+			return &fakeResult{columns: []string{"to_json"}, rows: [][]driver.Value{{[]byte(order)}}}, nil
+		}
+		return nil, nil
+	})
+
+	addressBook, err := cafeBeansAddress.NewAddressBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressesUseCase := addressesUseCases.AddressesUseCase(addressesRepositories.AddressesRepository(db), addressBook, newTestValidator(t, cfg))
+	useCase := ordersUseCases.OrdersUseCase(ordersRepositories.OrdersRepository(db), addressesUseCase)
+	handler := ordersHandlers.OrdersHandler(cfg, useCase)
+	mid := middlewareHandlers.MiddlewareHandler(cfg, &fakeSessionUseCase{cfg: cfg}, &fakeAuditUseCase{})
+
+	app := fiber.New()
+	router := app.Group("/users/:user_id/orders", mid.JwtAuth(), mid.ParamsCheck())
+	router.Post("/", mid.DenyImpersonation(), handler.AddOrder)
+	return app, fake
+}
+
+func placeOrder(t *testing.T, app *fiber.App, token, body string) (int, map[string]any) {
+	req := httptest.NewRequest(fiber.MethodPost, "/users/U000001/orders", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string]any)
+	json.NewDecoder(res.Body).Decode(&result)
+	return res.StatusCode, result
+}
+
+func customerToken(cfg config.IConfig) string {
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	return access.SignToken()
+}
+
+func TestInsertOrderSnapshotsAddress(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app, fake := newOrdersApp(t, cfg)
+
+	status, body := placeOrder(t, app, customerToken(cfg), `{"address_id":"`+orderAddressId+`","products":[{"product_id":"P000001","qty":2},{"product_id":"P000002","qty":1}]}`)
+	if status != fiber.StatusCreated || body["id"] != "O000001" {
+		t.Fatalf("expected the order to be created, got %v %v", status, body)
+	}
+
+	snapshot := savedAddress().Snapshot()
+	insert := fake.one(t, `INSERT INTO "orders"`)
+	if insert.args[0] != "U000001" || insert.args[1] != snapshot.Contact || insert.args[2] != snapshot.Address || insert.args[3] != orders.StatusWaiting {
+		t.Fatalf("expected the address to be copied into the order, got %v", insert.args)
+	}
+
+	products := fake.find(`INSERT INTO "products_orders"`)
+	if len(products) != 2 || products[0].args[0] != "O000001" || products[0].args[1] != 2 || products[1].args[2] != "P000002" {
+		t.Fatalf("unexpected products %v", products)
+	}
+	if fake.commits != 1 {
+		t.Fatalf("expected a commit, got %v", fake.commits)
+	}
+}
+
+func TestInsertOrderRefusesUnknownAddressAndProduct(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app, fake := newOrdersApp(t, cfg)
+
+	status, body := placeOrder(t, app, customerToken(cfg), `{"address_id":"7f1c2a1e-1f0b-4c52-9a55-3f0d5f7f1a01","products":[{"product_id":"P000001","qty":1}]}`)
+	if status != fiber.StatusBadRequest || body["message"] != "address not found" {
+		t.Fatalf("expected address not found, got %v %v", status, body)
+	}
+	if len(fake.find(`INSERT INTO "orders"`)) != 0 {
+		t.Fatal("expected no order without an address")
+	}
+
+	status, body = placeOrder(t, app, customerToken(cfg), `{"address_id":"`+orderAddressId+`","products":[{"product_id":"P999999","qty":1}]}`)
+	if status != fiber.StatusBadRequest || body["message"] != "product not found" {
+		t.Fatalf("expected product not found, got %v %v", status, body)
+	}
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Fatal("expected the order to be rolled back")
+	}
+}
+
+func TestInsertOrderOfAnotherUser(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app, fake := newOrdersApp(t, cfg)
+
+	access, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000002", RoleId: 1})
+	if status, _ := placeOrder(t, app, access.SignToken(), `{"address_id":"`+orderAddressId+`","products":[{"product_id":"P000001","qty":1}]}`); status != fiber.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", status)
+	}
+	if len(fake.find("")) != 0 {
+		t.Fatal("expected the database not to be touched")
+	}
+}
+
+func TestInsertOrderDeniesImpersonation(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app, fake := newOrdersApp(t, cfg)
+
+	impersonation, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Impersonation, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1, ImpersonatorId: "A000001"})
+	status, body := placeOrder(t, app, impersonation.SignToken(), `{"address_id":"`+orderAddressId+`","products":[{"product_id":"P000001","qty":1}]}`)
+	if status != fiber.StatusForbidden || body["message"] != "not allowed while impersonating" {
+		t.Fatalf("expected an impersonating admin to be refused, got %v %v", status, body)
+	}
+	if len(fake.find("")) != 0 {
+		t.Fatal("expected no order to be placed")
+	}
+}
+
+// The dataset is checked again when the address is used
+func TestInsertOrderRefusesStaleAddress(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	app, fake := newOrdersApp(t, cfg)
+
+	status, body := placeOrder(t, app, customerToken(cfg), `{"address_id":"`+staleAddressId+`","products":[{"product_id":"P000001","qty":1}]}`)
+	if status != fiber.StatusBadRequest || body["message"] != "address is no longer valid" {
+		t.Fatalf("expected address is no longer valid, got %v %v", status, body)
+	}
+	if len(fake.find(`INSERT INTO "orders"`)) != 0 {
+		t.Fatal("expected no order to a stale address")
+	}
+}
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansPassword"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHashes(t *testing.T) {
+	hasher := cafeBeansPassword.NewHasher(newTestConfig(t, fastPasswordEnv).Password())
+
+	hashed, err := hasher.Hash("Espresso-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("expected a PHC argon2id hash, got %v", hashed)
+	}
+	if !hasher.Verify("Espresso-42", hashed) || hasher.Verify("espresso-42", hashed) {
+		t.Fatal("expected only the right password to verify")
+	}
+
+	// salted, the same password doesn't hash the same twice
+	if again, _ := hasher.Hash("Espresso-42"); again == hashed {
+		t.Fatal("expected a new salt for every hash")
+	}
+	if hasher.NeedsRehash(hashed) {
+		t.Fatal("expected a hash of the configured parameters to be kept")
+	}
+	if hasher.Verify("Espresso-42", "$argon2id$v=19$m=1024,t=1,p=1$bm90LWJhc2U2NA") {
+		t.Fatal("expected a malformed hash to be refused")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon2id := cafeBeansPassword.NewHasher(newTestConfig(t, fastPasswordEnv).Password())
+	stronger := cafeBeansPassword.NewHasher(newTestConfig(t, "PASSWORD_ARGON2_MEMORY=2048\nPASSWORD_ARGON2_ITERATIONS=1\n").Password())
+	bcryptHasher := cafeBeansPassword.NewHasher(newTestConfig(t, "PASSWORD_ALGORITHM=bcrypt\nPASSWORD_BCRYPT_COST=5\n").Password())
+
+	argon2Hash, _ := argon2id.Hash("Espresso-42")
+	bcryptHash, _ := bcryptHasher.Hash("Espresso-42")
+	cheapBcrypt, _ := bcrypt.GenerateFromPassword([]byte("Espresso-42"), 4)
+
+	tests := map[string]struct {
+		hasher cafeBeansPassword.IHasher
+		hashed string
+		rehash bool
+	}{
+		"bcrypt under argon2id":           {argon2id, bcryptHash, true},
+		"argon2id of weaker parameters":   {stronger, argon2Hash, true},
+		"argon2id under bcrypt":           {bcryptHasher, argon2Hash, true},
+		"bcrypt of a lower cost":          {bcryptHasher, string(cheapBcrypt), true},
+		"bcrypt of the configured cost":   {bcryptHasher, bcryptHash, false},
+		"argon2id of the same parameters": {argon2id, argon2Hash, false},
+	}
+	for name, tt := range tests {
+		if got := tt.hasher.NeedsRehash(tt.hashed); got != tt.rehash {
+			t.Errorf("%v: expected %v, got %v", name, tt.rehash, got)
+		}
+		// every hasher verifies every kind of hash
+		if !tt.hasher.Verify("Espresso-42", tt.hashed) {
+			t.Errorf("%v: expected the password to verify", name)
+		}
+	}
+}
+
+func TestSignInUpgradesBcryptHash(t *testing.T) {
+	cfg := newTestConfig(t, fastPasswordEnv)
+	repo := newFakeAccountRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("Espresso-42"), bcrypt.MinCost)
+	repo.users["U000001"] = &users.UserCredentialCheck{Id: "U000001", Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1, Password: string(legacy)}
+
+	// a wrong password leaves the hash alone
+	if _, err := useCase.GetPassport(&users.UserCredential{Identifier: "latte@cafe-beans.com", Password: "wrong"}); err == nil {
+		t.Fatal("expected the sign in to fail")
+	}
+	if len(repo.rehashed) != 0 {
+		t.Fatal("expected no rehash on a failed sign in")
+	}
+
+	if _, err := useCase.GetPassport(&users.UserCredential{Identifier: "latte@cafe-beans.com", Password: "Espresso-42"}); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, ok := repo.rehashed["U000001"]
+	if !ok || !strings.HasPrefix(upgraded, "$argon2id$") {
+		t.Fatalf("expected an argon2id hash to be stored, got %v", upgraded)
+	}
+
+	// the new hash works and is kept
+	delete(repo.rehashed, "U000001")
+	if _, err := useCase.GetPassport(&users.UserCredential{Identifier: "latte@cafe-beans.com", Password: "Espresso-42"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.rehashed) != 0 {
+		t.Fatal("expected no rehash of an up to date hash")
+	}
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
+	"github.com/pandakn/cafe-beans/modules/roles"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+)
+
+// Roles, their permissions and the role of each user, shared by the
+// middleware and roles repositories like the tables are
+type fakeRolesDb struct {
+	permissions map[int][]string
+	userRoles   map[string]int
+	// how many times the middleware went to the db
+	permissionReads int
+	sessionReads    int
+}
+
+type fakeMiddlewareRepository struct {
+	middlewareRepositories.IMiddlewareRepository
+	db *fakeRolesDb
+}
+
+func (r *fakeMiddlewareRepository) FindPermission(roleId int) ([]string, error) {
+	r.db.permissionReads++
+	return r.db.permissions[roleId], nil
+}
+
+func (r *fakeMiddlewareRepository) FindAccessToken(userId, accessToken string, limits *middleware.SessionLimits) (*middleware.Session, error) {
+	r.db.sessionReads++
+	roleId, ok := r.db.userRoles[userId]
+	if !ok {
+		return nil, fmt.Errorf("session not found")
+	}
+	return &middleware.Session{Id: "oauth-1", UserId: userId, RoleId: roleId}, nil
+}
+
+func (r *fakeMiddlewareRepository) UpdateSessionLastUsed(sessionId string) error { return nil }
+
+type fakeRolesRepository struct {
+	rolesRepositories.IRolesRepository
+	db *fakeRolesDb
+}
+
+func (r *fakeRolesRepository) UpdateRolePermission(roleId int, req *roles.RolePermissionReq) error {
+	r.db.permissions[roleId] = req.Permissions
+	return nil
+}
+
+func (r *fakeRolesRepository) FindOneRole(roleId int) (*roles.Role, error) {
+	return &roles.Role{Id: roleId}, nil
+}
+
+func (r *fakeRolesRepository) DeleteRole(roleId int) error {
+	delete(r.db.permissions, roleId)
+	return nil
+}
+
+func (r *fakeRolesRepository) UpdateUserRole(userId string, roleId int) error {
+	r.db.userRoles[userId] = roleId
+	return nil
+}
+
+// The middleware and roles use cases over one cache, like the server builds them
+func newPermissionUseCases(t *testing.T) (middlewareUseCases.IMiddlewareUseCase, rolesUseCases.IRolesUseCase, *fakeRolesDb) {
+	cfg := newTestConfig(t, "CACHE_TTL=60\n")
+	cache := cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl())
+	db := &fakeRolesDb{
+		permissions: map[int][]string{3: {middleware.PermissionOrdersRead, middleware.PermissionOrdersWrite}},
+		userRoles:   map[string]int{"U000001": 3},
+	}
+
+	return middlewareUseCases.MiddlewareUseCase(cfg, &fakeMiddlewareRepository{db: db}, cache),
+		rolesUseCases.RolesUseCase(&fakeRolesRepository{db: db}, cache),
+		db
+}
+
+func TestPermissionsAreCached(t *testing.T) {
+	mid, _, db := newPermissionUseCases(t)
+
+	for i := 0; i < 3; i++ {
+		permissions, err := mid.FindPermission(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(permissions) != 2 {
+			t.Fatalf("unexpected permissions %v", permissions)
+		}
+	}
+	if db.permissionReads != 1 {
+		t.Fatalf("expected 1 read, got %v", db.permissionReads)
+	}
+}
+
+func TestUpdateRolePermissionInvalidatesCache(t *testing.T) {
+	mid, rolesUseCase, db := newPermissionUseCases(t)
+
+	mid.FindPermission(3)
+	if _, err := rolesUseCase.UpdateRolePermission(3, &roles.RolePermissionReq{Permissions: []string{middleware.PermissionOrdersRead}}); err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, _ := mid.FindPermission(3)
+	if len(permissions) != 1 || permissions[0] != middleware.PermissionOrdersRead {
+		t.Fatalf("expected the revoked permission to be gone, got %v", permissions)
+	}
+	if db.permissionReads != 2 {
+		t.Fatalf("expected the permissions to be read again, got %v reads", db.permissionReads)
+	}
+}
+
+func TestDeleteRoleInvalidatesCache(t *testing.T) {
+	mid, rolesUseCase, _ := newPermissionUseCases(t)
+
+	mid.FindPermission(3)
+	if err := rolesUseCase.DeleteRole(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// a role created later may get the same id
+	if permissions, _ := mid.FindPermission(3); len(permissions) != 0 {
+		t.Fatalf("expected no permissions, got %v", permissions)
+	}
+}
+
+func TestUpdateUserRoleInvalidatesSessions(t *testing.T) {
+	mid, rolesUseCase, db := newPermissionUseCases(t)
+
+	session, err := mid.FindAccessToken("U000001", "access-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mid.FindAccessToken("U000001", "access-token"); err != nil || db.sessionReads != 1 {
+		t.Fatalf("expected the session to be cached, got %v reads", db.sessionReads)
+	}
+
+	if err := rolesUseCase.UpdateUserRole("U000001", &roles.UserRoleReq{RoleId: roles.CustomerRoleId}); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := mid.FindAccessToken("U000001", "access-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.RoleId != 3 || changed.RoleId != roles.CustomerRoleId {
+		t.Fatalf("expected the role to change from 3 to %v, got %v", roles.CustomerRoleId, changed.RoleId)
+	}
+}
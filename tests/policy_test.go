@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/entities"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAddress"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansValidator"
+)
+
+func newTestValidator(t *testing.T, cfg config.IConfig) cafeBeansValidator.IValidator {
+	addresses, err := cafeBeansAddress.NewAddressBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := cafeBeansValidator.NewValidator(cfg.Policy(), addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func errorCodes(errs []*entities.FieldError) []string {
+	codes := make([]string, 0)
+	for _, e := range errs {
+		codes = append(codes, e.Code)
+	}
+	return codes
+}
+
+func expectCodes(t *testing.T, name string, errs []*entities.FieldError, codes ...string) {
+	t.Helper()
+	got := errorCodes(errs)
+	if len(got) != len(codes) {
+		t.Fatalf("%s: expected %v, got %v", name, codes, got)
+	}
+	for i := range codes {
+		if got[i] != codes[i] {
+			t.Fatalf("%s: expected %v, got %v", name, codes, got)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	v := newTestValidator(t, newTestConfig(t, ""))
+
+	tests := map[string]struct {
+		password string
+		codes    []string
+	}{
+		"empty":                     {"", []string{"required"}},
+		"strong":                    {"Cold-Brew-42", nil},
+		"too short":                 {"Ab1-", []string{"too_short"}},
+		"two character classes":     {"coldbrew42", []string{"too_weak"}},
+		"three character classes":   {"coldbrew-42", nil},
+		"breached":                  {"12345678", []string{"too_weak", "breached"}},
+		"breached of any case":      {"PASSWORD1", []string{"too_weak", "breached"}},
+		"contains the username":     {"Barista-Joe-99", []string{"too_similar"}},
+		"short and of a single one": {"abc", []string{"too_short", "too_weak"}},
+	}
+	for name, tt := range tests {
+		expectCodes(t, name, v.Password("password", tt.password, "barista-joe"), tt.codes...)
+	}
+}
+
+func TestPasswordPolicyIsConfigurable(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(list, []byte("Latte-Art-2024\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v := newTestValidator(t, newTestConfig(t, "PASSWORD_MIN_LENGTH=12\nPASSWORD_CHARACTER_CLASSES=4\nPASSWORD_BREACHED_LIST="+list+"\n"))
+
+	expectCodes(t, "shorter than the minimum", v.Password("password", "Mocha-42", ""), "too_short")
+	expectCodes(t, "three of four classes", v.Password("password", "Mocha-Frappe", ""), "too_weak")
+	expectCodes(t, "in the extra list", v.Password("password", "LATTE-art-2024", ""), "breached")
+	expectCodes(t, "all four classes", v.Password("password", "Mocha-Frappe-42", ""))
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	v := newTestValidator(t, newTestConfig(t, "USERNAME_MIN_LENGTH=4\nUSERNAME_MAX_LENGTH=12\n"))
+
+	tests := map[string]struct {
+		username string
+		codes    []string
+	}{
+		"empty":              {"", []string{"required"}},
+		"valid":              {"barista.joe", nil},
+		"too short":          {"joe", []string{"too_short"}},
+		"too long":           {"barista_joe_1987", []string{"too_long"}},
+		"invalid characters": {"joe barista", []string{"invalid_characters"}},
+		"reserved":           {"Admin", []string{"reserved"}},
+		"deleted prefix":     {"DELETED_42", []string{"reserved"}},
+	}
+	for name, tt := range tests {
+		expectCodes(t, name, v.Username("username", tt.username), tt.codes...)
+	}
+}
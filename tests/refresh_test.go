@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/config"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+)
+
+// Sessions keyed by their current refresh token, rotated tokens stay
+// retired under the same session until it's deleted
+type fakeOauthRepository struct {
+	usersRepositories.IUserRepository
+
+	current map[string]*users.Oauth
+	retired map[string]*users.Oauth
+	deleted []string
+	// another request rotates the token first
+	loseRace bool
+}
+
+func newFakeOauthRepository() *fakeOauthRepository {
+	return &fakeOauthRepository{
+		current: make(map[string]*users.Oauth),
+		retired: make(map[string]*users.Oauth),
+	}
+}
+
+func (r *fakeOauthRepository) FindOneOauth(refreshToken string) (*users.Oauth, error) {
+	oauth, ok := r.current[refreshToken]
+	if !ok {
+		return nil, fmt.Errorf("oauth not found")
+	}
+	return oauth, nil
+}
+
+func (r *fakeOauthRepository) FindRetiredOauth(refreshToken string) (*users.Oauth, error) {
+	oauth, ok := r.retired[refreshToken]
+	if !ok {
+		return nil, fmt.Errorf("oauth not found")
+	}
+	return oauth, nil
+}
+
+func (r *fakeOauthRepository) UpdateOauth(oldRefreshToken string, req *users.UserToken) error {
+	oauth, ok := r.current[oldRefreshToken]
+	if !ok || r.loseRace {
+		return users.ErrRefreshTokenReused
+	}
+	delete(r.current, oldRefreshToken)
+	r.retired[oldRefreshToken] = oauth
+	r.current[req.RefreshToken] = oauth
+	return nil
+}
+
+func (r *fakeOauthRepository) GetProfile(userId string) (*users.User, error) {
+	return &users.User{Id: userId, Email: "latte@cafe-beans.com", Username: "latte", RoleId: 1}, nil
+}
+
+func (r *fakeOauthRepository) DeleteOauth(oauthId string) (string, error) {
+	r.deleted = append(r.deleted, oauthId)
+	for _, tokens := range []map[string]*users.Oauth{r.current, r.retired} {
+		for token, oauth := range tokens {
+			if oauth.Id == oauthId {
+				delete(tokens, token)
+			}
+		}
+	}
+	return "U000001", nil
+}
+
+// A session signed in with a fresh refresh token
+func (r *fakeOauthRepository) signIn(t *testing.T, cfg config.IConfig) string {
+	token, err := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Refresh, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken := token.SignToken()
+	r.current[refreshToken] = &users.Oauth{Id: "oauth-1", UserId: "U000001"}
+	return refreshToken
+}
+
+func TestRefreshPassportRotatesToken(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	repo := newFakeOauthRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	refreshToken := repo.signIn(t, cfg)
+	passport, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: refreshToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passport.Token.RefreshToken == refreshToken {
+		t.Fatal("expected a new refresh token")
+	}
+	if _, ok := repo.current[passport.Token.RefreshToken]; !ok {
+		t.Fatal("expected the new refresh token to be stored")
+	}
+
+	// the rotated token keeps working
+	if _, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: passport.Token.RefreshToken}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshPassportRevokesFamilyOnReplay(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	repo := newFakeOauthRepository()
+	auditUseCase := &fakeAuditUseCase{}
+	useCase := newTestUserUseCase(t, cfg, repo, auditUseCase)
+
+	refreshToken := repo.signIn(t, cfg)
+	passport, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: refreshToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: refreshToken, Ip: "10.0.0.1"})
+	if err == nil || err.Error() != "refresh token reuse detected" {
+		t.Fatalf("expected refresh token reuse detected, got %v", err)
+	}
+	if len(repo.deleted) != 1 || repo.deleted[0] != "oauth-1" {
+		t.Fatalf("expected the session to be deleted, got %v", repo.deleted)
+	}
+
+	// the legitimate holder is signed out too
+	if _, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: passport.Token.RefreshToken}); err == nil {
+		t.Fatal("expected the latest refresh token to be revoked")
+	}
+
+	if len(auditUseCase.events) != 1 {
+		t.Fatalf("expected 1 audit event, got %v", len(auditUseCase.events))
+	}
+	event := auditUseCase.events[0]
+	if event.Action != audit.ActionRefreshTokenReuse || event.TargetId != "U000001" || event.Ip != "10.0.0.1" || event.Outcome != audit.OutcomeFailure {
+		t.Fatalf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestRefreshPassportRevokesFamilyWhenRotationLosesRace(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	repo := newFakeOauthRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	refreshToken := repo.signIn(t, cfg)
+	repo.loseRace = true
+
+	_, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: refreshToken})
+	if err == nil || err.Error() != "refresh token reuse detected" {
+		t.Fatalf("expected refresh token reuse detected, got %v", err)
+	}
+	if len(repo.deleted) != 1 {
+		t.Fatalf("expected the session to be deleted, got %v", repo.deleted)
+	}
+}
+
+func TestRefreshPassportRejectsAccessToken(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	useCase := newTestUserUseCase(t, cfg, newFakeOauthRepository(), &fakeAuditUseCase{})
+
+	token, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Access, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	if _, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: token.SignToken()}); err == nil {
+		t.Fatal("expected an access token to be refused")
+	}
+}
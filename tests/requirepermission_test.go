@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/modules/audit"
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareHandlers"
+	"github.com/pandakn/cafe-beans/modules/roles"
+)
+
+// The barista role is not seeded, it only gets what roles_permissions grants it
+const baristaRoleId = 3
+
+// An app with one route per permission, the role is set the way JwtAuth
+// sets it from the token
+func newRequirePermissionApp(t *testing.T) (*fiber.App, *fakeAuditUseCase) {
+	mid, _, db := newPermissionUseCases(t)
+	db.permissions[roles.CustomerRoleId] = []string{middleware.PermissionOrdersWrite}
+	db.permissions[roles.AdminRoleId] = []string{middleware.PermissionRolesManage, middleware.PermissionOrdersRead}
+	db.permissions[baristaRoleId] = []string{middleware.PermissionOrdersRead}
+
+	auditUseCase := &fakeAuditUseCase{}
+	handler := middlewareHandlers.MiddlewareHandler(newTestConfig(t, ""), mid, auditUseCase)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		roleId, _ := strconv.Atoi(c.Get("X-Role-Id"))
+		c.Locals("userRoleId", roleId)
+		return c.Next()
+	})
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+	app.Get("/roles", handler.RequirePermission(middleware.PermissionRolesManage), ok)
+	app.Get("/orders", handler.RequirePermission(middleware.PermissionOrdersRead), ok)
+	return app, auditUseCase
+}
+
+func callAsRole(t *testing.T, app *fiber.App, path string, roleId int) int {
+	req := httptest.NewRequest(fiber.MethodGet, path, nil)
+	req.Header.Set("X-Role-Id", strconv.Itoa(roleId))
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestRequirePermission(t *testing.T) {
+	app, auditUseCase := newRequirePermissionApp(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		roleId int
+		status int
+	}{
+		{"admin manages roles", "/roles", roles.AdminRoleId, fiber.StatusOK},
+		{"customer cannot manage roles", "/roles", roles.CustomerRoleId, fiber.StatusUnauthorized},
+		{"barista cannot manage roles", "/roles", baristaRoleId, fiber.StatusUnauthorized},
+		{"barista reads orders", "/orders", baristaRoleId, fiber.StatusOK},
+		{"admin reads orders", "/orders", roles.AdminRoleId, fiber.StatusOK},
+		{"customer cannot read orders", "/orders", roles.CustomerRoleId, fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if status := callAsRole(t, app, tt.path, tt.roleId); status != tt.status {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.status, status)
+		}
+	}
+
+	if len(auditUseCase.events) != 3 {
+		t.Fatalf("expected 3 denials to be recorded, got %v", len(auditUseCase.events))
+	}
+	for _, event := range auditUseCase.events {
+		if event.Action != audit.ActionPermissionDenied {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesHandlers"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesRepositories"
+	"github.com/pandakn/cafe-beans/modules/roles/rolesUseCases"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+)
+
+// What postgres answers when a delete hits a restricting foreign key
+var errRoleInUse = errors.New(`ERROR: update or delete on table "roles" violates foreign key constraint "users_role_id_fkey" on table "users" (SQLSTATE 23503)`)
+
+func newRolesApp(t *testing.T, respond func(query string, args []driver.Value) (*fakeResult, error)) (*fiber.App, *fakeDb, cafeBeansCache.ICafeBeansCache) {
+	db, fake := newFakeDb(respond)
+	cfg := newTestConfig(t, "")
+	cache := cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl())
+	handler := rolesHandlers.RolesHandler(
+		cfg,
+		rolesUseCases.RolesUseCase(rolesRepositories.RolesRepository(db), cache),
+		&fakeAuditUseCase{},
+	)
+
+	app := fiber.New()
+	app.Delete("/roles/:role_id", handler.RemoveRole)
+	return app, fake, cache
+}
+
+func deleteRole(t *testing.T, app *fiber.App, roleId string) int {
+	res, err := app.Test(httptest.NewRequest(fiber.MethodDelete, "/roles/"+roleId, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func TestDeleteRoleRefusesReservedRoles(t *testing.T) {
+	app, fake, _ := newRolesApp(t, nil)
+
+	for _, roleId := range []string{"1", "2"} {
+		if status := deleteRole(t, app, roleId); status != fiber.StatusBadRequest {
+			t.Fatalf("role %v: expected 400, got %v", roleId, status)
+		}
+	}
+	if len(fake.find()) != 0 {
+		t.Fatal("expected reserved roles to never reach the db")
+	}
+}
+
+func TestDeleteRoleRefusesRoleInUse(t *testing.T) {
+	app, fake, _ := newRolesApp(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		if strings.Contains(query, `DELETE FROM "roles"`) {
+			return nil, errRoleInUse
+		}
+		return nil, nil
+	})
+
+	if status := deleteRole(t, app, "3"); status != fiber.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", status)
+	}
+
+	db, _ := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		return nil, errRoleInUse
+	})
+	if err := rolesRepositories.RolesRepository(db).DeleteRole(3); err == nil || err.Error() != "role is assigned to users" {
+		t.Fatalf("expected role is assigned to users, got %v", err)
+	}
+
+	// the foreign key is the only guard, there's no check that could race with an assignment
+	if len(fake.find(`FROM "users"`)) != 0 {
+		t.Fatal("expected no separate check of the users")
+	}
+}
+
+func TestDeleteRoleNotFound(t *testing.T) {
+	app, _, _ := newRolesApp(t, nil)
+
+	if status := deleteRole(t, app, "42"); status != fiber.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", status)
+	}
+	if status := deleteRole(t, app, "barista"); status != fiber.StatusBadRequest {
+		t.Fatalf("expected an invalid id to be refused, got %v", status)
+	}
+}
+
+func TestDeleteRole(t *testing.T) {
+	app, fake, _ := newRolesApp(t, func(query string, args []driver.Value) (*fakeResult, error) {
+		return &fakeResult{affected: 1}, nil
+	})
+
+	if status := deleteRole(t, app, "3"); status != fiber.StatusOK {
+		t.Fatalf("expected 200, got %v", status)
+	}
+	if q := fake.one(t, `DELETE FROM "roles"`); q.args[0] != 3 {
+		t.Fatalf("expected role 3 to be deleted, got %v", q.args)
+	}
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareUseCases"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansCache"
+)
+
+const sessionLimitsEnv = "CACHE_TTL=30\nSESSION_ABSOLUTE_LIFETIME=86400\nSESSION_IDLE_TIMEOUT=3600\n"
+
+func TestRefreshPassportEnforcesSessionLimits(t *testing.T) {
+	tests := map[string]struct {
+		env     string
+		age     int
+		idle    int
+		expired bool
+	}{
+		"within the limits":        {sessionLimitsEnv, 86399, 3599, false},
+		"past the absolute limit":  {sessionLimitsEnv, 86400, 0, true},
+		"idle for too long":        {sessionLimitsEnv, 60, 3600, true},
+		"without limits":           {"", 86400 * 30, 86400 * 7, false},
+		"only the idle limit kept": {"SESSION_IDLE_TIMEOUT=3600\n", 86400 * 30, 60, false},
+	}
+	for name, tt := range tests {
+		cfg := newTestConfig(t, tt.env)
+		repo := newFakeOauthRepository()
+		useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+		refreshToken := repo.signIn(t, cfg)
+		repo.current[refreshToken].Age = tt.age
+		repo.current[refreshToken].Idle = tt.idle
+
+		_, err := useCase.RefreshPassport(&users.UserRefreshCredential{RefreshToken: refreshToken})
+		if !tt.expired {
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != "session has expired" {
+			t.Fatalf("%s: expected session has expired, got %v", name, err)
+		}
+		// the session is gone, not only refused
+		if len(repo.deleted) != 1 || repo.deleted[0] != "oauth-1" {
+			t.Fatalf("%s: expected oauth-1 to be deleted, got %v", name, repo.deleted)
+		}
+	}
+}
+
+// Records the limits the use case passes, expired are the users of the deleted sessions
+type fakeSessionRepository struct {
+	*fakeMiddlewareRepository
+
+	limits  []*middleware.SessionLimits
+	expired []string
+}
+
+func (r *fakeSessionRepository) FindAccessToken(userId, accessToken string, limits *middleware.SessionLimits) (*middleware.Session, error) {
+	r.limits = append(r.limits, limits)
+	return r.fakeMiddlewareRepository.FindAccessToken(userId, accessToken, limits)
+}
+
+func (r *fakeSessionRepository) DeleteExpiredSessions(limits *middleware.SessionLimits) ([]string, error) {
+	r.limits = append(r.limits, limits)
+	return r.expired, nil
+}
+
+func newSessionUseCase(t *testing.T, env string) (middlewareUseCases.IMiddlewareUseCase, *fakeSessionRepository) {
+	cfg := newTestConfig(t, env)
+	repo := &fakeSessionRepository{
+		fakeMiddlewareRepository: &fakeMiddlewareRepository{db: &fakeRolesDb{
+			userRoles: map[string]int{"U000001": 1, "U000002": 1, "U000003": 1},
+		}},
+	}
+	cache := cafeBeansCache.NewCafeBeansCache(cafeBeansCache.NewMemoryStore(), cfg.Cache().Ttl())
+	return middlewareUseCases.MiddlewareUseCase(cfg, repo, cache), repo
+}
+
+func TestSessionLimitsArePassedToRepository(t *testing.T) {
+	useCase, repo := newSessionUseCase(t, sessionLimitsEnv+"JWT_REFRESH_EXPIRES=604800\n")
+
+	if _, err := useCase.FindAccessToken("U000001", "access-token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useCase.DeleteExpiredSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := middleware.SessionLimits{
+		RefreshExpires:       604800,
+		ImpersonationExpires: cafeBeansAuth.ImpersonationExpiresIn,
+		AbsoluteLifetime:     86400,
+		IdleTimeout:          3600,
+	}
+	if len(repo.limits) != 2 || *repo.limits[0] != expected || *repo.limits[1] != expected {
+		t.Fatalf("expected %+v, got %v", expected, repo.limits)
+	}
+}
+
+func TestDeleteExpiredSessionsInvalidatesCache(t *testing.T) {
+	useCase, repo := newSessionUseCase(t, sessionLimitsEnv)
+
+	for _, userId := range []string{"U000001", "U000002", "U000003"} {
+		if _, err := useCase.FindAccessToken(userId, "access-token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// two sessions of U000001 and one of U000002 have expired
+	repo.expired = []string{"U000001", "U000002", "U000001"}
+	if count, err := useCase.DeleteExpiredSessions(); err != nil || count != 3 {
+		t.Fatalf("expected 3 sessions to be deleted, got %v %v", count, err)
+	}
+
+	reads := repo.db.sessionReads
+	for _, userId := range []string{"U000001", "U000002", "U000003"} {
+		useCase.FindAccessToken(userId, "access-token")
+	}
+	// U000003 is still cached, the others go to the db again
+	if repo.db.sessionReads-reads != 2 {
+		t.Fatalf("expected 2 sessions to be read again, got %v", repo.db.sessionReads-reads)
+	}
+}
+
+func TestSessionQueriesUseLimits(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		if strings.Contains(query, "RETURNING") {
+			return &fakeResult{columns: []string{"user_id"}, rows: [][]driver.Value{{"U000001"}, {"U000002"}}}, nil
+		}
+		return nil, nil
+	})
+	repo := middlewareRepositories.MiddlewareRepository(db)
+	limits := &middleware.SessionLimits{RefreshExpires: 604800, ImpersonationExpires: 900, AbsoluteLifetime: 86400, IdleTimeout: 3600}
+
+	if _, err := repo.FindAccessToken("U000001", "access-token", limits); err == nil || err.Error() != "session not found" {
+		t.Fatalf("expected session not found, got %v", err)
+	}
+	find := fake.one(t, `FROM "oauth" "o"`)
+	for _, condition := range []string{`"o"."created_at" > now() - $3::INT`, `"o"."last_used_at" > now() - $4::INT`, `"u"."disabled_at" IS NULL`} {
+		if !strings.Contains(find.query, condition) {
+			t.Fatalf("expected the session to be found only if %v", condition)
+		}
+	}
+	if find.args[2] != 86400 || find.args[3] != 3600 {
+		t.Fatalf("unexpected args %v", find.args)
+	}
+
+	userIds, err := repo.DeleteExpiredSessions(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userIds) != 2 || userIds[0] != "U000001" || userIds[1] != "U000002" {
+		t.Fatalf("expected the users of the deleted sessions, got %v", userIds)
+	}
+	q := fake.one(t, `DELETE FROM "oauth"`)
+	if q.args[0] != 604800 || q.args[1] != 900 || q.args[2] != 86400 || q.args[3] != 3600 {
+		t.Fatalf("unexpected args %v", q.args)
+	}
+}
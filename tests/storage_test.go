@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansStorage"
+)
+
+func TestLocalStorageUploadAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	storage := cafeBeansStorage.NewLocalStorage(dir, "/uploads/")
+
+	url, err := storage.Upload("avatars/7/a.png", "image/png", []byte("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/uploads/avatars/7/a.png" {
+		t.Fatalf("expected /uploads/avatars/7/a.png, got %v", url)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "avatars", "7", "a.png")); err != nil || string(data) != "png" {
+		t.Fatalf("expected the file to be written, got %v", err)
+	}
+
+	if err := storage.Delete(url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "avatars", "7", "a.png")); !os.IsNotExist(err) {
+		t.Fatal("expected the file to be removed")
+	}
+	// already gone is not an error
+	if err := storage.Delete(url); err != nil {
+		t.Fatalf("expected a missing file to be ignored, got %v", err)
+	}
+}
+
+func TestLocalStorageKeepsPathsInsideDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "uploads")
+	storage := cafeBeansStorage.NewLocalStorage(dir, "/uploads")
+
+	url, err := storage.Upload("../../escaped.png", "image/png", []byte("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/uploads/escaped.png" {
+		t.Fatalf("expected /uploads/escaped.png, got %v", url)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.png")); err != nil {
+		t.Fatal("expected the file to be written inside dir")
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.png")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be written outside dir")
+	}
+
+	for _, path := range []string{"", "/", "..", "a/../.."} {
+		if _, err := storage.Upload(path, "image/png", []byte("png")); err == nil || err.Error() != "file path is invalid" {
+			t.Fatalf("%q: expected file path is invalid, got %v", path, err)
+		}
+	}
+}
+
+func TestLocalStorageDeletesOnlyItsOwnFiles(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "keep.png")
+	if err := os.WriteFile(outside, []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage := cafeBeansStorage.NewLocalStorage(filepath.Join(root, "uploads"), "/uploads")
+
+	for _, url := range []string{"https://cdn.example.com/keep.png", "/uploadskeep.png", "/other/keep.png"} {
+		if err := storage.Delete(url); err == nil || err.Error() != "file is not in this storage" {
+			t.Fatalf("%q: expected file is not in this storage, got %v", url, err)
+		}
+	}
+	if err := storage.Delete("/uploads/../keep.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatal("expected a file outside dir to be kept")
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pandakn/cafe-beans/modules/middleware"
+	"github.com/pandakn/cafe-beans/modules/middleware/middlewareRepositories"
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/utils"
+)
+
+func TestHashTokenIsSha256Hex(t *testing.T) {
+	// FIPS 180-2 test vector
+	if got := utils.HashToken("abc"); got != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Fatalf("unexpected digest %v", got)
+	}
+	if utils.HashToken("a") == utils.HashToken("b") {
+		t.Fatal("expected different tokens to have different digests")
+	}
+}
+
+// No argument of any recorded query may be one of the raw tokens
+func assertNoRawTokens(t *testing.T, db *fakeDb, tokens ...string) {
+	t.Helper()
+	for _, q := range db.find() {
+		for _, arg := range q.args {
+			for _, token := range tokens {
+				if s, ok := arg.(string); ok && s == token {
+					t.Fatalf("raw token sent to the db in %q", strings.TrimSpace(q.query))
+				}
+			}
+		}
+	}
+}
+
+func TestInsertOauthStoresTokenDigests(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		return &fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{"oauth-1"}}}, nil
+	})
+	repo := usersRepositories.UserRepository(db)
+
+	passport := &users.UserPassport{
+		User:  &users.User{Id: "U000001"},
+		Token: &users.UserToken{AccessToken: "access-token", RefreshToken: "refresh-token"},
+	}
+	if err := repo.InsertOauth(passport); err != nil {
+		t.Fatal(err)
+	}
+
+	q := fake.one(t, `INSERT INTO "oauth"`)
+	if q.args[1] != utils.HashToken("access-token") || q.args[2] != utils.HashToken("refresh-token") {
+		t.Fatalf("expected token digests, got %v", q.args)
+	}
+	assertNoRawTokens(t, fake, "access-token", "refresh-token")
+}
+
+func TestFindOauthLooksUpTokenDigests(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := usersRepositories.UserRepository(db)
+
+	repo.FindOneOauth("refresh-token")
+	repo.FindRetiredOauth("refresh-token")
+
+	for _, q := range fake.find(`"refresh_token" = $1`) {
+		if q.args[0] != utils.HashToken("refresh-token") {
+			t.Fatalf("expected the token digest, got %v", q.args[0])
+		}
+	}
+	if len(fake.find(`"refresh_token" = $1`)) != 2 {
+		t.Fatal("expected both lookups to match on the refresh token")
+	}
+	assertNoRawTokens(t, fake, "refresh-token")
+}
+
+func TestUpdateOauthRetiresOldTokenDigest(t *testing.T) {
+	db, fake := newFakeDb(func(query string, args []driver.Value) (*fakeResult, error) {
+		return &fakeResult{affected: 1}, nil
+	})
+	repo := usersRepositories.UserRepository(db)
+
+	err := repo.UpdateOauth("old-refresh", &users.UserToken{Id: "oauth-1", AccessToken: "new-access", RefreshToken: "new-refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := fake.one(t, `UPDATE "oauth"`)
+	if update.args[0] != utils.HashToken("new-access") || update.args[1] != utils.HashToken("new-refresh") || update.args[3] != utils.HashToken("old-refresh") {
+		t.Fatalf("expected token digests, got %v", update.args)
+	}
+	retire := fake.one(t, `INSERT INTO "oauth_retired_tokens"`)
+	if retire.args[1] != utils.HashToken("old-refresh") {
+		t.Fatalf("expected the old token digest to be retired, got %v", retire.args)
+	}
+	if fake.commits != 1 {
+		t.Fatalf("expected a commit, got %v", fake.commits)
+	}
+	assertNoRawTokens(t, fake, "old-refresh", "new-access", "new-refresh")
+}
+
+func TestUpdateOauthReportsReuseWhenNothingMatches(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := usersRepositories.UserRepository(db)
+
+	err := repo.UpdateOauth("old-refresh", &users.UserToken{Id: "oauth-1", AccessToken: "a", RefreshToken: "r"})
+	if !errors.Is(err, users.ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if len(fake.find(`"oauth_retired_tokens"`)) != 0 || fake.rollbacks != 1 {
+		t.Fatal("expected the rotation to be rolled back")
+	}
+}
+
+func TestFindAccessTokenLooksUpTokenDigest(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := middlewareRepositories.MiddlewareRepository(db)
+
+	repo.FindAccessToken("U000001", "access-token", &middleware.SessionLimits{})
+
+	q := fake.one(t, `"o"."access_token" = $2`)
+	if q.args[1] != utils.HashToken("access-token") {
+		t.Fatalf("expected the token digest, got %v", q.args[1])
+	}
+	assertNoRawTokens(t, fake, "access-token")
+}
@@ -0,0 +1,270 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pandakn/cafe-beans/modules/users"
+	"github.com/pandakn/cafe-beans/modules/users/usersRepositories"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansAuth"
+	"github.com/pandakn/cafe-beans/pkg/cafeBeansTotp"
+	"github.com/pandakn/cafe-beans/pkg/utils"
+)
+
+// The secret of the RFC 4226 and RFC 6238 (SHA-1) test vectors
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestTotpRfc4226Vectors(t *testing.T) {
+	// RFC 4226 Appendix D, the counter is the step
+	codes := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range codes {
+		at := time.Unix(int64(counter)*30, 0)
+		step, ok := cafeBeansTotp.Validate(rfcSecret, code, at)
+		if !ok || step != int64(counter) {
+			t.Errorf("counter %v: expected %v to be valid at step %v, got %v %v", counter, code, counter, step, ok)
+		}
+	}
+}
+
+func TestTotpRfc6238Vectors(t *testing.T) {
+	// RFC 6238 Appendix B (SHA-1), the last 6 of the 8 digits
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, code := range vectors {
+		step, ok := cafeBeansTotp.Validate(rfcSecret, code, time.Unix(unix, 0))
+		if !ok || step != unix/30 {
+			t.Errorf("%v: expected %v to be valid at step %v, got %v %v", unix, code, unix/30, step, ok)
+		}
+	}
+}
+
+func TestTotpAcceptsOneStepOfSkew(t *testing.T) {
+	// RFC 4226 codes of counters 3 to 7, validated at step 5
+	at := time.Unix(5*30+10, 0)
+	tests := []struct {
+		code  string
+		step  int64
+		valid bool
+	}{
+		{"969429", 3, false},
+		{"338314", 4, true},
+		{"254676", 5, true},
+		{"287922", 6, true},
+		{"162583", 7, false},
+	}
+
+	for _, tt := range tests {
+		step, ok := cafeBeansTotp.Validate(rfcSecret, tt.code, at)
+		if ok != tt.valid || (ok && step != tt.step) {
+			t.Errorf("step %v: expected valid %v, got %v at step %v", tt.step, tt.valid, ok, step)
+		}
+	}
+}
+
+func TestTotpRejectsMalformedInput(t *testing.T) {
+	at := time.Unix(30, 0)
+	for _, code := range []string{"", "28708", "2870822", "abcdef"} {
+		if _, ok := cafeBeansTotp.Validate(rfcSecret, code, at); ok {
+			t.Errorf("expected %q to be invalid", code)
+		}
+	}
+	if _, ok := cafeBeansTotp.Validate("not base32!", "287082", at); ok {
+		t.Error("expected an invalid secret to be refused")
+	}
+	// surrounding spaces are pasted along often
+	if _, ok := cafeBeansTotp.Validate(rfcSecret, " 287082 ", at); !ok {
+		t.Error("expected the code to be trimmed")
+	}
+}
+
+// The code of a step, the reference HOTP of RFC 4226
+func totpCode(secret string, step int64) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+// One user with 2fa, the last step and the recovery codes behave like
+// the conditional updates of the repository
+type fakeMfaRepository struct {
+	usersRepositories.IUserRepository
+
+	totp          users.UserTotp
+	recoveryCodes map[string]bool // code digest -> used
+	attempts      []bool
+}
+
+func newFakeMfaRepository() *fakeMfaRepository {
+	return &fakeMfaRepository{
+		totp:          users.UserTotp{Email: "latte@cafe-beans.com", RoleId: 1},
+		recoveryCodes: make(map[string]bool),
+	}
+}
+
+func (r *fakeMfaRepository) FindTotp(userId string) (*users.UserTotp, error) {
+	totp := r.totp
+	return &totp, nil
+}
+
+func (r *fakeMfaRepository) UpdateTotpSecret(userId, secret string) error {
+	r.totp.Secret = secret
+	return nil
+}
+
+func (r *fakeMfaRepository) EnableTotp(userId string, step int64, recoveryCodes []string) error {
+	r.totp.Enabled = true
+	r.totp.LastStep = step
+	for _, code := range recoveryCodes {
+		r.recoveryCodes[utils.HashToken(code)] = false
+	}
+	return nil
+}
+
+func (r *fakeMfaRepository) UpdateTotpStep(userId string, step int64) error {
+	if step <= r.totp.LastStep {
+		return fmt.Errorf("code is invalid")
+	}
+	r.totp.LastStep = step
+	return nil
+}
+
+func (r *fakeMfaRepository) UseRecoveryCode(userId, recoveryCode string) error {
+	used, ok := r.recoveryCodes[utils.HashToken(recoveryCode)]
+	if !ok || used {
+		return fmt.Errorf("code is invalid")
+	}
+	r.recoveryCodes[utils.HashToken(recoveryCode)] = true
+	return nil
+}
+
+func (r *fakeMfaRepository) FindLoginFailures(identifier, ip string, window time.Duration) (*users.LoginFailures, error) {
+	return &users.LoginFailures{}, nil
+}
+
+func (r *fakeMfaRepository) InsertLoginAttempt(identifier, ip string, succeeded bool) error {
+	r.attempts = append(r.attempts, succeeded)
+	return nil
+}
+
+func (r *fakeMfaRepository) GetProfile(userId string) (*users.User, error) {
+	return &users.User{Id: userId, Email: r.totp.Email, RoleId: r.totp.RoleId}, nil
+}
+
+func (r *fakeMfaRepository) InsertOauth(req *users.UserPassport) error {
+	req.Token.Id = "oauth-1"
+	return nil
+}
+
+func TestVerifyMfaRefusesReusedStep(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	repo := newFakeMfaRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	enrollment, err := useCase.EnrollTotp("U000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := time.Now().Unix() / 30
+
+	// activating uses up the current step
+	if _, err := useCase.ActivateTotp("U000001", &users.UserTotpReq{Code: totpCode(enrollment.Secret, current)}); err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Challenge, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	for _, step := range []int64{current, current - 1} {
+		_, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), Code: totpCode(enrollment.Secret, step)})
+		if err == nil || err.Error() != "code is invalid" {
+			t.Fatalf("step %v: expected code is invalid, got %v", step-current, err)
+		}
+	}
+
+	// the next step is still fine, once
+	next := totpCode(enrollment.Secret, current+1)
+	if _, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), Code: next}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), Code: next}); err == nil {
+		t.Fatal("expected the code to be used up")
+	}
+
+	// the refused codes count as failed sign ins
+	if len(repo.attempts) != 4 || !repo.attempts[2] || repo.attempts[3] {
+		t.Fatalf("unexpected attempts %v", repo.attempts)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	repo := newFakeMfaRepository()
+	useCase := newTestUserUseCase(t, cfg, repo, &fakeAuditUseCase{})
+
+	enrollment, err := useCase.EnrollTotp("U000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := useCase.ActivateTotp("U000001", &users.UserTotpReq{Code: totpCode(enrollment.Secret, time.Now().Unix()/30)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.RecoveryCodes) != 10 || len(repo.recoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %v", len(result.RecoveryCodes))
+	}
+
+	challenge, _ := cafeBeansAuth.NewCafeBeansAuth(cafeBeansAuth.Challenge, cfg.Jwt(), &users.UserClaims{Id: "U000001", RoleId: 1})
+	code := " " + strings.ToUpper(result.RecoveryCodes[0]) + " "
+
+	if _, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), RecoveryCode: code}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), RecoveryCode: code}); err == nil || err.Error() != "code is invalid" {
+		t.Fatalf("expected the recovery code to be used up, got %v", err)
+	}
+
+	// the others are untouched
+	if _, err := useCase.VerifyMfa(&users.UserMfaReq{ChallengeToken: challenge.SignToken(), RecoveryCode: result.RecoveryCodes[1]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTotpRepositoryOnlyMovesForward(t *testing.T) {
+	db, fake := newFakeDb(nil)
+	repo := usersRepositories.UserRepository(db)
+
+	// nothing matched, the step isn't later than the last one
+	if err := repo.UpdateTotpStep("U000001", 42); err == nil || err.Error() != "code is invalid" {
+		t.Fatalf("expected code is invalid, got %v", err)
+	}
+	if q := fake.one(t, `"totp_last_step" = $1`); !strings.Contains(q.query, `"totp_last_step" < $1`) {
+		t.Fatal("expected the update to require a later step")
+	}
+
+	if err := repo.UseRecoveryCode("U000001", "abcde-fghij"); err == nil || err.Error() != "code is invalid" {
+		t.Fatalf("expected code is invalid, got %v", err)
+	}
+	q := fake.one(t, `UPDATE "recovery_codes"`)
+	if !strings.Contains(q.query, `"used_at" IS NULL`) || q.args[1] != utils.HashToken("abcde-fghij") {
+		t.Fatalf("expected an unused code to be matched by its digest, got %v", q.args)
+	}
+}